@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/core/note"
+)
+
+type AdminApi struct {
+	service AdminService
+}
+
+type AdminService interface {
+	Reindex(context.Context, bool) (note.IndexReport, error)
+}
+
+func NewAdminApi(service AdminService) *AdminApi {
+	return &AdminApi{service: service}
+}
+
+func (a *AdminApi) ConfigureRouter(r chi.Router) {
+	r.Post("/reindex", a.Reindex)
+}
+
+// Reindex reports how far the index has drifted from the stored notes. The
+// index is only repaired when the repair query parameter is true.
+func (a *AdminApi) Reindex(w http.ResponseWriter, r *http.Request) {
+	repair := false
+	if v := r.URL.Query().Get("repair"); v != "" {
+		var err error
+		if repair, err = strconv.ParseBool(v); err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	report, err := a.service.Reindex(r.Context(), repair)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewIndexReportResponse(report))
+}
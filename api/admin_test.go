@@ -0,0 +1,84 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestReindex(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		err        error
+		wantStatus int
+		wantRepair bool
+	}{
+		{name: "Dry Run", url: "/reindex", wantStatus: http.StatusOK},
+		{name: "Repair", url: "/reindex?repair=true", wantStatus: http.StatusOK, wantRepair: true},
+		{name: "Bad Repair", url: "/reindex?repair=maybe", wantStatus: http.StatusBadRequest},
+		{name: "Error", url: "/reindex", err: errors.New("some error"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		svc := &mockAdminService{returnError: test.err}
+		r := httptest.NewRequest(http.MethodPost, test.url, nil)
+		w := httptest.NewRecorder()
+
+		api.NewAdminApi(svc).Reindex(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if svc.repair != test.wantRepair {
+			t.Errorf("%v: expected repair %v got %v", test.name, test.wantRepair, svc.repair)
+		}
+
+		report := parseIndexReport(w, t)
+		if report.Repaired != test.wantRepair || len(report.Missing) != 1 {
+			t.Errorf("%v: unexpected report %+v", test.name, report)
+		}
+	}
+}
+
+type mockAdminService struct {
+	returnError error
+	repair      bool
+}
+
+func (m *mockAdminService) Reindex(_ context.Context, repair bool) (note.IndexReport, error) {
+	m.repair = repair
+	if m.returnError != nil {
+		return note.IndexReport{}, m.returnError
+	}
+	report := note.NewIndexReport()
+	report.Missing = []string{"1"}
+	report.Repaired = repair
+	return report, nil
+}
+
+func parseIndexReport(w *httptest.ResponseRecorder, t *testing.T) api.IndexReportResponse {
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	ir := api.IndexReportResponse{}
+	err = json.Unmarshal(data, &ir)
+	if err != nil {
+		t.Errorf("failed to parse response %v", err)
+	}
+	return ir
+}
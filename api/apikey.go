@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/user"
+)
+
+type KeyApi struct {
+	service KeyService
+}
+
+type KeyService interface {
+	Create(ctx context.Context, u user.User, name string, scope apikey.Scope, expires *time.Time) (apikey.Key, string, error)
+	List(ctx context.Context, u user.User) ([]apikey.Key, error)
+	Get(ctx context.Context, u user.User, id string) (apikey.Key, error)
+	Revoke(ctx context.Context, u user.User, id string) error
+}
+
+// NewKeyApi returns the api for managing the authenticated user's API keys.
+// It must be used after Authenticate.
+func NewKeyApi(service KeyService) *KeyApi {
+	return &KeyApi{service: service}
+}
+
+func (a *KeyApi) ConfigureRouter(r chi.Router) {
+	r.Use(NoAPIKeys)
+	r.Get("/", a.List)
+	r.Post("/", a.Create)
+	r.Get("/{id}", a.Get)
+	r.Delete("/{id}", a.Revoke)
+}
+
+// List returns the user's keys, without their secrets
+func (a *KeyApi) List(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	keys, err := a.service.List(r.Context(), u)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewKeyListResponse(keys))
+}
+
+// Create makes a key for the user. The response is the only time its token
+// is shown.
+func (a *KeyApi) Create(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	data := &KeyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	k, token, err := a.service.Create(r.Context(), u, data.Name, data.Scope, data.Expires)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	resp := NewKeyResponse(k)
+	resp.Token = token
+	w.Header().Set("Cache-Control", "no-store")
+	render.Status(r, http.StatusCreated)
+	Render(w, r, resp)
+}
+
+func (a *KeyApi) Get(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	k, err := a.service.Get(r.Context(), u, chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewKeyResponse(k))
+}
+
+// Revoke deletes the key, it stops working straight away
+func (a *KeyApi) Revoke(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	if err := a.service.Revoke(r.Context(), u, chi.URLParam(r, "id")); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
@@ -0,0 +1,190 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestKeys(t *testing.T) {
+	svc := newMockKeyService()
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, svc))
+	router.Route("/keys", api.NewKeyApi(svc).ConfigureRouter)
+
+	w := serveKeys(router, http.MethodPost, "/keys", `{"name": "backups", "scope": "read"}`, "password")
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("expected %v got %v", http.StatusCreated, w.Result().StatusCode)
+	}
+	created := api.KeyResponse{}
+	data, _ := ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &created); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if created.Name != "backups" || created.Scope != apikey.ScopeRead || created.Token == "" || strings.Contains(string(data), "secretHash") {
+		t.Errorf("expected the new key and its token got %s", data)
+	}
+
+	w = serveKeys(router, http.MethodGet, "/keys", "", "password")
+	list := api.KeyListResponse{}
+	data, _ = ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if len(list.Keys) != 1 || list.Keys[0].ID != created.ID || list.Keys[0].Token != "" {
+		t.Errorf("expected the key without its token got %s", data)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		auth       string
+		wantStatus int
+	}{
+		{name: "get", method: http.MethodGet, url: "/keys/" + created.ID, auth: "password", wantStatus: http.StatusOK},
+		{name: "get missing", method: http.MethodGet, url: "/keys/missing", auth: "password", wantStatus: http.StatusNotFound},
+		{name: "bad scope", method: http.MethodPost, url: "/keys", body: `{"name": "key", "scope": "everything"}`, auth: "password", wantStatus: http.StatusBadRequest},
+		{name: "missing name", method: http.MethodPost, url: "/keys", body: `{"scope": "read"}`, auth: "password", wantStatus: http.StatusBadRequest},
+		{name: "listed with a key", method: http.MethodGet, url: "/keys", auth: created.Token, wantStatus: http.StatusForbidden},
+		{name: "revoked with a key", method: http.MethodDelete, url: "/keys/" + created.ID, auth: created.Token, wantStatus: http.StatusForbidden},
+		{name: "revoked", method: http.MethodDelete, url: "/keys/" + created.ID, auth: "password", wantStatus: http.StatusNoContent},
+		{name: "revoked again", method: http.MethodDelete, url: "/keys/" + created.ID, auth: "password", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := serveKeys(router, test.method, test.url, test.body, test.auth)
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+// Keys can only do what their scope allows
+func TestAuthenticateKey(t *testing.T) {
+	svc := newMockKeyService()
+	tokens := make(map[apikey.Scope]string)
+	for _, scope := range []apikey.Scope{apikey.ScopeRead, apikey.ScopeWrite, apikey.ScopeAdmin} {
+		_, token, _ := svc.Create(context.Background(), user.User{ID: "admin-id", Username: "admin", Admin: true}, "key", scope, nil)
+		tokens[scope] = token
+	}
+
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, svc))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	router.Post("/", func(w http.ResponseWriter, r *http.Request) {})
+	router.With(api.RequireAdmin).Post("/admin", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		token      string
+		wantStatus int
+	}{
+		{name: "read", method: http.MethodGet, url: "/", token: tokens[apikey.ScopeRead], wantStatus: http.StatusOK},
+		{name: "write with read", method: http.MethodPost, url: "/", token: tokens[apikey.ScopeRead], wantStatus: http.StatusForbidden},
+		{name: "write", method: http.MethodPost, url: "/", token: tokens[apikey.ScopeWrite], wantStatus: http.StatusOK},
+		{name: "admin with write", method: http.MethodPost, url: "/admin", token: tokens[apikey.ScopeWrite], wantStatus: http.StatusForbidden},
+		{name: "admin", method: http.MethodPost, url: "/admin", token: tokens[apikey.ScopeAdmin], wantStatus: http.StatusOK},
+		{name: "invalid key", method: http.MethodGet, url: "/", token: apikey.TokenPrefix + "unknown_secret", wantStatus: http.StatusUnauthorized},
+		{name: "store failure", method: http.MethodGet, url: "/", token: apikey.TokenPrefix + "fail_secret", wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		w := serveKeys(router, test.method, test.url, "", test.token)
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+// serveKeys authenticates as the user test with the password, or with the
+// key when auth is an API key
+func serveKeys(router http.Handler, method, url, body, auth string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Add("Content-Type", "application/json")
+	if strings.HasPrefix(auth, apikey.TokenPrefix) {
+		r.Header.Set("Authorization", "Bearer "+auth)
+	} else {
+		r.SetBasicAuth("test", auth)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// mockKeyService hands out the key "nsk_<n>_secret" for the nth key made
+type mockKeyService struct {
+	keys map[string]apikey.Key
+	next int
+}
+
+func newMockKeyService() *mockKeyService {
+	return &mockKeyService{keys: make(map[string]apikey.Key)}
+}
+
+func (m *mockKeyService) Create(_ context.Context, u user.User, name string, scope apikey.Scope, expires *time.Time) (apikey.Key, string, error) {
+	switch scope {
+	case apikey.ScopeRead, apikey.ScopeWrite, apikey.ScopeAdmin:
+	default:
+		return apikey.Key{}, "", &core.ErrInvalid{Reason: "unknown scope"}
+	}
+
+	m.next++
+	id := string(rune('0' + m.next))
+	k := apikey.Key{ID: id, UserID: u.ID, Username: u.Username, Name: name, Scope: scope, Expires: expires}
+	m.keys[id] = k
+	return k, apikey.TokenPrefix + id + "_secret", nil
+}
+
+func (m *mockKeyService) List(_ context.Context, u user.User) ([]apikey.Key, error) {
+	keys := make([]apikey.Key, 0)
+	for _, k := range m.keys {
+		if k.UserID == u.ID {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockKeyService) Get(_ context.Context, u user.User, id string) (apikey.Key, error) {
+	k, ok := m.keys[id]
+	if !ok || k.UserID != u.ID {
+		return apikey.Key{}, &core.ErrNotFound{}
+	}
+	return k, nil
+}
+
+func (m *mockKeyService) Revoke(ctx context.Context, u user.User, id string) error {
+	if _, err := m.Get(ctx, u, id); err != nil {
+		return err
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *mockKeyService) Verify(_ context.Context, token string) (apikey.Key, user.User, error) {
+	id := strings.SplitN(strings.TrimPrefix(token, apikey.TokenPrefix), "_", 2)[0]
+	if id == "fail" {
+		return apikey.Key{}, user.User{}, errors.New("some store failure")
+	}
+	k, ok := m.keys[id]
+	if !ok {
+		return apikey.Key{}, user.User{}, apikey.ErrInvalidKey
+	}
+	return k, user.User{ID: k.UserID, Username: k.Username, Admin: k.Username == "admin"}, nil
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sksmith/note-server/core/note"
+)
+
+const (
+	// attachmentField is the multipart field an attachment is uploaded in
+	attachmentField = "file"
+
+	// multipartOverhead is what's allowed for the rest of an upload's body on
+	// top of the attachment itself
+	multipartOverhead = 1 << 20
+)
+
+// errAttachmentTooLarge is returned when reading an upload past the limit
+var errAttachmentTooLarge = errors.New("attachment is too large")
+
+// inlineTypes are the content types shown in the browser rather than
+// downloaded. Anything else could run script if it were opened on our origin.
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+type AttachmentApi struct {
+	service AttachmentService
+	maxSize int64
+}
+
+type AttachmentService interface {
+	AddAttachment(ctx context.Context, noteID, name string, r io.Reader) (note.Attachment, error)
+	ListAttachments(ctx context.Context, noteID string) ([]note.Attachment, error)
+	OpenAttachment(ctx context.Context, noteID, id string) (note.Attachment, io.ReadSeekCloser, error)
+	DeleteAttachment(ctx context.Context, noteID, id string) error
+}
+
+// NewAttachmentApi returns the api for notes' attachments, which can be up
+// to maxSize bytes each
+func NewAttachmentApi(service AttachmentService, maxSize int64) *AttachmentApi {
+	return &AttachmentApi{service: service, maxSize: maxSize}
+}
+
+func (a *AttachmentApi) ConfigureRouter(r chi.Router) {
+	r.Post("/{id}/attachments", a.Add)
+	r.Get("/{id}/attachments", a.List)
+	r.Get("/{id}/attachments/{attachment}", a.Get)
+	r.Delete("/{id}/attachments/{attachment}", a.Delete)
+}
+
+// Add attaches the file uploaded in the file field of a multipart form to the
+// note. The file is streamed through to storage as it's read, an upload over
+// the size limit is rejected with a 413. The response's Location header is
+// the new attachment's url.
+func (a *AttachmentApi) Add(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	r.Body = http.MaxBytesReader(w, r.Body, a.maxSize+multipartOverhead)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		Render(w, r, ErrUnsupportedMediaType(err))
+		return
+	}
+
+	var part io.Reader
+	name := ""
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		if p.FormName() == attachmentField {
+			part, name = p, p.FileName()
+			break
+		}
+	}
+	if part == nil || name == "" {
+		Render(w, r, ErrInvalidRequest(errors.New("a file is required in the file field")))
+		return
+	}
+
+	body := &limitedReader{r: part, n: a.maxSize}
+	att, err := a.service.AddAttachment(r.Context(), id, name, body)
+	if body.exceeded {
+		Render(w, r, ErrRequestTooLarge)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(r.URL.Path, url.PathEscape(att.ID)))
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewAttachmentResponse(att))
+}
+
+func (a *AttachmentApi) List(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	list, err := a.service.ListAttachments(r.Context(), id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewAttachmentListResponse(list))
+}
+
+// Get downloads the attachment, honouring Range requests. Only images are
+// shown inline, everything else is sent as a download, and the response is
+// sandboxed so an attachment can never run script on our origin.
+func (a *AttachmentApi) Get(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	att, content, err := a.service.OpenAttachment(r.Context(), id, chi.URLParam(r, "attachment"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	disposition := "attachment"
+	if inlineTypes[att.ContentType] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", att.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("ETag", `"`+att.SHA256+`"`)
+
+	http.ServeContent(w, r, "", att.Created, content)
+}
+
+func (a *AttachmentApi) Delete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := a.service.DeleteAttachment(r.Context(), id, chi.URLParam(r, "attachment")); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// limitedReader reads up to n bytes, failing once there's more than that
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errAttachmentTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.exceeded = true
+		return 0, errAttachmentTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
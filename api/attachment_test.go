@@ -0,0 +1,250 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func attachmentRouter(svc api.AttachmentService, maxSize int64) chi.Router {
+	router := chi.NewRouter()
+	api.NewAttachmentApi(svc, maxSize).ConfigureRouter(router)
+	return router
+}
+
+// multipartBody returns a form with the file in the given field
+func multipartBody(t *testing.T, field, name, data string) (io.Reader, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("comment", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile(field, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write([]byte(data))
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, mw.FormDataContentType()
+}
+
+func TestAddAttachment(t *testing.T) {
+	tests := []struct {
+		name        string
+		noteID      string
+		field       string
+		data        string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "Added", noteID: "1", field: "file", data: "some text", wantStatus: http.StatusCreated},
+		{name: "At The Limit", noteID: "1", field: "file", data: strings.Repeat("a", 16), wantStatus: http.StatusCreated},
+		{name: "Too Large", noteID: "1", field: "file", data: strings.Repeat("a", 17), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "No File", noteID: "1", field: "other", data: "some text", wantStatus: http.StatusBadRequest},
+		{name: "Not Multipart", noteID: "1", field: "file", contentType: "application/json", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "Missing Note", noteID: "9", field: "file", data: "some text", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		svc := newMockAttachmentService()
+		body, contentType := multipartBody(t, test.field, "notes.txt", test.data)
+		if test.contentType != "" {
+			contentType = test.contentType
+		}
+		r := httptest.NewRequest(http.MethodPost, "/"+test.noteID+"/attachments", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		attachmentRouter(svc, 16).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusCreated {
+			continue
+		}
+		resp := note.Attachment{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%v: failed to decode response: %v", test.name, err)
+		}
+		if resp.Name != "notes.txt" || resp.Size != int64(len(test.data)) {
+			t.Errorf("%v: unexpected response %+v", test.name, resp)
+		}
+		if got := w.Result().Header.Get("Location"); got != "/1/attachments/"+resp.ID {
+			t.Errorf("%v: expected location %v got %v", test.name, "/1/attachments/"+resp.ID, got)
+		}
+	}
+}
+
+func TestGetAttachment(t *testing.T) {
+	svc := newMockAttachmentService()
+	svc.add("1", note.Attachment{ID: "png", Name: "picture.png", ContentType: "image/png", SHA256: "abc"}, "0123456789")
+	svc.add("1", note.Attachment{ID: "html", Name: "page.html", ContentType: "text/html; charset=utf-8"}, "<script>")
+
+	tests := []struct {
+		name            string
+		url             string
+		rng             string
+		wantStatus      int
+		wantBody        string
+		wantDisposition string
+	}{
+		{name: "Whole", url: "/1/attachments/png", wantStatus: http.StatusOK, wantBody: "0123456789", wantDisposition: `inline; filename=picture.png`},
+		{name: "Range", url: "/1/attachments/png", rng: "bytes=2-5", wantStatus: http.StatusPartialContent, wantBody: "2345", wantDisposition: `inline; filename=picture.png`},
+		{name: "Suffix Range", url: "/1/attachments/png", rng: "bytes=-3", wantStatus: http.StatusPartialContent, wantBody: "789", wantDisposition: `inline; filename=picture.png`},
+		{name: "At End", url: "/1/attachments/png", rng: "bytes=10-", wantStatus: http.StatusRequestedRangeNotSatisfiable},
+		{name: "Unsatisfiable", url: "/1/attachments/png", rng: "bytes=20-", wantStatus: http.StatusRequestedRangeNotSatisfiable},
+		{name: "Download", url: "/1/attachments/html", wantStatus: http.StatusOK, wantBody: "<script>", wantDisposition: `attachment; filename=page.html`},
+		{name: "Missing", url: "/1/attachments/missing", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if test.rng != "" {
+			r.Header.Set("Range", test.rng)
+		}
+		w := httptest.NewRecorder()
+
+		attachmentRouter(svc, 16).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantBody == "" {
+			continue
+		}
+		if got := w.Body.String(); got != test.wantBody {
+			t.Errorf("%v: expected body %q got %q", test.name, test.wantBody, got)
+		}
+		h := w.Result().Header
+		if got := h.Get("Content-Disposition"); got != test.wantDisposition {
+			t.Errorf("%v: expected disposition %v got %v", test.name, test.wantDisposition, got)
+		}
+		if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("%v: expected the download to be sandboxed got %v", test.name, h)
+		}
+	}
+
+	// The ETag is the attachment's hash
+	r := httptest.NewRequest(http.MethodGet, "/1/attachments/png", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	w := httptest.NewRecorder()
+	attachmentRouter(svc, 16).ServeHTTP(w, r)
+	if w.Result().StatusCode != http.StatusNotModified {
+		t.Errorf("expected %v got %v", http.StatusNotModified, w.Result().StatusCode)
+	}
+}
+
+func TestListAttachments(t *testing.T) {
+	svc := newMockAttachmentService()
+	svc.add("1", note.Attachment{ID: "a", Name: "a.txt"}, "a")
+	svc.add("1", note.Attachment{ID: "b", Name: "b.txt"}, "b")
+
+	r := httptest.NewRequest(http.MethodGet, "/1/attachments", nil)
+	w := httptest.NewRecorder()
+	attachmentRouter(svc, 16).ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	resp := api.AttachmentListResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Attachments) != 2 || resp.Attachments[0].ID != "a" || resp.Attachments[1].ID != "b" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestDeleteAttachment(t *testing.T) {
+	svc := newMockAttachmentService()
+	svc.add("1", note.Attachment{ID: "a", Name: "a.txt"}, "a")
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		r := httptest.NewRequest(http.MethodDelete, "/1/attachments/a", nil)
+		w := httptest.NewRecorder()
+		attachmentRouter(svc, 16).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != want {
+			t.Errorf("expected %v got %v", want, w.Result().StatusCode)
+		}
+	}
+}
+
+// mockAttachmentService keeps the attachments of note 1
+type mockAttachmentService struct {
+	attachments []note.Attachment
+	data        map[string]string
+}
+
+func newMockAttachmentService() *mockAttachmentService {
+	return &mockAttachmentService{data: make(map[string]string)}
+}
+
+func (m *mockAttachmentService) add(noteID string, a note.Attachment, data string) {
+	a.Size = int64(len(data))
+	m.attachments = append(m.attachments, a)
+	m.data[a.ID] = data
+}
+
+func (m *mockAttachmentService) AddAttachment(_ context.Context, noteID, name string, r io.Reader) (note.Attachment, error) {
+	if noteID != "1" {
+		return note.Attachment{}, &core.ErrNotFound{}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return note.Attachment{}, err
+	}
+	a := note.Attachment{ID: "generated", Name: name, ContentType: "text/plain; charset=utf-8"}
+	m.add(noteID, a, string(data))
+	a.Size = int64(len(data))
+	return a, nil
+}
+
+func (m *mockAttachmentService) ListAttachments(_ context.Context, noteID string) ([]note.Attachment, error) {
+	if noteID != "1" {
+		return []note.Attachment{}, &core.ErrNotFound{}
+	}
+	return m.attachments, nil
+}
+
+func (m *mockAttachmentService) OpenAttachment(_ context.Context, noteID, id string) (note.Attachment, io.ReadSeekCloser, error) {
+	for _, a := range m.attachments {
+		if noteID == "1" && a.ID == id {
+			return a, nopSeekCloser{strings.NewReader(m.data[id])}, nil
+		}
+	}
+	return note.Attachment{}, nil, &core.ErrNotFound{}
+}
+
+func (m *mockAttachmentService) DeleteAttachment(_ context.Context, noteID, id string) error {
+	for i, a := range m.attachments {
+		if noteID == "1" && a.ID == id {
+			m.attachments = append(m.attachments[:i], m.attachments[i+1:]...)
+			return nil
+		}
+	}
+	return &core.ErrNotFound{}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+	"github.com/sksmith/note-server/core/audit"
+)
+
+type AuditApi struct {
+	service AuditService
+}
+
+type AuditService interface {
+	List(ctx context.Context, f audit.Filter, startIdx, endIdx int) ([]audit.Event, int, error)
+}
+
+// NewAuditApi returns the api for reading the audit log. It must only be
+// reachable by admins, see RequireAdmin.
+func NewAuditApi(service AuditService) *AuditApi {
+	return &AuditApi{service: service}
+}
+
+func (a *AuditApi) ConfigureRouter(r chi.Router) {
+	r.With(Paginate).Get("/", a.List)
+}
+
+// List returns a page of the audit log, oldest first. The from and to query
+// parameters are RFC 3339 times that limit it to the events recorded from
+// (inclusive) to (exclusive), actor=<username> and note=<id> narrow it down
+// further.
+func (a *AuditApi) List(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageFromContext(r.Context())
+
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	events, total, err := a.service.List(r.Context(), filter, offset, offset+limit)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	setPageHeaders(w, r.URL, offset, limit, total)
+	Render(w, r, NewAuditListResponse(events, total, nextCursor(offset, limit, total)))
+}
+
+func parseAuditFilter(q url.Values) (audit.Filter, error) {
+	f := audit.Filter{Actor: q.Get("actor"), NoteID: q.Get("note")}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return audit.Filter{}, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return audit.Filter{}, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	return f, nil
+}
+
+// AuditRequest places the request's ID, see middleware.RequestID, and the
+// address it came from in the request context so changes made by it are
+// attributed to it in the audit log.
+func AuditRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		ctx := audit.NewContext(r.Context(), audit.Request{ID: middleware.GetReqID(r.Context()), SourceIP: ip})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,95 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core/audit"
+)
+
+func TestAuditList(t *testing.T) {
+	from := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		url        string
+		auth       string
+		wantStatus int
+		wantFilter audit.Filter
+	}{
+		{name: "All", url: "/audit", auth: "admin", wantStatus: http.StatusOK},
+		{
+			name: "Filtered", url: "/audit?from=2021-05-05T10:00:00Z&to=2021-05-06T10:00:00Z&actor=alice&note=1", auth: "admin",
+			wantStatus: http.StatusOK, wantFilter: audit.Filter{From: from, To: from.Add(24 * time.Hour), Actor: "alice", NoteID: "1"},
+		},
+		{name: "Bad From", url: "/audit?from=yesterday", auth: "admin", wantStatus: http.StatusBadRequest},
+		{name: "Bad To", url: "/audit?to=2021-05-06", auth: "admin", wantStatus: http.StatusBadRequest},
+		{name: "Not An Admin", url: "/audit", auth: "test", wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		svc := &mockAuditService{}
+		router := chi.NewRouter()
+		router.Use(api.Authenticate(&mockUserService{}, nil, nil))
+		router.With(api.RequireAdmin).Route("/audit", api.NewAuditApi(svc).ConfigureRouter)
+
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		r.SetBasicAuth(test.auth, "password")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if svc.filter != test.wantFilter {
+			t.Errorf("%v: expected filter %+v got %+v", test.name, test.wantFilter, svc.filter)
+		}
+
+		resp := api.AuditListResponse{}
+		data, _ := ioutil.ReadAll(w.Result().Body)
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%v: failed to parse response %v", test.name, err)
+		}
+		if resp.Total != 1 || len(resp.Events) != 1 || resp.Events[0].Action != audit.ActionCreate {
+			t.Errorf("%v: expected the event got %s", test.name, data)
+		}
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	var got audit.Request
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(api.AuditRequest)
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		got, _ = audit.RequestFromContext(r.Context())
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got.ID == "" || got.SourceIP != "192.0.2.1" {
+		t.Errorf("expected the request id and source ip got %+v", got)
+	}
+}
+
+type mockAuditService struct {
+	filter audit.Filter
+}
+
+func (m *mockAuditService) List(_ context.Context, f audit.Filter, startIdx, endIdx int) ([]audit.Event, int, error) {
+	m.filter = f
+	return []audit.Event{{ID: "1", Action: audit.ActionCreate, NoteID: "1"}}, 1, nil
+}
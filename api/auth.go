@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/auth"
+)
+
+type AuthApi struct {
+	service AuthService
+}
+
+type AuthService interface {
+	Login(ctx context.Context, username, password string) (auth.Tokens, error)
+	Refresh(ctx context.Context, refreshToken string) (auth.Tokens, error)
+	Logout(ctx context.Context, refreshToken string) error
+}
+
+// NewAuthApi returns the api for exchanging a username and password for
+// bearer tokens
+func NewAuthApi(service AuthService) *AuthApi {
+	return &AuthApi{service: service}
+}
+
+func (a *AuthApi) ConfigureRouter(r chi.Router) {
+	r.Post("/token", a.Token)
+	r.Post("/refresh", a.Refresh)
+	r.Post("/logout", a.Logout)
+}
+
+// Token logs the user in, issuing an access token and a refresh token
+func (a *AuthApi) Token(w http.ResponseWriter, r *http.Request) {
+	data := &LoginRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	tokens, err := a.service.Login(r.Context(), data.Username, data.Password)
+	if err != nil {
+		handleAuthError(w, r, err)
+		return
+	}
+
+	renderTokens(w, r, tokens)
+}
+
+// Refresh exchanges a refresh token for new tokens
+func (a *AuthApi) Refresh(w http.ResponseWriter, r *http.Request) {
+	data := &RefreshRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	tokens, err := a.service.Refresh(r.Context(), data.RefreshToken)
+	if err != nil {
+		handleAuthError(w, r, err)
+		return
+	}
+
+	renderTokens(w, r, tokens)
+}
+
+// Logout revokes the refresh token and the access tokens issued with it
+func (a *AuthApi) Logout(w http.ResponseWriter, r *http.Request) {
+	data := &RefreshRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := a.service.Logout(r.Context(), data.RefreshToken); err != nil {
+		handleAuthError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// renderTokens responds with the tokens, which must never be cached
+func renderTokens(w http.ResponseWriter, r *http.Request, tokens auth.Tokens) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	Render(w, r, NewTokenResponse(tokens))
+}
+
+func handleAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	switch errors.Cause(err) {
+	case auth.ErrInvalidCredentials, auth.ErrInvalidToken:
+		log.Err(err).Send()
+		Render(w, r, ErrUnauthorized)
+	default:
+		handleError(w, r, err)
+	}
+}
@@ -0,0 +1,193 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{name: "logged in", url: "/token", body: `{"username": "test", "password": "password"}`, wantStatus: http.StatusOK},
+		{name: "wrong password", url: "/token", body: `{"username": "test", "password": "wrong"}`, wantStatus: http.StatusUnauthorized},
+		{name: "missing password", url: "/token", body: `{"username": "test"}`, wantStatus: http.StatusBadRequest},
+		{name: "refreshed", url: "/refresh", body: `{"refreshToken": "refresh"}`, wantStatus: http.StatusOK},
+		{name: "bad refresh token", url: "/refresh", body: `{"refreshToken": "used"}`, wantStatus: http.StatusUnauthorized},
+		{name: "missing refresh token", url: "/refresh", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "store failure", url: "/refresh", body: `{"refreshToken": "fail"}`, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewAuthApi(&mockAuthService{}).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPost, test.url, strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+
+		if got := w.Result().Header.Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%v: expected tokens not to be cached got %v", test.name, got)
+		}
+		resp := api.TokenResponse{}
+		data, _ := ioutil.ReadAll(w.Result().Body)
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%v: failed to parse response %v", test.name, err)
+		}
+		want := api.TokenResponse{AccessToken: "access", TokenType: "Bearer", ExpiresIn: 900, RefreshToken: "refresh"}
+		if resp != want {
+			t.Errorf("%v: expected %v got %v", test.name, want, resp)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "logged out", body: `{"refreshToken": "refresh"}`, wantStatus: http.StatusNoContent},
+		{name: "bad refresh token", body: `{"refreshToken": "used"}`, wantStatus: http.StatusUnauthorized},
+		{name: "missing refresh token", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		svc := &mockAuthService{}
+		router := chi.NewRouter()
+		api.NewAuthApi(svc).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if svc.loggedOut != (test.wantStatus == http.StatusNoContent) {
+			t.Errorf("%v: expected logged out=%v", test.name, !svc.loggedOut)
+		}
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		basic         bool
+		verifier      api.TokenVerifier
+		wantStatus    int
+		wantChallenge string
+	}{
+		{name: "bearer", authorization: "Bearer access", verifier: &mockAuthService{}, wantStatus: http.StatusOK},
+		{name: "lower case scheme", authorization: "bearer access", verifier: &mockAuthService{}, wantStatus: http.StatusOK},
+		{name: "basic with a verifier", basic: true, verifier: &mockAuthService{}, wantStatus: http.StatusOK},
+		{name: "invalid token", authorization: "Bearer expired", verifier: &mockAuthService{}, wantStatus: http.StatusUnauthorized, wantChallenge: `error="invalid_token"`},
+		{name: "store failure", authorization: "Bearer fail", verifier: &mockAuthService{}, wantStatus: http.StatusInternalServerError},
+		{name: "empty token", authorization: "Bearer ", verifier: &mockAuthService{}, wantStatus: http.StatusUnauthorized, wantChallenge: "Bearer"},
+		{name: "no verifier", authorization: "Bearer access", wantStatus: http.StatusUnauthorized, wantChallenge: "Basic"},
+	}
+
+	for _, test := range tests {
+		var got user.User
+		handler := api.Authenticate(&mockUserService{}, test.verifier, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = user.FromContext(r.Context())
+			if keyed, _ := r.Context().Value(api.CtxKeyUser).(user.User); keyed.ID != got.ID {
+				t.Errorf("expected the user under CtxKeyUser got %v", keyed)
+			}
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.basic {
+			r.SetBasicAuth("test", "password")
+		} else {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus == http.StatusOK && got.Username != "test" {
+			t.Errorf("%v: expected the user in the context got %v", test.name, got)
+		}
+		challenge := strings.Join(w.Result().Header.Values("WWW-Authenticate"), ", ")
+		if test.wantChallenge != "" && !strings.Contains(challenge, test.wantChallenge) {
+			t.Errorf("%v: expected a WWW-Authenticate header with %v got %v", test.name, test.wantChallenge, challenge)
+		}
+	}
+}
+
+// mockAuthService issues the tokens "access" and "refresh" to the user test
+// with the password "password"
+type mockAuthService struct {
+	loggedOut bool
+}
+
+func (m *mockAuthService) Login(ctx context.Context, username, password string) (auth.Tokens, error) {
+	if username != "test" || password != "password" {
+		return auth.Tokens{}, auth.ErrInvalidCredentials
+	}
+	return auth.Tokens{AccessToken: "access", ExpiresIn: 15 * time.Minute, RefreshToken: "refresh"}, nil
+}
+
+func (m *mockAuthService) Refresh(_ context.Context, refreshToken string) (auth.Tokens, error) {
+	switch refreshToken {
+	case "refresh":
+		return auth.Tokens{AccessToken: "access", ExpiresIn: 15 * time.Minute, RefreshToken: "refresh"}, nil
+	case "fail":
+		return auth.Tokens{}, errors.New("some store failure")
+	default:
+		return auth.Tokens{}, auth.ErrInvalidToken
+	}
+}
+
+func (m *mockAuthService) Logout(_ context.Context, refreshToken string) error {
+	if refreshToken != "refresh" {
+		return auth.ErrInvalidToken
+	}
+	m.loggedOut = true
+	return nil
+}
+
+func (m *mockAuthService) Verify(_ context.Context, token string) (user.User, error) {
+	switch token {
+	case "access":
+		return user.User{ID: "test-id", Username: "test"}, nil
+	case "fail":
+		return user.User{}, errors.New("some store failure")
+	default:
+		return user.User{}, auth.ErrInvalidToken
+	}
+}
+
+func (m *mockAuthService) Start(_ context.Context, u user.User) (auth.Tokens, error) {
+	return auth.Tokens{AccessToken: "access", ExpiresIn: 15 * time.Minute, RefreshToken: "refresh"}, nil
+}
@@ -3,19 +3,26 @@ package api
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/render"
 	"github.com/rs/zerolog/log"
 	"github.com/sksmith/note-server/config"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/auth"
 	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
 )
 
 type ListNoteResponse struct {
 	Notes []note.ListNote `json:"notes"`
+	Total int             `json:"total"`
+	Next  string          `json:"next,omitempty"`
 }
 
-func NewListNoteResponse(l []note.ListNote) *ListNoteResponse {
-	resp := &ListNoteResponse{Notes: l}
+func NewListNoteResponse(l []note.ListNote, total int, next string) *ListNoteResponse {
+	resp := &ListNoteResponse{Notes: l, Total: total, Next: next}
 	return resp
 }
 
@@ -24,6 +31,22 @@ func (nr *ListNoteResponse) Render(_ http.ResponseWriter, _ *http.Request) error
 	return nil
 }
 
+type SearchResponse struct {
+	Results []note.SearchResult `json:"results"`
+	Total   int                 `json:"total"`
+	Next    string              `json:"next,omitempty"`
+}
+
+func NewSearchResponse(results []note.SearchResult, total int, next string) *SearchResponse {
+	resp := &SearchResponse{Results: results, Total: total, Next: next}
+	return resp
+}
+
+func (sr *SearchResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
 type NoteResponse struct {
 	note.Note
 }
@@ -38,6 +61,112 @@ func (nr *NoteResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
 	return nil
 }
 
+type RevisionListResponse struct {
+	Revisions []note.Revision `json:"revisions"`
+}
+
+func NewRevisionListResponse(revs []note.Revision) *RevisionListResponse {
+	resp := &RevisionListResponse{Revisions: revs}
+	return resp
+}
+
+func (rr *RevisionListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type TagListResponse struct {
+	Tags []note.TagCount `json:"tags"`
+}
+
+func NewTagListResponse(tags []note.TagCount) *TagListResponse {
+	resp := &TagListResponse{Tags: tags}
+	return resp
+}
+
+func (tr *TagListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type AttachmentResponse struct {
+	note.Attachment
+}
+
+func NewAttachmentResponse(a note.Attachment) *AttachmentResponse {
+	resp := &AttachmentResponse{Attachment: a}
+	return resp
+}
+
+func (ar *AttachmentResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type AttachmentListResponse struct {
+	Attachments []note.Attachment `json:"attachments"`
+}
+
+func NewAttachmentListResponse(attachments []note.Attachment) *AttachmentListResponse {
+	resp := &AttachmentListResponse{Attachments: attachments}
+	return resp
+}
+
+func (ar *AttachmentListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type NotebookResponse struct {
+	note.Notebook
+}
+
+func NewNotebookResponse(nb note.Notebook) *NotebookResponse {
+	resp := &NotebookResponse{Notebook: nb}
+	return resp
+}
+
+func (nr *NotebookResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type NotebookListResponse struct {
+	Notebooks []note.Notebook `json:"notebooks"`
+}
+
+func NewNotebookListResponse(list []note.Notebook) *NotebookListResponse {
+	resp := &NotebookListResponse{Notebooks: list}
+	return resp
+}
+
+func (nr *NotebookListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type NotebookRequest struct {
+	*note.Notebook
+}
+
+func (p *NotebookRequest) Bind(_ *http.Request) error {
+	if p.Notebook == nil || p.Notebook.Name == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+// MoveNoteRequest names the notebook to move a note into, an empty notebookId
+// being the top level
+type MoveNoteRequest struct {
+	NotebookID string `json:"notebookId"`
+}
+
+func (p *MoveNoteRequest) Bind(_ *http.Request) error {
+	return nil
+}
+
 type CreateNoteRequest struct {
 	*note.Note
 }
@@ -50,12 +179,245 @@ func (p *CreateNoteRequest) Bind(_ *http.Request) error {
 	return nil
 }
 
+// AddNoteRequest is a note to be saved under an ID generated by the server
+type AddNoteRequest struct {
+	*note.Note
+}
+
+func (p *AddNoteRequest) Bind(_ *http.Request) error {
+	if p.Note == nil || p.Note.Data == "" {
+		return errors.New("missing required field(s)")
+	}
+	if p.Note.ID != "" {
+		return errors.New("id is generated by the server, PUT the note to its own url to choose one")
+	}
+
+	return nil
+}
+
+// ReplaceNoteRequest is a note replacing the one at its url. The body's id
+// may be left out but must match the url if it's given.
+type ReplaceNoteRequest struct {
+	*note.Note
+}
+
+func (p *ReplaceNoteRequest) Bind(_ *http.Request) error {
+	if p.Note == nil || p.Note.Data == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+// UserResponse is a user without their password hash
+type UserResponse struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Admin    bool      `json:"admin"`
+	Created  time.Time `json:"created"`
+}
+
+func NewUserResponse(u user.User) *UserResponse {
+	resp := &UserResponse{ID: u.ID, Username: u.Username, Admin: u.Admin, Created: u.Created}
+	return resp
+}
+
+func (ur *UserResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (p *RegisterRequest) Bind(_ *http.Request) error {
+	if p.Username == "" || p.Password == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+func (p *ChangePasswordRequest) Bind(_ *http.Request) error {
+	if p.CurrentPassword == "" || p.NewPassword == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (p *LoginRequest) Bind(_ *http.Request) error {
+	if p.Username == "" || p.Password == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func (p *RefreshRequest) Bind(_ *http.Request) error {
+	if p.RefreshToken == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+// TokenResponse carries the tokens issued by logging in or refreshing,
+// expiresIn is the access token's lifetime in seconds
+type TokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func NewTokenResponse(t auth.Tokens) *TokenResponse {
+	resp := &TokenResponse{
+		AccessToken:  t.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.ExpiresIn / time.Second),
+		RefreshToken: t.RefreshToken,
+	}
+	return resp
+}
+
+func (tr *TokenResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type KeyRequest struct {
+	Name    string       `json:"name"`
+	Scope   apikey.Scope `json:"scope"`
+	Expires *time.Time   `json:"expires,omitempty"`
+}
+
+func (p *KeyRequest) Bind(_ *http.Request) error {
+	if p.Name == "" || p.Scope == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+// KeyResponse is an API key without its secret's hash. Token is only set when
+// the key is made.
+type KeyResponse struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Scope    apikey.Scope `json:"scope"`
+	Created  time.Time    `json:"created"`
+	Expires  *time.Time   `json:"expires,omitempty"`
+	LastUsed *time.Time   `json:"lastUsed,omitempty"`
+	Token    string       `json:"token,omitempty"`
+}
+
+func NewKeyResponse(k apikey.Key) *KeyResponse {
+	resp := &KeyResponse{ID: k.ID, Name: k.Name, Scope: k.Scope, Created: k.Created, Expires: k.Expires, LastUsed: k.LastUsed}
+	return resp
+}
+
+func (kr *KeyResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type KeyListResponse struct {
+	Keys []*KeyResponse `json:"keys"`
+}
+
+func NewKeyListResponse(keys []apikey.Key) *KeyListResponse {
+	resp := &KeyListResponse{Keys: make([]*KeyResponse, 0, len(keys))}
+	for _, k := range keys {
+		resp.Keys = append(resp.Keys, NewKeyResponse(k))
+	}
+	return resp
+}
+
+func (kr *KeyListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type WrappedKeyRequest struct {
+	Algorithm  string `json:"algorithm"`
+	Key        string `json:"key"`
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+func (p *WrappedKeyRequest) Bind(_ *http.Request) error {
+	if p.Algorithm == "" || p.Key == "" || p.Salt == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+type WrappedKeyResponse struct {
+	note.WrappedKey
+}
+
+func NewWrappedKeyResponse(k note.WrappedKey) *WrappedKeyResponse {
+	resp := &WrappedKeyResponse{WrappedKey: k}
+	return resp
+}
+
+func (kr *WrappedKeyResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type WrappedKeyListResponse struct {
+	Keys []note.WrappedKey `json:"keys"`
+}
+
+func NewWrappedKeyListResponse(keys []note.WrappedKey) *WrappedKeyListResponse {
+	resp := &WrappedKeyListResponse{Keys: keys}
+	return resp
+}
+
+func (kr *WrappedKeyListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
 func Render(w http.ResponseWriter, r *http.Request, rnd render.Renderer) {
 	if err := render.Render(w, r, rnd); err != nil {
 		log.Warn().Err(err).Msg("failed to render")
 	}
 }
 
+type IndexReportResponse struct {
+	note.IndexReport
+}
+
+func NewIndexReportResponse(r note.IndexReport) *IndexReportResponse {
+	resp := &IndexReportResponse{IndexReport: r}
+	return resp
+}
+
+func (ir *IndexReportResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
 type EnvResponse struct {
 	config.Config
 }
@@ -69,3 +431,133 @@ func (er *EnvResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
 	// Pre-processing before a response is marshalled and sent across the wire
 	return nil
 }
+
+type ShareRequest struct {
+	Username string    `json:"username"`
+	Role     note.Role `json:"role"`
+}
+
+func (p *ShareRequest) Bind(_ *http.Request) error {
+	if p.Username == "" || p.Role == "" {
+		return errors.New("missing required field(s)")
+	}
+
+	return nil
+}
+
+// ShareResponse is who a note is shared with and as what, by username
+type ShareResponse struct {
+	NoteID   string    `json:"noteId"`
+	Owner    string    `json:"owner"`
+	Username string    `json:"username"`
+	Role     note.Role `json:"role"`
+	Created  time.Time `json:"created"`
+}
+
+func NewShareResponse(sh note.Share) *ShareResponse {
+	resp := &ShareResponse{NoteID: sh.NoteID, Owner: sh.OwnerUsername, Username: sh.Username, Role: sh.Role, Created: sh.Created}
+	return resp
+}
+
+func (sr *ShareResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type ShareListResponse struct {
+	Shares []*ShareResponse `json:"shares"`
+}
+
+func NewShareListResponse(shares []note.Share) *ShareListResponse {
+	resp := &ShareListResponse{Shares: make([]*ShareResponse, 0, len(shares))}
+	for _, sh := range shares {
+		resp.Shares = append(resp.Shares, NewShareResponse(sh))
+	}
+	return resp
+}
+
+func (sr *ShareListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type LinkRequest struct {
+	Expires  *time.Time `json:"expires,omitempty"`
+	Password string     `json:"password,omitempty"`
+}
+
+func (p *LinkRequest) Bind(_ *http.Request) error {
+	return nil
+}
+
+// LinkResponse is a share link without its hashes. Token is only set when
+// the link is made.
+type LinkResponse struct {
+	ID          string     `json:"id"`
+	NoteID      string     `json:"noteId"`
+	HasPassword bool       `json:"hasPassword"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Token       string     `json:"token,omitempty"`
+}
+
+func NewLinkResponse(l note.Link) *LinkResponse {
+	resp := &LinkResponse{ID: l.ID, NoteID: l.NoteID, HasPassword: l.HasPassword(), Created: l.Created, Expires: l.Expires}
+	return resp
+}
+
+func (lr *LinkResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type LinkListResponse struct {
+	Links []*LinkResponse `json:"links"`
+}
+
+func NewLinkListResponse(links []note.Link) *LinkListResponse {
+	resp := &LinkListResponse{Links: make([]*LinkResponse, 0, len(links))}
+	for _, l := range links {
+		resp.Links = append(resp.Links, NewLinkResponse(l))
+	}
+	return resp
+}
+
+func (lr *LinkListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+// SharedNoteResponse is what a share link shows of its note
+type SharedNoteResponse struct {
+	Title   string    `json:"title"`
+	Data    string    `json:"data"`
+	Tags    []string  `json:"tags,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func NewSharedNoteResponse(n note.Note) *SharedNoteResponse {
+	resp := &SharedNoteResponse{Title: n.Title, Data: n.Data, Tags: n.Tags, Updated: n.Updated}
+	return resp
+}
+
+func (sr *SharedNoteResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type AuditListResponse struct {
+	Events []audit.Event `json:"events"`
+	Total  int           `json:"total"`
+	Next   string        `json:"next,omitempty"`
+}
+
+func NewAuditListResponse(events []audit.Event, total int, next string) *AuditListResponse {
+	resp := &AuditListResponse{Events: events, Total: total, Next: next}
+	return resp
+}
+
+func (ar *AuditListResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -43,9 +43,48 @@ var ErrNotFound = &ErrResponse{
 	StatusText:     "Resource not found.",
 }
 
+var ErrUnauthorized = &ErrResponse{
+	HTTPStatusCode: http.StatusUnauthorized,
+	StatusText:     "Unauthorized.",
+	ErrorText:      "The credentials or token are invalid.",
+}
+
+var ErrForbidden = &ErrResponse{
+	HTTPStatusCode: http.StatusForbidden,
+	StatusText:     "Forbidden.",
+	ErrorText:      "You don't have access to this resource.",
+}
+
+var ErrPreconditionFailed = &ErrResponse{
+	HTTPStatusCode: http.StatusPreconditionFailed,
+	StatusText:     "Precondition failed.",
+	ErrorText:      "The resource has been modified since it was retrieved.",
+}
+
+var ErrRangeNotSatisfiable = &ErrResponse{
+	HTTPStatusCode: http.StatusRequestedRangeNotSatisfiable,
+	StatusText:     "Requested range not satisfiable.",
+	ErrorText:      "The range starts at or past the end of the resource.",
+}
+
+var ErrRequestTooLarge = &ErrResponse{
+	HTTPStatusCode: http.StatusRequestEntityTooLarge,
+	StatusText:     "Request entity too large.",
+	ErrorText:      "The upload is larger than the server accepts.",
+}
+
 var ErrInternalServer = &ErrResponse{
 	Err:            nil,
 	HTTPStatusCode: http.StatusInternalServerError,
 	StatusText:     "Internal server error.",
 	ErrorText:      "An internal server error has occurred.",
 }
+
+func ErrUnsupportedMediaType(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusUnsupportedMediaType,
+		StatusText:     "Unsupported media type.",
+		ErrorText:      err.Error(),
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sksmith/note-server/core/note"
+)
+
+// etag formats a note version as a strong entity tag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// expectedVersion returns the note version the request's preconditions
+// require. If-Match must hold a single entity tag previously returned by the
+// api and "If-None-Match: *" requires that the note doesn't exist yet.
+// Without either header any version may be overwritten.
+func expectedVersion(r *http.Request) (int64, error) {
+	if im := strings.TrimSpace(r.Header.Get("If-Match")); im != "" {
+		v, err := parseETag(im)
+		if err != nil {
+			return 0, err
+		}
+		return v, nil
+	}
+
+	if inm := strings.TrimSpace(r.Header.Get("If-None-Match")); inm != "" {
+		if inm != "*" {
+			return 0, errors.New(`If-None-Match only supports "*"`)
+		}
+		return 0, nil
+	}
+
+	return note.AnyVersion, nil
+}
+
+func parseETag(tag string) (int64, error) {
+	errInvalid := errors.New("If-Match must be a single entity tag returned by the api")
+
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, errInvalid
+	}
+	v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, errInvalid
+	}
+	return v, nil
+}
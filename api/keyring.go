@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/note"
+)
+
+type KeyRingApi struct {
+	service KeyRingService
+}
+
+type KeyRingService interface {
+	SaveWrappedKey(ctx context.Context, k note.WrappedKey) (note.WrappedKey, error)
+	GetWrappedKey(ctx context.Context, id string) (note.WrappedKey, error)
+	ListWrappedKeys(ctx context.Context) ([]note.WrappedKey, error)
+}
+
+// NewKeyRingApi returns the api for the authenticated user's wrapped keys,
+// the keys their encrypted notes are encrypted with. It must be used after
+// Authenticate.
+func NewKeyRingApi(service KeyRingService) *KeyRingApi {
+	return &KeyRingApi{service: service}
+}
+
+// ConfigureRouter adds the key ring's routes. Keys can't be deleted and an
+// API key can't replace one, as either would leave the notes encrypted with
+// it unreadable.
+func (a *KeyRingApi) ConfigureRouter(r chi.Router) {
+	r.Get("/", a.List)
+	r.Get("/{id}", a.Get)
+	r.With(NoAPIKeys).Put("/{id}", a.Save)
+}
+
+func (a *KeyRingApi) List(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.service.ListWrappedKeys(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewWrappedKeyListResponse(keys))
+}
+
+func (a *KeyRingApi) Get(w http.ResponseWriter, r *http.Request) {
+	k, err := a.service.GetWrappedKey(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewWrappedKeyResponse(k))
+}
+
+// Save adds a key to the key ring or replaces one that's been wrapped again
+func (a *KeyRingApi) Save(w http.ResponseWriter, r *http.Request) {
+	data := &WrappedKeyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	k := note.WrappedKey{
+		ID:         chi.URLParam(r, "id"),
+		Algorithm:  data.Algorithm,
+		Key:        data.Key,
+		Salt:       data.Salt,
+		Iterations: data.Iterations,
+	}
+	k, err := a.service.SaveWrappedKey(r.Context(), k)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewWrappedKeyResponse(k))
+}
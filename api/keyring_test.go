@@ -0,0 +1,102 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestKeyRing(t *testing.T) {
+	svc := &mockKeyRingService{keys: make(map[string]note.WrappedKey)}
+	keys := newMockKeyService()
+	_, token, _ := keys.Create(context.Background(), user.User{ID: "test-id", Username: "test"}, "key", apikey.ScopeWrite, nil)
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, keys))
+	router.Route("/keyring", api.NewKeyRingApi(svc).ConfigureRouter)
+
+	body := `{"algorithm": "PBKDF2-SHA256/A256KW", "key": "wrapped", "salt": "salt", "iterations": 100000}`
+	w := serveKeys(router, http.MethodPut, "/keyring/k1", body, "password")
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	saved := api.WrappedKeyResponse{}
+	data, _ := ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if saved.ID != "k1" || saved.Key != "wrapped" || saved.Iterations != 100000 {
+		t.Errorf("expected the saved key got %s", data)
+	}
+
+	w = serveKeys(router, http.MethodGet, "/keyring", "", token)
+	list := api.WrappedKeyListResponse{}
+	data, _ = ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if len(list.Keys) != 1 || list.Keys[0].ID != "k1" {
+		t.Errorf("expected the key got %s", data)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		auth       string
+		wantStatus int
+	}{
+		{name: "get", method: http.MethodGet, url: "/keyring/k1", auth: "password", wantStatus: http.StatusOK},
+		{name: "get missing", method: http.MethodGet, url: "/keyring/missing", auth: "password", wantStatus: http.StatusNotFound},
+		{name: "missing salt", method: http.MethodPut, url: "/keyring/k1", body: `{"algorithm": "PBKDF2-SHA256/A256KW", "key": "wrapped"}`, auth: "password", wantStatus: http.StatusBadRequest},
+		{name: "invalid", method: http.MethodPut, url: "/keyring/k1", body: strings.Replace(body, "100000", "10", 1), auth: "password", wantStatus: http.StatusBadRequest},
+		{name: "replaced with a key", method: http.MethodPut, url: "/keyring/k1", body: body, auth: token, wantStatus: http.StatusForbidden},
+		{name: "deleted", method: http.MethodDelete, url: "/keyring/k1", auth: "password", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		w := serveKeys(router, test.method, test.url, test.body, test.auth)
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+// mockKeyRingService only checks a key's iterations
+type mockKeyRingService struct {
+	keys map[string]note.WrappedKey
+}
+
+func (m *mockKeyRingService) SaveWrappedKey(_ context.Context, k note.WrappedKey) (note.WrappedKey, error) {
+	if k.Iterations < 100000 {
+		return note.WrappedKey{}, &core.ErrInvalid{Reason: "iterations must be at least 100000"}
+	}
+	m.keys[k.ID] = k
+	return k, nil
+}
+
+func (m *mockKeyRingService) GetWrappedKey(_ context.Context, id string) (note.WrappedKey, error) {
+	k, ok := m.keys[id]
+	if !ok {
+		return note.WrappedKey{}, &core.ErrNotFound{}
+	}
+	return k, nil
+}
+
+func (m *mockKeyRingService) ListWrappedKeys(_ context.Context) ([]note.WrappedKey, error) {
+	keys := make([]note.WrappedKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -4,23 +4,34 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/user"
 )
 
 const DefaultPageLimit = 50
 
+// linkPath is where share links are opened, the rest of the path is the
+// link's token which includes its secret
+const linkPath = "/share/"
+
 type CtxKey string
 
 const (
 	CtxKeyLimit  CtxKey = "limit"
 	CtxKeyOffset CtxKey = "offset"
-	CtxKeyUser   CtxKey = "user"
+	// CtxKeyUser holds the authenticated user.User. The core can't see the
+	// api's keys so it reads the same user through user.FromContext.
+	CtxKeyUser CtxKey = "user"
 )
 
 var (
@@ -43,7 +54,7 @@ func Logging(next http.Handler) http.Handler {
 			log.Info().
 				Str("method", r.Method).
 				Str("host", r.Host).
-				Str("uri", r.RequestURI).
+				Str("uri", loggedURI(r.RequestURI)).
 				Str("proto", r.Proto).
 				Int("status", ww.Status()).
 				Int("bytes", ww.BytesWritten()).
@@ -55,13 +66,77 @@ func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// loggedURI leaves the secret out of a share link's URI, keeping the link's ID
+// to tell which one was opened. Logging the secret would let anyone who can
+// read the logs open the link.
+func loggedURI(uri string) string {
+	if !strings.HasPrefix(uri, linkPath) {
+		return uri
+	}
+	token := strings.TrimPrefix(uri, linkPath)
+	if i := strings.IndexAny(token, "./?"); i >= 0 {
+		token = token[:i]
+	}
+	return linkPath + token + ".REDACTED"
+}
+
 type UserAccess interface {
-	Auth(ctx context.Context, username, password string) bool
+	Auth(ctx context.Context, username, password string) (user.User, bool)
+}
+
+// TokenVerifier returns the user a bearer token was issued to
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (user.User, error)
+}
+
+// KeyVerifier returns an API key and the user it acts as
+type KeyVerifier interface {
+	Verify(ctx context.Context, token string) (apikey.Key, user.User, error)
 }
 
-func Authenticate(ua UserAccess) func(http.Handler) http.Handler {
+// Authenticate checks the request's bearer token or basic auth credentials
+// and places the user in the request context under CtxKeyUser, see withUser.
+// Bearer tokens are API keys when they start with apikey.TokenPrefix and
+// access tokens otherwise, each is only accepted when there's a verifier for
+// it.
+// Requests made with an API key also carry it in their context, see
+// apikey.FromContext, and are turned away when it's out of scope.
+func Authenticate(ua UserAccess, tv TokenVerifier, kv KeyVerifier) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, bearer := bearerToken(r)
+			isKey := strings.HasPrefix(token, apikey.TokenPrefix)
+
+			switch {
+			case bearer && isKey && kv != nil:
+				k, u, err := kv.Verify(r.Context(), token)
+				if err != nil {
+					tokenErr(w, r, err)
+					return
+				}
+				if !k.Allows(r.Method) {
+					Render(w, r, ErrForbidden)
+					return
+				}
+
+				ctx := apikey.NewContext(withUser(r.Context(), u), k)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			case bearer && !isKey && tv != nil:
+				u, err := tv.Verify(r.Context(), token)
+				if err != nil {
+					tokenErr(w, r, err)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(withUser(r.Context(), u)))
+				return
+			}
+
+			if tv != nil || kv != nil {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="restricted"`)
+			}
+
 			username, password, ok := r.BasicAuth()
 
 			if !ok {
@@ -69,18 +144,93 @@ func Authenticate(ua UserAccess) func(http.Handler) http.Handler {
 				return
 			}
 
-			if !ua.Auth(r.Context(), username, password) {
+			u, ok := ua.Auth(r.Context(), username, password)
+			if !ok {
 				authErr(w)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(withUser(r.Context(), u)))
 		})
 	}
 }
 
+// withUser places the user in the context under CtxKeyUser and where
+// user.FromContext finds it
+func withUser(ctx context.Context, u user.User) context.Context {
+	return user.NewContext(context.WithValue(ctx, CtxKeyUser, u), u)
+}
+
+// RequireAdmin only lets admins through, and only with API keys in the admin
+// scope. It must be used after Authenticate.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := user.FromContext(r.Context())
+		if !ok || !u.Admin {
+			Render(w, r, ErrForbidden)
+			return
+		}
+		if k, ok := apikey.FromContext(r.Context()); ok && k.Scope != apikey.ScopeAdmin {
+			Render(w, r, ErrForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NoAPIKeys turns away requests made with an API key, so that a key can't
+// be used to make or revoke keys. It must be used after Authenticate.
+func NoAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apikey.FromContext(r.Context()); ok {
+			Render(w, r, ErrForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Paginate reads the limit, offset and cursor query parameters into the
+// request context under CtxKeyLimit and CtxKeyOffset.
+func Paginate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePage(r.URL.Query())
+		if err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), CtxKeyLimit, limit)
+		ctx = context.WithValue(ctx, CtxKeyOffset, offset)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// tokenErr responds to a bearer token or API key that couldn't be verified
+func tokenErr(w http.ResponseWriter, r *http.Request, err error) {
+	log.Err(err).Send()
+	switch errors.Cause(err) {
+	case auth.ErrInvalidToken, apikey.ErrInvalidKey:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="restricted", error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	default:
+		Render(w, r, ErrInternalServer)
+	}
+}
+
 func authErr(w http.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+	w.Header().Add("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
 }
 
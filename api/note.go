@@ -3,6 +3,9 @@ package api
 import (
 	"context"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
@@ -18,9 +21,18 @@ type NoteApi struct {
 
 type NoteService interface {
 	Get(context.Context, string) (note.Note, error)
-	Create(context.Context, note.Note) error
+	Create(context.Context, note.Note, int64) (note.Note, error)
+	Add(context.Context, note.Note) (note.Note, error)
+	Replace(ctx context.Context, n note.Note, expected int64, upsert bool) (note.Note, bool, error)
+	Patch(ctx context.Context, id string, p note.Patch, expected int64) (note.Note, error)
 	Delete(context.Context, string) error
-	List(context.Context, int, int) ([]note.ListNote, error)
+	List(context.Context, note.ListFilter, int, int) ([]note.ListNote, int, error)
+	ListRevisions(context.Context, string) ([]note.Revision, error)
+	GetRevision(context.Context, string, int64) (note.Note, error)
+	Diff(ctx context.Context, id string, from, to int64) (string, error)
+	Restore(ctx context.Context, id string, version, expected int64) (note.Note, error)
+	MoveNote(ctx context.Context, id, notebookID string, expected int64) (note.Note, error)
+	Search(ctx context.Context, query string, startIdx, endIdx int) ([]note.SearchResult, int, error)
 }
 
 func NewNoteApi(service NoteService) *NoteApi {
@@ -33,10 +45,19 @@ const (
 )
 
 func (n *NoteApi) ConfigureRouter(r chi.Router) {
-	r.Get("/", n.List)
+	r.With(Paginate).Get("/", n.List)
+	r.Post("/", n.Add)
 	r.Put("/", n.Create)
+	r.With(Paginate).Get("/search", n.Search)
 	r.Get("/{id}", n.Get)
+	r.Put("/{id}", n.Replace)
+	r.Patch("/{id}", n.Patch)
 	r.Delete("/{id}", n.Delete)
+	r.Get("/{id}/diff", n.Diff)
+	r.Post("/{id}/move", n.Move)
+	r.Get("/{id}/revisions", n.ListRevisions)
+	r.Get("/{id}/revisions/{rev}", n.GetRevision)
+	r.Post("/{id}/revisions/{rev}/restore", n.Restore)
 }
 
 func (a *NoteApi) Get(w http.ResponseWriter, r *http.Request) {
@@ -47,17 +68,31 @@ func (a *NoteApi) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(n.Version))
 	Render(w, r, NewNoteResponse(n))
 }
 
+// List returns a page of notes. Notes can be filtered by tag with one or more
+// tag parameters, which must all match unless match=any is given, and scoped
+// to a notebook with notebook=<id>, or notebook=root for the top level.
 func (a *NoteApi) List(w http.ResponseWriter, r *http.Request) {
-	n, err := a.service.List(r.Context(), 0, 0)
+	limit, offset := pageFromContext(r.Context())
+
+	tags, err := parseTagFilter(r.URL.Query())
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	filter := note.ListFilter{TagFilter: tags, Notebook: r.URL.Query().Get("notebook")}
+
+	n, total, err := a.service.List(r.Context(), filter, offset, offset+limit)
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	Render(w, r, NewListNoteResponse(n))
+	setPageHeaders(w, r.URL, offset, limit, total)
+	Render(w, r, NewListNoteResponse(n, total, nextCursor(offset, limit, total)))
 }
 
 func (a *NoteApi) Create(w http.ResponseWriter, r *http.Request) {
@@ -68,20 +103,96 @@ func (a *NoteApi) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.service.Create(r.Context(), *data.Note); err != nil {
+	version, err := expectedVersion(r)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.Create(r.Context(), *data.Note, version)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewNoteResponse(n))
+}
+
+// Add saves a new note under an ID generated by the server. The response's
+// Location header is the new note's url.
+func (a *NoteApi) Add(w http.ResponseWriter, r *http.Request) {
+	data := &AddNoteRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.Add(r.Context(), *data.Note)
+	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
+	w.Header().Set("Location", path.Join(r.URL.Path, url.PathEscape(n.ID)))
+	w.Header().Set("ETag", etag(n.Version))
 	render.Status(r, http.StatusCreated)
-	Render(w, r, NewNoteResponse(*data.Note))
+	Render(w, r, NewNoteResponse(n))
+}
+
+// Replace overwrites the note with the request's. A note that doesn't exist
+// is a 404 unless upsert=true is given, in which case it's created and the
+// response is a 201.
+func (a *NoteApi) Replace(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	data := &ReplaceNoteRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if data.Note.ID != "" && data.Note.ID != id {
+		Render(w, r, ErrInvalidRequest(errors.New("id doesn't match the url")))
+		return
+	}
+	data.Note.ID = id
+
+	upsert := false
+	if u := r.URL.Query().Get("upsert"); u != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(u); err != nil {
+			Render(w, r, ErrInvalidRequest(errors.New("upsert must be true or false")))
+			return
+		}
+	}
+
+	version, err := expectedVersion(r)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, created, err := a.service.Replace(r.Context(), *data.Note, version, upsert)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	if created {
+		render.Status(r, http.StatusCreated)
+	}
+	Render(w, r, NewNoteResponse(n))
 }
 
 func (a *NoteApi) Delete(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	err := a.service.Delete(r.Context(), id)
 	if err != nil && !core.IsErrNotFound(err) {
-		Render(w, r, ErrInternalServer)
+		handleError(w, r, err)
 		return
 	}
 
@@ -93,6 +204,14 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	switch errors.Cause(err).(type) {
 	case *core.ErrNotFound:
 		Render(w, r, ErrNotFound)
+	case *core.ErrVersionMismatch:
+		Render(w, r, ErrPreconditionFailed)
+	case *core.ErrInvalid:
+		Render(w, r, ErrInvalidRequest(errors.Cause(err)))
+	case *core.ErrForbidden:
+		Render(w, r, ErrForbidden)
+	case *core.ErrRangeNotSatisfiable:
+		Render(w, r, ErrRangeNotSatisfiable)
 	default:
 		Render(w, r, ErrInternalServer)
 	}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/go-chi/chi"
 	"github.com/sksmith/note-server/api"
 	"github.com/sksmith/note-server/core"
 	"github.com/sksmith/note-server/core/note"
@@ -32,6 +34,19 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestGetETag(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/1", nil)
+	w := httptest.NewRecorder()
+
+	noteApi := api.NewNoteApi(mockNoteService{currentVersion: 7})
+
+	noteApi.Get(w, r)
+
+	if got := w.Result().Header.Get("ETag"); got != `"7"` {
+		t.Errorf("expected %v got %v", `"7"`, got)
+	}
+}
+
 func TestGetInternalServerError(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/1", nil)
 	w := httptest.NewRecorder()
@@ -124,6 +139,100 @@ func TestList(t *testing.T) {
 	if len(lr.Notes) != 2 {
 		t.Errorf("expected %v got %v", 2, len(lr.Notes))
 	}
+	if lr.Total != 2 {
+		t.Errorf("expected %v got %v", 2, lr.Total)
+	}
+	if lr.Next != "" {
+		t.Errorf("expected no next cursor got %v", lr.Next)
+	}
+}
+
+func TestListPaginated(t *testing.T) {
+	svc := mockNoteService{listNotes: []note.ListNote{{ID: "1"}, {ID: "2"}, {ID: "3"}}}
+	router := chi.NewRouter()
+	api.NewNoteApi(svc).ConfigureRouter(router)
+
+	r := httptest.NewRequest(http.MethodGet, "/?limit=2", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	lr := parseListResponse(w, t)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	if len(lr.Notes) != 2 || lr.Notes[0].ID != "1" || lr.Notes[1].ID != "2" {
+		t.Errorf("expected notes 1 and 2 got %v", lr.Notes)
+	}
+	if lr.Total != 3 {
+		t.Errorf("expected %v got %v", 3, lr.Total)
+	}
+	if got := w.Result().Header.Get("X-Total-Count"); got != "3" {
+		t.Errorf("expected %v got %v", "3", got)
+	}
+	link := w.Result().Header.Get("Link")
+	if !strings.Contains(link, `rel="next"`) || !strings.Contains(link, `rel="last"`) {
+		t.Errorf("expected next and last links got %v", link)
+	}
+	if strings.Contains(link, `rel="prev"`) {
+		t.Errorf("expected no prev link got %v", link)
+	}
+	if lr.Next == "" {
+		t.Fatalf("expected a next cursor")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?limit=2&cursor="+lr.Next, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	lr = parseListResponse(w, t)
+
+	if len(lr.Notes) != 1 || lr.Notes[0].ID != "3" {
+		t.Errorf("expected note 3 got %v", lr.Notes)
+	}
+	if lr.Next != "" {
+		t.Errorf("expected no next cursor got %v", lr.Next)
+	}
+	link = w.Result().Header.Get("Link")
+	if !strings.Contains(link, `rel="prev"`) || strings.Contains(link, `rel="next"`) {
+		t.Errorf("expected a prev link and no next link got %v", link)
+	}
+}
+
+func TestListOffset(t *testing.T) {
+	svc := mockNoteService{listNotes: []note.ListNote{{ID: "1"}, {ID: "2"}, {ID: "3"}}}
+	router := chi.NewRouter()
+	api.NewNoteApi(svc).ConfigureRouter(router)
+
+	r := httptest.NewRequest(http.MethodGet, "/?limit=1&offset=1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	lr := parseListResponse(w, t)
+
+	if len(lr.Notes) != 1 || lr.Notes[0].ID != "2" {
+		t.Errorf("expected note 2 got %v", lr.Notes)
+	}
+}
+
+func TestListBadPageRequest(t *testing.T) {
+	tests := []string{
+		"/?limit=0",
+		"/?limit=abc",
+		"/?limit=100000",
+		"/?offset=-1",
+		"/?cursor=notacursor",
+	}
+
+	router := chi.NewRouter()
+	api.NewNoteApi(mockNoteService{}).ConfigureRouter(router)
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected %v got %v", test, http.StatusBadRequest, w.Result().StatusCode)
+		}
+	}
 }
 
 func TestListInternalServerError(t *testing.T) {
@@ -158,6 +267,43 @@ func TestCreate(t *testing.T) {
 	if n.ID != "1" {
 		t.Errorf("expected %v got %v", "1", n.ID)
 	}
+	if got := w.Result().Header.Get("ETag"); got != `"1"` {
+		t.Errorf("expected %v got %v", `"1"`, got)
+	}
+}
+
+func TestCreatePreconditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+		wantETag   string
+	}{
+		{name: "matching", header: "If-Match", value: `"3"`, wantStatus: http.StatusCreated, wantETag: `"4"`},
+		{name: "stale", header: "If-Match", value: `"2"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "malformed", header: "If-Match", value: `3`, wantStatus: http.StatusBadRequest},
+		{name: "weak", header: "If-Match", value: `W/"3"`, wantStatus: http.StatusBadRequest},
+		{name: "must not exist", header: "If-None-Match", value: `*`, wantStatus: http.StatusPreconditionFailed},
+		{name: "unsupported none match", header: "If-None-Match", value: `"3"`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"id": "1", "data": "somenote"}`))
+		r.Header.Add("Content-Type", "application/json")
+		r.Header.Add(test.header, test.value)
+		w := httptest.NewRecorder()
+
+		noteApi := api.NewNoteApi(mockNoteService{currentVersion: 3})
+		noteApi.Create(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if got := w.Result().Header.Get("ETag"); got != test.wantETag {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantETag, got)
+		}
+	}
 }
 
 func TestCreateBadRequest(t *testing.T) {
@@ -192,8 +338,90 @@ func TestCreateInternalServerError(t *testing.T) {
 	}
 }
 
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		service      mockNoteService
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "added", body: `{"title": "a note", "data": "somenote"}`, wantStatus: http.StatusCreated, wantLocation: "/api/v1/note/generated"},
+		{name: "client id", body: `{"id": "1", "data": "somenote"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing data", body: `{"title": "a note"}`, wantStatus: http.StatusBadRequest},
+		{name: "error", body: `{"data": "somenote"}`, service: mockNoteService{returnError: errors.New("some error")}, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		router.Route("/api/v1/note", api.NewNoteApi(test.service).ConfigureRouter)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/note", strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if got := w.Result().Header.Get("Location"); got != test.wantLocation {
+			t.Errorf("%v: expected location %v got %v", test.name, test.wantLocation, got)
+		}
+		if test.wantStatus == http.StatusCreated {
+			if resp := parseResponse(w, t); resp.ID != "generated" || resp.Version != 1 {
+				t.Errorf("%v: expected generated at version 1 got %v", test.name, resp.Note)
+			}
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		ifMatch    string
+		service    mockNoteService
+		wantStatus int
+		wantETag   string
+	}{
+		{name: "replaced", url: "/1", body: `{"data": "somenote"}`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusOK, wantETag: `"3"`},
+		{name: "matching id", url: "/1", body: `{"id": "1", "data": "somenote"}`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusOK, wantETag: `"3"`},
+		{name: "other id", url: "/1", body: `{"id": "2", "data": "somenote"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing", url: "/2", body: `{"data": "somenote"}`, wantStatus: http.StatusNotFound},
+		{name: "upsert", url: "/2?upsert=true", body: `{"data": "somenote"}`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusCreated, wantETag: `"1"`},
+		{name: "upsert trashed", url: "/trashed?upsert=true", body: `{"data": "somenote"}`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusCreated, wantETag: `"3"`},
+		{name: "bad upsert", url: "/2?upsert=maybe", body: `{"data": "somenote"}`, wantStatus: http.StatusBadRequest},
+		{name: "stale", url: "/1", body: `{"data": "somenote"}`, ifMatch: `"1"`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusPreconditionFailed},
+		{name: "missing data", url: "/1", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(test.service).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPut, test.url, strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if got := w.Result().Header.Get("ETag"); got != test.wantETag {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantETag, got)
+		}
+	}
+}
+
 type mockNoteService struct {
-	returnError error
+	returnError    error
+	listNotes      []note.ListNote
+	currentVersion int64
 }
 
 func (m *mockNoteService) ReturnError(err error) {
@@ -205,16 +433,53 @@ func (m mockNoteService) Get(context.Context, string) (note.Note, error) {
 		return note.Note{}, m.returnError
 	}
 	return note.Note{
-		ID:   "1",
-		Data: "somenote",
+		ID:      "1",
+		Data:    "somenote",
+		Version: m.currentVersion,
 	}, nil
 }
 
-func (m mockNoteService) Create(context.Context, note.Note) error {
+func (m mockNoteService) Create(_ context.Context, n note.Note, version int64) (note.Note, error) {
 	if m.returnError != nil {
-		return m.returnError
+		return note.Note{}, m.returnError
 	}
-	return nil
+	if version != note.AnyVersion && version != m.currentVersion {
+		return note.Note{}, &core.ErrVersionMismatch{Expected: version, Actual: m.currentVersion}
+	}
+	n.Version = m.currentVersion + 1
+	return n, nil
+}
+
+func (m mockNoteService) Add(ctx context.Context, n note.Note) (note.Note, error) {
+	n.ID = "generated"
+	return m.Create(ctx, n, 0)
+}
+
+// The mock's only note is "1", "trashed" is in the trash so its versions
+// carry on from the current version when it's upserted
+func (m mockNoteService) Replace(ctx context.Context, n note.Note, version int64, upsert bool) (note.Note, bool, error) {
+	if n.ID == "1" {
+		n, err := m.Create(ctx, n, version)
+		return n, false, err
+	}
+	if !upsert {
+		return note.Note{}, false, &core.ErrNotFound{}
+	}
+	if n.ID != "trashed" {
+		m.currentVersion = 0
+	}
+	n, err := m.Create(ctx, n, version)
+	return n, err == nil, err
+}
+
+// The mock's patched note holds the type of patch it was given
+func (m mockNoteService) Patch(ctx context.Context, id string, p note.Patch, version int64) (note.Note, error) {
+	n, err := m.Get(ctx, id)
+	if err != nil {
+		return note.Note{}, err
+	}
+	n.Data = fmt.Sprintf("%T", p)
+	return m.Create(ctx, n, version)
 }
 
 func (m mockNoteService) Delete(context.Context, string) error {
@@ -224,14 +489,96 @@ func (m mockNoteService) Delete(context.Context, string) error {
 	return nil
 }
 
-func (m mockNoteService) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, error) {
+func (m mockNoteService) List(ctx context.Context, filter note.ListFilter, startIdx, endIdx int) ([]note.ListNote, int, error) {
 	if m.returnError != nil {
-		return []note.ListNote{}, m.returnError
+		return []note.ListNote{}, 0, m.returnError
 	}
-	return []note.ListNote{
-		{ID: "1"},
-		{ID: "2"},
-	}, nil
+	list := m.listNotes
+	if list == nil {
+		list = []note.ListNote{
+			{ID: "1"},
+			{ID: "2"},
+		}
+	}
+	matched := make([]note.ListNote, 0)
+	for _, ln := range list {
+		if filter.Matches(ln) {
+			matched = append(matched, ln)
+		}
+	}
+	return note.Page(matched, startIdx, endIdx), len(matched), nil
+}
+
+// The mock's note has every version from 1 to currentVersion
+func (m mockNoteService) ListRevisions(context.Context, string) ([]note.Revision, error) {
+	if m.returnError != nil {
+		return []note.Revision{}, m.returnError
+	}
+	revs := make([]note.Revision, 0)
+	for v := m.currentVersion; v > 0; v-- {
+		revs = append(revs, note.Revision{Version: v, Current: v == m.currentVersion})
+	}
+	return revs, nil
+}
+
+func (m mockNoteService) GetRevision(_ context.Context, id string, version int64) (note.Note, error) {
+	if m.returnError != nil {
+		return note.Note{}, m.returnError
+	}
+	if version > m.currentVersion {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	return note.Note{ID: id, Data: fmt.Sprintf("version %v", version), Version: version}, nil
+}
+
+func (m mockNoteService) Diff(_ context.Context, id string, from, to int64) (string, error) {
+	if m.returnError != nil {
+		return "", m.returnError
+	}
+	if from > m.currentVersion || to > m.currentVersion {
+		return "", &core.ErrNotFound{}
+	}
+	return fmt.Sprintf("--- %v@%v\n+++ %v@%v\n", id, from, id, to), nil
+}
+
+func (m mockNoteService) Restore(ctx context.Context, id string, version, expected int64) (note.Note, error) {
+	n, err := m.GetRevision(ctx, id, version)
+	if err != nil {
+		return note.Note{}, err
+	}
+	return m.Create(ctx, n, expected)
+}
+
+// The mock's notebooks are "work" and "home"
+func (m mockNoteService) MoveNote(ctx context.Context, id, notebookID string, expected int64) (note.Note, error) {
+	if notebookID != "" && notebookID != "work" && notebookID != "home" {
+		return note.Note{}, &core.ErrInvalid{Reason: "notebook does not exist"}
+	}
+	n, err := m.Get(ctx, id)
+	if err != nil {
+		return note.Note{}, err
+	}
+	n.NotebookID = notebookID
+	return m.Create(ctx, n, expected)
+}
+
+// The mock finds the listed notes whose ID is in the query
+func (m mockNoteService) Search(ctx context.Context, query string, startIdx, endIdx int) ([]note.SearchResult, int, error) {
+	list, _, err := m.List(ctx, note.ListFilter{}, 0, 0)
+	if err != nil {
+		return []note.SearchResult{}, 0, err
+	}
+	matched := make([]note.ListNote, 0)
+	for _, ln := range list {
+		if strings.Contains(query, ln.ID) {
+			matched = append(matched, ln)
+		}
+	}
+	results := make([]note.SearchResult, 0)
+	for _, ln := range note.Page(matched, startIdx, endIdx) {
+		results = append(results, note.SearchResult{ListNote: ln, Score: 1, Snippet: "<mark>" + ln.ID + "</mark>"})
+	}
+	return results, len(matched), nil
 }
 
 func parseErrorResponse(w *httptest.ResponseRecorder, t *testing.T) api.ErrResponse {
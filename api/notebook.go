@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/note"
+)
+
+type NotebookApi struct {
+	service NotebookService
+}
+
+type NotebookService interface {
+	ListNotebooks(context.Context) ([]note.Notebook, error)
+	GetNotebook(context.Context, string) (note.Notebook, error)
+	CreateNotebook(context.Context, note.Notebook) (note.Notebook, error)
+	UpdateNotebook(context.Context, note.Notebook) (note.Notebook, error)
+	DeleteNotebook(ctx context.Context, id, contents string) error
+}
+
+func NewNotebookApi(service NotebookService) *NotebookApi {
+	return &NotebookApi{service: service}
+}
+
+func (a *NotebookApi) ConfigureRouter(r chi.Router) {
+	r.Get("/", a.List)
+	r.Post("/", a.Create)
+	r.Get("/{id}", a.Get)
+	r.Put("/{id}", a.Update)
+	r.Delete("/{id}", a.Delete)
+}
+
+// List returns every notebook, clients build the tree from their parentIds
+func (a *NotebookApi) List(w http.ResponseWriter, r *http.Request) {
+	list, err := a.service.ListNotebooks(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewNotebookListResponse(list))
+}
+
+func (a *NotebookApi) Get(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	nb, err := a.service.GetNotebook(r.Context(), id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewNotebookResponse(nb))
+}
+
+// Create saves a new notebook, the server picks its ID
+func (a *NotebookApi) Create(w http.ResponseWriter, r *http.Request) {
+	data := &NotebookRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	nb, err := a.service.CreateNotebook(r.Context(), *data.Notebook)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewNotebookResponse(nb))
+}
+
+// Update renames the notebook and moves it under its parentId
+func (a *NotebookApi) Update(w http.ResponseWriter, r *http.Request) {
+	data := &NotebookRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	data.Notebook.ID = chi.URLParam(r, "id")
+
+	nb, err := a.service.UpdateNotebook(r.Context(), *data.Notebook)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewNotebookResponse(nb))
+}
+
+// Delete deletes the notebook. contents=move (the default) moves what's in it
+// up into its parent, contents=trash deletes its notebooks too and moves
+// every note in them into the trash.
+func (a *NotebookApi) Delete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := a.service.DeleteNotebook(r.Context(), id, r.URL.Query().Get("contents")); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// Move files the note in another notebook, honouring If-Match
+func (a *NoteApi) Move(w http.ResponseWriter, r *http.Request) {
+	data := &MoveNoteRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	version, err := expectedVersion(r)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.MoveNote(r.Context(), chi.URLParam(r, "id"), data.NotebookID, version)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	Render(w, r, NewNoteResponse(n))
+}
@@ -0,0 +1,328 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func notebookRouter(svc api.NotebookService) chi.Router {
+	router := chi.NewRouter()
+	api.NewNotebookApi(svc).ConfigureRouter(router)
+	return router
+}
+
+func TestListNotebooks(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	notebookRouter(newMockNotebookService("home", "work")).ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	resp := api.NotebookListResponse{}
+	parseJSON(w, t, &resp)
+	if len(resp.Notebooks) != 2 || resp.Notebooks[0].ID != "home" || resp.Notebooks[1].ID != "work" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestGetNotebook(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		err        error
+		wantStatus int
+	}{
+		{name: "Found", id: "work", wantStatus: http.StatusOK},
+		{name: "Not Found", id: "play", wantStatus: http.StatusNotFound},
+		{name: "Error", id: "work", err: errors.New("some error"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		svc := newMockNotebookService("work")
+		svc.returnError = test.err
+		r := httptest.NewRequest(http.MethodGet, "/"+test.id, nil)
+		w := httptest.NewRecorder()
+
+		notebookRouter(svc).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		resp := api.NotebookResponse{}
+		parseJSON(w, t, &resp)
+		if resp.ID != test.id {
+			t.Errorf("%v: unexpected response %+v", test.name, resp)
+		}
+	}
+}
+
+func TestCreateNotebook(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "Created", body: `{"name":"projects","parentId":"work"}`, wantStatus: http.StatusCreated},
+		{name: "Missing Name", body: `{"parentId":"work"}`, wantStatus: http.StatusBadRequest},
+		{name: "Missing Parent", body: `{"name":"projects","parentId":"play"}`, wantStatus: http.StatusBadRequest},
+		{name: "Bad Body", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		notebookRouter(newMockNotebookService("work")).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusCreated {
+			continue
+		}
+		resp := api.NotebookResponse{}
+		parseJSON(w, t, &resp)
+		if resp.ID == "" || resp.Name != "projects" || resp.ParentID != "work" {
+			t.Errorf("%v: unexpected response %+v", test.name, resp)
+		}
+	}
+}
+
+func TestUpdateNotebook(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		body       string
+		wantStatus int
+	}{
+		{name: "Renamed", id: "work", body: `{"name":"office"}`, wantStatus: http.StatusOK},
+		{name: "Not Found", id: "play", body: `{"name":"office"}`, wantStatus: http.StatusNotFound},
+		{name: "Into Itself", id: "work", body: `{"name":"office","parentId":"work"}`, wantStatus: http.StatusBadRequest},
+		{name: "Missing Name", id: "work", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/"+test.id, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		notebookRouter(newMockNotebookService("work")).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		resp := api.NotebookResponse{}
+		parseJSON(w, t, &resp)
+		if resp.ID != test.id || resp.Name != "office" {
+			t.Errorf("%v: unexpected response %+v", test.name, resp)
+		}
+	}
+}
+
+func TestDeleteNotebook(t *testing.T) {
+	tests := []struct {
+		name         string
+		url          string
+		wantStatus   int
+		wantContents string
+	}{
+		{name: "Default", url: "/work", wantStatus: http.StatusNoContent, wantContents: ""},
+		{name: "Trash", url: "/work?contents=trash", wantStatus: http.StatusNoContent, wantContents: note.TrashContents},
+		{name: "Bad Contents", url: "/work?contents=burn", wantStatus: http.StatusBadRequest},
+		{name: "Not Found", url: "/play", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		svc := newMockNotebookService("work")
+		r := httptest.NewRequest(http.MethodDelete, test.url, nil)
+		w := httptest.NewRecorder()
+
+		notebookRouter(svc).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus == http.StatusNoContent && svc.deletedContents != test.wantContents {
+			t.Errorf("%v: expected contents %q got %q", test.name, test.wantContents, svc.deletedContents)
+		}
+	}
+}
+
+func TestMoveNote(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		ifMatch    string
+		wantStatus int
+	}{
+		{name: "Moved", body: `{"notebookId":"work"}`, wantStatus: http.StatusOK},
+		{name: "Top Level", body: `{}`, wantStatus: http.StatusOK},
+		{name: "If-Match", body: `{"notebookId":"work"}`, ifMatch: `"3"`, wantStatus: http.StatusOK},
+		{name: "Stale If-Match", body: `{"notebookId":"work"}`, ifMatch: `"2"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "Missing Notebook", body: `{"notebookId":"play"}`, wantStatus: http.StatusBadRequest},
+		{name: "Bad Body", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(mockNoteService{currentVersion: 3}).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPost, "/1/move", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := w.Result().Header.Get("ETag"); got != `"4"` {
+			t.Errorf("%v: expected etag %v got %v", test.name, `"4"`, got)
+		}
+	}
+}
+
+func TestListNotebookScope(t *testing.T) {
+	svc := mockNoteService{listNotes: []note.ListNote{
+		{ID: "1", NotebookID: "work"},
+		{ID: "2", NotebookID: "home", Tags: []string{"todo"}},
+		{ID: "3"},
+	}}
+
+	tests := []struct {
+		url     string
+		wantIDs string
+	}{
+		{url: "/", wantIDs: "[1 2 3]"},
+		{url: "/?notebook=work", wantIDs: "[1]"},
+		{url: "/?notebook=root", wantIDs: "[3]"},
+		{url: "/?notebook=home&tag=todo", wantIDs: "[2]"},
+		{url: "/?notebook=work&tag=todo", wantIDs: "[]"},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(svc).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		resp := parseListResponse(w, t)
+		ids := make([]string, len(resp.Notes))
+		for i, ln := range resp.Notes {
+			ids[i] = ln.ID
+		}
+		if fmt.Sprint(ids) != test.wantIDs {
+			t.Errorf("%v: expected %v got %v", test.url, test.wantIDs, ids)
+		}
+	}
+}
+
+type mockNotebookService struct {
+	returnError     error
+	notebooks       []note.Notebook
+	deletedContents string
+}
+
+func newMockNotebookService(ids ...string) *mockNotebookService {
+	m := &mockNotebookService{}
+	for _, id := range ids {
+		m.notebooks = append(m.notebooks, note.Notebook{ID: id, Name: id})
+	}
+	return m
+}
+
+func (m *mockNotebookService) ListNotebooks(context.Context) ([]note.Notebook, error) {
+	if m.returnError != nil {
+		return []note.Notebook{}, m.returnError
+	}
+	return m.notebooks, nil
+}
+
+func (m *mockNotebookService) GetNotebook(_ context.Context, id string) (note.Notebook, error) {
+	if m.returnError != nil {
+		return note.Notebook{}, m.returnError
+	}
+	for _, nb := range m.notebooks {
+		if nb.ID == id {
+			return nb, nil
+		}
+	}
+	return note.Notebook{}, &core.ErrNotFound{}
+}
+
+func (m *mockNotebookService) CreateNotebook(ctx context.Context, nb note.Notebook) (note.Notebook, error) {
+	if nb.ParentID != "" {
+		if _, err := m.GetNotebook(ctx, nb.ParentID); err != nil {
+			return note.Notebook{}, &core.ErrInvalid{Reason: "notebook does not exist"}
+		}
+	}
+	nb.ID = "new"
+	return nb, nil
+}
+
+func (m *mockNotebookService) UpdateNotebook(ctx context.Context, nb note.Notebook) (note.Notebook, error) {
+	if _, err := m.GetNotebook(ctx, nb.ID); err != nil {
+		return note.Notebook{}, err
+	}
+	if nb.ParentID == nb.ID {
+		return note.Notebook{}, &core.ErrInvalid{Reason: "a notebook can't be moved into itself"}
+	}
+	return nb, nil
+}
+
+func (m *mockNotebookService) DeleteNotebook(ctx context.Context, id, contents string) error {
+	if contents != "" && contents != note.MoveContents && contents != note.TrashContents {
+		return &core.ErrInvalid{Reason: "bad contents"}
+	}
+	if _, err := m.GetNotebook(ctx, id); err != nil {
+		return err
+	}
+	m.deletedContents = contents
+	return nil
+}
+
+func parseJSON(w *httptest.ResponseRecorder, t *testing.T, v interface{}) {
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Errorf("failed to parse response %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/oidc"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// loginCookie keeps the login in progress while the user is at the provider
+const (
+	loginCookie    = "oidc_login"
+	loginCookieAge = 600
+)
+
+type OIDCApi struct {
+	provider OIDCProvider
+	sessions SessionStarter
+	appURL   string
+	secure   bool
+}
+
+type OIDCProvider interface {
+	Start(ctx context.Context) (oidc.Login, string, error)
+	Finish(ctx context.Context, login oidc.Login, state, code string) (user.User, error)
+}
+
+type SessionStarter interface {
+	Start(ctx context.Context, u user.User) (auth.Tokens, error)
+}
+
+// NewOIDCApi returns the api for logging in through an OpenID Connect
+// provider, which ends in the same tokens as logging in with a password.
+// They're handed to the app at appURL, which mustn't have a fragment of its
+// own. Secure marks the login cookie as https only.
+func NewOIDCApi(provider OIDCProvider, sessions SessionStarter, appURL string, secure bool) *OIDCApi {
+	return &OIDCApi{provider: provider, sessions: sessions, appURL: appURL, secure: secure}
+}
+
+func (a *OIDCApi) ConfigureRouter(r chi.Router) {
+	r.Get("/login", a.Login)
+	r.Get("/callback", a.Callback)
+}
+
+// Login sends the user to the provider to log in
+func (a *OIDCApi) Login(w http.ResponseWriter, r *http.Request) {
+	login, url, err := a.provider.Start(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	value, err := json.Marshal(login)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	a.setLoginCookie(w, base64.RawURLEncoding.EncodeToString(value), loginCookieAge)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back to. It issues tokens
+// for the user they logged in as and sends them on to the app with the tokens
+// in the URL's fragment, which browsers never send to a server or put in a
+// Referer header.
+func (a *OIDCApi) Callback(w http.ResponseWriter, r *http.Request) {
+	a.setLoginCookie(w, "", -1)
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Warn().Str("error", e).Str("description", q.Get("error_description")).Msg("provider refused login")
+		Render(w, r, ErrUnauthorized)
+		return
+	}
+
+	login, err := readLoginCookie(r)
+	if err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrUnauthorized)
+		return
+	}
+
+	u, err := a.provider.Finish(r.Context(), login, q.Get("state"), q.Get("code"))
+	if err != nil {
+		handleOIDCError(w, r, err)
+		return
+	}
+
+	tokens, err := a.sessions.Start(r.Context(), u)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	resp := NewTokenResponse(tokens)
+	fragment := url.Values{
+		"access_token":  {resp.AccessToken},
+		"token_type":    {resp.TokenType},
+		"expires_in":    {strconv.FormatInt(resp.ExpiresIn, 10)},
+		"refresh_token": {resp.RefreshToken},
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, a.appURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+func (a *OIDCApi) setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   a.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readLoginCookie(r *http.Request) (oidc.Login, error) {
+	login := oidc.Login{}
+	c, err := r.Cookie(loginCookie)
+	if err != nil {
+		return login, errors.Wrap(err, "no login in progress")
+	}
+	value, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return login, errors.Wrap(err, "bad login cookie")
+	}
+	return login, errors.Wrap(json.Unmarshal(value, &login), "bad login cookie")
+}
+
+func handleOIDCError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Cause(err) == oidc.ErrInvalidLogin {
+		log.Err(err).Send()
+		Render(w, r, ErrUnauthorized)
+		return
+	}
+	handleError(w, r, err)
+}
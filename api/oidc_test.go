@@ -0,0 +1,122 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/oidc"
+	"github.com/sksmith/note-server/core/oidc/oidctest"
+)
+
+const (
+	callbackURL = "http://notes.example.com/oidc/callback"
+	appURL      = "http://notes.example.com/app/"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		deny       bool
+		noCookie   bool
+		state      string
+		wantStatus int
+	}{
+		{name: "logged in", username: "alice", wantStatus: http.StatusFound},
+		{name: "denied", username: "alice", deny: true, wantStatus: http.StatusUnauthorized},
+		{name: "no login in progress", username: "alice", noCookie: true, wantStatus: http.StatusUnauthorized},
+		{name: "wrong state", username: "alice", state: "forged", wantStatus: http.StatusUnauthorized},
+		{name: "username taken", username: "test", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		fake := oidctest.NewFakeProvider("notes", callbackURL)
+		fake.Claims["preferred_username"] = test.username
+		fake.Deny = test.deny
+		provider := oidc.NewProvider(core.NewClock(), oidc.Config{
+			Issuer:        fake.Issuer(),
+			ClientID:      fake.ClientID,
+			RedirectURL:   callbackURL,
+			UsernameClaim: "preferred_username",
+		}, nil, &mockUserService{})
+		router := chi.NewRouter()
+		router.Route("/oidc", api.NewOIDCApi(provider, &mockAuthService{}, appURL, true).ConfigureRouter)
+
+		// Logging in sends the user to the provider with a cookie to come back with
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+		if w.Result().StatusCode != http.StatusFound {
+			t.Fatalf("%v: expected %v got %v", test.name, http.StatusFound, w.Result().StatusCode)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+			t.Fatalf("%v: expected a secure login cookie got %v", test.name, cookies)
+		}
+
+		back := followToProvider(t, w.Result().Header.Get("Location"))
+		if test.state != "" {
+			q := back.Query()
+			q.Set("state", test.state)
+			back.RawQuery = q.Encode()
+		}
+
+		r := httptest.NewRequest(http.MethodGet, back.RequestURI(), nil)
+		if !test.noCookie {
+			r.AddCookie(cookies[0])
+		}
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		fake.Close()
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if cleared := w.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+			t.Errorf("%v: expected the login cookie to be cleared got %v", test.name, cleared)
+		}
+		if test.wantStatus != http.StatusFound {
+			continue
+		}
+
+		// The tokens are only in the fragment of the app's URL
+		location := w.Result().Header.Get("Location")
+		app, err := url.Parse(location)
+		if err != nil || !strings.HasPrefix(location, appURL+"#") || app.RawQuery != "" {
+			t.Fatalf("%v: expected a redirect to %v got %v", test.name, appURL, location)
+		}
+		tokens, err := url.ParseQuery(app.Fragment)
+		if err != nil || tokens.Get("access_token") != "access" || tokens.Get("refresh_token") != "refresh" || tokens.Get("token_type") != "Bearer" {
+			t.Errorf("%v: expected tokens in the fragment got %v", test.name, app.Fragment)
+		}
+		if w.Result().Header.Get("Cache-Control") != "no-store" || w.Result().Header.Get("Referrer-Policy") != "no-referrer" {
+			t.Errorf("%v: expected an uncached redirect without a referrer got %v", test.name, w.Result().Header)
+		}
+	}
+}
+
+// followToProvider follows the login redirect, returning where the provider
+// sends the user back to
+func followToProvider(t *testing.T, location string) *url.URL {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(location)
+	if err != nil {
+		t.Fatalf("failed to reach the provider %v", err)
+	}
+	resp.Body.Close()
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(back.String(), callbackURL) {
+		t.Fatalf("expected a redirect back to %v got %v", callbackURL, back)
+	}
+	return back
+}
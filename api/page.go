@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const MaxPageLimit = 500
+
+const cursorPrefix = "o:"
+
+// parsePage reads the limit, offset and cursor query parameters. A cursor
+// takes precedence over an offset.
+func parsePage(q url.Values) (limit, offset int, err error) {
+	limit = DefaultPageLimit
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be a number between 1 and %d", MaxPageLimit)
+		}
+	}
+
+	if o := q.Get("offset"); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative number")
+		}
+	}
+
+	if c := q.Get("cursor"); c != "" {
+		offset, err = decodeCursor(c)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// pageFromContext returns the limit and offset placed in the context by the
+// Paginate middleware, falling back to the first page.
+func pageFromContext(ctx context.Context) (limit, offset int) {
+	limit, ok := ctx.Value(CtxKeyLimit).(int)
+	if !ok {
+		limit = DefaultPageLimit
+	}
+	offset, _ = ctx.Value(CtxKeyOffset).(int)
+	return limit, offset
+}
+
+// encodeCursor returns the cursor for the page at the offset. A cursor is
+// only the offset encoded so clients pass it back rather than build URLs of
+// their own, it isn't opaque and doesn't keep its place when notes are added
+// or removed between pages, just like an offset.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	errInvalid := errors.New("invalid cursor")
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalid
+	}
+	s := string(b)
+	if !strings.HasPrefix(s, cursorPrefix) {
+		return 0, errInvalid
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(s, cursorPrefix))
+	if err != nil || offset < 0 {
+		return 0, errInvalid
+	}
+	return offset, nil
+}
+
+// nextCursor returns the cursor for the page after the given one or an empty
+// string if this is the last page.
+func nextCursor(offset, limit, total int) string {
+	if offset+limit >= total {
+		return ""
+	}
+	return encodeCursor(offset + limit)
+}
+
+// setPageHeaders writes the X-Total-Count header and an RFC 5988 Link header
+// with the first, prev, next and last pages relative to the request URL.
+func setPageHeaders(w http.ResponseWriter, u *url.URL, offset, limit, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	last := 0
+	if total > 0 {
+		last = ((total - 1) / limit) * limit
+	}
+
+	links := []string{pageLink(u, 0, limit, "first")}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(u, prev, limit, "prev"))
+	}
+	if offset+limit < total {
+		links = append(links, pageLink(u, offset+limit, limit, "next"))
+	}
+	links = append(links, pageLink(u, last, limit, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+func pageLink(u *url.URL, offset, limit int, rel string) string {
+	q := u.Query()
+	q.Del("offset")
+	q.Set("cursor", encodeCursor(offset))
+	q.Set("limit", strconv.Itoa(limit))
+
+	link := url.URL{Path: u.Path, RawQuery: q.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, link.String(), rel)
+}
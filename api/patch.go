@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// The patch formats PATCH accepts, chosen by the request's Content-Type
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+	TextPatchType  = "application/vnd.note-server.text-patch+json"
+)
+
+// Patch changes part of a note. The body is a JSON Merge Patch, a JSON Patch
+// or a list of text edits to splice into the note's data, depending on the
+// request's Content-Type.
+func (a *NoteApi) Patch(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	var p note.Patch
+	switch mediaType {
+	case MergePatchType:
+		if !json.Valid(body) {
+			Render(w, r, ErrInvalidRequest(fmt.Errorf("the merge patch isn't valid JSON")))
+			return
+		}
+		p = note.MergePatch(body)
+	case JSONPatchType:
+		ops := note.JSONPatch{}
+		if err := json.Unmarshal(body, &ops); err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		p = ops
+	case TextPatchType:
+		edits := note.TextPatch{}
+		if err := json.Unmarshal(body, &edits); err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		p = edits
+	default:
+		Render(w, r, ErrUnsupportedMediaType(fmt.Errorf("Content-Type must be %s, %s or %s", MergePatchType, JSONPatchType, TextPatchType)))
+		return
+	}
+
+	version, err := expectedVersion(r)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.Patch(r.Context(), chi.URLParam(r, "id"), p, version)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	Render(w, r, NewNoteResponse(n))
+}
@@ -0,0 +1,63 @@
+package api_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+)
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		ifMatch     string
+		service     mockNoteService
+		wantStatus  int
+		wantData    string
+	}{
+		{name: "merge", contentType: api.MergePatchType, body: `{"title": "new"}`, wantStatus: http.StatusOK, wantData: "note.MergePatch"},
+		{name: "json", contentType: api.JSONPatchType, body: `[{"op": "replace", "path": "/title", "value": "new"}]`, wantStatus: http.StatusOK, wantData: "note.JSONPatch"},
+		{name: "text", contentType: api.TextPatchType + "; charset=utf-8", body: `[{"text": " more"}]`, wantStatus: http.StatusOK, wantData: "note.TextPatch"},
+		{name: "invalid merge", contentType: api.MergePatchType, body: `{"title"`, wantStatus: http.StatusBadRequest},
+		{name: "invalid json", contentType: api.JSONPatchType, body: `{"op": "add"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid text", contentType: api.TextPatchType, body: `[{"start": "one"}]`, wantStatus: http.StatusBadRequest},
+		{name: "plain json", contentType: "application/json", body: `{"title": "new"}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "no content type", body: `{"title": "new"}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "stale", contentType: api.MergePatchType, body: `{"title": "new"}`, ifMatch: `"1"`, service: mockNoteService{currentVersion: 2}, wantStatus: http.StatusPreconditionFailed},
+		{name: "missing", contentType: api.MergePatchType, body: `{"title": "new"}`, service: mockNoteService{returnError: &core.ErrNotFound{}}, wantStatus: http.StatusNotFound},
+		{name: "rejected", contentType: api.MergePatchType, body: `{"id": "2"}`, service: mockNoteService{returnError: &core.ErrInvalid{Reason: "bad patch"}}, wantStatus: http.StatusBadRequest},
+		{name: "error", contentType: api.MergePatchType, body: `{"title": "new"}`, service: mockNoteService{returnError: errors.New("some error")}, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(test.service).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPatch, "/1", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus == http.StatusOK {
+			if resp := parseResponse(w, t); resp.Data != test.wantData || w.Result().Header.Get("ETag") != `"1"` {
+				t.Errorf("%v: expected %v at version 1 got %v", test.name, test.wantData, resp.Note)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+)
+
+func (a *NoteApi) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	revs, err := a.service.ListRevisions(r.Context(), id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewRevisionListResponse(revs))
+}
+
+func (a *NoteApi) GetRevision(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	version, err := parseVersion(chi.URLParam(r, "rev"))
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.GetRevision(r.Context(), id, version)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewNoteResponse(n))
+}
+
+// Diff writes a unified diff of the note's data between the from and to
+// versions. to defaults to the current version.
+func (a *NoteApi) Diff(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	from, err := parseVersion(r.URL.Query().Get("from"))
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	var to int64
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseVersion(v); err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	} else {
+		n, err := a.service.Get(r.Context(), id)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		to = n.Version
+	}
+
+	d, err := a.service.Diff(r.Context(), id, from, to)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, d); err != nil {
+		log.Warn().Err(err).Msg("failed to write diff")
+	}
+}
+
+// Restore saves the given revision as the new current version of the note,
+// honouring the same preconditions as Create
+func (a *NoteApi) Restore(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	version, err := parseVersion(chi.URLParam(r, "rev"))
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	expected, err := expectedVersion(r)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	n, err := a.service.Restore(r.Context(), id, version, expected)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewNoteResponse(n))
+}
+
+func parseVersion(s string) (int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 1 {
+		return 0, errors.New("revision must be a positive version number")
+	}
+	return v, nil
+}
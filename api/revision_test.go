@@ -0,0 +1,141 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+)
+
+func revisionRouter(svc api.NoteService) chi.Router {
+	router := chi.NewRouter()
+	api.NewNoteApi(svc).ConfigureRouter(router)
+	return router
+}
+
+func TestListRevisions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/1/revisions", nil)
+	w := httptest.NewRecorder()
+
+	revisionRouter(mockNoteService{currentVersion: 3}).ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+
+	resp := api.RevisionListResponse{}
+	data, _ := ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if len(resp.Revisions) != 3 || resp.Revisions[0].Version != 3 || !resp.Revisions[0].Current {
+		t.Errorf("expected versions 3 (current), 2, 1 got %v", resp.Revisions)
+	}
+}
+
+func TestGetRevision(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{name: "found", url: "/1/revisions/2", wantStatus: http.StatusOK},
+		{name: "missing", url: "/1/revisions/9", wantStatus: http.StatusNotFound},
+		{name: "not a number", url: "/1/revisions/abc", wantStatus: http.StatusBadRequest},
+		{name: "zero", url: "/1/revisions/0", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		w := httptest.NewRecorder()
+
+		revisionRouter(mockNoteService{currentVersion: 3}).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus == http.StatusOK {
+			if resp := parseResponse(w, t); resp.Version != 2 || resp.Data != "version 2" {
+				t.Errorf("%v: expected version 2 got %v", test.name, resp.Note)
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "between versions", url: "/1/diff?from=1&to=2", wantStatus: http.StatusOK, wantBody: "--- 1@1\n+++ 1@2\n"},
+		{name: "against current", url: "/1/diff?from=1", wantStatus: http.StatusOK, wantBody: "--- 1@1\n+++ 1@3\n"},
+		{name: "missing from", url: "/1/diff", wantStatus: http.StatusBadRequest},
+		{name: "bad to", url: "/1/diff?from=1&to=x", wantStatus: http.StatusBadRequest},
+		{name: "missing revision", url: "/1/diff?from=1&to=9", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		w := httptest.NewRecorder()
+
+		revisionRouter(mockNoteService{currentVersion: 3}).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := w.Result().Header.Get("Content-Type"); got != "text/x-diff; charset=utf-8" {
+			t.Errorf("%v: expected a diff content type got %v", test.name, got)
+		}
+		if got := w.Body.String(); got != test.wantBody {
+			t.Errorf("%v: expected %q got %q", test.name, test.wantBody, got)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		ifMatch    string
+		wantStatus int
+		wantETag   string
+	}{
+		{name: "restore", url: "/1/revisions/1/restore", wantStatus: http.StatusCreated, wantETag: `"4"`},
+		{name: "matching version", url: "/1/revisions/1/restore", ifMatch: `"3"`, wantStatus: http.StatusCreated, wantETag: `"4"`},
+		{name: "stale version", url: "/1/revisions/1/restore", ifMatch: `"2"`, wantStatus: http.StatusPreconditionFailed},
+		{name: "missing revision", url: "/1/revisions/9/restore", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, test.url, nil)
+		if test.ifMatch != "" {
+			r.Header.Add("If-Match", test.ifMatch)
+		}
+		w := httptest.NewRecorder()
+
+		revisionRouter(mockNoteService{currentVersion: 3}).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if got := w.Result().Header.Get("ETag"); got != test.wantETag {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantETag, got)
+		}
+		if test.wantStatus == http.StatusCreated {
+			if resp := parseResponse(w, t); resp.Data != "version 1" {
+				t.Errorf("%v: expected version 1's data got %v", test.name, resp.Data)
+			}
+		}
+	}
+}
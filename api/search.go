@@ -0,0 +1,29 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Search returns a page of the notes matching the q parameter, most relevant
+// first, each with a snippet of its data where the matching words are wrapped
+// in <mark> tags.
+func (a *NoteApi) Search(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageFromContext(r.Context())
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		Render(w, r, ErrInvalidRequest(errors.New("q is required")))
+		return
+	}
+
+	results, total, err := a.service.Search(r.Context(), query, offset, offset+limit)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	setPageHeaders(w, r.URL, offset, limit, total)
+	Render(w, r, NewSearchResponse(results, total, nextCursor(offset, limit, total)))
+}
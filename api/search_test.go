@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestSearch(t *testing.T) {
+	notes := []note.ListNote{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+
+	tests := []struct {
+		name       string
+		url        string
+		service    mockNoteService
+		wantStatus int
+		wantIDs    string
+		wantTotal  int
+		wantNext   bool
+	}{
+		{name: "matches", url: "/search?q=1+3", service: mockNoteService{listNotes: notes}, wantStatus: http.StatusOK, wantIDs: "[1 3]", wantTotal: 2},
+		{name: "paged", url: "/search?q=1+2+3&limit=2", service: mockNoteService{listNotes: notes}, wantStatus: http.StatusOK, wantIDs: "[1 2]", wantTotal: 3, wantNext: true},
+		{name: "no matches", url: "/search?q=9", service: mockNoteService{listNotes: notes}, wantStatus: http.StatusOK, wantIDs: "[]", wantTotal: 0},
+		{name: "missing query", url: "/search", wantStatus: http.StatusBadRequest},
+		{name: "blank query", url: "/search?q=+", wantStatus: http.StatusBadRequest},
+		{name: "bad limit", url: "/search?q=1&limit=0", wantStatus: http.StatusBadRequest},
+		{name: "error", url: "/search?q=1", service: mockNoteService{returnError: errors.New("some error")}, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(test.service).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+
+		resp := api.SearchResponse{}
+		data, _ := ioutil.ReadAll(w.Result().Body)
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%v: failed to parse response %v", test.name, err)
+		}
+		ids := make([]string, len(resp.Results))
+		for i, res := range resp.Results {
+			ids[i] = res.ID
+			if res.Snippet != "<mark>"+res.ID+"</mark>" {
+				t.Errorf("%v: expected a snippet got %v", test.name, res.Snippet)
+			}
+		}
+		if fmt.Sprint(ids) != test.wantIDs || resp.Total != test.wantTotal || (resp.Next != "") != test.wantNext {
+			t.Errorf("%v: expected %v (%v) got %v (%v) next=%q", test.name, test.wantIDs, test.wantTotal, ids, resp.Total, resp.Next)
+		}
+		if got := w.Result().Header.Get("X-Total-Count"); got != fmt.Sprint(test.wantTotal) {
+			t.Errorf("%v: expected X-Total-Count %v got %v", test.name, test.wantTotal, got)
+		}
+	}
+}
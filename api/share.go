@@ -0,0 +1,283 @@
+package api
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+type ShareApi struct {
+	service ShareService
+	users   UserLookup
+}
+
+type ShareService interface {
+	Share(ctx context.Context, id string, with user.User, role note.Role) (note.Share, error)
+	ListShares(ctx context.Context, id string) ([]note.Share, error)
+	Unshare(ctx context.Context, id, userID string) error
+	ListShared(ctx context.Context) ([]note.Share, error)
+	CreateLink(ctx context.Context, id string, expires *time.Time, password string) (note.Link, string, error)
+	ListLinks(ctx context.Context, id string) ([]note.Link, error)
+	DeleteLink(ctx context.Context, id, linkID string) error
+}
+
+// UserLookup finds users by their username
+type UserLookup interface {
+	Get(ctx context.Context, username string) (user.User, error)
+}
+
+// NewShareApi returns the api for sharing the authenticated user's notes with
+// other users and through public links. It must be used after Authenticate.
+func NewShareApi(service ShareService, users UserLookup) *ShareApi {
+	return &ShareApi{service: service, users: users}
+}
+
+// ConfigureRouter adds the routes for a note's shares and links, it goes
+// alongside the NoteApi's routes
+func (a *ShareApi) ConfigureRouter(r chi.Router) {
+	r.Get("/{id}/shares", a.ListShares)
+	r.Post("/{id}/shares", a.Share)
+	r.Delete("/{id}/shares/{username}", a.Unshare)
+	r.Get("/{id}/links", a.ListLinks)
+	r.Post("/{id}/links", a.CreateLink)
+	r.Delete("/{id}/links/{linkId}", a.DeleteLink)
+}
+
+// ListShared returns the notes other users have shared with the user
+func (a *ShareApi) ListShared(w http.ResponseWriter, r *http.Request) {
+	shares, err := a.service.ListShared(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewShareListResponse(shares))
+}
+
+// Share gives another user a role on the note, replacing any they had
+func (a *ShareApi) Share(w http.ResponseWriter, r *http.Request) {
+	data := &ShareRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	with, err := a.users.Get(r.Context(), data.Username)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	sh, err := a.service.Share(r.Context(), chi.URLParam(r, "id"), with, data.Role)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewShareResponse(sh))
+}
+
+func (a *ShareApi) ListShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := a.service.ListShares(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewShareListResponse(shares))
+}
+
+func (a *ShareApi) Unshare(w http.ResponseWriter, r *http.Request) {
+	with, err := a.users.Get(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := a.service.Unshare(r.Context(), chi.URLParam(r, "id"), with.ID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// CreateLink makes a public read-only link to the note. The response is the
+// only time its token is shown.
+func (a *ShareApi) CreateLink(w http.ResponseWriter, r *http.Request) {
+	data := &LinkRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	l, token, err := a.service.CreateLink(r.Context(), chi.URLParam(r, "id"), data.Expires, data.Password)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	resp := NewLinkResponse(l)
+	resp.Token = token
+	w.Header().Set("Cache-Control", "no-store")
+	render.Status(r, http.StatusCreated)
+	Render(w, r, resp)
+}
+
+func (a *ShareApi) ListLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := a.service.ListLinks(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewLinkListResponse(links))
+}
+
+// DeleteLink stops the link working straight away
+func (a *ShareApi) DeleteLink(w http.ResponseWriter, r *http.Request) {
+	if err := a.service.DeleteLink(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "linkId")); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// SharedBy has the request work on the notes shared by the user named in the
+// owner URL parameter, see note.WithOwner. It must be used after
+// Authenticate.
+func SharedBy(users UserLookup) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			owner, err := users.Get(r.Context(), chi.URLParam(r, "owner"))
+			if err != nil {
+				handleError(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(note.WithOwner(r.Context(), owner.ID)))
+		})
+	}
+}
+
+type LinkApi struct {
+	service LinkOpener
+}
+
+type LinkOpener interface {
+	OpenLink(ctx context.Context, token, password string) (note.Note, error)
+}
+
+// NewLinkApi returns the public api for opening share links. It doesn't need
+// authentication, the link's token is all it takes.
+func NewLinkApi(service LinkOpener) *LinkApi {
+	return &LinkApi{service: service}
+}
+
+func (a *LinkApi) ConfigureRouter(r chi.Router) {
+	r.Get("/{token}", a.Open)
+	r.Post("/{token}", a.Open)
+}
+
+// Open shows the note the link is for as a read-only page, or as JSON when
+// that's what's accepted. A link with a password takes it as the password
+// form field of a POST.
+func (a *LinkApi) Open(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	asJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+
+	n, err := a.service.OpenLink(r.Context(), chi.URLParam(r, "token"), r.PostFormValue("password"))
+	switch {
+	case err == nil:
+	case errors.Cause(err) == note.ErrLinkPassword && asJSON:
+		Render(w, r, ErrUnauthorized)
+		return
+	case errors.Cause(err) == note.ErrLinkPassword:
+		renderLinkPage(w, http.StatusUnauthorized, linkPage{NeedsPassword: true, Retry: r.Method == http.MethodPost})
+		return
+	case asJSON:
+		handleError(w, r, err)
+		return
+	default:
+		log.Err(err).Send()
+		renderLinkPage(w, http.StatusNotFound, linkPage{Missing: true})
+		return
+	}
+
+	if asJSON {
+		Render(w, r, NewSharedNoteResponse(n))
+		return
+	}
+	renderLinkPage(w, http.StatusOK, linkPage{Note: n})
+}
+
+type linkPage struct {
+	Note          note.Note
+	NeedsPassword bool
+	Retry         bool
+	Missing       bool
+}
+
+// linkTemplate is the page for a share link, it has no scripts and its
+// styles are inline so the page's policy can block everything else
+var linkTemplate = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Note.Title}}{{.Note.Title}}{{else}}Shared note{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+pre { white-space: pre-wrap; word-wrap: break-word; font-family: inherit; }
+.tags, .updated { color: #666; font-size: 0.9rem; }
+</style>
+</head>
+<body>
+{{- if .Missing}}
+<h1>Not found</h1>
+<p>This link doesn't exist or has expired.</p>
+{{- else if .NeedsPassword}}
+<h1>Password required</h1>
+{{- if .Retry}}
+<p>That password isn't right.</p>
+{{- end}}
+<form method="post">
+<input type="password" name="password" aria-label="Password" autofocus required>
+<button type="submit">Open</button>
+</form>
+{{- else}}
+<h1>{{.Note.Title}}</h1>
+{{- if .Note.Tags}}
+<p class="tags">{{range $i, $t := .Note.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</p>
+{{- end}}
+<pre>{{.Note.Data}}</pre>
+<p class="updated">Last updated {{.Note.Updated.Format "2 January 2006"}}</p>
+{{- end}}
+</body>
+</html>
+`))
+
+func renderLinkPage(w http.ResponseWriter, status int, page linkPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := linkTemplate.Execute(w, page); err != nil {
+		log.Warn().Err(err).Msg("failed to render share link")
+	}
+}
@@ -0,0 +1,326 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestShares(t *testing.T) {
+	svc := newMockShareService()
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, nil))
+	router.Route("/note", api.NewShareApi(svc, &mockUserService{}).ConfigureRouter)
+
+	w := serveKeys(router, http.MethodPost, "/note/1/shares", `{"username": "admin", "role": "editor"}`, "password")
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("expected %v got %v", http.StatusCreated, w.Result().StatusCode)
+	}
+	created := api.ShareResponse{}
+	data, _ := ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &created); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if created.Username != "admin" || created.Owner != "test" || created.Role != note.RoleEditor || strings.Contains(string(data), "admin-id") {
+		t.Errorf("expected the share by username got %s", data)
+	}
+
+	w = serveKeys(router, http.MethodPost, "/note/1/links", `{"password": "hunter2"}`, "password")
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("expected %v got %v", http.StatusCreated, w.Result().StatusCode)
+	}
+	link := api.LinkResponse{}
+	data, _ = ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &link); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if link.Token == "" || !link.HasPassword || strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "Hash") {
+		t.Errorf("expected the link and its token without hashes got %s", data)
+	}
+
+	w = serveKeys(router, http.MethodGet, "/note/1/links", "", "password")
+	links := api.LinkListResponse{}
+	data, _ = ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &links); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if len(links.Links) != 1 || links.Links[0].ID != link.ID || links.Links[0].Token != "" {
+		t.Errorf("expected the link without its token got %s", data)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{name: "list shares", method: http.MethodGet, url: "/note/1/shares", wantStatus: http.StatusOK},
+		{name: "share missing note", method: http.MethodPost, url: "/note/2/shares", body: `{"username": "admin", "role": "viewer"}`, wantStatus: http.StatusNotFound},
+		{name: "share with unknown user", method: http.MethodPost, url: "/note/1/shares", body: `{"username": "nobody", "role": "viewer"}`, wantStatus: http.StatusNotFound},
+		{name: "share without role", method: http.MethodPost, url: "/note/1/shares", body: `{"username": "admin"}`, wantStatus: http.StatusBadRequest},
+		{name: "share as owner", method: http.MethodPost, url: "/note/1/shares", body: `{"username": "admin", "role": "owner"}`, wantStatus: http.StatusBadRequest},
+		{name: "share someone else's", method: http.MethodPost, url: "/note/forbidden/shares", body: `{"username": "admin", "role": "viewer"}`, wantStatus: http.StatusForbidden},
+		{name: "unshare", method: http.MethodDelete, url: "/note/1/shares/admin", wantStatus: http.StatusNoContent},
+		{name: "unshare again", method: http.MethodDelete, url: "/note/1/shares/admin", wantStatus: http.StatusNotFound},
+		{name: "delete link", method: http.MethodDelete, url: "/note/1/links/" + link.ID, wantStatus: http.StatusNoContent},
+		{name: "delete link again", method: http.MethodDelete, url: "/note/1/links/" + link.ID, wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := serveKeys(router, test.method, test.url, test.body, "password")
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestSharedBy(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, nil))
+	router.With(api.SharedBy(&mockUserService{})).Get("/shared/{owner}/note", func(w http.ResponseWriter, r *http.Request) {
+		owner, _ := note.OwnerFromContext(r.Context())
+		_, _ = w.Write([]byte(owner))
+	})
+
+	w := serveKeys(router, http.MethodGet, "/shared/admin/note", "", "password")
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if w.Result().StatusCode != http.StatusOK || string(body) != "admin-id" {
+		t.Errorf("expected the owner admin-id got %v %s", w.Result().StatusCode, body)
+	}
+
+	w = serveKeys(router, http.MethodGet, "/shared/nobody/note", "", "password")
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("expected %v got %v", http.StatusNotFound, w.Result().StatusCode)
+	}
+}
+
+func TestSharedDeleteForbidden(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(api.Authenticate(&mockUserService{}, nil, nil))
+	router.With(api.SharedBy(&mockUserService{})).Route("/shared/{owner}/note", api.NewNoteApi(ownerOnlyNoteService{}).ConfigureRouter)
+
+	w := serveKeys(router, http.MethodDelete, "/shared/admin/note/1", "", "password")
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("expected %v got %v", http.StatusForbidden, w.Result().StatusCode)
+	}
+	w = serveKeys(router, http.MethodDelete, "/shared/test/note/1", "", "password")
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Errorf("expected %v got %v", http.StatusNoContent, w.Result().StatusCode)
+	}
+}
+
+// ownerOnlyNoteService only lets the owner of a shared note delete it, as
+// the namespaced service does
+type ownerOnlyNoteService struct {
+	mockNoteService
+}
+
+func (s ownerOnlyNoteService) Delete(ctx context.Context, id string) error {
+	u, _ := user.FromContext(ctx)
+	if owner, ok := note.OwnerFromContext(ctx); ok && owner != u.ID {
+		return &core.ErrForbidden{Reason: "only the owner can delete the note"}
+	}
+	return s.mockNoteService.Delete(ctx, id)
+}
+
+func TestOpenLink(t *testing.T) {
+	svc := newMockShareService()
+	_, open, _ := svc.CreateLink(context.Background(), "1", nil, "")
+	_, locked, _ := svc.CreateLink(context.Background(), "1", nil, "hunter2")
+	router := chi.NewRouter()
+	router.Route("/share", api.NewLinkApi(svc).ConfigureRouter)
+
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		password   string
+		accept     string
+		wantStatus int
+		want       string
+	}{
+		{name: "page", method: http.MethodGet, token: open, wantStatus: http.StatusOK, want: "&lt;script&gt;walrus&lt;/script&gt;"},
+		{name: "json", method: http.MethodGet, token: open, accept: "application/json", wantStatus: http.StatusOK, want: `"data":"\u003cscript\u003ewalrus`},
+		{name: "password form", method: http.MethodGet, token: locked, wantStatus: http.StatusUnauthorized, want: `name="password"`},
+		{name: "wrong password", method: http.MethodPost, token: locked, password: "hunter3", wantStatus: http.StatusUnauthorized, want: "isn't right"},
+		{name: "password", method: http.MethodPost, token: locked, password: "hunter2", wantStatus: http.StatusOK, want: "&lt;script&gt;"},
+		{name: "json without password", method: http.MethodGet, token: locked, accept: "application/json", wantStatus: http.StatusUnauthorized},
+		{name: "unknown", method: http.MethodGet, token: "unknown.secret", wantStatus: http.StatusNotFound, want: "Not found"},
+		{name: "unknown json", method: http.MethodGet, token: "unknown.secret", accept: "application/json", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		form := url.Values{}
+		if test.password != "" {
+			form.Set("password", test.password)
+		}
+		r := httptest.NewRequest(test.method, "/share/"+test.token, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if !strings.Contains(string(body), test.want) || strings.Contains(string(body), "<script>") {
+			t.Errorf("%v: expected %q got %s", test.name, test.want, body)
+		}
+		if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Referrer-Policy") != "no-referrer" {
+			t.Errorf("%v: expected the link not to be cached or leaked got %v", test.name, w.Header())
+		}
+		if test.accept == "" && !strings.HasPrefix(w.Header().Get("Content-Security-Policy"), "default-src 'none'") {
+			t.Errorf("%v: expected a content security policy got %v", test.name, w.Header())
+		}
+	}
+}
+
+func TestOpenLinkNotLogged(t *testing.T) {
+	svc := newMockShareService()
+	_, token, _ := svc.CreateLink(context.Background(), "1", nil, "")
+	router := chi.NewRouter()
+	router.Use(api.Logging)
+	router.Route("/share", api.NewLinkApi(svc).ConfigureRouter)
+
+	var logged bytes.Buffer
+	defer func(l zerolog.Logger) { log.Logger = l }(log.Logger)
+	log.Logger = zerolog.New(&logged)
+
+	r := httptest.NewRequest(http.MethodGet, "/share/"+token+"?from=email", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if strings.Contains(logged.String(), parts[1]) {
+		t.Errorf("expected the link's secret not to be logged got %s", logged.String())
+	}
+	if !strings.Contains(logged.String(), `"uri":"/share/`+parts[0]+`.REDACTED"`) {
+		t.Errorf("expected the link's ID to be logged got %s", logged.String())
+	}
+}
+
+// mockShareService owns note 1 only, the note forbidden belongs to someone
+// else
+type mockShareService struct {
+	shares map[string]note.Share
+	links  map[string]note.Link
+}
+
+func newMockShareService() *mockShareService {
+	return &mockShareService{shares: make(map[string]note.Share), links: make(map[string]note.Link)}
+}
+
+func (m *mockShareService) check(id string) error {
+	switch id {
+	case "1":
+		return nil
+	case "forbidden":
+		return &core.ErrForbidden{Reason: "only the owner can do that"}
+	default:
+		return &core.ErrNotFound{}
+	}
+}
+
+func (m *mockShareService) Share(ctx context.Context, id string, with user.User, role note.Role) (note.Share, error) {
+	if err := m.check(id); err != nil {
+		return note.Share{}, err
+	}
+	if role != note.RoleEditor && role != note.RoleViewer {
+		return note.Share{}, &core.ErrInvalid{Reason: "role must be editor or viewer"}
+	}
+	owner, _ := user.FromContext(ctx)
+	sh := note.Share{OwnerID: owner.ID, OwnerUsername: owner.Username, NoteID: id, UserID: with.ID, Username: with.Username, Role: role}
+	m.shares[with.ID] = sh
+	return sh, nil
+}
+
+func (m *mockShareService) ListShares(ctx context.Context, id string) ([]note.Share, error) {
+	if err := m.check(id); err != nil {
+		return nil, err
+	}
+	shares := make([]note.Share, 0, len(m.shares))
+	for _, sh := range m.shares {
+		shares = append(shares, sh)
+	}
+	return shares, nil
+}
+
+func (m *mockShareService) Unshare(ctx context.Context, id, userID string) error {
+	if err := m.check(id); err != nil {
+		return err
+	}
+	if _, ok := m.shares[userID]; !ok {
+		return &core.ErrNotFound{}
+	}
+	delete(m.shares, userID)
+	return nil
+}
+
+func (m *mockShareService) ListShared(ctx context.Context) ([]note.Share, error) {
+	return []note.Share{}, nil
+}
+
+func (m *mockShareService) CreateLink(ctx context.Context, id string, expires *time.Time, password string) (note.Link, string, error) {
+	if err := m.check(id); err != nil {
+		return note.Link{}, "", err
+	}
+	l := note.Link{ID: "link" + string(rune('a'+len(m.links))), NoteID: id, SecretHash: "hash", Expires: expires}
+	if password != "" {
+		l.PasswordHash = "hash of " + password
+	}
+	m.links[l.ID] = l
+	return l, l.ID + ".secret", nil
+}
+
+func (m *mockShareService) ListLinks(ctx context.Context, id string) ([]note.Link, error) {
+	if err := m.check(id); err != nil {
+		return nil, err
+	}
+	links := make([]note.Link, 0, len(m.links))
+	for _, l := range m.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (m *mockShareService) DeleteLink(ctx context.Context, id, linkID string) error {
+	if _, ok := m.links[linkID]; !ok {
+		return &core.ErrNotFound{}
+	}
+	delete(m.links, linkID)
+	return nil
+}
+
+func (m *mockShareService) OpenLink(ctx context.Context, token, password string) (note.Note, error) {
+	parts := strings.SplitN(token, ".", 2)
+	l, ok := m.links[parts[0]]
+	if !ok || len(parts) != 2 || parts[1] != "secret" {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	if l.HasPassword() && l.PasswordHash != "hash of "+password {
+		return note.Note{}, note.ErrLinkPassword
+	}
+	return note.Note{ID: l.NoteID, Title: "Walrus", Data: "<script>walrus</script>", Tags: []string{"animals"}}, nil
+}
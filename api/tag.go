@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/core/note"
+)
+
+const (
+	matchAll = "all"
+	matchAny = "any"
+)
+
+type TagApi struct {
+	service TagService
+}
+
+type TagService interface {
+	Tags(context.Context) ([]note.TagCount, error)
+}
+
+func NewTagApi(service TagService) *TagApi {
+	return &TagApi{service: service}
+}
+
+func (a *TagApi) ConfigureRouter(r chi.Router) {
+	r.Get("/", a.List)
+}
+
+// List returns every tag in use along with how many notes use it
+func (a *TagApi) List(w http.ResponseWriter, r *http.Request) {
+	tags, err := a.service.Tags(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	Render(w, r, NewTagListResponse(tags))
+}
+
+// parseTagFilter reads the tag filter from the query. Tags can be given as
+// repeated tag parameters or separated by commas, match chooses between all
+// (the default) and any of them.
+func parseTagFilter(q url.Values) (note.TagFilter, error) {
+	filter := note.TagFilter{}
+	for _, v := range q["tag"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				filter.Tags = append(filter.Tags, t)
+			}
+		}
+	}
+
+	switch q.Get("match") {
+	case "", matchAll:
+	case matchAny:
+		filter.Any = true
+	default:
+		return note.TagFilter{}, errors.New(`match must be "all" or "any"`)
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,147 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestListTagFilter(t *testing.T) {
+	svc := mockNoteService{listNotes: []note.ListNote{
+		{ID: "1", Tags: []string{"home"}},
+		{ID: "2", Tags: []string{"home", "work"}},
+		{ID: "3", Tags: []string{"work"}},
+	}}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantIDs    string
+	}{
+		{name: "No Filter", url: "/", wantStatus: http.StatusOK, wantIDs: "[1 2 3]"},
+		{name: "One Tag", url: "/?tag=home", wantStatus: http.StatusOK, wantIDs: "[1 2]"},
+		{name: "All Tags", url: "/?tag=home&tag=work", wantStatus: http.StatusOK, wantIDs: "[2]"},
+		{name: "Comma Separated", url: "/?tag=home,work", wantStatus: http.StatusOK, wantIDs: "[2]"},
+		{name: "Any Tag", url: "/?tag=home&tag=work&match=any", wantStatus: http.StatusOK, wantIDs: "[1 2 3]"},
+		{name: "Bad Match", url: "/?tag=home&match=some", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewNoteApi(svc).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+
+		resp := parseListResponse(w, t)
+		ids := make([]string, len(resp.Notes))
+		for i, ln := range resp.Notes {
+			ids[i] = ln.ID
+		}
+		if fmt.Sprint(ids) != test.wantIDs {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantIDs, ids)
+		}
+	}
+}
+
+func TestListTagFilterLinks(t *testing.T) {
+	svc := mockNoteService{listNotes: []note.ListNote{
+		{ID: "1", Tags: []string{"home"}},
+		{ID: "2", Tags: []string{"home"}},
+	}}
+	router := chi.NewRouter()
+	api.NewNoteApi(svc).ConfigureRouter(router)
+
+	r := httptest.NewRequest(http.MethodGet, "/?tag=home&limit=1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	// Following the links has to keep filtering
+	if link := w.Result().Header.Get("Link"); !strings.Contains(link, "tag=home") {
+		t.Errorf("expected links to keep the tag filter got %v", link)
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"id": "1", "data": "somenote", "tags": ["to do"]}`))
+	r.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	svc := mockNoteService{}
+	svc.ReturnError(&core.ErrInvalid{Reason: `tag "to do" contains whitespace or a comma`})
+	api.NewNoteApi(svc).Create(w, r)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %v got %v", http.StatusBadRequest, w.Result().StatusCode)
+	}
+	if resp := parseErrorResponse(w, t); !strings.Contains(resp.ErrorText, "to do") {
+		t.Errorf("expected the reason in the response got %+v", resp)
+	}
+}
+
+func TestTagList(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{name: "Tags", wantStatus: http.StatusOK},
+		{name: "Error", err: errors.New("some error"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+
+		api.NewTagApi(mockTagService{returnError: test.err}).List(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+
+		resp := api.TagListResponse{}
+		data, _ := ioutil.ReadAll(w.Result().Body)
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("failed to parse response %v", err)
+		}
+		if fmt.Sprint(resp.Tags) != "[{home 2} {work 1}]" {
+			t.Errorf("%v: unexpected tags %v", test.name, resp.Tags)
+		}
+	}
+}
+
+type mockTagService struct {
+	returnError error
+}
+
+func (m mockTagService) Tags(context.Context) ([]note.TagCount, error) {
+	if m.returnError != nil {
+		return []note.TagCount{}, m.returnError
+	}
+	return []note.TagCount{{Name: "home", Count: 2}, {Name: "work", Count: 1}}, nil
+}
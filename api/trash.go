@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sksmith/note-server/core/note"
+)
+
+type TrashApi struct {
+	service TrashService
+}
+
+type TrashService interface {
+	ListTrash(context.Context, int, int) ([]note.ListNote, int, error)
+	RestoreTrashed(context.Context, string) (note.Note, error)
+	Purge(context.Context, string) error
+}
+
+func NewTrashApi(service TrashService) *TrashApi {
+	return &TrashApi{service: service}
+}
+
+func (a *TrashApi) ConfigureRouter(r chi.Router) {
+	r.With(Paginate).Get("/", a.List)
+	r.Post("/{id}/restore", a.Restore)
+	r.Delete("/{id}", a.Purge)
+}
+
+func (a *TrashApi) List(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageFromContext(r.Context())
+
+	n, total, err := a.service.ListTrash(r.Context(), offset, offset+limit)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	setPageHeaders(w, r.URL, offset, limit, total)
+	Render(w, r, NewListNoteResponse(n, total, nextCursor(offset, limit, total)))
+}
+
+// Restore takes the note out of the trash
+func (a *TrashApi) Restore(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	n, err := a.service.RestoreTrashed(r.Context(), id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(n.Version))
+	Render(w, r, NewNoteResponse(n))
+}
+
+// Purge permanently deletes a note that's in the trash. Unlike deleting a
+// note, purging one that isn't in the trash is reported as not found.
+func (a *TrashApi) Purge(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := a.service.Purge(r.Context(), id); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
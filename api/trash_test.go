@@ -0,0 +1,139 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func trashRouter(svc api.TrashService) chi.Router {
+	router := chi.NewRouter()
+	api.NewTrashApi(svc).ConfigureRouter(router)
+	return router
+}
+
+func TestListTrash(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?limit=1", nil)
+	w := httptest.NewRecorder()
+
+	trashRouter(newMockTrashService("1", "2")).ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %v got %v", http.StatusOK, w.Result().StatusCode)
+	}
+	if got := w.Result().Header.Get("X-Total-Count"); got != "2" {
+		t.Errorf("expected total 2 got %v", got)
+	}
+	resp := parseListResponse(w, t)
+	if len(resp.Notes) != 1 || resp.Notes[0].ID != "1" || resp.Notes[0].Trashed == nil || resp.Next == "" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestRestoreTrashed(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		err        error
+		wantStatus int
+	}{
+		{name: "Trashed", id: "1", wantStatus: http.StatusOK},
+		{name: "Not Trashed", id: "9", wantStatus: http.StatusNotFound},
+		{name: "Error", id: "1", err: errors.New("some error"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		svc := newMockTrashService("1")
+		svc.returnError = test.err
+		r := httptest.NewRequest(http.MethodPost, "/"+test.id+"/restore", nil)
+		w := httptest.NewRecorder()
+
+		trashRouter(svc).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := w.Result().Header.Get("ETag"); got != `"1"` {
+			t.Errorf("%v: expected etag %v got %v", test.name, `"1"`, got)
+		}
+		if resp := parseResponse(w, t); resp.ID != test.id || resp.Trashed != nil {
+			t.Errorf("%v: unexpected response %+v", test.name, resp.Note)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		err        error
+		wantStatus int
+	}{
+		{name: "Trashed", id: "1", wantStatus: http.StatusNoContent},
+		{name: "Not Trashed", id: "9", wantStatus: http.StatusNotFound},
+		{name: "Error", id: "1", err: errors.New("some error"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		svc := newMockTrashService("1")
+		svc.returnError = test.err
+		r := httptest.NewRequest(http.MethodDelete, "/"+test.id, nil)
+		w := httptest.NewRecorder()
+
+		trashRouter(svc).ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+type mockTrashService struct {
+	returnError error
+	trash       []note.ListNote
+}
+
+func newMockTrashService(ids ...string) *mockTrashService {
+	trashed := time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)
+	m := &mockTrashService{}
+	for _, id := range ids {
+		m.trash = append(m.trash, note.ListNote{ID: id, Version: 1, Trashed: &trashed})
+	}
+	return m
+}
+
+func (m *mockTrashService) ListTrash(_ context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	if m.returnError != nil {
+		return []note.ListNote{}, 0, m.returnError
+	}
+	return note.Page(m.trash, startIdx, endIdx), len(m.trash), nil
+}
+
+func (m *mockTrashService) RestoreTrashed(_ context.Context, id string) (note.Note, error) {
+	if m.returnError != nil {
+		return note.Note{}, m.returnError
+	}
+	for _, ln := range m.trash {
+		if ln.ID == id {
+			return note.Note{ID: id, Version: ln.Version}, nil
+		}
+	}
+	return note.Note{}, &core.ErrNotFound{}
+}
+
+func (m *mockTrashService) Purge(ctx context.Context, id string) error {
+	_, err := m.RestoreTrashed(ctx, id)
+	return err
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/user"
+)
+
+type UserApi struct {
+	service      UserService
+	authenticate func(http.Handler) http.Handler
+	registration bool
+}
+
+type UserService interface {
+	UserAccess
+	Register(ctx context.Context, username, password string) (user.User, error)
+	ChangePassword(ctx context.Context, username, current, password string) error
+}
+
+// NewUserApi returns the api for managing accounts, users are authenticated
+// by authenticate, see Authenticate. Anyone can sign up for an account when
+// registration is set.
+func NewUserApi(service UserService, authenticate func(http.Handler) http.Handler, registration bool) *UserApi {
+	return &UserApi{service: service, authenticate: authenticate, registration: registration}
+}
+
+func (a *UserApi) ConfigureRouter(r chi.Router) {
+	if a.registration {
+		r.Post("/", a.Register)
+	}
+	r.Group(func(r chi.Router) {
+		r.Use(a.authenticate)
+		r.Get("/me", a.Me)
+		r.Put("/me/password", a.ChangePassword)
+	})
+}
+
+func (a *UserApi) Register(w http.ResponseWriter, r *http.Request) {
+	data := &RegisterRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	u, err := a.service.Register(r.Context(), data.Username, data.Password)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewUserResponse(u))
+}
+
+// Me returns the authenticated user
+func (a *UserApi) Me(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	Render(w, r, NewUserResponse(u))
+}
+
+func (a *UserApi) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u, ok := user.FromContext(r.Context())
+	if !ok {
+		authErr(w)
+		return
+	}
+
+	data := &ChangePasswordRequest{}
+	if err := render.Bind(r, data); err != nil {
+		log.Err(err).Send()
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := a.service.ChangePassword(r.Context(), u.Username, data.CurrentPassword, data.NewPassword); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
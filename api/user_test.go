@@ -0,0 +1,212 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/note-server/api"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{name: "authenticated", username: "test", password: "password", wantStatus: http.StatusOK},
+		{name: "wrong password", username: "test", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		var got user.User
+		handler := api.Authenticate(&mockUserService{}, nil, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = user.FromContext(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.username != "" {
+			r.SetBasicAuth(test.username, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if test.wantStatus == http.StatusOK && got.Username != "test" {
+			t.Errorf("%v: expected the user in the context got %v", test.name, got)
+		}
+		if test.wantStatus == http.StatusUnauthorized && w.Result().Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%v: expected a WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		wantStatus int
+	}{
+		{name: "admin", username: "admin", wantStatus: http.StatusOK},
+		{name: "not an admin", username: "test", wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		router.Use(api.Authenticate(&mockUserService{}, nil, nil))
+		router.With(api.RequireAdmin).Get("/", func(w http.ResponseWriter, r *http.Request) {})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(test.username, "password")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name         string
+		registration bool
+		body         string
+		wantStatus   int
+	}{
+		{name: "registered", registration: true, body: `{"username": "new", "password": "password"}`, wantStatus: http.StatusCreated},
+		{name: "taken", registration: true, body: `{"username": "test", "password": "password"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing password", registration: true, body: `{"username": "new"}`, wantStatus: http.StatusBadRequest},
+		{name: "registration off", body: `{"username": "new", "password": "password"}`, wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		router := chi.NewRouter()
+		api.NewUserApi(&mockUserService{}, api.Authenticate(&mockUserService{}, nil, nil), test.registration).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+			continue
+		}
+		if test.wantStatus == http.StatusCreated {
+			data, _ := ioutil.ReadAll(w.Result().Body)
+			if strings.Contains(string(data), "passwordHash") {
+				t.Errorf("%v: expected no password hash got %s", test.name, data)
+			}
+			resp := api.UserResponse{}
+			if err := json.Unmarshal(data, &resp); err != nil || resp.Username != "new" {
+				t.Errorf("%v: expected the new user got %s", test.name, data)
+			}
+		}
+	}
+}
+
+func TestMe(t *testing.T) {
+	router := chi.NewRouter()
+	api.NewUserApi(&mockUserService{}, api.Authenticate(&mockUserService{}, nil, nil), false).ConfigureRouter(router)
+
+	r := httptest.NewRequest(http.MethodGet, "/me", nil)
+	r.SetBasicAuth("admin", "password")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	resp := api.UserResponse{}
+	data, _ := ioutil.ReadAll(w.Result().Body)
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("failed to parse response %v", err)
+	}
+	if w.Result().StatusCode != http.StatusOK || resp.Username != "admin" || !resp.Admin {
+		t.Errorf("expected the admin got %v %s", w.Result().StatusCode, data)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		body       string
+		wantStatus int
+	}{
+		{name: "changed", password: "password", body: `{"currentPassword": "password", "newPassword": "newpassword"}`, wantStatus: http.StatusNoContent},
+		{name: "wrong current", password: "password", body: `{"currentPassword": "wrong", "newPassword": "newpassword"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing new", password: "password", body: `{"currentPassword": "password"}`, wantStatus: http.StatusBadRequest},
+		{name: "unauthenticated", password: "wrong", body: `{"currentPassword": "password", "newPassword": "newpassword"}`, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		svc := &mockUserService{}
+		router := chi.NewRouter()
+		api.NewUserApi(svc, api.Authenticate(svc, nil, nil), false).ConfigureRouter(router)
+
+		r := httptest.NewRequest(http.MethodPut, "/me/password", strings.NewReader(test.body))
+		r.Header.Add("Content-Type", "application/json")
+		r.SetBasicAuth("test", test.password)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != test.wantStatus {
+			t.Errorf("%v: expected %v got %v", test.name, test.wantStatus, w.Result().StatusCode)
+		}
+		if changed := svc.changed == "test"; changed != (test.wantStatus == http.StatusNoContent) {
+			t.Errorf("%v: expected the password to be changed=%v", test.name, !changed)
+		}
+	}
+}
+
+// mockUserService has the users test and admin, both with the password
+// "password"
+type mockUserService struct {
+	changed string
+}
+
+func (m *mockUserService) Auth(_ context.Context, username, password string) (user.User, bool) {
+	if (username != "test" && username != "admin") || password != "password" {
+		return user.User{}, false
+	}
+	return user.User{ID: username + "-id", Username: username, PasswordHash: "hash", Admin: username == "admin"}, true
+}
+
+func (m *mockUserService) Register(_ context.Context, username, password string) (user.User, error) {
+	if username == "test" || username == "admin" {
+		return user.User{}, &core.ErrInvalid{Reason: "username is taken"}
+	}
+	return user.User{ID: username + "-id", Username: username, PasswordHash: "hash"}, nil
+}
+
+func (m *mockUserService) ChangePassword(ctx context.Context, username, current, password string) error {
+	if _, ok := m.Auth(ctx, username, current); !ok {
+		return &core.ErrInvalid{Reason: "the current password is wrong"}
+	}
+	m.changed = username
+	return nil
+}
+
+func (m *mockUserService) Get(_ context.Context, username string) (user.User, error) {
+	if username != "test" && username != "admin" {
+		return user.User{}, &core.ErrNotFound{}
+	}
+	return user.User{ID: username + "-id", Username: username, Admin: username == "admin"}, nil
+}
+
+func (m *mockUserService) Provision(_ context.Context, username, subject string, admin *bool) (user.User, error) {
+	if username == "test" || username == "admin" {
+		return user.User{}, &core.ErrInvalid{Reason: "username is taken"}
+	}
+	return user.User{ID: username + "-id", Username: username, Subject: subject}, nil
+}
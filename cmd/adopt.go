@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/user"
+)
+
+type adopter interface {
+	Adopt(ctx context.Context, userID string) (int, error)
+}
+
+// adopt runs the adopt command, moving the notes stored before there were
+// users into the user's namespace
+func adopt(ctx context.Context, notes adopter, users *user.Service, username string) int {
+	u, err := users.Get(ctx, username)
+	if err != nil {
+		log.Error().Err(err).Str("username", username).Msg("failed to get user")
+		return exitError
+	}
+
+	moved, err := notes.Adopt(ctx, u.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to adopt notes")
+		return exitError
+	}
+
+	fmt.Printf("moved %d notes to %s\n", moved, u.Username)
+	return exitOK
+}
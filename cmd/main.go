@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -18,14 +22,42 @@ import (
 	"github.com/sksmith/note-server/api"
 	"github.com/sksmith/note-server/config"
 	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/auth"
 	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/oidc"
 	"github.com/sksmith/note-server/core/user"
 	"github.com/sksmith/note-server/repo/noterepo"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	indexCompactInterval = 5 * time.Minute
+	trashPurgeInterval   = time.Hour
+	reencryptInterval    = 24 * time.Hour
+	oidcTimeout          = 10 * time.Second
+
+	// Commands that can be given before any flags
+	cmdServe     = "serve"
+	cmdReindex   = "reindex"
+	cmdUserAdd   = "useradd"
+	cmdAdopt     = "adopt"
+	cmdReencrypt = "reencrypt"
+	cmdMigrate   = "migrate"
+)
+
+var (
+	repair = flag.Bool("repair", false, "rewrite the index to match the stored notes when reindexing")
+
+	username = flag.String("username", "", "username of the user to create with useradd or to adopt notes with adopt")
+	password = flag.String("password", "", "password of the user to create with useradd, read from stdin when empty")
+	admin    = flag.Bool("admin", false, "make the user created with useradd an admin")
+)
+
 func main() {
+	command := popCommand()
 	cfg := loadConfigs()
 
 	configLogging(cfg)
@@ -34,27 +66,164 @@ func main() {
 	log.Info().Msg("creating note repository...")
 	repo := createNoteRepo(cfg)
 
+	if command == cmdMigrate {
+		os.Exit(migrate(context.Background(), repo))
+	}
+
+	// Memory storage is already in memory
+	if cfg.CacheSize > 0 && cfg.Storage != config.StorageMemory {
+		log.Info().Int64("size", cfg.CacheSize).Msg("caching note repository...")
+		repo = cacheNoteRepo(repo, cfg)
+	}
+
+	if cfg.EncryptionKeys != "" {
+		log.Info().Msg("encrypting note repository...")
+		repo = encryptNoteRepo(repo, cfg.EncryptionKeys, command != cmdReencrypt)
+	}
+	if command == cmdReencrypt {
+		os.Exit(reencrypt(context.Background(), repo))
+	}
+
 	log.Info().Msg("creating note service...")
-	noteService := note.NewService(core.NewClock(), repo)
+	namespaces, ok := repo.(note.Namespaces)
+	if !ok {
+		log.Fatal().Str("storage", cfg.Storage).Msg("storage does not keep namespaces")
+	}
+	noteService := note.NewNamespacedService(core.NewClock(), namespaces)
+
+	if command == cmdReindex {
+		os.Exit(reindex(context.Background(), noteService, *repair))
+	}
 
 	log.Info().Msg("creating user service...")
-	userService := user.NewService()
+	userRepo, ok := repo.(user.Repository)
+	if !ok {
+		log.Fatal().Str("storage", cfg.Storage).Msg("storage does not keep users")
+	}
+	userService := user.NewService(core.NewClock(), userRepo)
+
+	if command == cmdUserAdd {
+		os.Exit(useradd(context.Background(), userService, *username, *password, *admin, os.Stdin))
+	}
+	if command == cmdAdopt {
+		os.Exit(adopt(context.Background(), noteService, userService, *username))
+	}
+
+	log.Info().Msg("creating auth service...")
+	authStore, ok := repo.(auth.Store)
+	if !ok {
+		log.Fatal().Str("storage", cfg.Storage).Msg("storage does not keep sessions")
+	}
+	authService := auth.NewService(core.NewClock(), auth.Config{
+		AccessTTL:   cfg.AccessTokenTTL,
+		RefreshTTL:  cfg.RefreshTokenTTL,
+		KeyRotation: cfg.KeyRotation,
+	}, authStore, userService)
+
+	log.Info().Msg("creating api key service...")
+	keyStore, ok := repo.(apikey.Store)
+	if !ok {
+		log.Fatal().Str("storage", cfg.Storage).Msg("storage does not keep api keys")
+	}
+	keyService := apikey.NewService(core.NewClock(), keyStore, userService)
+
+	log.Info().Msg("creating audit service...")
+	auditStore, ok := repo.(audit.Store)
+	if !ok {
+		log.Fatal().Str("storage", cfg.Storage).Msg("storage does not keep an audit log")
+	}
+	auditService := audit.NewService(core.NewClock(), auditStore)
+
+	var oidcProvider api.OIDCProvider
+	if cfg.OIDCIssuer != "" {
+		log.Info().Str("issuer", cfg.OIDCIssuer).Msg("creating openid connect provider...")
+		oidcProvider = oidc.NewProvider(core.NewClock(), oidc.Config{
+			Issuer:        cfg.OIDCIssuer,
+			ClientID:      cfg.OIDCClientID,
+			ClientSecret:  cfg.OIDCClientSecret,
+			RedirectURL:   cfg.OIDCRedirectURL,
+			Scopes:        strings.Fields(cfg.OIDCScopes),
+			UsernameClaim: cfg.OIDCUsernameClaim,
+			AdminGroup:    cfg.OIDCAdminGroup,
+		}, &http.Client{Timeout: oidcTimeout}, userService)
+	}
+
+	if cfg.TrashRetention > 0 {
+		go noteService.PurgeEvery(context.Background(), trashPurgeInterval, cfg.TrashRetention)
+	}
 
 	log.Info().Msg("configuring router...")
-	r := configureRouter(cfg, userService, noteService)
+	r := configureRouter(cfg, services{
+		users: userService,
+		auth:  authService,
+		keys:  keyService,
+		oidc:  oidcProvider,
+		notes: noteService,
+		audit: auditService,
+	})
 
 	log.Info().Str("port", cfg.Port).Msg("listening")
 	log.Fatal().Err(http.ListenAndServe(":"+cfg.Port, r))
 }
 
 func createNoteRepo(cfg config.Config) note.Repository {
+	switch cfg.Storage {
+	case config.StorageFile:
+		repo, err := noterepo.NewFileRepo(cfg.DataDir)
+		if err != nil {
+			log.Fatal().Err(err).Str("dir", cfg.DataDir).Msg("failed to create file repository")
+		}
+		return repo
+	case config.StorageMemory:
+		log.Warn().Msg("notes are kept in memory and will be lost on shutdown")
+		return noterepo.NewMemRepo()
+	}
+
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(cfg.Region),
 	}))
 	downloader := s3manager.NewDownloader(sess)
 	uploader := s3manager.NewUploader(sess)
-	deleter := s3.New(sess)
-	return noterepo.NewS3Repo(uploader, downloader, deleter, cfg.BucketName)
+	client := s3.New(sess)
+	repo := noterepo.NewS3Repo(uploader, downloader, client, client, cfg.BucketName)
+	repo.SetCompression(cfg.Compression == config.CompressionGzip)
+
+	go repo.CompactEvery(context.Background(), indexCompactInterval)
+
+	return repo
+}
+
+// cacheNoteRepo wraps the repository so notes and indexes are cached in memory
+func cacheNoteRepo(repo note.Repository, cfg config.Config) note.Repository {
+	backend, ok := repo.(noterepo.Backend)
+	if !ok {
+		log.Fatal().Msg("storage can't be cached")
+	}
+	return noterepo.NewCachingRepo(core.NewClock(), backend, noterepo.CacheConfig{
+		Size: cfg.CacheSize,
+		TTL:  cfg.CacheTTL,
+	})
+}
+
+// encryptNoteRepo wraps the repository so notes are encrypted at rest,
+// re-encrypting what isn't encrypted with the current key in the background
+// when asked to
+func encryptNoteRepo(repo note.Repository, keys string, background bool) note.Repository {
+	backend, ok := repo.(noterepo.Backend)
+	if !ok {
+		log.Fatal().Msg("storage can't be encrypted")
+	}
+	k, err := noterepo.ParseKeys(keys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse encryption keys")
+	}
+	encrypted := noterepo.NewEncryptedRepo(backend, k)
+
+	if background {
+		go encrypted.ReencryptEvery(context.Background(), reencryptInterval)
+	}
+
+	return encrypted
 }
 
 func loadConfigs() (cfg config.Config) {
@@ -75,6 +244,13 @@ func printLogHeader(c config.Config) {
 		log.Info().Msg(fmt.Sprintf("    Application: %s", c.ApplicationName))
 		log.Info().Msg(fmt.Sprintf("       Revision: %s", c.Revision))
 		log.Info().Msg(fmt.Sprintf("        Profile: %s", c.Profile))
+		log.Info().Msg(fmt.Sprintf("        Storage: %s", c.Storage))
+		log.Info().Msg(fmt.Sprintf("    Compression: %s", c.Compression))
+		log.Info().Msg(fmt.Sprintf(" Max Attachment: %d", c.MaxAttachment))
+		log.Info().Msg(fmt.Sprintf("Trash Retention: %s", c.TrashRetention))
+		log.Info().Msg(fmt.Sprintf("   Registration: %t", c.Registration))
+		log.Info().Msg(fmt.Sprintf("     Access TTL: %s", c.AccessTokenTTL))
+		log.Info().Msg(fmt.Sprintf("    OIDC Issuer: %s", c.OIDCIssuer))
 		log.Info().Msg(fmt.Sprintf("    Tag Version: %s", c.AppVersion))
 		log.Info().Msg(fmt.Sprintf("   Sha1 Version: %s", c.Sha1Version))
 		log.Info().Msg(fmt.Sprintf("     Build Time: %s", c.BuildTime))
@@ -83,6 +259,13 @@ func printLogHeader(c config.Config) {
 		log.Info().Str("application", c.ApplicationName).
 			Str("revision", c.Revision).
 			Str("profile", c.Profile).
+			Str("storage", c.Storage).
+			Str("compression", c.Compression).
+			Int64("max-attachment-size", c.MaxAttachment).
+			Dur("trash-retention", c.TrashRetention).
+			Bool("registration", c.Registration).
+			Dur("access-token-ttl", c.AccessTokenTTL).
+			Str("oidc-issuer", c.OIDCIssuer).
 			Str("version", c.AppVersion).
 			Str("sha1ver", c.Sha1Version).
 			Str("build-time", c.BuildTime).
@@ -90,20 +273,64 @@ func printLogHeader(c config.Config) {
 	}
 }
 
-func configureRouter(cfg config.Config, userService user.Service, service api.NoteService) chi.Router {
+// popCommand removes the command from the arguments so the remaining flags
+// can be parsed, defaulting to serving the api
+func popCommand() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return cmdServe
+	}
+
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	switch command {
+	case cmdServe, cmdReindex, cmdUserAdd, cmdAdopt, cmdReencrypt, cmdMigrate:
+		return command
+	default:
+		log.Fatal().Str("command", command).Msg("unknown command")
+		return ""
+	}
+}
+
+// services are what the router hands requests on to, oidc is nil when
+// OpenID Connect logins aren't offered
+type services struct {
+	users *user.Service
+	auth  *auth.Service
+	keys  *apikey.Service
+	oidc  api.OIDCProvider
+	notes noteServices
+	audit api.AuditService
+}
+
+// noteServices is everything the api needs from the note service
+type noteServices interface {
+	api.NoteService
+	api.ShareService
+	api.LinkOpener
+	api.TrashService
+	api.TagService
+	api.NotebookService
+	api.KeyRingService
+	api.AttachmentService
+	api.AdminService
+}
+
+func configureRouter(cfg config.Config, s services) chi.Router {
 	r := chi.NewRouter()
 
 	r.Use(cors.Handler(cors.Options{
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins:   []string{"https://*.seanksmith.me", "http://*.seanksmith.me", "http://localhost*", "https://localhost*"},
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "If-None-Match", "Range"},
+		ExposedHeaders:   []string{"Link", "X-Total-Count", "ETag", "Location", "Content-Range", "Content-Disposition"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 	r.Use(middleware.RequestID)
+	r.Use(api.AuditRequest)
 	r.Use(middleware.Recoverer)
 	r.Use(api.Metrics)
 	r.Use(render.SetContentType(render.ContentTypeJSON))
@@ -119,9 +346,42 @@ func configureRouter(cfg config.Config, userService user.Service, service api.No
 	r.Handle("/metrics", promhttp.Handler())
 
 	r.Route("/env", envApi(cfg))
+	r.Route("/share", linkApi(s.notes))
+
+	r.Route("/api/v1", func(r chi.Router) {
+		authenticate := api.Authenticate(s.users, s.auth, s.keys)
+
+		r.Route("/auth", func(r chi.Router) {
+			authApi(s.auth)(r)
+			if s.oidc != nil {
+				secure := strings.HasPrefix(cfg.OIDCRedirectURL, "https://")
+				r.Route("/oidc", oidcApi(s.oidc, s.auth, cfg.OIDCAppURL, secure))
+			}
+		})
+		r.Route("/users", userApi(s.users, authenticate, cfg.Registration))
 
-	r.With(api.Authenticate(userService)).Route("/api/v1", func(r chi.Router) {
-		r.Route("/note", noteApi(service))
+		r.Group(func(r chi.Router) {
+			r.Use(authenticate)
+			r.Route("/keys", keyApi(s.keys))
+			r.Route("/note", func(r chi.Router) {
+				noteApi(s.notes)(r)
+				attachmentApi(s.notes, cfg.MaxAttachment)(r)
+				shareApi(s.notes, s.users)(r)
+			})
+			r.Route("/shared", func(r chi.Router) {
+				r.Get("/", api.NewShareApi(s.notes, s.users).ListShared)
+				r.With(api.SharedBy(s.users)).Route("/{owner}/note", func(r chi.Router) {
+					noteApi(s.notes)(r)
+					attachmentApi(s.notes, cfg.MaxAttachment)(r)
+				})
+			})
+			r.Route("/trash", trashApi(s.notes))
+			r.Route("/tags", tagApi(s.notes))
+			r.Route("/notebook", notebookApi(s.notes))
+			r.Route("/keyring", keyRingApi(s.notes))
+			r.With(api.RequireAdmin).Route("/admin", adminApi(s.notes))
+			r.With(api.RequireAdmin).Route("/audit", auditApi(s.audit))
+		})
 	})
 
 	return r
@@ -132,11 +392,76 @@ func envApi(cfg config.Config) func(r chi.Router) {
 	return envApi.ConfigureRouter
 }
 
+func authApi(s api.AuthService) func(r chi.Router) {
+	authApi := api.NewAuthApi(s)
+	return authApi.ConfigureRouter
+}
+
+func oidcApi(p api.OIDCProvider, s api.SessionStarter, appURL string, secure bool) func(r chi.Router) {
+	oidcApi := api.NewOIDCApi(p, s, appURL, secure)
+	return oidcApi.ConfigureRouter
+}
+
+func userApi(s api.UserService, authenticate func(http.Handler) http.Handler, registration bool) func(r chi.Router) {
+	userApi := api.NewUserApi(s, authenticate, registration)
+	return userApi.ConfigureRouter
+}
+
+func keyApi(s api.KeyService) func(r chi.Router) {
+	keyApi := api.NewKeyApi(s)
+	return keyApi.ConfigureRouter
+}
+
+func adminApi(s api.AdminService) func(r chi.Router) {
+	adminApi := api.NewAdminApi(s)
+	return adminApi.ConfigureRouter
+}
+
+func auditApi(s api.AuditService) func(r chi.Router) {
+	auditApi := api.NewAuditApi(s)
+	return auditApi.ConfigureRouter
+}
+
+func trashApi(s api.TrashService) func(r chi.Router) {
+	trashApi := api.NewTrashApi(s)
+	return trashApi.ConfigureRouter
+}
+
+func tagApi(s api.TagService) func(r chi.Router) {
+	tagApi := api.NewTagApi(s)
+	return tagApi.ConfigureRouter
+}
+
+func notebookApi(s api.NotebookService) func(r chi.Router) {
+	notebookApi := api.NewNotebookApi(s)
+	return notebookApi.ConfigureRouter
+}
+
+func keyRingApi(s api.KeyRingService) func(r chi.Router) {
+	keyRingApi := api.NewKeyRingApi(s)
+	return keyRingApi.ConfigureRouter
+}
+
+func shareApi(s api.ShareService, users api.UserLookup) func(r chi.Router) {
+	shareApi := api.NewShareApi(s, users)
+	return shareApi.ConfigureRouter
+}
+
+func linkApi(s api.LinkOpener) func(r chi.Router) {
+	linkApi := api.NewLinkApi(s)
+	return linkApi.ConfigureRouter
+}
+
 func noteApi(s api.NoteService) func(r chi.Router) {
 	noteApi := api.NewNoteApi(s)
 	return noteApi.ConfigureRouter
 }
 
+func attachmentApi(s api.AttachmentService, maxSize int64) func(r chi.Router) {
+	attachmentApi := api.NewAttachmentApi(s, maxSize)
+	return attachmentApi.ConfigureRouter
+}
+
 func configLogging(cfg config.Config) {
 	log.Info().Msg("configuring logging...")
 
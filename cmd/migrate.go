@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo/noterepo"
+)
+
+type migrator interface {
+	Migrate(ctx context.Context) (noterepo.MigrateReport, error)
+}
+
+// migrate runs the migrate command, rewriting the stored objects that aren't
+// compressed the way the server is configured to compress them and printing
+// the report to stdout
+func migrate(ctx context.Context, repo note.Repository) int {
+	m, ok := repo.(migrator)
+	if !ok {
+		log.Error().Msg("only s3 storage can be migrated")
+		return exitError
+	}
+
+	report, err := m.Migrate(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to migrate objects")
+		return exitError
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Error().Err(err).Msg("failed to print report")
+		return exitError
+	}
+	return exitOK
+}
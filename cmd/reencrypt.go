@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/note"
+)
+
+type reencrypter interface {
+	Reencrypt(ctx context.Context) (int, error)
+}
+
+// reencrypt runs the reencrypt command, encrypting every note that isn't
+// encrypted with the current key with it so older keys can be dropped
+func reencrypt(ctx context.Context, repo note.Repository) int {
+	r, ok := repo.(reencrypter)
+	if !ok {
+		log.Error().Msg("notes aren't encrypted, set the encryption keys to re-encrypt them")
+		return exitError
+	}
+
+	n, err := r.Reencrypt(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to re-encrypt notes")
+		return exitError
+	}
+
+	fmt.Printf("re-encrypted %d notes, revisions and search documents\n", n)
+	return exitOK
+}
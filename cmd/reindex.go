@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/api"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitDrift = 2
+)
+
+// reindex runs the reindex command, printing the report to stdout. It exits
+// with exitDrift when the index has drifted and wasn't repaired so it can be
+// used in scheduled checks.
+func reindex(ctx context.Context, service api.AdminService, repair bool) int {
+	report, err := service.Reindex(ctx, repair)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reindex")
+		return exitError
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Error().Err(err).Msg("failed to print report")
+		return exitError
+	}
+
+	if report.Drifted() && !report.Repaired {
+		return exitDrift
+	}
+	return exitOK
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// useradd runs the useradd command. The password is read from the first line
+// of stdin when it isn't given as a flag so that it doesn't have to show up
+// in the process list or shell history.
+func useradd(ctx context.Context, service *user.Service, username, password string, admin bool, stdin io.Reader) int {
+	if password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Error().Err(err).Msg("failed to read password")
+			return exitError
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	u, err := service.Create(ctx, username, password, admin)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create user")
+		return exitError
+	}
+
+	fmt.Printf("created user %s (%s)\n", u.Username, u.ID)
+	return exitOK
+}
@@ -1,27 +1,84 @@
 package config
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
 
 type Config struct {
-	Port            string `json:"port"`
-	LogLevel        string `json:"logLevel"`
-	LogText         bool   `json:"logText"`
-	Region          string `json:"region"`
-	BucketName      string `json:"bucketName"`
-	Revision        string `json:"revision"`
-	ApplicationName string `json:"applicationName"`
-	AppVersion      string `json:"applicationVersion"`
-	Sha1Version     string `json:"sha1Version"`
-	BuildTime       string `json:"buildTime"`
-	Profile         string `json:"profile"`
+	Port            string        `json:"port"`
+	LogLevel        string        `json:"logLevel"`
+	LogText         bool          `json:"logText"`
+	Region          string        `json:"region"`
+	BucketName      string        `json:"bucketName"`
+	Storage         string        `json:"storage"`
+	DataDir         string        `json:"dataDir"`
+	Compression     string        `json:"compression"`
+	CacheSize       int64         `json:"cacheSize"`
+	CacheTTL        time.Duration `json:"cacheTtl"`
+	MaxAttachment   int64         `json:"maxAttachmentSize"`
+	TrashRetention  time.Duration `json:"trashRetention"`
+	Registration    bool          `json:"registration"`
+	AccessTokenTTL  time.Duration `json:"accessTokenTtl"`
+	RefreshTokenTTL time.Duration `json:"refreshTokenTtl"`
+	KeyRotation     time.Duration `json:"keyRotation"`
+	Revision        string        `json:"revision"`
+	ApplicationName string        `json:"applicationName"`
+	AppVersion      string        `json:"applicationVersion"`
+	Sha1Version     string        `json:"sha1Version"`
+	BuildTime       string        `json:"buildTime"`
+	Profile         string        `json:"profile"`
+
+	// OpenID Connect logins are only offered when OIDCIssuer is set, the
+	// client secret is never shown
+	OIDCIssuer        string `json:"oidcIssuer"`
+	OIDCClientID      string `json:"oidcClientId"`
+	OIDCClientSecret  string `json:"-"`
+	OIDCRedirectURL   string `json:"oidcRedirectUrl"`
+	OIDCAppURL        string `json:"oidcAppUrl"`
+	OIDCScopes        string `json:"oidcScopes"`
+	OIDCUsernameClaim string `json:"oidcUsernameClaim"`
+	OIDCAdminGroup    string `json:"oidcAdminGroup"`
+
+	// Notes are only encrypted at rest when EncryptionKeys is set, the keys
+	// are never shown
+	EncryptionKeys string `json:"-"`
 }
 
 var (
 	// Runtime flags
 	bucket  *string
+	dataDir *string
 	port    *string
 	profile *string
 	region  *string
+	storage *string
+
+	compression *string
+	cacheSize   *int64
+	cacheTTL    *time.Duration
+
+	maxAttachment *int64
+
+	trashRetention  *time.Duration
+	registration    *bool
+	accessTokenTTL  *time.Duration
+	refreshTokenTTL *time.Duration
+	keyRotation     *time.Duration
+
+	oidcIssuer        *string
+	oidcClientID      *string
+	oidcClientSecret  *string
+	oidcRedirectURL   *string
+	oidcAppURL        *string
+	oidcScopes        *string
+	oidcUsernameClaim *string
+	oidcAdminGroup    *string
+
+	encryptionKeys *string
 
 	// Build time arguments
 	AppVersion  string
@@ -34,11 +91,45 @@ const (
 	ApplicationName = "note-server"
 	Revision        = "1"
 
+	// Storage backends for notes
+	StorageS3     = "s3"
+	StorageFile   = "file"
+	StorageMemory = "memory"
+
+	// Compression of the objects notes are stored in
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+
 	// Default runtime arguments
 	DefaultBucket  = "sksmithnotes"
+	DefaultDataDir = "data"
 	DefaultPort    = "8080"
 	DefaultProfile = "local"
 	DefaultRegion  = "us-east-1"
+	DefaultStorage = StorageS3
+
+	DefaultCompression = CompressionGzip
+	DefaultCacheSize   = 64 << 20
+	DefaultCacheTTL    = time.Minute
+
+	DefaultMaxAttachment = 25 << 20
+
+	DefaultTrashRetention  = 30 * 24 * time.Hour
+	DefaultRegistration    = false
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	DefaultKeyRotation     = 24 * time.Hour
+
+	DefaultOIDCScopes        = "openid profile email"
+	DefaultOIDCUsernameClaim = "preferred_username"
+
+	// OIDCClientSecretEnv is read for the client secret when the flag isn't
+	// given, so it can be kept out of the process list
+	OIDCClientSecretEnv = "OIDC_CLIENT_SECRET"
+
+	// EncryptionKeysEnv is read for the encryption keys when the flag isn't
+	// given, so they can be kept out of the process list
+	EncryptionKeysEnv = "ENCRYPTION_KEYS"
 
 	// Default runtime arguments when running locally
 	DefaultLocalLogLevel = "trace"
@@ -57,11 +148,88 @@ func LoadConfigs() (Config, error) {
 		ApplicationName: ApplicationName,
 		BucketName:      *bucket,
 		BuildTime:       BuildTime,
+		DataDir:         *dataDir,
 		Profile:         *profile,
 		Port:            *port,
 		Region:          *region,
 		Revision:        Revision,
 		Sha1Version:     Sha1Version,
+		Storage:         *storage,
+		Compression:     *compression,
+		CacheSize:       *cacheSize,
+		CacheTTL:        *cacheTTL,
+		MaxAttachment:   *maxAttachment,
+		TrashRetention:  *trashRetention,
+		Registration:    *registration,
+		AccessTokenTTL:  *accessTokenTTL,
+		RefreshTokenTTL: *refreshTokenTTL,
+		KeyRotation:     *keyRotation,
+
+		OIDCIssuer:        *oidcIssuer,
+		OIDCClientID:      *oidcClientID,
+		OIDCClientSecret:  *oidcClientSecret,
+		OIDCRedirectURL:   *oidcRedirectURL,
+		OIDCAppURL:        *oidcAppURL,
+		OIDCScopes:        *oidcScopes,
+		OIDCUsernameClaim: *oidcUsernameClaim,
+		OIDCAdminGroup:    *oidcAdminGroup,
+
+		EncryptionKeys: *encryptionKeys,
+	}
+	if cfg.OIDCClientSecret == "" {
+		cfg.OIDCClientSecret = os.Getenv(OIDCClientSecretEnv)
+	}
+	if cfg.EncryptionKeys == "" {
+		cfg.EncryptionKeys = os.Getenv(EncryptionKeysEnv)
+	}
+
+	switch cfg.Storage {
+	case StorageS3, StorageFile, StorageMemory:
+	default:
+		return Config{}, fmt.Errorf("unknown storage %q, must be %q, %q or %q", cfg.Storage, StorageS3, StorageFile, StorageMemory)
+	}
+
+	switch cfg.Compression {
+	case CompressionGzip, CompressionNone:
+	default:
+		return Config{}, fmt.Errorf("unknown compression %q, must be %q or %q", cfg.Compression, CompressionGzip, CompressionNone)
+	}
+
+	if cfg.CacheSize < 0 {
+		return Config{}, fmt.Errorf("cache size %v must not be negative", cfg.CacheSize)
+	}
+	if cfg.CacheSize > 0 && cfg.CacheTTL <= 0 {
+		return Config{}, fmt.Errorf("cache ttl %v must be positive", cfg.CacheTTL)
+	}
+
+	if cfg.MaxAttachment <= 0 {
+		return Config{}, fmt.Errorf("max attachment size %v must be positive", cfg.MaxAttachment)
+	}
+
+	if cfg.TrashRetention < 0 {
+		return Config{}, fmt.Errorf("trash retention %v must not be negative", cfg.TrashRetention)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"access token ttl":  cfg.AccessTokenTTL,
+		"refresh token ttl": cfg.RefreshTokenTTL,
+		"key rotation":      cfg.KeyRotation,
+	} {
+		if d <= 0 {
+			return Config{}, fmt.Errorf("%s %v must be positive", name, d)
+		}
+	}
+
+	if cfg.OIDCIssuer != "" {
+		if cfg.OIDCClientID == "" || cfg.OIDCUsernameClaim == "" {
+			return Config{}, fmt.Errorf("oidc issuer %q needs a client id and username claim", cfg.OIDCIssuer)
+		}
+		if u, err := url.Parse(cfg.OIDCRedirectURL); err != nil || !u.IsAbs() {
+			return Config{}, fmt.Errorf("oidc redirect url %q must be an absolute url", cfg.OIDCRedirectURL)
+		}
+		if u, err := url.Parse(cfg.OIDCAppURL); err != nil || !u.IsAbs() || u.Fragment != "" {
+			return Config{}, fmt.Errorf("oidc app url %q must be an absolute url without a fragment", cfg.OIDCAppURL)
+		}
 	}
 
 	if cfg.Profile == "local" {
@@ -97,4 +265,24 @@ func init() {
 	port = flag.String("p", DefaultPort, "port for the application to listen to")
 	region = flag.String("r", DefaultRegion, "region the bucket resides in")
 	bucket = flag.String("b", DefaultBucket, "bucket name for the application to use")
+	storage = flag.String("s", DefaultStorage, "where notes are stored, either s3, file or memory")
+	dataDir = flag.String("d", DefaultDataDir, "directory notes are stored in when using file storage")
+	cacheSize = flag.Int64("cache-size", DefaultCacheSize, "roughly how many bytes of notes and indexes are cached in memory, 0 turns the cache off")
+	cacheTTL = flag.Duration("cache-ttl", DefaultCacheTTL, "how long cached notes are used before they're checked for changes")
+	maxAttachment = flag.Int64("max-attachment-size", DefaultMaxAttachment, "the largest file, in bytes, that can be attached to a note")
+	compression = flag.String("compression", DefaultCompression, "how objects are compressed when using s3 storage, either gzip or none")
+	trashRetention = flag.Duration("t", DefaultTrashRetention, "how long deleted notes are kept in the trash, 0 keeps them forever")
+	registration = flag.Bool("registration", DefaultRegistration, "let anyone create an account through the api")
+	accessTokenTTL = flag.Duration("access-token-ttl", DefaultAccessTokenTTL, "how long bearer access tokens are accepted for")
+	refreshTokenTTL = flag.Duration("refresh-token-ttl", DefaultRefreshTokenTTL, "how long a login lasts without its refresh token being used")
+	keyRotation = flag.Duration("key-rotation", DefaultKeyRotation, "how often the key access tokens are signed with is replaced")
+	oidcIssuer = flag.String("oidc-issuer", "", "url of an openid connect provider to let users log in with")
+	oidcClientID = flag.String("oidc-client-id", "", "client id registered with the openid connect provider")
+	oidcClientSecret = flag.String("oidc-client-secret", "", "client secret registered with the openid connect provider, defaults to $"+OIDCClientSecretEnv)
+	oidcRedirectURL = flag.String("oidc-redirect-url", "", "url of /api/v1/auth/oidc/callback as the provider should send users back to it")
+	oidcAppURL = flag.String("oidc-app-url", "", "url of the app users are sent back to once they've logged in, with their tokens in the fragment")
+	oidcScopes = flag.String("oidc-scopes", DefaultOIDCScopes, "space separated scopes requested from the openid connect provider")
+	oidcUsernameClaim = flag.String("oidc-username-claim", DefaultOIDCUsernameClaim, "id token claim used as the username")
+	oidcAdminGroup = flag.String("oidc-admin-group", "", "group in the id token's groups claim whose members are admins, empty leaves admins alone")
+	encryptionKeys = flag.String("encryption-keys", "", "comma separated <id>:<base64 256 bit key> pairs notes are encrypted at rest with, the first encrypts and the rest only decrypt, defaults to $"+EncryptionKeysEnv)
 }
@@ -3,6 +3,7 @@ package config_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/sksmith/note-server/config"
@@ -26,6 +27,21 @@ func TestLoadLocalConfigs(t *testing.T) {
 	expect(cfg.AppVersion, "appversion", t)
 	expect(cfg.ApplicationName, config.ApplicationName, t)
 	expect(cfg.BucketName, config.DefaultBucket, t)
+	expect(cfg.Storage, config.DefaultStorage, t)
+	expect(cfg.DataDir, config.DefaultDataDir, t)
+	expect(cfg.Compression, config.DefaultCompression, t)
+	expect(cfg.CacheSize, int64(config.DefaultCacheSize), t)
+	expect(cfg.CacheTTL, config.DefaultCacheTTL, t)
+	expect(cfg.MaxAttachment, int64(config.DefaultMaxAttachment), t)
+	expect(cfg.TrashRetention, config.DefaultTrashRetention, t)
+	expect(cfg.Registration, config.DefaultRegistration, t)
+	expect(cfg.AccessTokenTTL, config.DefaultAccessTokenTTL, t)
+	expect(cfg.RefreshTokenTTL, config.DefaultRefreshTokenTTL, t)
+	expect(cfg.KeyRotation, config.DefaultKeyRotation, t)
+	expect(cfg.OIDCIssuer, "", t)
+	expect(cfg.OIDCScopes, config.DefaultOIDCScopes, t)
+	expect(cfg.OIDCUsernameClaim, config.DefaultOIDCUsernameClaim, t)
+	expect(cfg.EncryptionKeys, "", t)
 	expect(cfg.BuildTime, "buildtime", t)
 	expect(cfg.Profile, config.DefaultProfile, t)
 	expect(cfg.Port, config.DefaultPort, t)
@@ -42,11 +58,46 @@ func TestLoadOverriddenConfigs(t *testing.T) {
 		expPort    = "9999"
 		expRegion  = "some-region"
 		expBucket  = "some-bucket"
+		expStorage = "file"
+		expDataDir = "/some/dir"
+		expTrash   = 48 * time.Hour
+		expAccess  = 5 * time.Minute
+		expRefresh = 72 * time.Hour
+		expRotate  = time.Hour
+		expIssuer  = "https://idp.example.com"
+		expClient  = "notes"
+		expSecret  = "some secret"
+		expURL     = "https://notes.example.com/api/v1/auth/oidc/callback"
+		expAppURL  = "https://notes.example.com/app/"
+		expClaim   = "email"
+		expGroup   = "admins"
+		expKeys    = "k1:MTExMTExMTExMTExMTExMTExMTExMTExMTExMTExMTE="
 	)
 	addArg("-P", expProfile)
 	addArg("-p", expPort)
 	addArg("-r", expRegion)
 	addArg("-b", expBucket)
+	addArg("-s", expStorage)
+	addArg("-d", expDataDir)
+	addArg("-compression", config.CompressionNone)
+	addArg("-cache-size", "1024")
+	addArg("-cache-ttl", "10s")
+	addArg("-max-attachment-size", "1048576")
+	addArg("-t", expTrash.String())
+	addArg("-access-token-ttl", expAccess.String())
+	addArg("-refresh-token-ttl", expRefresh.String())
+	addArg("-key-rotation", expRotate.String())
+	addArg("-oidc-issuer", expIssuer)
+	addArg("-oidc-client-id", expClient)
+	addArg("-oidc-redirect-url", expURL)
+	addArg("-oidc-app-url", expAppURL)
+	addArg("-oidc-username-claim", expClaim)
+	addArg("-oidc-admin-group", expGroup)
+	addArg("-encryption-keys", expKeys)
+	os.Setenv(config.OIDCClientSecretEnv, expSecret)
+	defer os.Unsetenv(config.OIDCClientSecretEnv)
+	// Boolean flags only take a value joined to them with =
+	os.Args = append(os.Args, "-registration=true")
 
 	config.AppVersion = "appversion"
 	config.Sha1Version = "sha1version"
@@ -60,6 +111,25 @@ func TestLoadOverriddenConfigs(t *testing.T) {
 	expect(cfg.AppVersion, "appversion", t)
 	expect(cfg.ApplicationName, config.ApplicationName, t)
 	expect(cfg.BucketName, expBucket, t)
+	expect(cfg.Storage, expStorage, t)
+	expect(cfg.DataDir, expDataDir, t)
+	expect(cfg.Compression, config.CompressionNone, t)
+	expect(cfg.CacheSize, int64(1024), t)
+	expect(cfg.CacheTTL, 10*time.Second, t)
+	expect(cfg.MaxAttachment, int64(1048576), t)
+	expect(cfg.TrashRetention, expTrash, t)
+	expect(cfg.Registration, true, t)
+	expect(cfg.AccessTokenTTL, expAccess, t)
+	expect(cfg.RefreshTokenTTL, expRefresh, t)
+	expect(cfg.KeyRotation, expRotate, t)
+	expect(cfg.OIDCIssuer, expIssuer, t)
+	expect(cfg.OIDCClientID, expClient, t)
+	expect(cfg.OIDCClientSecret, expSecret, t)
+	expect(cfg.OIDCRedirectURL, expURL, t)
+	expect(cfg.OIDCAppURL, expAppURL, t)
+	expect(cfg.OIDCUsernameClaim, expClaim, t)
+	expect(cfg.OIDCAdminGroup, expGroup, t)
+	expect(cfg.EncryptionKeys, expKeys, t)
 	expect(cfg.BuildTime, "buildtime", t)
 	expect(cfg.Profile, expProfile, t)
 	expect(cfg.Port, expPort, t)
@@ -70,6 +140,77 @@ func TestLoadOverriddenConfigs(t *testing.T) {
 	expect(cfg.LogText, config.DefaultEnvironmentLogText, t)
 }
 
+func TestLoadInvalidStorage(t *testing.T) {
+	addArg("-s", "floppy")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for an unknown storage")
+	}
+}
+
+func TestLoadInvalidCompression(t *testing.T) {
+	addArg("-s", "file")
+	addArg("-compression", "zip")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+}
+
+func TestLoadInvalidCacheTTL(t *testing.T) {
+	addArg("-compression", "gzip")
+	addArg("-cache-ttl", "0s")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for a cache ttl that isn't positive")
+	}
+}
+
+func TestLoadInvalidMaxAttachment(t *testing.T) {
+	addArg("-cache-ttl", "1m")
+	addArg("-max-attachment-size", "0")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for a max attachment size that isn't positive")
+	}
+}
+
+func TestLoadInvalidTrashRetention(t *testing.T) {
+	addArg("-max-attachment-size", "1024")
+	addArg("-t", "-1h")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for a negative trash retention")
+	}
+}
+
+func TestLoadInvalidAccessTokenTTL(t *testing.T) {
+	addArg("-t", "1h")
+	addArg("-access-token-ttl", "0s")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for an access token ttl that isn't positive")
+	}
+}
+
+func TestLoadInvalidOIDCRedirectURL(t *testing.T) {
+	addArg("-access-token-ttl", "15m")
+	addArg("-oidc-redirect-url", "/api/v1/auth/oidc/callback")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for a relative oidc redirect url")
+	}
+}
+
+func TestLoadInvalidOIDCAppURL(t *testing.T) {
+	addArg("-oidc-redirect-url", "https://notes.example.com/api/v1/auth/oidc/callback")
+	addArg("-oidc-app-url", "https://notes.example.com/#/login")
+
+	if _, err := config.LoadConfigs(); err == nil {
+		t.Errorf("expected an error for an oidc app url with a fragment")
+	}
+}
+
 func addArg(flag, value string) {
 	os.Args = append(os.Args, flag)
 	os.Args = append(os.Args, value)
@@ -0,0 +1,288 @@
+// Package apikey manages the personal API keys scripts and integrations
+// authenticate with instead of a user's password.
+//
+// A key acts as the user who made it, limited to its scope, until it expires
+// or is revoked. Only a hash of its secret is stored, the key itself is shown
+// once when it's made.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// TokenPrefix starts every key so they're easy to tell apart from other
+// tokens, and to find when they're leaked
+const TokenPrefix = "nsk_"
+
+// MaxNameLength bounds the length of a key's name in characters
+const MaxNameLength = 100
+
+// lastUsedPrecision is how stale a key's last used time can get, saving it
+// on every request would be a write per request
+const lastUsedPrecision = time.Minute
+
+// A Scope limits what a key can do
+type Scope string
+
+const (
+	// ScopeRead keys can only read
+	ScopeRead Scope = "read"
+	// ScopeWrite keys can do anything their user can except use the admin
+	// endpoints
+	ScopeWrite Scope = "write"
+	// ScopeAdmin keys can do anything their user can, only admins can make them
+	ScopeAdmin Scope = "admin"
+)
+
+// ErrInvalidKey is returned for keys that are malformed, expired, revoked or
+// whose user no longer exists
+var ErrInvalidKey = errors.New("invalid api key")
+
+// A Key belongs to the user who made it
+type Key struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"userId"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Scope      Scope      `json:"scope"`
+	SecretHash string     `json:"secretHash"`
+	Created    time.Time  `json:"created"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"`
+}
+
+// Store keeps the keys
+type Store interface {
+	SaveAPIKey(ctx context.Context, k Key) error
+	// GetAPIKey returns the key or a core.ErrNotFound
+	GetAPIKey(ctx context.Context, id string) (Key, error)
+	ListAPIKeys(ctx context.Context) ([]Key, error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	// TouchAPIKey records when the key was last used apart from the key
+	// itself, so that it can't bring back a key revoked in the meantime.
+	// GetAPIKey and ListAPIKeys return it as the key's LastUsed.
+	TouchAPIKey(ctx context.Context, id string, used time.Time) error
+}
+
+// Users looks up the users keys act as
+type Users interface {
+	Get(ctx context.Context, username string) (user.User, error)
+}
+
+func NewService(clock core.Clock, store Store, users Users) *Service {
+	return &Service{clock: clock, store: store, users: users}
+}
+
+type Service struct {
+	clock core.Clock
+	store Store
+	users Users
+}
+
+// Create makes a key for the user and returns it along with the token to
+// authenticate with, which can't be recovered later. Keys without an expiry
+// last until they're revoked.
+func (s *Service) Create(ctx context.Context, u user.User, name string, scope Scope, expires *time.Time) (Key, string, error) {
+	const funcName = "CreateAPIKey"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", u.Username).
+		Str("name", name).
+		Str("scope", string(scope)).
+		Msg("creating api key")
+
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > MaxNameLength {
+		return Key{}, "", errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("key names must be 1 to %d characters long", MaxNameLength)})
+	}
+
+	switch scope {
+	case ScopeRead, ScopeWrite:
+	case ScopeAdmin:
+		if !u.Admin {
+			return Key{}, "", errors.WithStack(&core.ErrInvalid{Reason: "only admins can make admin keys"})
+		}
+	default:
+		return Key{}, "", errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("scope must be %q, %q or %q", ScopeRead, ScopeWrite, ScopeAdmin)})
+	}
+
+	now := s.clock.Now()
+	if expires != nil && !expires.After(now) {
+		return Key{}, "", errors.WithStack(&core.ErrInvalid{Reason: "keys must expire in the future"})
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Key{}, "", errors.WithStack(err)
+	}
+	id := hex.EncodeToString(b)
+
+	b = make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Key{}, "", errors.WithStack(err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	k := Key{
+		ID:         id,
+		UserID:     u.ID,
+		Username:   u.Username,
+		Name:       name,
+		Scope:      scope,
+		SecretHash: hashSecret(secret),
+		Created:    now,
+		Expires:    expires,
+	}
+	if err := s.store.SaveAPIKey(ctx, k); err != nil {
+		return Key{}, "", errors.WithStack(err)
+	}
+
+	return k, TokenPrefix + id + "_" + secret, nil
+}
+
+// List returns the user's keys, oldest first
+func (s *Service) List(ctx context.Context, u user.User) ([]Key, error) {
+	const funcName = "ListAPIKeys"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", u.Username).
+		Msg("listing api keys")
+
+	all, err := s.store.ListAPIKeys(ctx)
+	if err != nil {
+		return []Key{}, errors.WithStack(err)
+	}
+
+	keys := make([]Key, 0)
+	for _, k := range all {
+		if k.UserID == u.ID {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys, nil
+}
+
+// Get returns one of the user's keys. Other users' keys are reported as not
+// found.
+func (s *Service) Get(ctx context.Context, u user.User, id string) (Key, error) {
+	const funcName = "GetAPIKey"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", u.Username).
+		Str("id", id).
+		Msg("getting api key")
+
+	k, err := s.store.GetAPIKey(ctx, id)
+	if err != nil {
+		return Key{}, errors.WithStack(err)
+	}
+	if k.UserID != u.ID {
+		return Key{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	return k, nil
+}
+
+// Revoke deletes one of the user's keys, it stops working straight away
+func (s *Service) Revoke(ctx context.Context, u user.User, id string) error {
+	const funcName = "RevokeAPIKey"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", u.Username).
+		Str("id", id).
+		Msg("revoking api key")
+
+	if _, err := s.Get(ctx, u, id); err != nil {
+		return err
+	}
+	return errors.WithStack(s.store.DeleteAPIKey(ctx, id))
+}
+
+// Verify returns the key for the token and the user it acts as, recording
+// when it was used
+func (s *Service) Verify(ctx context.Context, token string) (Key, user.User, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, TokenPrefix), "_", 2)
+	if !strings.HasPrefix(token, TokenPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "malformed key")
+	}
+
+	k, err := s.store.GetAPIKey(ctx, parts[0])
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "key revoked")
+		}
+		return Key{}, user.User{}, errors.WithStack(err)
+	}
+	if subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashSecret(parts[1]))) != 1 {
+		return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "wrong secret")
+	}
+
+	now := s.clock.Now()
+	if k.Expires != nil && !now.Before(*k.Expires) {
+		return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "key expired")
+	}
+
+	u, err := s.users.Get(ctx, k.Username)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "user no longer exists")
+		}
+		return Key{}, user.User{}, errors.WithStack(err)
+	}
+	if u.ID != k.UserID {
+		return Key{}, user.User{}, errors.Wrap(ErrInvalidKey, "user no longer exists")
+	}
+
+	if k.LastUsed == nil || now.Sub(*k.LastUsed) >= lastUsedPrecision {
+		k.LastUsed = &now
+		if err := s.store.TouchAPIKey(ctx, k.ID, now); err != nil {
+			log.Error().Err(err).Str("func", "VerifyAPIKey").Str("id", k.ID).Msg("failed to record when the key was used")
+		}
+	}
+
+	return k, u, nil
+}
+
+// Allows reports whether the key's scope lets it make a request with the
+// method. Admin endpoints check for ScopeAdmin themselves.
+func (k Key) Allows(method string) bool {
+	switch k.Scope {
+	case ScopeWrite, ScopeAdmin:
+		return true
+	case ScopeRead:
+		switch method {
+		case "GET", "HEAD", "OPTIONS":
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
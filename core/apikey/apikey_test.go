@@ -0,0 +1,333 @@
+package apikey_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+var (
+	alice = user.User{ID: "alice-id", Username: "alice"}
+	admin = user.User{ID: "admin-id", Username: "admin", Admin: true}
+)
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	store := newMockStore()
+	svc := apikey.NewService(clock, store, newMockUsers())
+
+	expires := clock.now.Add(time.Hour)
+	k, token, err := svc.Create(ctx, alice, " backups ", apikey.ScopeRead, &expires)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if k.ID == "" || k.UserID != alice.ID || k.Name != "backups" || k.Scope != apikey.ScopeRead || !k.Created.Equal(clock.now) {
+		t.Errorf("got=[%v] want=[alice's backups key]", k)
+	}
+	if !strings.HasPrefix(token, apikey.TokenPrefix+k.ID+"_") {
+		t.Errorf("got=[%v] want=[a token naming the key]", token)
+	}
+	secret := strings.TrimPrefix(token, apikey.TokenPrefix+k.ID+"_")
+	if saved := store.keys[k.ID]; saved.SecretHash == "" || strings.Contains(saved.SecretHash, secret) {
+		t.Errorf("expected the secret to be hashed got=[%v]", saved.SecretHash)
+	}
+
+	if _, _, err := svc.Create(ctx, admin, "admin", apikey.ScopeAdmin, nil); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+
+	past := clock.now
+	tests := []struct {
+		name    string
+		u       user.User
+		keyName string
+		scope   apikey.Scope
+		expires *time.Time
+	}{
+		{name: "Empty Name", u: alice, keyName: " ", scope: apikey.ScopeRead},
+		{name: "Long Name", u: alice, keyName: strings.Repeat("a", apikey.MaxNameLength+1), scope: apikey.ScopeRead},
+		{name: "Unknown Scope", u: alice, keyName: "key", scope: "everything"},
+		{name: "Admin Scope", u: alice, keyName: "key", scope: apikey.ScopeAdmin},
+		{name: "Expired", u: alice, keyName: "key", scope: apikey.ScopeRead, expires: &past},
+	}
+
+	for _, test := range tests {
+		if _, _, err := svc.Create(ctx, test.u, test.keyName, test.scope, test.expires); !core.IsErrInvalid(err) {
+			t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+		}
+	}
+}
+
+func TestListAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	svc := apikey.NewService(clock, newMockStore(), newMockUsers())
+
+	first := mustCreate(t, svc, alice, apikey.ScopeRead)
+	clock.now = clock.now.Add(time.Second)
+	second := mustCreate(t, svc, alice, apikey.ScopeWrite)
+	theirs := mustCreate(t, svc, admin, apikey.ScopeWrite)
+
+	expectKeys(t, svc, alice, first, second)
+	if _, err := svc.Get(ctx, alice, theirs.ID); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if err := svc.Revoke(ctx, alice, theirs.ID); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	if err := svc.Revoke(ctx, alice, first.ID); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectKeys(t, svc, alice, second)
+	expectKeys(t, svc, admin, theirs)
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	store := newMockStore()
+	users := newMockUsers()
+	svc := apikey.NewService(clock, store, users)
+
+	expires := clock.now.Add(time.Hour)
+	k, token, err := svc.Create(ctx, alice, "backups", apikey.ScopeRead, &expires)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, u, err := svc.Verify(ctx, token)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.ID != k.ID || u.ID != alice.ID {
+		t.Errorf("got=[%v %v] want=[alice's key]", got, u)
+	}
+	if used, ok := store.used[k.ID]; !ok || !used.Equal(clock.now) {
+		t.Errorf("got=[%v] want=[%v]", used, clock.now)
+	}
+
+	// The last use is only saved once it's a minute out of date
+	clock.now = clock.now.Add(time.Second)
+	if _, _, err := svc.Verify(ctx, token); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if used := store.used[k.ID]; !used.Equal(clock.now.Add(-time.Second)) {
+		t.Errorf("got=[%v] want=[%v]", used, clock.now.Add(-time.Second))
+	}
+
+	id := strings.SplitN(strings.TrimPrefix(token, apikey.TokenPrefix), "_", 2)[0]
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "Empty", token: ""},
+		{name: "No Prefix", token: strings.TrimPrefix(token, apikey.TokenPrefix)},
+		{name: "No Secret", token: apikey.TokenPrefix + id},
+		{name: "Wrong Secret", token: apikey.TokenPrefix + id + "_wrong"},
+		{name: "Unknown Key", token: apikey.TokenPrefix + "unknown_secret"},
+	}
+
+	for _, test := range tests {
+		if _, _, err := svc.Verify(ctx, test.token); errors.Cause(err) != apikey.ErrInvalidKey {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, err, apikey.ErrInvalidKey)
+		}
+	}
+
+	clock.now = expires
+	if _, _, err := svc.Verify(ctx, token); errors.Cause(err) != apikey.ErrInvalidKey {
+		t.Errorf("expired: got=[%v] want=[%v]", err, apikey.ErrInvalidKey)
+	}
+}
+
+func TestVerifyRevokedAndDeletedUser(t *testing.T) {
+	ctx := context.Background()
+	users := newMockUsers()
+	svc := apikey.NewService(newClock(), newMockStore(), users)
+
+	revoked, token, err := svc.Create(ctx, alice, "revoked", apikey.ScopeWrite, nil)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := svc.Revoke(ctx, alice, revoked.ID); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, _, err := svc.Verify(ctx, token); errors.Cause(err) != apikey.ErrInvalidKey {
+		t.Errorf("revoked: got=[%v] want=[%v]", err, apikey.ErrInvalidKey)
+	}
+
+	_, token, err = svc.Create(ctx, alice, "orphaned", apikey.ScopeWrite, nil)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	delete(users.users, alice.Username)
+	if _, _, err := svc.Verify(ctx, token); errors.Cause(err) != apikey.ErrInvalidKey {
+		t.Errorf("deleted user: got=[%v] want=[%v]", err, apikey.ErrInvalidKey)
+	}
+}
+
+// A key revoked while it's being verified must stay revoked once its use has
+// been recorded
+func TestVerifyRevokedDuringVerify(t *testing.T) {
+	ctx := context.Background()
+	store := newMockStore()
+	svc := apikey.NewService(newClock(), store, newMockUsers())
+
+	k, token, err := svc.Create(ctx, alice, "revoked", apikey.ScopeWrite, nil)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	store.afterGet = func() {
+		store.afterGet = nil
+		if err := svc.Revoke(ctx, alice, k.ID); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	_, _, _ = svc.Verify(ctx, token)
+	if _, ok := store.keys[k.ID]; ok {
+		t.Errorf("got=[%v] want=[the key to stay revoked]", store.keys[k.ID])
+	}
+	if _, _, err := svc.Verify(ctx, token); errors.Cause(err) != apikey.ErrInvalidKey {
+		t.Errorf("got=[%v] want=[%v]", err, apikey.ErrInvalidKey)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		scope  apikey.Scope
+		method string
+		want   bool
+	}{
+		{scope: apikey.ScopeRead, method: "GET", want: true},
+		{scope: apikey.ScopeRead, method: "HEAD", want: true},
+		{scope: apikey.ScopeRead, method: "POST", want: false},
+		{scope: apikey.ScopeRead, method: "DELETE", want: false},
+		{scope: apikey.ScopeWrite, method: "PUT", want: true},
+		{scope: apikey.ScopeAdmin, method: "DELETE", want: true},
+		{scope: "unknown", method: "GET", want: false},
+	}
+
+	for _, test := range tests {
+		if got := (apikey.Key{Scope: test.scope}).Allows(test.method); got != test.want {
+			t.Errorf("%v %v: got=[%v] want=[%v]", test.scope, test.method, got, test.want)
+		}
+	}
+}
+
+func mustCreate(t *testing.T, svc *apikey.Service, u user.User, scope apikey.Scope) apikey.Key {
+	t.Helper()
+	k, _, err := svc.Create(context.Background(), u, "key", scope, nil)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return k
+}
+
+func expectKeys(t *testing.T, svc *apikey.Service, u user.User, want ...apikey.Key) {
+	t.Helper()
+	keys, err := svc.List(context.Background(), u)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got=[%v] want=[%v]", keys, want)
+	}
+	for i := range want {
+		if keys[i].ID != want[i].ID {
+			t.Errorf("got=[%v] want=[%v]", keys[i].ID, want[i].ID)
+		}
+	}
+}
+
+type stepClock struct {
+	now time.Time
+}
+
+func newClock() *stepClock {
+	return &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+type mockStore struct {
+	keys map[string]apikey.Key
+	used map[string]time.Time
+
+	// afterGet is called once a key has been read
+	afterGet func()
+}
+
+func newMockStore() *mockStore {
+	return &mockStore{keys: make(map[string]apikey.Key), used: make(map[string]time.Time)}
+}
+
+func (m *mockStore) SaveAPIKey(_ context.Context, k apikey.Key) error {
+	m.keys[k.ID] = k
+	return nil
+}
+
+func (m *mockStore) GetAPIKey(_ context.Context, id string) (apikey.Key, error) {
+	k, ok := m.keys[id]
+	if !ok {
+		return apikey.Key{}, &core.ErrNotFound{}
+	}
+	if used, ok := m.used[id]; ok {
+		k.LastUsed = &used
+	}
+	if m.afterGet != nil {
+		m.afterGet()
+	}
+	return k, nil
+}
+
+func (m *mockStore) ListAPIKeys(_ context.Context) ([]apikey.Key, error) {
+	keys := make([]apikey.Key, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m *mockStore) DeleteAPIKey(_ context.Context, id string) error {
+	delete(m.keys, id)
+	delete(m.used, id)
+	return nil
+}
+
+func (m *mockStore) TouchAPIKey(_ context.Context, id string, used time.Time) error {
+	m.used[id] = used
+	return nil
+}
+
+type mockUsers struct {
+	users map[string]user.User
+}
+
+func newMockUsers() *mockUsers {
+	return &mockUsers{users: map[string]user.User{alice.Username: alice, admin.Username: admin}}
+}
+
+func (m *mockUsers) Get(_ context.Context, username string) (user.User, error) {
+	u, ok := m.users[username]
+	if !ok {
+		return user.User{}, &core.ErrNotFound{}
+	}
+	return u, nil
+}
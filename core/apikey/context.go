@@ -0,0 +1,18 @@
+package apikey
+
+import "context"
+
+type ctxKey struct{}
+
+// NewContext returns a copy of the context carrying the key the request was
+// authenticated with
+func NewContext(ctx context.Context, k Key) context.Context {
+	return context.WithValue(ctx, ctxKey{}, k)
+}
+
+// FromContext returns the key carried by the context, if the request was
+// authenticated with one
+func FromContext(ctx context.Context) (Key, bool) {
+	k, ok := ctx.Value(ctxKey{}).(Key)
+	return k, ok
+}
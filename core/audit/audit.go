@@ -0,0 +1,160 @@
+// Package audit keeps an append-only record of who changed which note, when,
+// from where and what the note was before and after.
+//
+// Events are only ever appended, nothing in the server updates or deletes
+// them. Each carries hashes of the note rather than its contents so the log
+// can show a note changed without keeping a copy of it.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// An Action is what was done to a note
+type Action string
+
+const (
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionTrash   Action = "trash"
+	ActionRestore Action = "restore"
+	ActionPurge   Action = "purge"
+	// ActionDelete is a note deleted for good by storage without a trash
+	ActionDelete Action = "delete"
+	// ActionAdopt is a note moved into a user's namespace by the adopt command
+	ActionAdopt Action = "adopt"
+)
+
+// An Event is a single change to a note. Events without an actor were made
+// by the server itself, such as purging expired notes from the trash. Before
+// and After are hashes of the note, empty when it didn't exist.
+type Event struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	ActorID   string    `json:"actorId,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	APIKeyID  string    `json:"apiKeyId,omitempty"`
+	Action    Action    `json:"action"`
+	OwnerID   string    `json:"ownerId"`
+	NoteID    string    `json:"noteId"`
+	RequestID string    `json:"requestId,omitempty"`
+	SourceIP  string    `json:"sourceIp,omitempty"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+}
+
+// Store keeps the events. It must never change or remove an event once it's
+// appended.
+type Store interface {
+	AppendAuditEvent(ctx context.Context, e Event) error
+	// ListAuditEvents returns the events recorded from (inclusive) to
+	// (exclusive) in any order, a zero time leaves that end of the range open
+	ListAuditEvents(ctx context.Context, from, to time.Time) ([]Event, error)
+}
+
+// Filter narrows down the events that are listed. Zero values match
+// everything.
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Actor  string
+	NoteID string
+}
+
+type Service struct {
+	clock core.Clock
+	store Store
+}
+
+func NewService(clock core.Clock, store Store) *Service {
+	return &Service{clock: clock, store: store}
+}
+
+// Record appends the event, filling in its ID, time, and the actor and
+// request from the context
+func (s *Service) Record(ctx context.Context, e Event) error {
+	id, err := randomID()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	e.ID = id
+	e.Time = s.clock.Now()
+
+	if u, ok := user.FromContext(ctx); ok {
+		e.ActorID = u.ID
+		e.Actor = u.Username
+	}
+	if k, ok := apikey.FromContext(ctx); ok {
+		e.APIKeyID = k.ID
+	}
+	if r, ok := RequestFromContext(ctx); ok {
+		e.RequestID = r.ID
+		e.SourceIP = r.SourceIP
+	}
+
+	return errors.WithStack(s.store.AppendAuditEvent(ctx, e))
+}
+
+// List returns the events between startIdx (inclusive) and endIdx (exclusive)
+// of those matching the filter, oldest first, along with how many match. An
+// endIdx of zero or less means the end of the list.
+func (s *Service) List(ctx context.Context, f Filter, startIdx, endIdx int) ([]Event, int, error) {
+	const funcName = "ListAuditEvents"
+
+	log.Info().
+		Str("func", funcName).
+		Time("from", f.From).
+		Time("to", f.To).
+		Str("actor", f.Actor).
+		Str("noteId", f.NoteID).
+		Msg("listing audit events")
+
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return []Event{}, 0, errors.WithStack(&core.ErrInvalid{Reason: "from must be before to"})
+	}
+
+	all, err := s.store.ListAuditEvents(ctx, f.From, f.To)
+	if err != nil {
+		return []Event{}, 0, errors.WithStack(err)
+	}
+
+	events := make([]Event, 0, len(all))
+	for _, e := range all {
+		if (f.Actor == "" || e.Actor == f.Actor) && (f.NoteID == "" || e.NoteID == f.NoteID) {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Time.Equal(events[j].Time) {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	total := len(events)
+	if startIdx > total {
+		startIdx = total
+	}
+	if endIdx <= 0 || endIdx > total {
+		endIdx = total
+	}
+	return events[startIdx:endIdx], total, nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,129 @@
+package audit_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+func TestRecord(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	store := &mockStore{}
+	svc := audit.NewService(clock, store)
+
+	ctx := user.NewContext(context.Background(), user.User{ID: "alice-id", Username: "alice"})
+	ctx = apikey.NewContext(ctx, apikey.Key{ID: "key-id"})
+	ctx = audit.NewContext(ctx, audit.Request{ID: "host/1", SourceIP: "192.0.2.1"})
+
+	e := audit.Event{ID: "ignored", Action: audit.ActionUpdate, OwnerID: "bob-id", NoteID: "1", Before: "a", After: "b"}
+	if err := svc.Record(ctx, e); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := svc.Record(context.Background(), audit.Event{Action: audit.ActionPurge, OwnerID: "bob-id", NoteID: "2"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if len(store.events) != 2 {
+		t.Fatalf("got=[%v] want=[2 events]", store.events)
+	}
+	got := store.events[0]
+	if got.ID == "" || got.ID == "ignored" || got.ID == store.events[1].ID || !got.Time.Equal(clock.now) {
+		t.Errorf("got=[%v] want=[a new id and the current time]", got)
+	}
+	want := audit.Event{
+		ID: got.ID, Time: clock.now, ActorID: "alice-id", Actor: "alice", APIKeyID: "key-id", Action: audit.ActionUpdate,
+		OwnerID: "bob-id", NoteID: "1", RequestID: "host/1", SourceIP: "192.0.2.1", Before: "a", After: "b",
+	}
+	if got != want {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+	if system := store.events[1]; system.ActorID != "" || system.RequestID != "" {
+		t.Errorf("got=[%v] want=[an event without an actor or request]", system)
+	}
+}
+
+func TestList(t *testing.T) {
+	start := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	store := &mockStore{events: []audit.Event{
+		{ID: "c", Time: start.Add(2 * time.Hour), Actor: "alice", NoteID: "2"},
+		{ID: "a", Time: start, Actor: "alice", NoteID: "1"},
+		{ID: "d", Time: start.Add(3 * time.Hour), Actor: "bob", NoteID: "1"},
+		{ID: "b", Time: start.Add(time.Hour), Actor: "bob", NoteID: "1"},
+	}}
+	svc := audit.NewService(&stepClock{}, store)
+
+	tests := []struct {
+		name      string
+		filter    audit.Filter
+		start     int
+		end       int
+		want      []string
+		wantTotal int
+	}{
+		{name: "All", want: []string{"a", "b", "c", "d"}, wantTotal: 4},
+		{name: "Range", filter: audit.Filter{From: start.Add(time.Hour), To: start.Add(3 * time.Hour)}, want: []string{"b", "c"}, wantTotal: 2},
+		{name: "Actor", filter: audit.Filter{Actor: "bob"}, want: []string{"b", "d"}, wantTotal: 2},
+		{name: "Note", filter: audit.Filter{NoteID: "1"}, want: []string{"a", "b", "d"}, wantTotal: 3},
+		{name: "Page", start: 1, end: 3, want: []string{"b", "c"}, wantTotal: 4},
+		{name: "Past The End", start: 5, end: 10, want: []string{}, wantTotal: 4},
+	}
+
+	for _, test := range tests {
+		events, total, err := svc.List(context.Background(), test.filter, test.start, test.end)
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		got := make([]string, 0, len(events))
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) || total != test.wantTotal {
+			t.Errorf("%v: got=[%v %v] want=[%v %v]", test.name, got, total, test.want, test.wantTotal)
+		}
+	}
+
+	_, _, err := svc.List(context.Background(), audit.Filter{From: start, To: start}, 0, 0)
+	if !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+}
+
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+type mockStore struct {
+	events []audit.Event
+}
+
+func (m *mockStore) AppendAuditEvent(_ context.Context, e audit.Event) error {
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *mockStore) ListAuditEvents(_ context.Context, from, to time.Time) ([]audit.Event, error) {
+	events := make([]audit.Event, 0, len(m.events))
+	for _, e := range m.events {
+		if (from.IsZero() || !e.Time.Before(from)) && (to.IsZero() || e.Time.Before(to)) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,23 @@
+package audit
+
+import "context"
+
+// Request is where a change came from
+type Request struct {
+	ID       string
+	SourceIP string
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of the context carrying the request that events
+// recorded with it are attributed to
+func NewContext(ctx context.Context, r Request) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// RequestFromContext returns the request carried by the context, if any
+func RequestFromContext(ctx context.Context) (Request, bool) {
+	r, ok := ctx.Value(ctxKey{}).(Request)
+	return r, ok
+}
@@ -0,0 +1,527 @@
+// Package auth issues and checks the bearer tokens users can authenticate with
+// instead of sending their password on every request.
+//
+// Logging in starts a session and returns a short lived JWT access token along
+// with a refresh token. The refresh token is exchanged for new tokens, and a
+// new refresh token, until the session expires or is ended by logging out.
+// Access tokens are only accepted while their session lasts, so logging out
+// revokes both, as does the user changing their password.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+	"github.com/sksmith/note-server/internal/lock"
+)
+
+// Issuer is the iss claim of every access token
+const Issuer = "note-server"
+
+// keysRefetch is how often a token signed by an unknown key can make the keys
+// be loaded again. It's how long a key made by another server can take to be
+// accepted, and stops tokens with made up key IDs loading them on every
+// request.
+const keysRefetch = 5 * time.Second
+
+var (
+	// ErrInvalidCredentials is returned when logging in with the wrong username
+	// or password
+	ErrInvalidCredentials = errors.New("invalid username or password")
+
+	// ErrInvalidToken is returned for tokens that are malformed, expired,
+	// signed by an unknown key or whose session has ended
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Config sets how long tokens last and how often the key they're signed with
+// is replaced
+type Config struct {
+	AccessTTL   time.Duration
+	RefreshTTL  time.Duration
+	KeyRotation time.Duration
+}
+
+// A SigningKey signs access tokens, which name it in their kid header
+type SigningKey struct {
+	ID      string    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// A Session is started by logging in. Only a hash of its refresh token's
+// secret is stored.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Username   string    `json:"username"`
+	SecretHash string    `json:"secretHash"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Store keeps the signing keys and sessions
+type Store interface {
+	SaveSigningKey(ctx context.Context, k SigningKey) error
+	ListSigningKeys(ctx context.Context) ([]SigningKey, error)
+	DeleteSigningKey(ctx context.Context, id string) error
+
+	SaveSession(ctx context.Context, s Session) error
+	// GetSession returns the session or a core.ErrNotFound
+	GetSession(ctx context.Context, id string) (Session, error)
+	DeleteSession(ctx context.Context, id string) error
+}
+
+// Users checks passwords and looks up the users tokens are issued to
+type Users interface {
+	Auth(ctx context.Context, username, password string) (user.User, bool)
+	Get(ctx context.Context, username string) (user.User, error)
+}
+
+// Tokens are issued by logging in or refreshing
+type Tokens struct {
+	AccessToken  string
+	ExpiresIn    time.Duration
+	RefreshToken string
+}
+
+type claims struct {
+	Username  string `json:"name"`
+	Admin     bool   `json:"admin,omitempty"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+func NewService(clock core.Clock, cfg Config, store Store, users Users) *Service {
+	return &Service{clock: clock, cfg: cfg, store: store, users: users}
+}
+
+type Service struct {
+	clock core.Clock
+	cfg   Config
+	store Store
+	users Users
+
+	// mu guards keys, which are newest first and nil until they're loaded,
+	// along with when they were last loaded and how many times they've been
+	// replaced
+	mu          sync.Mutex
+	keys        []SigningKey
+	keysLoaded  time.Time
+	keysVersion int
+
+	// sessions serializes using a refresh token so that it can only be
+	// exchanged once, and a session that's ended stays ended
+	sessions lock.KeyedMutex
+}
+
+// Login starts a session for the user if the password is theirs
+func (s *Service) Login(ctx context.Context, username, password string) (Tokens, error) {
+	const funcName = "Login"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", username).
+		Msg("logging in")
+
+	u, ok := s.users.Auth(ctx, username, password)
+	if !ok {
+		return Tokens{}, errors.WithStack(ErrInvalidCredentials)
+	}
+
+	return s.start(ctx, u)
+}
+
+// Start begins a session for a user who has already been authenticated some
+// other way, such as through an OpenID Connect provider.
+func (s *Service) Start(ctx context.Context, u user.User) (Tokens, error) {
+	const funcName = "Start"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", u.Username).
+		Msg("starting session")
+
+	return s.start(ctx, u)
+}
+
+func (s *Service) start(ctx context.Context, u user.User) (Tokens, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+
+	now := s.clock.Now()
+	sess := Session{
+		ID:         id,
+		UserID:     u.ID,
+		Username:   u.Username,
+		SecretHash: hashSecret(secret),
+		Created:    now,
+		Expires:    now.Add(s.cfg.RefreshTTL),
+	}
+	if err = s.store.SaveSession(ctx, sess); err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+
+	return s.issue(ctx, sess, secret, u)
+}
+
+// Refresh exchanges a refresh token for new tokens. The refresh token can
+// only be used once, using it again ends the session in case it was stolen.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	const funcName = "Refresh"
+
+	log.Info().
+		Str("func", funcName).
+		Msg("refreshing tokens")
+
+	unlock := s.lockSession(refreshToken)
+	defer unlock()
+
+	sess, err := s.session(ctx, refreshToken)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	// The user may have been changed since they logged in
+	u, err := s.users.Get(ctx, sess.Username)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Tokens{}, s.endSession(ctx, sess.ID)
+		}
+		return Tokens{}, errors.WithStack(err)
+	}
+	if revoked(sess, u) {
+		return Tokens{}, s.endSession(ctx, sess.ID)
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+	sess.SecretHash = hashSecret(secret)
+	sess.Expires = s.clock.Now().Add(s.cfg.RefreshTTL)
+	if err = s.store.SaveSession(ctx, sess); err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+
+	return s.issue(ctx, sess, secret, u)
+}
+
+// Logout ends the refresh token's session, after which neither it nor the
+// access tokens issued for it are accepted
+func (s *Service) Logout(ctx context.Context, refreshToken string) error {
+	const funcName = "Logout"
+
+	log.Info().
+		Str("func", funcName).
+		Msg("logging out")
+
+	unlock := s.lockSession(refreshToken)
+	defer unlock()
+
+	sess, err := s.session(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(s.store.DeleteSession(ctx, sess.ID))
+}
+
+// Verify returns the user the access token was issued to
+func (s *Service) Verify(ctx context.Context, accessToken string) (user.User, error) {
+	c := &claims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithoutClaimsValidation())
+	_, err := parser.ParseWithClaims(accessToken, c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return s.verificationKey(ctx, kid)
+	})
+	if err != nil {
+		return user.User{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	// Expiry is checked against our own clock rather than the jwt package's
+	if c.Issuer != Issuer || c.ExpiresAt == nil || !s.clock.Now().Before(c.ExpiresAt.Time) {
+		return user.User{}, errors.Wrap(ErrInvalidToken, "token expired")
+	}
+
+	sess, err := s.store.GetSession(ctx, c.SessionID)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return user.User{}, errors.Wrap(ErrInvalidToken, "session ended")
+		}
+		return user.User{}, errors.WithStack(err)
+	}
+	if sess.UserID != c.Subject {
+		return user.User{}, errors.Wrap(ErrInvalidToken, "session belongs to someone else")
+	}
+
+	u, err := s.users.Get(ctx, sess.Username)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return user.User{}, errors.Wrap(ErrInvalidToken, "user no longer exists")
+		}
+		return user.User{}, errors.WithStack(err)
+	}
+	if u.ID != c.Subject {
+		return user.User{}, errors.Wrap(ErrInvalidToken, "user no longer exists")
+	}
+	if revoked(sess, u) {
+		return user.User{}, errors.Wrap(ErrInvalidToken, "password changed")
+	}
+	return u, nil
+}
+
+// revoked reports whether the user changed their password after logging in to
+// the session
+func revoked(sess Session, u user.User) bool {
+	return u.PasswordChanged != nil && sess.Created.Before(*u.PasswordChanged)
+}
+
+// issue signs an access token for the session and pairs it with the refresh
+// token made from the session's secret
+func (s *Service) issue(ctx context.Context, sess Session, secret string, u user.User) (Tokens, error) {
+	key, err := s.signingKey(ctx)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := s.clock.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Username:  u.Username,
+		Admin:     u.Admin,
+		SessionID: sess.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Subject:   u.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.AccessTTL)),
+		},
+	})
+	t.Header["kid"] = key.ID
+
+	signed, err := t.SignedString(key.Secret)
+	if err != nil {
+		return Tokens{}, errors.WithStack(err)
+	}
+
+	return Tokens{AccessToken: signed, ExpiresIn: s.cfg.AccessTTL, RefreshToken: sess.ID + "." + secret}, nil
+}
+
+// lockSession locks the session of a refresh token, the store can't check
+// that a session is unchanged when it's saved so tokens are only used one at a
+// time within this process
+func (s *Service) lockSession(refreshToken string) func() {
+	return s.sessions.Lock(strings.SplitN(refreshToken, ".", 2)[0])
+}
+
+// session returns the session of a refresh token, which is its session's ID
+// and secret joined by a dot
+func (s *Service) session(ctx context.Context, refreshToken string) (Session, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Session{}, errors.Wrap(ErrInvalidToken, "malformed refresh token")
+	}
+
+	sess, err := s.store.GetSession(ctx, parts[0])
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Session{}, errors.Wrap(ErrInvalidToken, "session ended")
+		}
+		return Session{}, errors.WithStack(err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sess.SecretHash), []byte(hashSecret(parts[1]))) != 1 {
+		log.Warn().Str("session", sess.ID).Str("username", sess.Username).Msg("refresh token reused, ending the session")
+		return Session{}, s.endSession(ctx, sess.ID)
+	}
+	if !s.clock.Now().Before(sess.Expires) {
+		return Session{}, s.endSession(ctx, sess.ID)
+	}
+
+	return sess, nil
+}
+
+// endSession deletes the session and returns ErrInvalidToken for the token
+// that led to it
+func (s *Service) endSession(ctx context.Context, id string) error {
+	if err := s.store.DeleteSession(ctx, id); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrap(ErrInvalidToken, "session ended")
+}
+
+// signingKey returns the newest key, replacing it when it's older than the
+// key rotation
+func (s *Service) signingKey(ctx context.Context) (SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		if err := s.loadKeys(ctx); err != nil {
+			return SigningKey{}, err
+		}
+	}
+
+	now := s.clock.Now()
+	if len(s.keys) > 0 && now.Sub(s.keys[0].Created) < s.cfg.KeyRotation {
+		return s.keys[0], nil
+	}
+
+	// Another server may have replaced it already
+	if err := s.loadKeys(ctx); err != nil {
+		return SigningKey{}, err
+	}
+	if len(s.keys) > 0 && now.Sub(s.keys[0].Created) < s.cfg.KeyRotation {
+		return s.keys[0], nil
+	}
+
+	return s.rotate(ctx, now)
+}
+
+// rotate adds a new signing key. Keys replaced for longer than an access
+// token lasts can't have signed a token that's still valid and are deleted.
+func (s *Service) rotate(ctx context.Context, now time.Time) (SigningKey, error) {
+	const funcName = "RotateKey"
+
+	id, err := randomString(8)
+	if err != nil {
+		return SigningKey{}, errors.WithStack(err)
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return SigningKey{}, errors.WithStack(err)
+	}
+
+	key := SigningKey{ID: id, Secret: secret, Created: now}
+	if err = s.store.SaveSigningKey(ctx, key); err != nil {
+		return SigningKey{}, errors.WithStack(err)
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("kid", key.ID).
+		Msg("rotated signing key")
+
+	keys := []SigningKey{key}
+	replaced := now
+	for _, k := range s.keys {
+		if now.Sub(replaced) > s.cfg.AccessTTL {
+			if err := s.store.DeleteSigningKey(ctx, k.ID); err != nil {
+				log.Error().Err(err).Str("func", funcName).Str("kid", k.ID).Msg("failed to delete signing key")
+				keys = append(keys, k)
+			}
+		} else {
+			keys = append(keys, k)
+		}
+		replaced = k.Created
+	}
+	s.keys = keys
+	s.keysVersion++
+
+	return key, nil
+}
+
+// verificationKey returns the secret of the key named by a token's kid,
+// looking for keys added by other servers when it isn't one we know of. The
+// keys are loaded without holding mu so that verifying other tokens, and
+// issuing them, doesn't wait on the store.
+func (s *Service) verificationKey(ctx context.Context, kid string) ([]byte, error) {
+	s.mu.Lock()
+	if secret, ok := findKey(s.keys, kid); ok {
+		s.mu.Unlock()
+		return secret, nil
+	}
+	now := s.clock.Now()
+	if !s.keysLoaded.IsZero() && now.Sub(s.keysLoaded) < keysRefetch {
+		s.mu.Unlock()
+		return nil, errors.Errorf("unknown signing key %q", kid)
+	}
+	s.keysLoaded = now
+	version := s.keysVersion
+	s.mu.Unlock()
+
+	keys, err := s.listKeys(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("kid", kid).Msg("failed to load signing keys")
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The keys may have been rotated while these were loading, in which case
+	// they're newer than what was loaded
+	if s.keysVersion == version {
+		s.keys = keys
+		s.keysVersion++
+	}
+	if secret, ok := findKey(keys, kid); ok {
+		return secret, nil
+	}
+	return nil, errors.Errorf("unknown signing key %q", kid)
+}
+
+func findKey(keys []SigningKey, kid string) ([]byte, bool) {
+	for _, k := range keys {
+		if k.ID == kid {
+			return k.Secret, true
+		}
+	}
+	return nil, false
+}
+
+// loadKeys must be called with mu held
+func (s *Service) loadKeys(ctx context.Context) error {
+	keys, err := s.listKeys(ctx)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.keysLoaded = s.clock.Now()
+	s.keysVersion++
+	return nil
+}
+
+// listKeys returns the keys in the store, newest first
+func (s *Service) listKeys(ctx context.Context) ([]SigningKey, error) {
+	keys, err := s.store.ListSigningKeys(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns size random bytes, base64 encoded for use in urls
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
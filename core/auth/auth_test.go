@@ -0,0 +1,501 @@
+package auth_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+var cfg = auth.Config{AccessTTL: 15 * time.Minute, RefreshTTL: 24 * time.Hour, KeyRotation: time.Hour}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	svc := auth.NewService(newClock(), cfg, newMockStore(), newMockUsers())
+
+	if _, err := svc.Login(ctx, "test", "wrong"); errors.Cause(err) != auth.ErrInvalidCredentials {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidCredentials)
+	}
+
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.ExpiresIn != cfg.AccessTTL {
+		t.Errorf("got=[%v] want=[tokens lasting %v]", tokens, cfg.AccessTTL)
+	}
+
+	u := expectVerified(t, svc, tokens.AccessToken)
+	if u.ID != "test-id" || u.Username != "test" {
+		t.Errorf("got=[%v] want=[test]", u)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(tokens.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	if parsed.Header["kid"] == nil || parsed.Header["alg"] != "HS256" || claims["sub"] != "test-id" || claims["iss"] != auth.Issuer {
+		t.Errorf("got=[%v %v] want=[an HS256 token for test-id naming its key]", parsed.Header, claims)
+	}
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+	users := newMockUsers()
+	users.users["sso"] = user.User{ID: "sso-id", Username: "sso", Subject: "https://idp sso"}
+	svc := auth.NewService(newClock(), cfg, newMockStore(), users)
+
+	tokens, err := svc.Start(ctx, users.users["sso"])
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if u := expectVerified(t, svc, tokens.AccessToken); u.ID != "sso-id" {
+		t.Errorf("got=[%v] want=[sso]", u)
+	}
+	if _, err := svc.Refresh(ctx, tokens.RefreshToken); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ctx := context.Background()
+	svc := auth.NewService(newClock(), cfg, newMockStore(), newMockUsers())
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	parts := strings.Split(tokens.AccessToken, ".")
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "test-id", "iss": auth.Issuer}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	unknownKey := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "test-id", "iss": auth.Issuer})
+	unknownKey.Header["kid"] = "unknown"
+	forged, _ := unknownKey.SignedString([]byte("secret"))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "Empty", token: ""},
+		{name: "Malformed", token: "not.a.token"},
+		{name: "Tampered", token: parts[0] + "." + parts[1] + "x." + parts[2]},
+		{name: "Bad Signature", token: parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))},
+		{name: "Unsigned", token: unsigned},
+		{name: "Unknown Key", token: forged},
+		{name: "Refresh Token", token: tokens.RefreshToken},
+	}
+
+	for _, test := range tests {
+		if _, err := svc.Verify(ctx, test.token); errors.Cause(err) != auth.ErrInvalidToken {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, err, auth.ErrInvalidToken)
+		}
+	}
+}
+
+func TestAccessTokenExpires(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	svc := auth.NewService(clock, cfg, newMockStore(), newMockUsers())
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	clock.now = clock.now.Add(cfg.AccessTTL - time.Second)
+	expectVerified(t, svc, tokens.AccessToken)
+
+	clock.now = clock.now.Add(time.Second)
+	expectInvalid(t, svc, tokens.AccessToken)
+}
+
+// A refresh token can be used once, using it again ends its session
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	users := newMockUsers()
+	svc := auth.NewService(clock, cfg, newMockStore(), users)
+	first, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	users.users["test"] = user.User{ID: "test-id", Username: "test", Admin: true}
+	second, err := svc.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Errorf("expected new tokens got=[%v]", second)
+	}
+	if u := expectVerified(t, svc, second.AccessToken); !u.Admin {
+		t.Errorf("expected the user to be read again got=[%v]", u)
+	}
+
+	if _, err := svc.Refresh(ctx, first.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+	if _, err := svc.Refresh(ctx, second.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+	expectInvalid(t, svc, second.AccessToken)
+
+	for _, token := range []string{"", "nodot", ".secret", "missing.secret"} {
+		if _, err := svc.Refresh(ctx, token); errors.Cause(err) != auth.ErrInvalidToken {
+			t.Errorf("%q: got=[%v] want=[%v]", token, err, auth.ErrInvalidToken)
+		}
+	}
+}
+
+// Using a refresh token twice at once only gets one set of new tokens
+func TestRefreshConcurrently(t *testing.T) {
+	ctx := context.Background()
+	store := newMockStore()
+	svc := auth.NewService(newClock(), cfg, store, newMockUsers())
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	const attempts = 10
+	var wg sync.WaitGroup
+	refreshed := make(chan auth.Tokens, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := svc.Refresh(ctx, tokens.RefreshToken); err == nil {
+				refreshed <- got
+			}
+		}()
+	}
+	wg.Wait()
+	close(refreshed)
+
+	if len(refreshed) != 1 {
+		t.Fatalf("got=[%v] want=[1 refresh]", len(refreshed))
+	}
+	// The reuse ended the session, the tokens that were issued with it too
+	second := <-refreshed
+	if _, err := svc.Refresh(ctx, second.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("got=[%v] want=[no sessions]", store.sessions)
+	}
+}
+
+func TestRefreshExpires(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	svc := auth.NewService(clock, cfg, newMockStore(), newMockUsers())
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	clock.now = clock.now.Add(cfg.RefreshTTL)
+	if _, err := svc.Refresh(ctx, tokens.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	svc := auth.NewService(newClock(), cfg, newMockStore(), newMockUsers())
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	other, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if err := svc.Logout(ctx, tokens.RefreshToken); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectInvalid(t, svc, tokens.AccessToken)
+	if _, err := svc.Refresh(ctx, tokens.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+	if err := svc.Logout(ctx, tokens.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+
+	// Other sessions carry on
+	expectVerified(t, svc, other.AccessToken)
+}
+
+func TestDeletedUser(t *testing.T) {
+	ctx := context.Background()
+	users := newMockUsers()
+	svc := auth.NewService(newClock(), cfg, newMockStore(), users)
+	tokens, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	delete(users.users, "test")
+	expectInvalid(t, svc, tokens.AccessToken)
+	if _, err := svc.Refresh(ctx, tokens.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+}
+
+// Changing the password ends the sessions started before it
+func TestPasswordChanged(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	users := newMockUsers()
+	svc := auth.NewService(clock, cfg, newMockStore(), users)
+	before, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	changed := clock.now
+	users.users["test"] = user.User{ID: "test-id", Username: "test", PasswordChanged: &changed}
+	after, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	expectInvalid(t, svc, before.AccessToken)
+	if _, err := svc.Refresh(ctx, before.RefreshToken); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+	expectVerified(t, svc, after.AccessToken)
+	if _, err := svc.Refresh(ctx, after.RefreshToken); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+// Tokens are signed with a new key once the current one is older than the
+// rotation. Old keys verify the tokens they signed until those expire and
+// every server sharing the store accepts every key.
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	store := newMockStore()
+	svc := auth.NewService(clock, cfg, store, newMockUsers())
+
+	first, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	clock.now = clock.now.Add(cfg.KeyRotation)
+	second, err := svc.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if kid(t, first.AccessToken) == kid(t, second.AccessToken) {
+		t.Errorf("expected a new key after %v", cfg.KeyRotation)
+	}
+	if len(store.keys) != 2 {
+		t.Errorf("got=[%v] want=[2 keys]", len(store.keys))
+	}
+
+	// A server started after the rotation knows both keys
+	other := auth.NewService(clock, cfg, store, newMockUsers())
+	expectVerified(t, other, second.AccessToken)
+
+	clock.now = clock.now.Add(cfg.KeyRotation)
+	third, err := other.Login(ctx, "test", "password")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, ok := store.keys[kid(t, first.AccessToken)]; ok {
+		t.Errorf("expected the first key to be deleted once its tokens expired")
+	}
+
+	// The first server learns of the key it didn't make
+	expectVerified(t, svc, third.AccessToken)
+	if kid(t, third.AccessToken) == kid(t, second.AccessToken) {
+		t.Errorf("expected a new key after %v", cfg.KeyRotation)
+	}
+}
+
+// Tokens naming keys no one has made only load the keys so often
+func TestUnknownKeys(t *testing.T) {
+	ctx := context.Background()
+	clock := newClock()
+	store := newMockStore()
+	svc := auth.NewService(clock, cfg, store, newMockUsers())
+	if _, err := svc.Login(ctx, "test", "password"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	loaded := store.lists
+
+	forge := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: auth.Issuer})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString([]byte("guessed"))
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		return signed
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	for i := 0; i < 10; i++ {
+		expectInvalid(t, svc, forge(fmt.Sprintf("made-up-%d", i)))
+	}
+	if store.lists != loaded+1 {
+		t.Errorf("got=[%v] want=[%v]", store.lists-loaded, 1)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	expectInvalid(t, svc, forge("made-up"))
+	if store.lists != loaded+2 {
+		t.Errorf("got=[%v] want=[%v]", store.lists-loaded, 2)
+	}
+}
+
+func expectVerified(t *testing.T, svc *auth.Service, token string) user.User {
+	t.Helper()
+	u, err := svc.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return u
+}
+
+func expectInvalid(t *testing.T, svc *auth.Service, token string) {
+	t.Helper()
+	if _, err := svc.Verify(context.Background(), token); errors.Cause(err) != auth.ErrInvalidToken {
+		t.Errorf("got=[%v] want=[%v]", err, auth.ErrInvalidToken)
+	}
+}
+
+func kid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	id, _ := parsed.Header["kid"].(string)
+	return id
+}
+
+type stepClock struct {
+	now time.Time
+}
+
+func newClock() *stepClock {
+	return &stepClock{now: time.Now().UTC()}
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+type mockStore struct {
+	mu       sync.Mutex
+	keys     map[string]auth.SigningKey
+	sessions map[string]auth.Session
+
+	// lists counts how many times the keys have been listed
+	lists int
+}
+
+func newMockStore() *mockStore {
+	return &mockStore{keys: make(map[string]auth.SigningKey), sessions: make(map[string]auth.Session)}
+}
+
+func (m *mockStore) SaveSigningKey(_ context.Context, k auth.SigningKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys[k.ID] = k
+	return nil
+}
+
+func (m *mockStore) ListSigningKeys(_ context.Context) ([]auth.SigningKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lists++
+	keys := make([]auth.SigningKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m *mockStore) DeleteSigningKey(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *mockStore) SaveSession(_ context.Context, s auth.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *mockStore) GetSession(_ context.Context, id string) (auth.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return auth.Session{}, &core.ErrNotFound{}
+	}
+	return s, nil
+}
+
+func (m *mockStore) DeleteSession(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+// mockUsers has the user test with the password "password"
+type mockUsers struct {
+	users map[string]user.User
+}
+
+func newMockUsers() *mockUsers {
+	return &mockUsers{users: map[string]user.User{"test": {ID: "test-id", Username: "test"}}}
+}
+
+func (m *mockUsers) Auth(_ context.Context, username, password string) (user.User, bool) {
+	u, ok := m.users[username]
+	if !ok || password != "password" {
+		return user.User{}, false
+	}
+	return u, true
+}
+
+func (m *mockUsers) Get(_ context.Context, username string) (user.User, error) {
+	u, ok := m.users[username]
+	if !ok {
+		return user.User{}, &core.ErrNotFound{}
+	}
+	return u, nil
+}
@@ -0,0 +1,249 @@
+// Package diff produces line based unified diffs
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultContext is the number of unchanged lines shown around each change
+const DefaultContext = 3
+
+type op int
+
+const (
+	opEqual op = iota
+	opDelete
+	opInsert
+)
+
+// edit is one line of the edit script turning a into b. aIdx and bIdx are the
+// line's position in a and b, only the one matching the op is meaningful for
+// deletes and inserts.
+type edit struct {
+	op   op
+	line string
+	aIdx int
+	bIdx int
+}
+
+// Unified returns the unified diff that turns a into b, labelling the two
+// sides with fromName and toName. It returns an empty string when a and b are
+// the same.
+func Unified(fromName, toName, a, b string, context int) string {
+	edits := myers(splitLines(a), splitLines(b))
+
+	hunks := group(edits, context)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "--- %s\n+++ %s\n", fromName, toName)
+	for _, h := range hunks {
+		writeHunk(sb, h)
+	}
+	return sb.String()
+}
+
+// splitLines splits s into lines, each keeping its trailing newline
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// myers computes the shortest edit script between a and b using Myers'
+// O(ND) algorithm
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+2)
+	trace := make([][]int, 0)
+
+search:
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	return backtrack(a, b, trace, offset)
+}
+
+func backtrack(a, b []string, trace [][]int, offset int) []edit {
+	x, y := len(a), len(b)
+	edits := make([]edit, 0, x+y)
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{op: opEqual, line: a[x-1], aIdx: x - 1, bIdx: y - 1})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{op: opInsert, line: b[prevY], aIdx: x, bIdx: prevY})
+			} else {
+				edits = append(edits, edit{op: opDelete, line: a[prevX], aIdx: prevX, bIdx: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+type hunk struct {
+	aStart, aLen int
+	bStart, bLen int
+	edits        []edit
+
+	// end is the index just past the hunk in the edit script
+	end int
+}
+
+// group splits the edit script into hunks of changes with up to context
+// unchanged lines around them. Changes that are close enough to share their
+// context end up in the same hunk.
+func group(edits []edit, context int) []hunk {
+	hunks := make([]hunk, 0)
+
+	i := 0
+	for i < len(edits) {
+		// Find the next change
+		for i < len(edits) && edits[i].op == opEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// Don't repeat context that's already in the previous hunk
+		if len(hunks) > 0 && start < hunks[len(hunks)-1].end {
+			start = hunks[len(hunks)-1].end
+		}
+
+		// Extend the hunk until there's a run of unchanged lines long
+		// enough to separate it from the next change
+		end := i
+		for end < len(edits) {
+			if edits[end].op != opEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == opEqual {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end += min(context, run-end)
+				break
+			}
+			end = run
+		}
+
+		hunks = append(hunks, newHunk(edits, start, end))
+		i = end
+	}
+
+	return hunks
+}
+
+func newHunk(edits []edit, start, end int) hunk {
+	h := hunk{edits: edits[start:end], end: end}
+	h.aStart, h.bStart = edits[start].aIdx, edits[start].bIdx
+	for _, e := range h.edits {
+		switch e.op {
+		case opEqual:
+			h.aLen++
+			h.bLen++
+		case opDelete:
+			h.aLen++
+		case opInsert:
+			h.bLen++
+		}
+	}
+	return h
+}
+
+func writeHunk(sb *strings.Builder, h hunk) {
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(h.aStart, h.aLen), hunkRange(h.bStart, h.bLen))
+	for _, e := range h.edits {
+		switch e.op {
+		case opEqual:
+			sb.WriteString(" ")
+		case opDelete:
+			sb.WriteString("-")
+		case opInsert:
+			sb.WriteString("+")
+		}
+		sb.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the 1-based start and length of one side of a hunk. An
+// empty range starts at the line before it, as diff(1) does.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, length)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,87 @@
+package diff_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/note-server/core/diff"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{
+			name: "same",
+			a:    "one\ntwo\n",
+			b:    "one\ntwo\n",
+			want: "",
+		},
+		{
+			name: "empty to text",
+			a:    "",
+			b:    "one\ntwo\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+		},
+		{
+			name: "text to empty",
+			a:    "one\n",
+			b:    "",
+			want: "--- a\n+++ b\n@@ -1 +0,0 @@\n-one\n",
+		},
+		{
+			name: "changed line",
+			a:    "one\ntwo\nthree\n",
+			b:    "one\n2\nthree\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n",
+		},
+		{
+			name: "no trailing newline",
+			a:    "one\ntwo",
+			b:    "one\ntwo\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n one\n-two\n\\ No newline at end of file\n+two\n",
+		},
+		{
+			name: "separate hunks",
+			a:    numbered(1, 20),
+			b:    strings.Replace(strings.Replace(numbered(1, 20), "2\n", "two\n", 1), "18\n", "eighteen\n", 1),
+			want: "--- a\n+++ b\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n",
+		},
+		{
+			name: "merged hunks",
+			a:    numbered(1, 10),
+			b:    strings.Replace(strings.Replace(numbered(1, 10), "2\n", "two\n", 1), "8\n", "eight\n", 1),
+			want: "--- a\n+++ b\n" +
+				"@@ -1,10 +1,10 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+		{
+			name: "insert in middle",
+			a:    numbered(1, 9),
+			b:    strings.Replace(numbered(1, 9), "5\n", "5\nnew\n", 1),
+			want: "--- a\n+++ b\n@@ -3,6 +3,7 @@\n 3\n 4\n 5\n+new\n 6\n 7\n 8\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diff.Unified("a", "b", test.a, test.b, diff.DefaultContext)
+			if got != test.want {
+				t.Errorf("unexpected diff\ngot:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func numbered(from, to int) string {
+	sb := strings.Builder{}
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&sb, "%d\n", i)
+	}
+	return sb.String()
+}
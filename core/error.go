@@ -1,6 +1,10 @@
 package core
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 type ErrNotFound struct{}
 
@@ -16,3 +20,78 @@ func IsErrNotFound(err error) bool {
 		return false
 	}
 }
+
+// ErrVersionMismatch is returned when a write expected a different version
+// of a resource than the one currently stored
+type ErrVersionMismatch struct {
+	Expected int64
+	Actual   int64
+}
+
+func (v *ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("version mismatch: expected %d but found %d", v.Expected, v.Actual)
+}
+
+func IsErrVersionMismatch(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ErrVersionMismatch:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrInvalid is returned when a request can't be carried out because of
+// something wrong with what was asked for
+type ErrInvalid struct {
+	Reason string
+}
+
+func (i *ErrInvalid) Error() string {
+	return i.Reason
+}
+
+func IsErrInvalid(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ErrInvalid:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrForbidden is returned when the user can see a resource but isn't allowed
+// to do what they asked with it
+type ErrForbidden struct {
+	Reason string
+}
+
+func (f *ErrForbidden) Error() string {
+	return f.Reason
+}
+
+func IsErrForbidden(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ErrForbidden:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrRangeNotSatisfiable is returned when a read starts at or past the end of
+// what's being read
+type ErrRangeNotSatisfiable struct{}
+
+func (r *ErrRangeNotSatisfiable) Error() string {
+	return "range not satisfiable"
+}
+
+func IsErrRangeNotSatisfiable(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ErrRangeNotSatisfiable:
+		return true
+	default:
+		return false
+	}
+}
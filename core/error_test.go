@@ -30,3 +30,75 @@ func TestIsErrNotFound(t *testing.T) {
 		}
 	}
 }
+
+func TestIsErrVersionMismatch(t *testing.T) {
+	tests := []struct {
+		input error
+		want  bool
+	}{
+		{input: errors.New("some madeup error"), want: false},
+		{input: &core.ErrNotFound{}, want: false},
+		{input: &core.ErrVersionMismatch{Expected: 1, Actual: 2}, want: true},
+	}
+
+	for _, test := range tests {
+		got := core.IsErrVersionMismatch(test.input)
+		if test.want != got {
+			t.Errorf("want=[%v] got=[%v]", test.want, got)
+		}
+	}
+}
+
+func TestIsErrInvalid(t *testing.T) {
+	tests := []struct {
+		input error
+		want  bool
+	}{
+		{input: errors.New("some madeup error"), want: false},
+		{input: &core.ErrNotFound{}, want: false},
+		{input: &core.ErrInvalid{Reason: "some reason"}, want: true},
+	}
+
+	for _, test := range tests {
+		got := core.IsErrInvalid(test.input)
+		if test.want != got {
+			t.Errorf("want=[%v] got=[%v]", test.want, got)
+		}
+	}
+}
+
+func TestIsErrForbidden(t *testing.T) {
+	tests := []struct {
+		input error
+		want  bool
+	}{
+		{input: errors.New("some madeup error"), want: false},
+		{input: &core.ErrInvalid{Reason: "some reason"}, want: false},
+		{input: &core.ErrForbidden{Reason: "some reason"}, want: true},
+	}
+
+	for _, test := range tests {
+		got := core.IsErrForbidden(test.input)
+		if test.want != got {
+			t.Errorf("want=[%v] got=[%v]", test.want, got)
+		}
+	}
+}
+
+func TestIsErrRangeNotSatisfiable(t *testing.T) {
+	tests := []struct {
+		input error
+		want  bool
+	}{
+		{input: errors.New("some madeup error"), want: false},
+		{input: &core.ErrNotFound{}, want: false},
+		{input: &core.ErrRangeNotSatisfiable{}, want: true},
+	}
+
+	for _, test := range tests {
+		got := core.IsErrRangeNotSatisfiable(test.input)
+		if test.want != got {
+			t.Errorf("want=[%v] got=[%v]", test.want, got)
+		}
+	}
+}
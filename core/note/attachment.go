@@ -0,0 +1,376 @@
+package note
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+)
+
+// Attachments are files stored alongside a note, listed on the note itself.
+// They belong to the note rather than to a version of it: saving or restoring
+// the note keeps the attachments it has, they're only added and removed
+// through the attachment methods, and they're deleted along with the note when
+// it's purged. Revisions list the attachments the note had at the time but
+// only the current ones can be downloaded.
+
+const (
+	// MaxAttachments is the most attachments a note can have
+	MaxAttachments = 100
+
+	// maxAttachmentNameLength is the longest an attachment's name can be
+	maxAttachmentNameLength = 255
+
+	// sniffLength is how much of an attachment its content type is sniffed
+	// from, see http.DetectContentType
+	sniffLength = 512
+)
+
+// An Attachment describes a file attached to a note. The content type is
+// sniffed from the file rather than taken from the client.
+type Attachment struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+}
+
+// AttachmentStore is implemented by repositories that store the contents of
+// attachments. Their descriptions are stored with the note.
+type AttachmentStore interface {
+	// SaveAttachment stores the attachment's contents, read from r until EOF.
+	// Nothing is stored if reading r fails.
+	SaveAttachment(ctx context.Context, noteID, id string, r io.Reader) error
+	// OpenAttachment returns the attachment's contents from the offset on,
+	// a core.ErrNotFound if there's no such attachment or a
+	// core.ErrRangeNotSatisfiable if the offset isn't 0 and is at or past the
+	// end of it
+	OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error)
+	// DeleteAttachment removes the attachment's contents
+	DeleteAttachment(ctx context.Context, noteID, id string) error
+	// DeleteAttachments removes the contents of every attachment of the note
+	DeleteAttachments(ctx context.Context, noteID string) error
+}
+
+// validateAttachmentName checks the name is something a file could be called
+// on any system it's downloaded to
+func validateAttachmentName(name string) error {
+	if name == "" || len(name) > maxAttachmentNameLength {
+		return &core.ErrInvalid{Reason: "attachment name must be 1 to 255 bytes"}
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return &core.ErrInvalid{Reason: "attachment name must not be a path"}
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || c == unicode.ReplacementChar {
+			return &core.ErrInvalid{Reason: "attachment name must be printable text"}
+		}
+	}
+	return nil
+}
+
+// FindAttachment returns the note's attachment with the ID
+func (n Note) FindAttachment(id string) (Attachment, bool) {
+	for _, a := range n.Attachments {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// countingReader counts and hashes what's read through it
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	hash hash.Hash
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+// AddAttachment stores the file read from r as a new attachment of the note
+// and returns it. The file is stored before the note is locked so a large
+// upload doesn't hold up changes to the note, it's deleted again if the note
+// is gone or full by the time it's done.
+func (s *service) AddAttachment(ctx context.Context, noteID, name string, r io.Reader) (Attachment, error) {
+	const funcName = "AddAttachment"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", noteID).
+		Str("name", name).
+		Msg("adding attachment")
+
+	if err := validateAttachmentName(name); err != nil {
+		return Attachment{}, errors.WithStack(err)
+	}
+	store, err := s.attachments()
+	if err != nil {
+		return Attachment{}, err
+	}
+	n, err := s.get(ctx, noteID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if len(n.Attachments) >= MaxAttachments {
+		return Attachment{}, errors.WithStack(&core.ErrInvalid{Reason: "a note can have at most 100 attachments"})
+	}
+
+	now := s.clock.Now()
+	id, err := newNoteID(now)
+	if err != nil {
+		return Attachment{}, errors.WithStack(err)
+	}
+
+	head := make([]byte, sniffLength)
+	read, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Attachment{}, errors.WithStack(err)
+	}
+	head = head[:read]
+
+	body := &countingReader{r: io.MultiReader(bytes.NewReader(head), r), hash: sha256.New()}
+	if err := store.SaveAttachment(ctx, noteID, id, body); err != nil {
+		return Attachment{}, errors.WithStack(err)
+	}
+	a := Attachment{
+		ID:          id,
+		Name:        name,
+		ContentType: http.DetectContentType(head),
+		Size:        body.n,
+		SHA256:      hex.EncodeToString(body.hash.Sum(nil)),
+		Created:     now,
+	}
+
+	if err := s.attach(ctx, noteID, a); err != nil {
+		if derr := store.DeleteAttachment(ctx, noteID, id); derr != nil {
+			log.Warn().Err(derr).Str("func", funcName).Str("id", noteID).Str("attachment", id).Msg("failed to delete unused attachment")
+		}
+		return Attachment{}, err
+	}
+	return a, nil
+}
+
+// attach adds the attachment to the note
+func (s *service) attach(ctx context.Context, noteID string, a Attachment) error {
+	unlock := s.locks.Lock(noteID)
+	defer unlock()
+
+	n, err := s.get(ctx, noteID)
+	if err != nil {
+		return err
+	}
+	if len(n.Attachments) >= MaxAttachments {
+		return errors.WithStack(&core.ErrInvalid{Reason: "a note can have at most 100 attachments"})
+	}
+
+	n.Attachments = append(append([]Attachment{}, n.Attachments...), a)
+	_, err = s.saveNote(ctx, n, n.Version, true)
+	return err
+}
+
+// ListAttachments returns the note's attachments, oldest first
+func (s *service) ListAttachments(ctx context.Context, noteID string) ([]Attachment, error) {
+	n, err := s.get(ctx, noteID)
+	if err != nil {
+		return []Attachment{}, err
+	}
+	if n.Attachments == nil {
+		return []Attachment{}, nil
+	}
+	return n.Attachments, nil
+}
+
+// OpenAttachment returns the attachment and its contents, which must be
+// closed. The contents are only read from the repository once they're read
+// and are read again from wherever they're sought to.
+func (s *service) OpenAttachment(ctx context.Context, noteID, id string) (Attachment, io.ReadSeekCloser, error) {
+	const funcName = "OpenAttachment"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", noteID).
+		Str("attachment", id).
+		Msg("opening attachment")
+
+	store, err := s.attachments()
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	n, err := s.get(ctx, noteID)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	a, ok := n.FindAttachment(id)
+	if !ok {
+		return Attachment{}, nil, errors.WithStack(&core.ErrNotFound{})
+	}
+
+	return a, &attachmentReader{ctx: ctx, store: store, noteID: noteID, a: a}, nil
+}
+
+// DeleteAttachment removes the attachment from the note and deletes it
+func (s *service) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	const funcName = "DeleteAttachment"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", noteID).
+		Str("attachment", id).
+		Msg("deleting attachment")
+
+	store, err := s.attachments()
+	if err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(noteID)
+	defer unlock()
+
+	n, err := s.get(ctx, noteID)
+	if err != nil {
+		return err
+	}
+	if _, ok := n.FindAttachment(id); !ok {
+		return errors.WithStack(&core.ErrNotFound{})
+	}
+
+	kept := make([]Attachment, 0, len(n.Attachments)-1)
+	for _, a := range n.Attachments {
+		if a.ID != id {
+			kept = append(kept, a)
+		}
+	}
+	n.Attachments = kept
+	if _, err := s.saveNote(ctx, n, n.Version, true); err != nil {
+		return err
+	}
+
+	// The note no longer lists the attachment so failing to delete it only
+	// leaves it behind unused
+	if err := store.DeleteAttachment(ctx, noteID, id); err != nil {
+		log.Warn().Err(err).Str("func", funcName).Str("id", noteID).Str("attachment", id).Msg("failed to delete attachment")
+	}
+	return nil
+}
+
+func (s *service) attachments() (AttachmentStore, error) {
+	store, ok := s.repo.(AttachmentStore)
+	if !ok {
+		return nil, errors.New("repository does not store attachments")
+	}
+	return store, nil
+}
+
+// attachmentReader reads an attachment's contents, opening them from the
+// store at the current offset when they're first read after a seek
+type attachmentReader struct {
+	ctx    context.Context
+	store  AttachmentStore
+	noteID string
+	a      Attachment
+
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.a.Size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := r.store.OpenAttachment(r.ctx, r.noteID, r.a.ID, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *attachmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.a.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != r.offset {
+		if err := r.Close(); err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *attachmentReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// Attachments can be read by anyone the note is shared with and changed by
+// its editors
+
+func (s *namespacedService) AddAttachment(ctx context.Context, noteID, name string, r io.Reader) (Attachment, error) {
+	svc, err := s.scopeNote(ctx, noteID, RoleEditor)
+	if err != nil {
+		return Attachment{}, err
+	}
+	return svc.AddAttachment(ctx, noteID, name, r)
+}
+
+func (s *namespacedService) ListAttachments(ctx context.Context, noteID string) ([]Attachment, error) {
+	svc, err := s.scopeNote(ctx, noteID, RoleViewer)
+	if err != nil {
+		return []Attachment{}, err
+	}
+	return svc.ListAttachments(ctx, noteID)
+}
+
+func (s *namespacedService) OpenAttachment(ctx context.Context, noteID, id string) (Attachment, io.ReadSeekCloser, error) {
+	svc, err := s.scopeNote(ctx, noteID, RoleViewer)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	return svc.OpenAttachment(ctx, noteID, id)
+}
+
+func (s *namespacedService) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	svc, err := s.scopeNote(ctx, noteID, RoleEditor)
+	if err != nil {
+		return err
+	}
+	return svc.DeleteAttachment(ctx, noteID, id)
+}
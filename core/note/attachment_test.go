@@ -0,0 +1,177 @@
+package note_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+var png = append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{1, 2, 3}, 1000)...)
+
+func TestAttachments(t *testing.T) {
+	ctx := context.Background()
+
+	service := note.NewService(&mockClock{}, &mockRepo{})
+	if _, err := service.AddAttachment(ctx, "1", "picture.png", bytes.NewReader(png)); err == nil {
+		t.Errorf("expected an error for a repository that doesn't store attachments")
+	}
+
+	repo := newMockAttachmentRepo()
+	service = note.NewService(&mockClock{}, repo)
+	if _, err := service.AddAttachment(ctx, "1", "picture.png", bytes.NewReader(png)); !core.IsErrNotFound(err) {
+		t.Errorf("missing note: got=[%v] want=[not found]", err)
+	}
+	if _, err := service.Create(ctx, note.Note{ID: "1", Data: "some note"}, note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	for _, name := range []string{"", "..", "a/b", `a\b`, "a\nb", strings.Repeat("a", 256)} {
+		if _, err := service.AddAttachment(ctx, "1", name, bytes.NewReader(png)); !core.IsErrInvalid(err) {
+			t.Errorf("name %q: got=[%v] want=[invalid]", name, err)
+		}
+	}
+
+	a, err := service.AddAttachment(ctx, "1", "picture.png", bytes.NewReader(png))
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	sum := sha256.Sum256(png)
+	if a.ID == "" || a.ContentType != "image/png" || a.Size != int64(len(png)) || a.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("got=[%+v] want=[a %v byte png]", a, len(png))
+	}
+	text, err := service.AddAttachment(ctx, "1", "notes.txt", strings.NewReader("some text"))
+	if err != nil || !strings.HasPrefix(text.ContentType, "text/plain") {
+		t.Errorf("got=[%+v, %v] want=[text]", text, err)
+	}
+
+	n, err := service.Get(ctx, "1")
+	if err != nil || n.Version != 3 || len(n.Attachments) != 2 || n.Attachments[0] != a {
+		t.Errorf("got=[%v, %v] want=[version 3 with both attachments]", n, err)
+	}
+
+	// Saving the note keeps its attachments whatever it's saved with
+	n, err = service.Create(ctx, note.Note{ID: "1", Data: "changed", Attachments: []note.Attachment{{ID: "made up"}}}, 3)
+	if err != nil || len(n.Attachments) != 2 || n.Attachments[1] != text {
+		t.Errorf("got=[%v, %v] want=[both attachments]", n, err)
+	}
+	n, err = service.Restore(ctx, "1", 1, 4)
+	if err != nil || len(n.Attachments) != 2 {
+		t.Errorf("got=[%v, %v] want=[both attachments]", n, err)
+	}
+
+	got, content, err := service.OpenAttachment(ctx, "1", a.ID)
+	if err != nil || got != a {
+		t.Fatalf("got=[%v, %v] want=[%v]", got, err, a)
+	}
+	if _, err := content.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if data, err := ioutil.ReadAll(content); err != nil || !bytes.Equal(data, png[len(png)-100:]) {
+		t.Errorf("got=[%v bytes, %v] want=[the last 100 bytes]", len(data), err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if data, err := ioutil.ReadAll(content); err != nil || !bytes.Equal(data, png) {
+		t.Errorf("got=[%v bytes, %v] want=[the whole png]", len(data), err)
+	}
+	content.Close()
+	if _, _, err := service.OpenAttachment(ctx, "1", "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	if err := service.DeleteAttachment(ctx, "1", text.ID); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.DeleteAttachment(ctx, "1", text.ID); !core.IsErrNotFound(err) {
+		t.Errorf("deleting twice: got=[%v] want=[not found]", err)
+	}
+	list, err := service.ListAttachments(ctx, "1")
+	if err != nil || len(list) != 1 || list[0] != a || repo.blobs["1"][text.ID] != nil {
+		t.Errorf("got=[%v, %v] want=[only the png]", list, err)
+	}
+
+	// Attachments outlive the trash but not a purge
+	if err := service.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, _, err := service.OpenAttachment(ctx, "1", a.ID); !core.IsErrNotFound(err) {
+		t.Errorf("trashed: got=[%v] want=[not found]", err)
+	}
+	if len(repo.blobs["1"]) != 1 {
+		t.Errorf("got=[%v] want=[the png kept in the trash]", repo.blobs["1"])
+	}
+	if err := service.Purge(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(repo.blobs["1"]) != 0 {
+		t.Errorf("got=[%v] want=[purged]", repo.blobs["1"])
+	}
+}
+
+func TestAttachmentLimit(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockAttachmentRepo()
+	service := note.NewService(&mockClock{}, repo)
+
+	attachments := make([]note.Attachment, note.MaxAttachments)
+	if err := repo.Save(ctx, note.Note{ID: "1", Version: 1, Attachments: attachments}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := service.AddAttachment(ctx, "1", "one.txt", strings.NewReader("one too many")); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if len(repo.blobs["1"]) != 0 {
+		t.Errorf("got=[%v] want=[nothing stored]", repo.blobs["1"])
+	}
+}
+
+// mockAttachmentRepo keeps attachments in memory on top of the trash
+type mockAttachmentRepo struct {
+	*mockTrashRepo
+	blobs map[string]map[string][]byte
+}
+
+func newMockAttachmentRepo() *mockAttachmentRepo {
+	return &mockAttachmentRepo{
+		mockTrashRepo: &mockTrashRepo{mockRevisionRepo: newMockRevisionRepo()},
+		blobs:         make(map[string]map[string][]byte),
+	}
+}
+
+func (r *mockAttachmentRepo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if r.blobs[noteID] == nil {
+		r.blobs[noteID] = make(map[string][]byte)
+	}
+	r.blobs[noteID][id] = data
+	return nil
+}
+
+func (r *mockAttachmentRepo) OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error) {
+	data, ok := r.blobs[noteID][id]
+	if !ok {
+		return nil, &core.ErrNotFound{}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (r *mockAttachmentRepo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	delete(r.blobs[noteID], id)
+	return nil
+}
+
+func (r *mockAttachmentRepo) DeleteAttachments(ctx context.Context, noteID string) error {
+	delete(r.blobs, noteID)
+	return nil
+}
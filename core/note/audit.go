@@ -0,0 +1,43 @@
+package note
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/note-server/core/audit"
+)
+
+// Recorder records changes to notes, see audit.Service
+type Recorder interface {
+	Record(ctx context.Context, e audit.Event) error
+}
+
+// record adds the change to the audit log, if the service keeps one. A zero
+// note before or after is one that didn't exist.
+func (s *service) record(ctx context.Context, action audit.Action, id string, before, after Note) error {
+	if s.audit == nil {
+		return nil
+	}
+	return errors.WithStack(s.audit.Record(ctx, audit.Event{
+		Action:  action,
+		OwnerID: s.owner,
+		NoteID:  id,
+		Before:  hashNote(before),
+		After:   hashNote(after),
+	}))
+}
+
+// hashNote returns a hash of everything about the note, or nothing for a
+// zero note
+func hashNote(n Note) string {
+	if n.ID == "" {
+		return ""
+	}
+	// A note is plain data, marshalling it can't fail
+	data, _ := json.Marshal(n)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,96 @@
+package note_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// Every change to a note is recorded against the owner of the note, whoever
+// makes it, with the note's hash before and after
+func TestAuditLog(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	repo := newMockAuditRepo()
+	service := note.NewNamespacedService(clock, repo)
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	bob := user.User{ID: "bob", Username: "bob"}
+	asBob := note.WithOwner(user.NewContext(context.Background(), bob), "alice")
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus"})
+	mustShare(alice, t, service, "1", bob, note.RoleEditor)
+	if _, err := service.Patch(asBob, "1", note.MergePatch(json.RawMessage(`{"data": "the otter"}`)), note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := service.Get(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Delete(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := service.RestoreTrashed(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Delete(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Purge(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus again"})
+
+	want := []struct {
+		action audit.Action
+		actor  string
+	}{
+		{audit.ActionCreate, "alice"},
+		{audit.ActionUpdate, "bob"},
+		{audit.ActionTrash, "alice"},
+		{audit.ActionRestore, "alice"},
+		{audit.ActionTrash, "alice"},
+		{audit.ActionPurge, "alice"},
+		{audit.ActionCreate, "alice"},
+	}
+	if len(repo.events) != len(want) {
+		t.Fatalf("got=[%v] want=[%v events]", repo.events, len(want))
+	}
+	for i, e := range repo.events {
+		if e.Action != want[i].action || e.Actor != want[i].actor || e.OwnerID != "alice" || e.NoteID != "1" {
+			t.Errorf("event %v: got=[%v] want=[%v by %v]", i, e, want[i].action, want[i].actor)
+		}
+		if i > 0 && e.Before != repo.events[i-1].After {
+			t.Errorf("event %v: got=[before %v] want=[the hash after event %v]", i, e.Before, i-1)
+		}
+	}
+
+	first, purge := repo.events[0], repo.events[5]
+	if first.Before != "" || first.After == "" || purge.Before == "" || purge.After != "" {
+		t.Errorf("got=[%v, %v] want=[no hash before creating or after purging]", first, purge)
+	}
+	if repo.events[1].After == repo.events[1].Before {
+		t.Errorf("got=[%v] want=[the hash to change]", repo.events[1])
+	}
+}
+
+// mockAuditRepo is a mockShareRepo that keeps an audit log
+type mockAuditRepo struct {
+	*mockShareRepo
+	events []audit.Event
+}
+
+func newMockAuditRepo() *mockAuditRepo {
+	return &mockAuditRepo{mockShareRepo: newMockShareRepo()}
+}
+
+func (r *mockAuditRepo) AppendAuditEvent(ctx context.Context, e audit.Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *mockAuditRepo) ListAuditEvents(ctx context.Context, from, to time.Time) ([]audit.Event, error) {
+	return r.events, nil
+}
@@ -0,0 +1,281 @@
+package note
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+)
+
+// Encrypted notes are encrypted and decrypted by the client, the server only
+// ever sees envelopes. An encrypted note's data must be an envelope and its
+// title may be one too. Its tags and notebook stay in plain text so that
+// filtering and filing keep working.
+//
+// The server can't read an encrypted note so its data isn't searched, nor is
+// its title when that's encrypted, search results have no snippet of it, it
+// can't be diffed and it can't be opened through a public share link. Sharing
+// it with another user works but they need the key from the owner.
+//
+// The keys notes are encrypted with are generated by the client and stored
+// wrapped, encrypted with a key derived from a passphrase the server never
+// sees, in the user's key ring.
+
+const (
+	// EnvelopePrefix starts every envelope, it names the envelope's version
+	EnvelopePrefix = "e2e1."
+
+	// WrapPBKDF2AESKW wraps a 256 bit AES key with AES key wrap (RFC 3394)
+	// using a key derived from a passphrase with PBKDF2-HMAC-SHA256
+	WrapPBKDF2AESKW = "PBKDF2-SHA256/A256KW"
+
+	// envelopeIVSize is the size of an AES-GCM nonce
+	envelopeIVSize = 12
+	// envelopeTagSize is the size of an AES-GCM tag, the smallest ciphertext
+	// there can be
+	envelopeTagSize = 16
+	// wrappedKeySize is the size of a 256 bit key once it's wrapped
+	wrappedKeySize = 40
+	// minKeySaltSize and minKeyIterations are the least PBKDF2 is accepted with
+	minKeySaltSize   = 16
+	minKeyIterations = 100000
+	// maxKeyIDLength is the longest a key ID can be
+	maxKeyIDLength = 64
+)
+
+// An Envelope is an encrypted value as it's stored, written as
+// e2e1.<key id>.<iv>.<ciphertext> with the IV and ciphertext base64url
+// encoded without padding. The ciphertext is AES-256-GCM and includes its
+// tag.
+type Envelope struct {
+	KeyID      string
+	IV         []byte
+	Ciphertext []byte
+}
+
+// IsEnvelope reports whether the value looks like an envelope, it may still
+// not be a valid one
+func IsEnvelope(s string) bool {
+	return strings.HasPrefix(s, EnvelopePrefix)
+}
+
+// ParseEnvelope checks the value is a well formed envelope and returns it.
+// Only its format can be checked, the server can't decrypt it.
+func ParseEnvelope(s string) (Envelope, error) {
+	if !IsEnvelope(s) {
+		return Envelope{}, errors.WithStack(&core.ErrInvalid{Reason: "encrypted value must start with " + EnvelopePrefix})
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, EnvelopePrefix), ".")
+	if len(parts) != 3 {
+		return Envelope{}, errors.WithStack(&core.ErrInvalid{Reason: "encrypted value must have a key id, an iv and a ciphertext"})
+	}
+	if !validKeyID(parts[0]) {
+		return Envelope{}, errors.WithStack(&core.ErrInvalid{Reason: "encrypted value has an invalid key id"})
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(iv) != envelopeIVSize {
+		return Envelope{}, errors.WithStack(&core.ErrInvalid{Reason: "encrypted value must have a 12 byte iv"})
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(ciphertext) < envelopeTagSize {
+		return Envelope{}, errors.WithStack(&core.ErrInvalid{Reason: "encrypted value has an invalid ciphertext"})
+	}
+
+	return Envelope{KeyID: parts[0], IV: iv, Ciphertext: ciphertext}, nil
+}
+
+// String returns the envelope as it's stored
+func (e Envelope) String() string {
+	return EnvelopePrefix + e.KeyID + "." +
+		base64.RawURLEncoding.EncodeToString(e.IV) + "." +
+		base64.RawURLEncoding.EncodeToString(e.Ciphertext)
+}
+
+// A WrappedKey is a key notes are encrypted with, wrapped by the client.
+// Key and Salt are base64url encoded without padding. A key can be wrapped
+// again, when the passphrase changes, but never deleted as that would leave
+// the notes encrypted with it unreadable.
+type WrappedKey struct {
+	ID         string    `json:"id"`
+	Algorithm  string    `json:"algorithm"`
+	Key        string    `json:"key"`
+	Salt       string    `json:"salt"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+}
+
+// KeyRing is implemented by repositories that keep the users' wrapped keys.
+// Namespaced repositories keep a key ring per namespace.
+type KeyRing interface {
+	SaveWrappedKey(ctx context.Context, k WrappedKey) error
+	GetWrappedKey(ctx context.Context, id string) (WrappedKey, error)
+	ListWrappedKeys(ctx context.Context) ([]WrappedKey, error)
+}
+
+// validKeyID reports whether the ID can name a key, it has to fit in an
+// envelope and in a storage key
+func validKeyID(id string) bool {
+	if id == "" || len(id) > maxKeyIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func validateWrappedKey(k WrappedKey) error {
+	if !validKeyID(k.ID) {
+		return &core.ErrInvalid{Reason: "key id must be up to 64 letters, digits, dashes or underscores"}
+	}
+	if k.Algorithm != WrapPBKDF2AESKW {
+		return &core.ErrInvalid{Reason: "key algorithm must be " + WrapPBKDF2AESKW}
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(k.Key); err != nil || len(key) != wrappedKeySize {
+		return &core.ErrInvalid{Reason: "key must be a wrapped 256 bit key"}
+	}
+	if salt, err := base64.RawURLEncoding.DecodeString(k.Salt); err != nil || len(salt) < minKeySaltSize {
+		return &core.ErrInvalid{Reason: "salt must be at least 16 bytes"}
+	}
+	if k.Iterations < minKeyIterations {
+		return &core.ErrInvalid{Reason: "iterations must be at least 100000"}
+	}
+	return nil
+}
+
+// SaveWrappedKey adds the key to the key ring, or replaces the key with the
+// same ID when it's wrapped again. The saved key is returned.
+func (s *service) SaveWrappedKey(ctx context.Context, k WrappedKey) (WrappedKey, error) {
+	const funcName = "SaveWrappedKey"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", k.ID).
+		Msg("saving wrapped key")
+
+	if err := validateWrappedKey(k); err != nil {
+		return WrappedKey{}, errors.WithStack(err)
+	}
+	kr, err := s.keyRing()
+	if err != nil {
+		return WrappedKey{}, err
+	}
+
+	now := s.clock.Now()
+	k.Created = now
+	k.Updated = now
+	current, err := kr.GetWrappedKey(ctx, k.ID)
+	switch {
+	case err == nil:
+		k.Created = current.Created
+	case !core.IsErrNotFound(err):
+		return WrappedKey{}, errors.WithStack(err)
+	}
+
+	if err := kr.SaveWrappedKey(ctx, k); err != nil {
+		return WrappedKey{}, errors.WithStack(err)
+	}
+	return k, nil
+}
+
+func (s *service) GetWrappedKey(ctx context.Context, id string) (WrappedKey, error) {
+	kr, err := s.keyRing()
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	k, err := kr.GetWrappedKey(ctx, id)
+	return k, errors.WithStack(err)
+}
+
+// ListWrappedKeys returns every key in the key ring, oldest first
+func (s *service) ListWrappedKeys(ctx context.Context) ([]WrappedKey, error) {
+	kr, err := s.keyRing()
+	if err != nil {
+		return []WrappedKey{}, err
+	}
+	keys, err := kr.ListWrappedKeys(ctx)
+	if err != nil {
+		return []WrappedKey{}, errors.WithStack(err)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// checkEncrypted makes sure an encrypted note's data is an envelope, its title
+// is either plain text or an envelope, and that their keys are in the key ring
+func (s *service) checkEncrypted(ctx context.Context, n Note) error {
+	if !n.Encrypted {
+		return nil
+	}
+
+	envelopes := []string{n.Data}
+	if IsEnvelope(n.Title) {
+		envelopes = append(envelopes, n.Title)
+	}
+
+	kr, err := s.keyRing()
+	if err != nil {
+		return err
+	}
+	for _, v := range envelopes {
+		e, err := ParseEnvelope(v)
+		if err != nil {
+			return err
+		}
+		if _, err := kr.GetWrappedKey(ctx, e.KeyID); err != nil {
+			if core.IsErrNotFound(err) {
+				return errors.WithStack(&core.ErrInvalid{Reason: "key " + e.KeyID + " isn't in the key ring"})
+			}
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *service) keyRing() (KeyRing, error) {
+	kr, ok := s.repo.(KeyRing)
+	if !ok {
+		return nil, errors.New("repository does not keep encryption keys")
+	}
+	return kr, nil
+}
+
+// The key ring is the user's own, it isn't shared along with their notes
+
+func (s *namespacedService) SaveWrappedKey(ctx context.Context, k WrappedKey) (WrappedKey, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return svc.SaveWrappedKey(ctx, k)
+}
+
+func (s *namespacedService) GetWrappedKey(ctx context.Context, id string) (WrappedKey, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return svc.GetWrappedKey(ctx, id)
+}
+
+func (s *namespacedService) ListWrappedKeys(ctx context.Context) ([]WrappedKey, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []WrappedKey{}, err
+	}
+	return svc.ListWrappedKeys(ctx)
+}
@@ -0,0 +1,233 @@
+package note_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+const (
+	envelope      = "e2e1.k1.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAA"
+	titleEnvelope = "e2e1.k1.AQEBAQEBAQEBAQEB.AQEBAQEBAQEBAQEBAQEBAQ"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "Valid", input: envelope},
+		{name: "Plain Text", input: "the walrus", wantErr: true},
+		{name: "Another Version", input: "e2e2.k1.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "Missing Part", input: "e2e1.k1.AAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "Extra Part", input: envelope + ".AA", wantErr: true},
+		{name: "Bad Key ID", input: "e2e1.k/1.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "Short IV", input: "e2e1.k1.AAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "Padded IV", input: "e2e1.k1.AAAAAAAAAAAAAAAA==.AAAAAAAAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "No Tag", input: "e2e1.k1.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAA", wantErr: true},
+		{name: "Not Base64", input: "e2e1.k1.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAA!", wantErr: true},
+	}
+
+	for _, test := range tests {
+		e, err := note.ParseEnvelope(test.input)
+		if test.wantErr {
+			if !core.IsErrInvalid(err) {
+				t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		if e.KeyID != "k1" || len(e.IV) != 12 || len(e.Ciphertext) != 16 || e.String() != test.input {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, e, test.input)
+		}
+	}
+}
+
+func TestSaveWrappedKey(t *testing.T) {
+	ctx := context.Background()
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+
+	service := note.NewService(clock, &mockRepo{})
+	if _, err := service.SaveWrappedKey(ctx, newWrappedKey("k1")); err == nil {
+		t.Errorf("expected an error for a repository that doesn't keep keys")
+	}
+
+	service = note.NewService(clock, newMockKeyRingRepo())
+	tests := []struct {
+		name  string
+		input func(k *note.WrappedKey)
+	}{
+		{name: "Bad ID", input: func(k *note.WrappedKey) { k.ID = "../k1" }},
+		{name: "Long ID", input: func(k *note.WrappedKey) { k.ID = strings.Repeat("k", 65) }},
+		{name: "Unknown Algorithm", input: func(k *note.WrappedKey) { k.Algorithm = "none" }},
+		{name: "Short Key", input: func(k *note.WrappedKey) { k.Key = "AAAA" }},
+		{name: "Short Salt", input: func(k *note.WrappedKey) { k.Salt = "AAAA" }},
+		{name: "Few Iterations", input: func(k *note.WrappedKey) { k.Iterations = 1000 }},
+	}
+	for _, test := range tests {
+		k := newWrappedKey("k1")
+		test.input(&k)
+		if _, err := service.SaveWrappedKey(ctx, k); !core.IsErrInvalid(err) {
+			t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+		}
+	}
+
+	created, err := service.SaveWrappedKey(ctx, newWrappedKey("k1"))
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	rewrapped := newWrappedKey("k1")
+	rewrapped.Iterations = 200000
+	if _, err := service.SaveWrappedKey(ctx, rewrapped); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := service.GetWrappedKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.Iterations != 200000 || !got.Created.Equal(created.Created) || !got.Updated.Equal(clock.now) {
+		t.Errorf("got=[%v] want=[the rewrapped key created at %v]", got, created.Created)
+	}
+	if _, err := service.GetWrappedKey(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// An encrypted note must be made of envelopes whose keys are in the key ring,
+// and the server leaves it out of what needs to read it
+func TestEncryptedNote(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockKeyRingRepo()
+	service := note.NewService(&mockClock{}, repo)
+
+	if _, err := service.Create(ctx, note.Note{ID: "1", Data: envelope, Encrypted: true}, note.AnyVersion); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid without the key]", err)
+	}
+	if _, err := service.SaveWrappedKey(ctx, newWrappedKey("k1")); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   note.Note
+		wantErr bool
+	}{
+		{name: "Plain Data", input: note.Note{ID: "1", Data: "the walrus", Encrypted: true}, wantErr: true},
+		{name: "Bad Envelope", input: note.Note{ID: "1", Data: "e2e1.k1.AAAA.AAAA", Encrypted: true}, wantErr: true},
+		{name: "Bad Title Envelope", input: note.Note{ID: "1", Title: "e2e1.k1", Data: envelope, Encrypted: true}, wantErr: true},
+		{name: "Unknown Key", input: note.Note{ID: "1", Data: strings.Replace(envelope, "k1", "k2", 1), Encrypted: true}, wantErr: true},
+		{name: "Plain Title", input: note.Note{ID: "1", Title: "Walrus", Data: envelope, Encrypted: true}},
+		{name: "Encrypted Title", input: note.Note{ID: "1", Title: titleEnvelope, Data: envelope, Encrypted: true}},
+		{name: "Not Encrypted", input: note.Note{ID: "2", Title: "Walrus", Data: "the walrus"}},
+	}
+	for _, test := range tests {
+		_, err := service.Create(ctx, test.input, note.AnyVersion)
+		if test.wantErr && !core.IsErrInvalid(err) {
+			t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+	}
+
+	expectSearch(ctx, t, service, "walrus", 0, 0, 1, "2")
+	expectSearch(ctx, t, service, "k1", 0, 0, 0)
+	mustCreate(ctx, t, service, note.Note{ID: "1", Title: "Walrus", Data: envelope, Encrypted: true})
+	results, _, err := service.Search(ctx, "walrus", 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(results) != 2 || results[0].ID != "1" || results[0].Snippet != "" || !results[0].Encrypted {
+		t.Errorf("got=%+v want=[the encrypted note by its plain title without a snippet]", results)
+	}
+
+	if _, err := service.Diff(ctx, "1", 1, 2); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.Diff(ctx, "2", 1, 1); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+// Encrypted notes can't be read through a share link, even one made before
+// the note was encrypted
+func TestEncryptedNoteLinks(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	repo := newMockShareRepo()
+	service := note.NewNamespacedService(clock, repo)
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus"})
+	_, token, err := service.CreateLink(alice, "1", nil, "")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	// The mock namespaces don't keep keys so the note is encrypted behind the
+	// service's back
+	ns, _ := repo.Namespace("alice")
+	n, _ := ns.Get(alice, "1")
+	n.Data = envelope
+	n.Encrypted = true
+	if err := ns.Save(alice, n); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, _, err := service.CreateLink(alice, "1", nil, ""); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.OpenLink(context.Background(), token, ""); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+func newWrappedKey(id string) note.WrappedKey {
+	return note.WrappedKey{
+		ID:         id,
+		Algorithm:  note.WrapPBKDF2AESKW,
+		Key:        strings.Repeat("A", 54),
+		Salt:       strings.Repeat("A", 22),
+		Iterations: 100000,
+	}
+}
+
+// mockKeyRingRepo is a mockSearchRepo that keeps wrapped keys
+type mockKeyRingRepo struct {
+	*mockSearchRepo
+	keys map[string]note.WrappedKey
+}
+
+func newMockKeyRingRepo() *mockKeyRingRepo {
+	return &mockKeyRingRepo{mockSearchRepo: newMockSearchRepo(), keys: make(map[string]note.WrappedKey)}
+}
+
+func (r *mockKeyRingRepo) SaveWrappedKey(ctx context.Context, k note.WrappedKey) error {
+	r.keys[k.ID] = k
+	return nil
+}
+
+func (r *mockKeyRingRepo) GetWrappedKey(ctx context.Context, id string) (note.WrappedKey, error) {
+	k, ok := r.keys[id]
+	if !ok {
+		return note.WrappedKey{}, &core.ErrNotFound{}
+	}
+	return k, nil
+}
+
+func (r *mockKeyRingRepo) ListWrappedKeys(ctx context.Context) ([]note.WrappedKey, error) {
+	keys := make([]note.WrappedKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
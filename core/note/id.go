@@ -0,0 +1,28 @@
+package note
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// newNoteID returns a version 7 UUID (RFC 9562) for a note created at now.
+// The leading millisecond timestamp keeps IDs roughly in creation order and
+// the remaining 74 random bits make collisions practically impossible.
+func newNoteID(now time.Time) (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		return "", err
+	}
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now.UnixNano()/int64(time.Millisecond)))
+	copy(u[:6], ts[2:])
+
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
@@ -0,0 +1,65 @@
+package note
+
+import (
+	"context"
+	"time"
+)
+
+// Reindexer is implemented by repositories whose index can drift from the
+// notes they store
+type Reindexer interface {
+	// Reindex compares the index against the stored notes and, if repair is
+	// set, rewrites the index to match them
+	Reindex(ctx context.Context, repair bool) (IndexReport, error)
+}
+
+// IndexReport describes how the index differs from the stored notes
+type IndexReport struct {
+	// Notes is the number of notes in storage
+	Notes int `json:"notes"`
+	// Indexed is the number of entries in the index
+	Indexed int `json:"indexed"`
+	// Missing are notes that have no entry in the index
+	Missing []string `json:"missing"`
+	// Orphaned are index entries whose note doesn't exist
+	Orphaned []string `json:"orphaned"`
+	// Stale are index entries that don't match their note
+	Stale []string `json:"stale"`
+	// Repaired is set when the drift was fixed
+	Repaired bool `json:"repaired"`
+}
+
+func NewIndexReport() IndexReport {
+	return IndexReport{Missing: []string{}, Orphaned: []string{}, Stale: []string{}}
+}
+
+// Drifted reports whether the index and the notes disagree
+func (r IndexReport) Drifted() bool {
+	return len(r.Missing) > 0 || len(r.Orphaned) > 0 || len(r.Stale) > 0
+}
+
+// IndexMatches reports whether an index entry is up to date with its note
+func IndexMatches(ln ListNote, n Note) bool {
+	return ln.ID == n.ID && ln.Title == n.Title && ln.NotebookID == n.NotebookID && ln.Version == n.Version &&
+		ln.Created.Equal(n.Created) && ln.Updated.Equal(n.Updated) &&
+		timesEqual(ln.Trashed, n.Trashed) && tagsEqual(ln.Tags, n.Tags)
+}
+
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
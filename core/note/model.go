@@ -5,19 +5,116 @@ import (
 	"time"
 )
 
-// A note as created by a user
+// AnyVersion skips the version check when saving a note
+const AnyVersion int64 = -1
+
+// MaxIDLength is the longest, in bytes, a note's ID may be. Notes are stored
+// under their hex encoded IDs, which have to fit in a file name.
+const MaxIDLength = 100
+
+// A note as created by a user. Version starts at 1 and is incremented every
+// time the note is saved. NotebookID is the notebook the note is filed in, if
+// any. Trashed is set to when the note was deleted while it's in the trash.
+// Encrypted is set when the note's data is encrypted by the client, see
+// encrypted.go. Attachments are the files attached to the note, see
+// attachment.go.
 type Note struct {
-	ID      string    `json:"id"`
-	Title   string    `json:"title"`
-	Data    string    `json:"data"`
-	Created time.Time `json:"created"`
-	Updated time.Time `json:"updated"`
+	ID          string       `json:"id"`
+	Title       string       `json:"title"`
+	Data        string       `json:"data"`
+	Tags        []string     `json:"tags,omitempty"`
+	NotebookID  string       `json:"notebookId,omitempty"`
+	Encrypted   bool         `json:"encrypted,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Version     int64        `json:"version"`
+	Created     time.Time    `json:"created"`
+	Updated     time.Time    `json:"updated"`
+	Trashed     *time.Time   `json:"trashed,omitempty"`
+}
+
+// IsTrashed reports whether the note is in the trash
+func (n Note) IsTrashed() bool {
+	return n.Trashed != nil
 }
 
 // A note as represented in the index
 type ListNote struct {
-	ID      string    `json:"id"`
-	Title   string    `json:"title"`
-	Created time.Time `json:"created"`
-	Updated time.Time `json:"updated"`
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Tags       []string   `json:"tags,omitempty"`
+	NotebookID string     `json:"notebookId,omitempty"`
+	Encrypted  bool       `json:"encrypted,omitempty"`
+	Version    int64      `json:"version"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+	Trashed    *time.Time `json:"trashed,omitempty"`
+}
+
+// NewListNote returns the note's index entry
+func NewListNote(n Note) ListNote {
+	return ListNote{
+		ID:         n.ID,
+		Title:      n.Title,
+		Tags:       n.Tags,
+		NotebookID: n.NotebookID,
+		Encrypted:  n.Encrypted,
+		Version:    n.Version,
+		Created:    n.Created,
+		Updated:    n.Updated,
+		Trashed:    n.Trashed,
+	}
+}
+
+// ListFilter selects the notes returned by List. The zero value selects every
+// note.
+type ListFilter struct {
+	TagFilter
+	// Notebook limits the notes to those filed directly in the notebook, or to
+	// those in no notebook at all when it's RootNotebook
+	Notebook string
+}
+
+// IsEmpty reports whether the filter matches every note
+func (f ListFilter) IsEmpty() bool {
+	return f.TagFilter.IsEmpty() && f.Notebook == ""
+}
+
+// Matches reports whether the note passes the filter
+func (f ListFilter) Matches(ln ListNote) bool {
+	switch f.Notebook {
+	case "":
+	case RootNotebook:
+		if ln.NotebookID != "" {
+			return false
+		}
+	default:
+		if ln.NotebookID != f.Notebook {
+			return false
+		}
+	}
+	return f.TagFilter.Matches(ln.Tags)
+}
+
+// Page returns the portion of the list between startIdx (inclusive) and endIdx
+// (exclusive). An endIdx of zero or less means the end of the list.
+func Page(list []ListNote, startIdx, endIdx int) []ListNote {
+	start, end := pageBounds(len(list), startIdx, endIdx)
+	if start == end {
+		return []ListNote{}
+	}
+	return list[start:end]
+}
+
+// pageBounds clamps a page of a list of the given length to the list
+func pageBounds(length, startIdx, endIdx int) (int, int) {
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	if endIdx <= 0 || endIdx > length {
+		endIdx = length
+	}
+	if startIdx >= endIdx {
+		return endIdx, endIdx
+	}
+	return startIdx, endIdx
 }
@@ -0,0 +1,512 @@
+package note
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// ErrNoUser is returned by a namespaced service called without a user in the
+// context. It means a route was left unauthenticated, so it's never treated
+// as a client error.
+var ErrNoUser = errors.New("no user in the context")
+
+// Namespaces is implemented by repositories that keep each user's notes
+// apart. A namespace is a complete repository of its own, with its own index,
+// trash, revisions, notebooks, search documents and key ring, so users can't
+// read, list or overwrite each other's notes even when they use the same IDs.
+type Namespaces interface {
+	Repository
+	// Namespace returns the repository holding the notes of the user with the
+	// ID
+	Namespace(userID string) (Repository, error)
+	// ListNamespaces returns the IDs of the users that have notes stored
+	ListNamespaces(ctx context.Context) ([]string, error)
+}
+
+// NewNamespacedService returns a service that works on the notes of the user
+// in the context of every call, see user.NewContext. Calls without a user fail
+// with ErrNoUser. Every change to a note is recorded in the audit log when the
+// repository is an audit.Store.
+func NewNamespacedService(clock core.Clock, repo Namespaces) *namespacedService {
+	shares, _ := repo.(ShareRepository)
+	s := &namespacedService{clock: clock, repo: repo, shares: shares, services: make(map[string]*service)}
+	if store, ok := repo.(audit.Store); ok {
+		s.audit = audit.NewService(clock, store)
+	}
+	return s
+}
+
+type namespacedService struct {
+	clock  core.Clock
+	repo   Namespaces
+	shares ShareRepository
+	audit  Recorder
+
+	// mu guards services, a service per namespace which is created the first
+	// time the namespace is used so each keeps its own locks and search index
+	mu       sync.Mutex
+	services map[string]*service
+}
+
+// scope returns the service for the namespace of the user in the context.
+// Only the owner can work on more than a single note at a time, see
+// scopeNote.
+func (s *namespacedService) scope(ctx context.Context) (*service, error) {
+	u, ok := user.FromContext(ctx)
+	if !ok || u.ID == "" {
+		return nil, errors.WithStack(ErrNoUser)
+	}
+	if ownerID, ok := OwnerFromContext(ctx); ok && ownerID != u.ID {
+		return nil, errors.WithStack(&core.ErrForbidden{Reason: "only the owner can do that"})
+	}
+	return s.namespace(u.ID)
+}
+
+// isOwner says whether the user in the context owns the notes they're working
+// on, rather than having them shared with them
+func isOwner(ctx context.Context) bool {
+	u, _ := user.FromContext(ctx)
+	ownerID, ok := OwnerFromContext(ctx)
+	return !ok || ownerID == u.ID
+}
+
+func (s *namespacedService) namespace(userID string) (*service, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if svc, ok := s.services[userID]; ok {
+		return svc, nil
+	}
+
+	repo, err := s.repo.Namespace(userID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	svc := NewService(s.clock, repo)
+	svc.audit = s.audit
+	svc.owner = userID
+	s.services[userID] = svc
+	return svc, nil
+}
+
+func (s *namespacedService) Create(ctx context.Context, note Note, version int64) (Note, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.Create(ctx, note, version)
+}
+
+func (s *namespacedService) Add(ctx context.Context, note Note) (Note, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.Add(ctx, note)
+}
+
+func (s *namespacedService) Replace(ctx context.Context, note Note, version int64, upsert bool) (Note, bool, error) {
+	svc, err := s.scopeNote(ctx, note.ID, RoleEditor)
+	if err != nil {
+		return Note{}, false, err
+	}
+	return svc.replace(ctx, note, version, upsert, isOwner(ctx))
+}
+
+func (s *namespacedService) Patch(ctx context.Context, id string, p Patch, expected int64) (Note, error) {
+	svc, err := s.scopeNote(ctx, id, RoleEditor)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.patch(ctx, id, p, expected, isOwner(ctx))
+}
+
+func (s *namespacedService) Get(ctx context.Context, id string) (Note, error) {
+	svc, err := s.scopeNote(ctx, id, RoleViewer)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.Get(ctx, id)
+}
+
+func (s *namespacedService) Delete(ctx context.Context, id string) error {
+	svc, err := s.scopeNote(ctx, id, RoleOwner)
+	if err != nil {
+		return err
+	}
+	return svc.Delete(ctx, id)
+}
+
+func (s *namespacedService) List(ctx context.Context, filter ListFilter, startIdx, endIdx int) ([]ListNote, int, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []ListNote{}, 0, err
+	}
+	return svc.List(ctx, filter, startIdx, endIdx)
+}
+
+func (s *namespacedService) ListRevisions(ctx context.Context, id string) ([]Revision, error) {
+	svc, err := s.scopeNote(ctx, id, RoleViewer)
+	if err != nil {
+		return []Revision{}, err
+	}
+	return svc.ListRevisions(ctx, id)
+}
+
+func (s *namespacedService) GetRevision(ctx context.Context, id string, version int64) (Note, error) {
+	svc, err := s.scopeNote(ctx, id, RoleViewer)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.GetRevision(ctx, id, version)
+}
+
+func (s *namespacedService) Diff(ctx context.Context, id string, from, to int64) (string, error) {
+	svc, err := s.scopeNote(ctx, id, RoleViewer)
+	if err != nil {
+		return "", err
+	}
+	return svc.Diff(ctx, id, from, to)
+}
+
+func (s *namespacedService) Restore(ctx context.Context, id string, version, expected int64) (Note, error) {
+	svc, err := s.scopeNote(ctx, id, RoleEditor)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.Restore(ctx, id, version, expected)
+}
+
+func (s *namespacedService) MoveNote(ctx context.Context, id, notebookID string, expected int64) (Note, error) {
+	svc, err := s.scopeNote(ctx, id, RoleOwner)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.MoveNote(ctx, id, notebookID, expected)
+}
+
+func (s *namespacedService) Search(ctx context.Context, query string, startIdx, endIdx int) ([]SearchResult, int, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []SearchResult{}, 0, err
+	}
+	return svc.Search(ctx, query, startIdx, endIdx)
+}
+
+func (s *namespacedService) Tags(ctx context.Context) ([]TagCount, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []TagCount{}, err
+	}
+	return svc.Tags(ctx)
+}
+
+func (s *namespacedService) CreateNotebook(ctx context.Context, nb Notebook) (Notebook, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Notebook{}, err
+	}
+	return svc.CreateNotebook(ctx, nb)
+}
+
+func (s *namespacedService) GetNotebook(ctx context.Context, id string) (Notebook, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Notebook{}, err
+	}
+	return svc.GetNotebook(ctx, id)
+}
+
+func (s *namespacedService) UpdateNotebook(ctx context.Context, nb Notebook) (Notebook, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Notebook{}, err
+	}
+	return svc.UpdateNotebook(ctx, nb)
+}
+
+func (s *namespacedService) ListNotebooks(ctx context.Context) ([]Notebook, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []Notebook{}, err
+	}
+	return svc.ListNotebooks(ctx)
+}
+
+func (s *namespacedService) DeleteNotebook(ctx context.Context, id, contents string) error {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return err
+	}
+	return svc.DeleteNotebook(ctx, id, contents)
+}
+
+func (s *namespacedService) ListTrash(ctx context.Context, startIdx, endIdx int) ([]ListNote, int, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return []ListNote{}, 0, err
+	}
+	return svc.ListTrash(ctx, startIdx, endIdx)
+}
+
+func (s *namespacedService) RestoreTrashed(ctx context.Context, id string) (Note, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return Note{}, err
+	}
+	return svc.RestoreTrashed(ctx, id)
+}
+
+func (s *namespacedService) Purge(ctx context.Context, id string) error {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return err
+	}
+	return svc.Purge(ctx, id)
+}
+
+// Reindex reconciles the index of every namespace with its notes. IDs in the
+// report are prefixed with the ID of the user whose namespace they're in, as
+// in <user id>/<note id>.
+func (s *namespacedService) Reindex(ctx context.Context, repair bool) (IndexReport, error) {
+	report := NewIndexReport()
+	err := s.eachNamespace(ctx, func(userID string, svc *service) error {
+		r, err := svc.Reindex(ctx, repair)
+		if err != nil {
+			return err
+		}
+
+		report.Notes += r.Notes
+		report.Indexed += r.Indexed
+		report.Missing = appendNamespaced(report.Missing, userID, r.Missing)
+		report.Orphaned = appendNamespaced(report.Orphaned, userID, r.Orphaned)
+		report.Stale = appendNamespaced(report.Stale, userID, r.Stale)
+		report.Repaired = report.Repaired || r.Repaired
+		return nil
+	})
+	if err != nil {
+		return IndexReport{}, err
+	}
+	return report, nil
+}
+
+func appendNamespaced(to []string, userID string, ids []string) []string {
+	for _, id := range ids {
+		to = append(to, userID+"/"+id)
+	}
+	return to
+}
+
+// PurgeExpired purges the expired notes from the trash of every namespace and
+// returns how many were purged
+func (s *namespacedService) PurgeExpired(ctx context.Context, retention time.Duration) (int, error) {
+	purged := 0
+	err := s.eachNamespace(ctx, func(userID string, svc *service) error {
+		n, err := svc.PurgeExpired(ctx, retention)
+		purged += n
+		return err
+	})
+	return purged, err
+}
+
+// PurgeEvery purges expired notes from the trash of every namespace on the
+// given interval until the context is done
+func (s *namespacedService) PurgeEvery(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := s.PurgeExpired(ctx, retention); err != nil {
+				log.Warn().Err(err).Str("func", "PurgeEvery").Msg("failed to purge trash")
+			}
+		}
+	}
+}
+
+// Adopt moves the notes stored outside of any namespace, by versions of the
+// server from before there were users, into the namespace of the user with the
+// ID along with their revisions and notebooks. Notes whose ID is already taken
+// in the namespace are left where they are. It returns how many notes were
+// moved.
+func (s *namespacedService) Adopt(ctx context.Context, userID string) (int, error) {
+	const funcName = "AdoptNotes"
+
+	log.Info().
+		Str("func", funcName).
+		Str("userId", userID).
+		Msg("adopting notes")
+
+	to, err := s.repo.Namespace(userID)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	// Notebooks go first so that the notes' notebooks exist when they arrive
+	if err := adoptNotebooks(ctx, s.repo, to); err != nil {
+		return 0, err
+	}
+
+	list, _, err := s.repo.List(ctx, 0, 0)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if t, ok := s.repo.(Trash); ok {
+		trashed, _, err := t.ListTrash(ctx, 0, 0)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		list = append(list, trashed...)
+	}
+
+	// The namespace's search index is rebuilt from its notes the next time
+	// it's loaded
+	s.mu.Lock()
+	delete(s.services, userID)
+	s.mu.Unlock()
+
+	moved := 0
+	for _, ln := range list {
+		n, ok, err := adoptNote(ctx, s.repo, to, ln.ID)
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			continue
+		}
+		moved++
+
+		if s.audit != nil {
+			e := audit.Event{Action: audit.ActionAdopt, OwnerID: userID, NoteID: n.ID, After: hashNote(n)}
+			if err := s.audit.Record(ctx, e); err != nil {
+				return moved, errors.WithStack(err)
+			}
+		}
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("userId", userID).
+		Int("notes", len(list)).
+		Int("moved", moved).
+		Msg("adopted notes")
+
+	return moved, nil
+}
+
+func adoptNotebooks(ctx context.Context, from, to Repository) error {
+	fnr, ok := from.(NotebookRepository)
+	if !ok {
+		return nil
+	}
+	tnr, ok := to.(NotebookRepository)
+	if !ok {
+		return errors.New("repository does not keep notebooks")
+	}
+
+	nbs, err := fnr.ListNotebooks(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, nb := range nbs {
+		if err := tnr.SaveNotebook(ctx, nb); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := fnr.DeleteNotebook(ctx, nb.ID); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// adoptNote moves the note and its revisions, returning it or reporting false
+// if it was left where it is. A note that was copied by an adoption that failed part way is
+// only removed.
+func adoptNote(ctx context.Context, from, to Repository, id string) (Note, bool, error) {
+	n, err := from.Get(ctx, id)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Note{}, false, nil
+		}
+		return Note{}, false, errors.WithStack(err)
+	}
+
+	existing, err := to.Get(ctx, id)
+	if err != nil && !core.IsErrNotFound(err) {
+		return Note{}, false, errors.WithStack(err)
+	}
+	if err == nil && (existing.Version != n.Version || !existing.Updated.Equal(n.Updated)) {
+		log.Warn().Str("func", "adoptNote").Str("id", id).Msg("note already exists in the namespace")
+		return Note{}, false, nil
+	}
+
+	frr, ok := from.(Revisioner)
+	if ok {
+		trr, ok := to.(Revisioner)
+		if !ok {
+			return Note{}, false, errors.New("repository does not keep revisions")
+		}
+
+		revs, err := frr.ListRevisions(ctx, id)
+		if err != nil {
+			return Note{}, false, errors.WithStack(err)
+		}
+		for _, r := range revs {
+			rev, err := frr.GetRevision(ctx, id, r.Version)
+			if err != nil {
+				return Note{}, false, errors.WithStack(err)
+			}
+			if err := trr.SaveRevision(ctx, rev); err != nil {
+				return Note{}, false, errors.WithStack(err)
+			}
+		}
+	}
+
+	// The note is only removed once its copy is saved, so a failure part way
+	// leaves it in both places rather than neither
+	if err := to.Save(ctx, n); err != nil {
+		return Note{}, false, errors.WithStack(err)
+	}
+	if ok {
+		if err := frr.DeleteRevisions(ctx, id); err != nil {
+			return Note{}, false, errors.WithStack(err)
+		}
+	}
+	if ss, ok := from.(SearchStore); ok {
+		if err := ss.DeleteSearchDocument(ctx, id); err != nil {
+			return Note{}, false, errors.WithStack(err)
+		}
+	}
+	if err := from.Delete(ctx, id); err != nil {
+		return Note{}, false, errors.WithStack(err)
+	}
+	return n, true, nil
+}
+
+func (s *namespacedService) eachNamespace(ctx context.Context, fn func(userID string, svc *service) error) error {
+	ids, err := s.repo.ListNamespaces(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, id := range ids {
+		svc, err := s.namespace(id)
+		if err != nil {
+			return err
+		}
+		if err := fn(id, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
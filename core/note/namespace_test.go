@@ -0,0 +1,198 @@
+package note_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// One user can never read, list, change or delete another user's notes, even
+// when their notes have the same IDs
+func TestNamespaceIsolation(t *testing.T) {
+	service := note.NewNamespacedService(&stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}, newMockNamespaceRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice"})
+	bob := user.NewContext(context.Background(), user.User{ID: "bob"})
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Title: "shared id", Data: "alice's walrus", Tags: []string{"alice"}})
+	mustCreate(alice, t, service, note.Note{ID: "secret", Data: "the walrus lives"})
+	mustCreate(bob, t, service, note.Note{ID: "1", Title: "shared id", Data: "bob's otter"})
+
+	n, err := service.Get(bob, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if n.Data != "bob's otter" || n.Version != 1 {
+		t.Errorf("got=[%v] want=[bob's own note at version 1]", n)
+	}
+
+	if _, err := service.Get(bob, "secret"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.Create(bob, note.Note{ID: "secret", Data: "overwritten"}, 1); !core.IsErrVersionMismatch(err) {
+		t.Errorf("got=[%v] want=[version mismatch]", err)
+	}
+	if err := service.Delete(bob, "secret"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.ListRevisions(bob, "secret"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	expectListed(alice, t, service, note.ListFilter{}, "1", "secret")
+	expectListed(bob, t, service, note.ListFilter{}, "1")
+	expectSearch(alice, t, service, "walrus", 0, 0, 2, "secret", "1")
+	expectSearch(bob, t, service, "walrus", 0, 0, 0)
+
+	tags, err := service.Tags(bob)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("got=[%v] want=[no tags]", tags)
+	}
+
+	if err := service.Delete(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectTrash(alice, t, service, "1")
+	expectTrash(bob, t, service)
+	if err := service.Purge(bob, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.Get(bob, "1"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+func TestNamespaceRequiresUser(t *testing.T) {
+	service := note.NewNamespacedService(&mockClock{}, newMockNamespaceRepo())
+
+	for _, ctx := range []context.Context{context.Background(), user.NewContext(context.Background(), user.User{})} {
+		if _, err := service.Get(ctx, "1"); errors.Cause(err) != note.ErrNoUser {
+			t.Errorf("got=[%v] want=[%v]", err, note.ErrNoUser)
+		}
+		if _, _, err := service.List(ctx, note.ListFilter{}, 0, 0); errors.Cause(err) != note.ErrNoUser {
+			t.Errorf("got=[%v] want=[%v]", err, note.ErrNoUser)
+		}
+	}
+}
+
+// Expired notes are purged from every namespace, not just those used since
+// the server started
+func TestNamespacePurgeExpired(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	repo := newMockNamespaceRepo()
+	service := note.NewNamespacedService(clock, repo)
+
+	for _, id := range []string{"alice", "bob"} {
+		ctx := user.NewContext(context.Background(), user.User{ID: id})
+		mustCreate(ctx, t, service, note.Note{ID: "1", Data: "data"})
+		if err := service.Delete(ctx, "1"); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	clock.now = clock.now.Add(48 * time.Hour)
+	purged, err := note.NewNamespacedService(clock, repo).PurgeExpired(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if purged != 2 {
+		t.Errorf("got=[%v] want=[2]", purged)
+	}
+}
+
+// Notes stored before there were namespaces are moved into a user's along
+// with their revisions and notebooks
+func TestAdopt(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockNamespaceRepo()
+	service := note.NewNamespacedService(&stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}, repo)
+	alice := user.NewContext(ctx, user.User{ID: "alice"})
+
+	repo.notebooks["nb"] = note.Notebook{ID: "nb", Name: "notebook"}
+	repo.notes["1"] = note.Note{ID: "1", Data: "version 2", NotebookID: "nb", Version: 2}
+	repo.revisions["1"] = map[int64]note.Note{1: {ID: "1", Data: "version 1", Version: 1}}
+	repo.notes["taken"] = note.Note{ID: "taken", Data: "legacy", Version: 1}
+	mustCreate(alice, t, service, note.Note{ID: "taken", Data: "alice's"})
+
+	// Copied by an earlier adoption that failed before removing it
+	repo.notes["copied"] = note.Note{ID: "copied", Data: "copied", Version: 1}
+	ns, _ := repo.Namespace("alice")
+	if err := ns.Save(ctx, repo.notes["copied"]); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	moved, err := service.Adopt(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if moved != 2 {
+		t.Errorf("got=[%v] want=[2]", moved)
+	}
+
+	n, err := service.Get(alice, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if n.Data != "version 2" || n.NotebookID != "nb" {
+		t.Errorf("got=[%v] want=[the adopted note]", n)
+	}
+	rev, err := service.GetRevision(alice, "1", 1)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if rev.Data != "version 1" {
+		t.Errorf("got=[%v] want=[version 1]", rev.Data)
+	}
+	if _, err := service.GetNotebook(alice, "nb"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+
+	if n, _ := service.Get(alice, "taken"); n.Data != "alice's" {
+		t.Errorf("got=[%v] want=[alice's]", n.Data)
+	}
+	if _, ok := repo.notes["taken"]; !ok {
+		t.Errorf("expected a note whose ID is taken to be left where it was")
+	}
+	if _, ok := repo.notes["copied"]; ok {
+		t.Errorf("expected a note copied by an earlier adoption to be removed")
+	}
+	if _, ok := repo.notes["1"]; ok || len(repo.revisions["1"]) != 0 || len(repo.notebooks) != 0 {
+		t.Errorf("expected the adopted note, its revisions and notebook to be removed")
+	}
+}
+
+// mockNamespaceRepo keeps every namespace in a mockSearchRepo of its own
+type mockNamespaceRepo struct {
+	*mockSearchRepo
+	namespaces map[string]*mockSearchRepo
+}
+
+func newMockNamespaceRepo() *mockNamespaceRepo {
+	return &mockNamespaceRepo{mockSearchRepo: newMockSearchRepo(), namespaces: make(map[string]*mockSearchRepo)}
+}
+
+func (r *mockNamespaceRepo) Namespace(userID string) (note.Repository, error) {
+	ns, ok := r.namespaces[userID]
+	if !ok {
+		ns = newMockSearchRepo()
+		r.namespaces[userID] = ns
+	}
+	return ns, nil
+}
+
+func (r *mockNamespaceRepo) ListNamespaces(ctx context.Context) ([]string, error) {
+	ids := make([]string, 0, len(r.namespaces))
+	for id := range r.namespaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,395 @@
+package note
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+)
+
+const (
+	// RootNotebook scopes a listing to the notes that aren't in any notebook
+	RootNotebook = "root"
+
+	// MaxNotebookNameLength is the longest a notebook's name may be
+	MaxNotebookNameLength = 256
+)
+
+// What happens to the notes and notebooks in a notebook when it's deleted
+const (
+	// MoveContents moves them up into the deleted notebook's parent
+	MoveContents = "move"
+	// TrashContents deletes the notebooks along with it and trashes the notes
+	// in all of them
+	TrashContents = "trash"
+)
+
+// A Notebook files notes, and other notebooks, together. A notebook without a
+// ParentID sits at the top level.
+type Notebook struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	ParentID string    `json:"parentId,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// NotebookRepository is implemented by repositories that can store notebooks
+type NotebookRepository interface {
+	SaveNotebook(ctx context.Context, nb Notebook) error
+	// GetNotebook returns the notebook or a core.ErrNotFound
+	GetNotebook(ctx context.Context, id string) (Notebook, error)
+	DeleteNotebook(ctx context.Context, id string) error
+	// ListNotebooks returns every notebook in no particular order
+	ListNotebooks(ctx context.Context) ([]Notebook, error)
+}
+
+// CreateNotebook saves a new notebook under a generated ID and returns it
+func (s *service) CreateNotebook(ctx context.Context, nb Notebook) (Notebook, error) {
+	const funcName = "CreateNotebook"
+
+	log.Info().
+		Str("func", funcName).
+		Str("name", nb.Name).
+		Str("parentId", nb.ParentID).
+		Msg("creating notebook")
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return Notebook{}, err
+	}
+
+	name, err := notebookName(nb.Name)
+	if err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	s.notebooksMu.Lock()
+	defer s.notebooksMu.Unlock()
+
+	if err = s.checkNotebook(ctx, nb.ParentID); err != nil {
+		return Notebook{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	now := s.clock.Now()
+	nb = Notebook{ID: id, Name: name, ParentID: nb.ParentID, Created: now, Updated: now}
+	if err = repo.SaveNotebook(ctx, nb); err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	return nb, nil
+}
+
+func (s *service) GetNotebook(ctx context.Context, id string) (Notebook, error) {
+	const funcName = "GetNotebook"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Msg("getting notebook")
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return Notebook{}, err
+	}
+
+	nb, err := repo.GetNotebook(ctx, id)
+	if err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+	return nb, nil
+}
+
+// UpdateNotebook renames the notebook and moves it under its ParentID. A
+// notebook can't be moved into itself or any of its own notebooks.
+func (s *service) UpdateNotebook(ctx context.Context, nb Notebook) (Notebook, error) {
+	const funcName = "UpdateNotebook"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", nb.ID).
+		Str("name", nb.Name).
+		Str("parentId", nb.ParentID).
+		Msg("updating notebook")
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return Notebook{}, err
+	}
+
+	name, err := notebookName(nb.Name)
+	if err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	s.notebooksMu.Lock()
+	defer s.notebooksMu.Unlock()
+
+	current, err := repo.GetNotebook(ctx, nb.ID)
+	if err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	if nb.ParentID != "" {
+		all, err := repo.ListNotebooks(ctx)
+		if err != nil {
+			return Notebook{}, errors.WithStack(err)
+		}
+
+		byID := make(map[string]Notebook, len(all))
+		for _, n := range all {
+			byID[n.ID] = n
+		}
+		if _, ok := byID[nb.ParentID]; !ok {
+			return Notebook{}, errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("notebook %q does not exist", nb.ParentID)})
+		}
+
+		seen := make(map[string]bool)
+		for id := nb.ParentID; id != "" && !seen[id]; id = byID[id].ParentID {
+			if id == nb.ID {
+				return Notebook{}, errors.WithStack(&core.ErrInvalid{Reason: "a notebook can't be moved into itself or one of its own notebooks"})
+			}
+			seen[id] = true
+		}
+	}
+
+	current.Name = name
+	current.ParentID = nb.ParentID
+	current.Updated = s.clock.Now()
+	if err = repo.SaveNotebook(ctx, current); err != nil {
+		return Notebook{}, errors.WithStack(err)
+	}
+
+	return current, nil
+}
+
+// ListNotebooks returns every notebook sorted by name
+func (s *service) ListNotebooks(ctx context.Context) ([]Notebook, error) {
+	const funcName = "ListNotebooks"
+
+	log.Info().
+		Str("func", funcName).
+		Msg("listing notebooks")
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return []Notebook{}, err
+	}
+
+	list, err := repo.ListNotebooks(ctx)
+	if err != nil {
+		return []Notebook{}, errors.WithStack(err)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// DeleteNotebook deletes the notebook. Its notes and notebooks are either
+// moved up into its parent (MoveContents, the default) or deleted along with
+// it (TrashContents), in which case the notes are moved into the trash.
+func (s *service) DeleteNotebook(ctx context.Context, id, contents string) error {
+	const funcName = "DeleteNotebook"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Str("contents", contents).
+		Msg("deleting notebook")
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return err
+	}
+
+	switch contents {
+	case "":
+		contents = MoveContents
+	case MoveContents, TrashContents:
+	default:
+		return errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("contents must be %q or %q", MoveContents, TrashContents)})
+	}
+
+	s.notebooksMu.Lock()
+	defer s.notebooksMu.Unlock()
+
+	nb, err := repo.GetNotebook(ctx, id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	all, err := repo.ListNotebooks(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	notes, _, err := s.repo.List(ctx, 0, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// The notebooks are only deleted once everything in them has been dealt
+	// with so a failure part way through can be retried
+	if contents == MoveContents {
+		for _, child := range all {
+			if child.ParentID != id {
+				continue
+			}
+			child.ParentID = nb.ParentID
+			child.Updated = s.clock.Now()
+			if err := repo.SaveNotebook(ctx, child); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		for _, ln := range notes {
+			if ln.NotebookID != id {
+				continue
+			}
+			if _, err := s.moveNote(ctx, ln.ID, nb.ParentID, AnyVersion); err != nil && !core.IsErrNotFound(err) {
+				return err
+			}
+		}
+		return errors.WithStack(repo.DeleteNotebook(ctx, id))
+	}
+
+	tree := descendants(all, id)
+	inTree := make(map[string]bool, len(tree))
+	for _, nbID := range tree {
+		inTree[nbID] = true
+	}
+	for _, ln := range notes {
+		if !inTree[ln.NotebookID] {
+			continue
+		}
+		if err := s.Delete(ctx, ln.ID); err != nil && !core.IsErrNotFound(err) {
+			return err
+		}
+	}
+	// Children go first so that a notebook is never left without its parent
+	for i := len(tree) - 1; i >= 0; i-- {
+		if err := repo.DeleteNotebook(ctx, tree[i]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// MoveNote files the note in the notebook, or in no notebook when notebookID
+// is empty, saving it as a new version. The expected version is checked the
+// same way Create does.
+func (s *service) MoveNote(ctx context.Context, id, notebookID string, expected int64) (Note, error) {
+	const funcName = "MoveNote"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Str("notebookId", notebookID).
+		Int64("version", expected).
+		Msg("moving note")
+
+	if err := s.checkNotebook(ctx, notebookID); err != nil {
+		return Note{}, err
+	}
+
+	return s.moveNote(ctx, id, notebookID, expected)
+}
+
+func (s *service) moveNote(ctx context.Context, id, notebookID string, expected int64) (Note, error) {
+	unlock := s.locks.Lock(id)
+	defer unlock()
+
+	n, err := s.get(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+
+	n.NotebookID = notebookID
+	return s.save(ctx, n, expected)
+}
+
+// checkNotebook returns a core.ErrInvalid if a note or notebook can't be
+// filed in the notebook because it doesn't exist. An empty ID is the top
+// level and always exists.
+func (s *service) checkNotebook(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+
+	repo, err := s.notebooks()
+	if err != nil {
+		return err
+	}
+
+	if _, err = repo.GetNotebook(ctx, id); err != nil {
+		if core.IsErrNotFound(err) {
+			return errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("notebook %q does not exist", id)})
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *service) notebooks() (NotebookRepository, error) {
+	repo, ok := s.repo.(NotebookRepository)
+	if !ok {
+		return nil, errors.New("repository does not keep notebooks")
+	}
+	return repo, nil
+}
+
+// descendants returns the notebook followed by every notebook beneath it,
+// parents always coming before their children
+func descendants(all []Notebook, id string) []string {
+	children := make(map[string][]string)
+	for _, nb := range all {
+		children[nb.ParentID] = append(children[nb.ParentID], nb.ID)
+	}
+
+	tree := []string{id}
+	seen := map[string]bool{id: true}
+	for i := 0; i < len(tree); i++ {
+		for _, child := range children[tree[i]] {
+			if !seen[child] {
+				seen[child] = true
+				tree = append(tree, child)
+			}
+		}
+	}
+	return tree
+}
+
+func notebookName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", &core.ErrInvalid{Reason: "notebook name is required"}
+	}
+	if len([]rune(name)) > MaxNotebookNameLength {
+		return "", &core.ErrInvalid{Reason: fmt.Sprintf("notebook name is longer than %d characters", MaxNotebookNameLength)}
+	}
+	return name, nil
+}
+
+// newID returns a random 128 bit ID, hex encoded
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
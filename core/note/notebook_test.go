@@ -0,0 +1,285 @@
+package note_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestNotebooks(t *testing.T) {
+	ctx := context.Background()
+
+	service := note.NewService(&mockClock{}, &mockRepo{})
+	if _, err := service.CreateNotebook(ctx, note.Notebook{Name: "work"}); err == nil {
+		t.Errorf("expected an error for a repository that doesn't keep notebooks")
+	}
+
+	service = note.NewService(&mockClock{}, newMockNotebookRepo())
+
+	for _, name := range []string{"", "  ", strings.Repeat("a", note.MaxNotebookNameLength+1)} {
+		if _, err := service.CreateNotebook(ctx, note.Notebook{Name: name}); !core.IsErrInvalid(err) {
+			t.Errorf("name %q: got=[%v] want=[invalid]", name, err)
+		}
+	}
+	if _, err := service.CreateNotebook(ctx, note.Notebook{Name: "work", ParentID: "missing"}); !core.IsErrInvalid(err) {
+		t.Errorf("missing parent: got=[%v] want=[invalid]", err)
+	}
+
+	work := mustCreateNotebook(ctx, t, service, " work ", "")
+	if work.ID == "" || work.Name != "work" || !work.Created.Equal((&mockClock{}).Now()) {
+		t.Errorf("got=[%v] want=[work with an id]", work)
+	}
+	projects := mustCreateNotebook(ctx, t, service, "projects", work.ID)
+	home := mustCreateNotebook(ctx, t, service, "home", "")
+
+	got, err := service.GetNotebook(ctx, projects.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got != projects {
+		t.Errorf("got=[%v] want=[%v]", got, projects)
+	}
+	if _, err := service.GetNotebook(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectNotebookNames(ctx, t, service, "home", "projects", "work")
+
+	if _, err := service.UpdateNotebook(ctx, note.Notebook{ID: work.ID, Name: "work", ParentID: work.ID}); !core.IsErrInvalid(err) {
+		t.Errorf("into itself: got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.UpdateNotebook(ctx, note.Notebook{ID: work.ID, Name: "work", ParentID: projects.ID}); !core.IsErrInvalid(err) {
+		t.Errorf("into a child: got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.UpdateNotebook(ctx, note.Notebook{ID: "missing", Name: "work"}); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	moved, err := service.UpdateNotebook(ctx, note.Notebook{ID: projects.ID, Name: "side projects", ParentID: home.ID})
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if moved.Name != "side projects" || moved.ParentID != home.ID || !moved.Created.Equal(projects.Created) {
+		t.Errorf("got=[%v] want=[side projects in home]", moved)
+	}
+	expectNotebookNames(ctx, t, service, "home", "side projects", "work")
+}
+
+func TestMoveNote(t *testing.T) {
+	ctx := context.Background()
+	service := note.NewService(&mockClock{}, newMockNotebookRepo())
+
+	work := mustCreateNotebook(ctx, t, service, "work", "")
+	home := mustCreateNotebook(ctx, t, service, "home", "")
+
+	if _, err := service.Create(ctx, note.Note{ID: "1", NotebookID: "missing"}, note.AnyVersion); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	for _, n := range []note.Note{{ID: "1", NotebookID: work.ID}, {ID: "2", NotebookID: work.ID}, {ID: "3"}} {
+		if _, err := service.Create(ctx, n, note.AnyVersion); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	if _, err := service.MoveNote(ctx, "1", "missing", note.AnyVersion); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.MoveNote(ctx, "1", home.ID, 2); !core.IsErrVersionMismatch(err) {
+		t.Errorf("got=[%v] want=[version mismatch]", err)
+	}
+	if _, err := service.MoveNote(ctx, "missing", home.ID, note.AnyVersion); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	moved, err := service.MoveNote(ctx, "1", home.ID, 1)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if moved.NotebookID != home.ID || moved.Version != 2 {
+		t.Errorf("got=[%v] want=[version 2 in home]", moved)
+	}
+
+	expectListed(ctx, t, service, note.ListFilter{Notebook: work.ID}, "2")
+	expectListed(ctx, t, service, note.ListFilter{Notebook: home.ID}, "1")
+	expectListed(ctx, t, service, note.ListFilter{Notebook: note.RootNotebook}, "3")
+
+	if _, err := service.MoveNote(ctx, "2", "", note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectListed(ctx, t, service, note.ListFilter{Notebook: note.RootNotebook}, "2", "3")
+}
+
+func TestDeleteNotebook(t *testing.T) {
+	ctx := context.Background()
+	service := note.NewService(&mockClock{}, newMockNotebookRepo())
+
+	work := mustCreateNotebook(ctx, t, service, "work", "")
+	projects := mustCreateNotebook(ctx, t, service, "projects", work.ID)
+	old := mustCreateNotebook(ctx, t, service, "old", projects.ID)
+	for _, n := range []note.Note{{ID: "1", NotebookID: work.ID}, {ID: "2", NotebookID: projects.ID}, {ID: "3", NotebookID: old.ID}} {
+		if _, err := service.Create(ctx, n, note.AnyVersion); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	if err := service.DeleteNotebook(ctx, projects.ID, "burn"); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if err := service.DeleteNotebook(ctx, "missing", ""); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	// The contents move up into work by default
+	if err := service.DeleteNotebook(ctx, projects.ID, ""); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNotebookNames(ctx, t, service, "old", "work")
+	expectListed(ctx, t, service, note.ListFilter{Notebook: work.ID}, "1", "2")
+	got, err := service.GetNotebook(ctx, old.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.ParentID != work.ID {
+		t.Errorf("got=[%v] want=[%v]", got.ParentID, work.ID)
+	}
+
+	// Trashing work takes old and every note in either with it
+	if err := service.DeleteNotebook(ctx, work.ID, note.TrashContents); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNotebookNames(ctx, t, service)
+	expectListed(ctx, t, service, note.ListFilter{})
+	expectTrash(ctx, t, service, "1", "2", "3")
+
+	// Restoring a note whose notebook is gone files it at the top level
+	restored, err := service.RestoreTrashed(ctx, "3")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if restored.NotebookID != "" {
+		t.Errorf("got=[%v] want=[]", restored.NotebookID)
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	ln := note.ListNote{ID: "1", Tags: []string{"home"}, NotebookID: "work"}
+
+	tests := []struct {
+		filter note.ListFilter
+		note   note.ListNote
+		want   bool
+	}{
+		{filter: note.ListFilter{}, note: ln, want: true},
+		{filter: note.ListFilter{Notebook: "work"}, note: ln, want: true},
+		{filter: note.ListFilter{Notebook: "home"}, note: ln, want: false},
+		{filter: note.ListFilter{Notebook: note.RootNotebook}, note: ln, want: false},
+		{filter: note.ListFilter{Notebook: note.RootNotebook}, note: note.ListNote{ID: "2"}, want: true},
+		{filter: note.ListFilter{Notebook: "work", TagFilter: note.TagFilter{Tags: []string{"home"}}}, note: ln, want: true},
+		{filter: note.ListFilter{Notebook: "work", TagFilter: note.TagFilter{Tags: []string{"play"}}}, note: ln, want: false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.Matches(test.note); got != test.want {
+			t.Errorf("%+v: got=[%v] want=[%v]", test.filter, got, test.want)
+		}
+	}
+}
+
+type notebookService interface {
+	CreateNotebook(context.Context, note.Notebook) (note.Notebook, error)
+	ListNotebooks(context.Context) ([]note.Notebook, error)
+	List(context.Context, note.ListFilter, int, int) ([]note.ListNote, int, error)
+}
+
+func mustCreateNotebook(ctx context.Context, t *testing.T, service notebookService, name, parentID string) note.Notebook {
+	t.Helper()
+	nb, err := service.CreateNotebook(ctx, note.Notebook{Name: name, ParentID: parentID})
+	if err != nil {
+		t.Fatalf("failed to create notebook %v: %v", name, err)
+	}
+	return nb
+}
+
+func expectNotebookNames(ctx context.Context, t *testing.T, service notebookService, want ...string) {
+	t.Helper()
+	list, err := service.ListNotebooks(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	got := make([]string, len(list))
+	for i, nb := range list {
+		got[i] = nb.Name
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v want=%v", got, want)
+	}
+}
+
+func expectListed(ctx context.Context, t *testing.T, service notebookService, filter note.ListFilter, want ...string) {
+	t.Helper()
+	list, total, err := service.List(ctx, filter, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	got := make([]string, len(list))
+	for i, ln := range list {
+		got[i] = ln.ID
+	}
+	if total != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%+v: got=%v (%v) want=%v", filter, got, total, want)
+	}
+}
+
+// mockNotebookRepo lists the live notes in ID order
+type mockNotebookRepo struct {
+	*mockTrashRepo
+	notebooks map[string]note.Notebook
+}
+
+func newMockNotebookRepo() *mockNotebookRepo {
+	return &mockNotebookRepo{
+		mockTrashRepo: &mockTrashRepo{mockRevisionRepo: newMockRevisionRepo()},
+		notebooks:     make(map[string]note.Notebook),
+	}
+}
+
+func (r *mockNotebookRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list := make([]note.ListNote, 0)
+	for _, n := range r.notes {
+		if !n.IsTrashed() {
+			list = append(list, note.ListNote{ID: n.ID, Tags: n.Tags, NotebookID: n.NotebookID})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return note.Page(list, startIdx, endIdx), len(list), nil
+}
+
+func (r *mockNotebookRepo) SaveNotebook(ctx context.Context, nb note.Notebook) error {
+	r.notebooks[nb.ID] = nb
+	return nil
+}
+
+func (r *mockNotebookRepo) GetNotebook(ctx context.Context, id string) (note.Notebook, error) {
+	nb, ok := r.notebooks[id]
+	if !ok {
+		return note.Notebook{}, &core.ErrNotFound{}
+	}
+	return nb, nil
+}
+
+func (r *mockNotebookRepo) DeleteNotebook(ctx context.Context, id string) error {
+	delete(r.notebooks, id)
+	return nil
+}
+
+func (r *mockNotebookRepo) ListNotebooks(ctx context.Context) ([]note.Notebook, error) {
+	list := make([]note.Notebook, 0, len(r.notebooks))
+	for _, nb := range r.notebooks {
+		list = append(list, nb)
+	}
+	return list, nil
+}
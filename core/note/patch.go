@@ -0,0 +1,138 @@
+package note
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/patch"
+)
+
+// A Patch changes some of a note's fields. Merge and JSON patches work on the
+// note's title, data, tags and notebookId, the other fields are managed by
+// the service and can't be patched.
+type Patch interface {
+	apply(n Note) (Note, error)
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396)
+type MergePatch json.RawMessage
+
+// JSONPatch is a JSON Patch (RFC 6902)
+type JSONPatch []patch.Operation
+
+// TextPatch splices text into the note's data, see patch.TextEdit
+type TextPatch []patch.TextEdit
+
+// patchable is the document merge and JSON patches are applied to
+type patchable struct {
+	Title      string   `json:"title"`
+	Data       string   `json:"data"`
+	Tags       []string `json:"tags"`
+	NotebookID string   `json:"notebookId"`
+}
+
+func (p MergePatch) apply(n Note) (Note, error) {
+	return applyToDocument(n, func(doc []byte) ([]byte, error) {
+		return patch.Merge(doc, p)
+	})
+}
+
+func (p JSONPatch) apply(n Note) (Note, error) {
+	return applyToDocument(n, func(doc []byte) ([]byte, error) {
+		return patch.Apply(doc, p)
+	})
+}
+
+func (p TextPatch) apply(n Note) (Note, error) {
+	data, err := patch.Splice(n.Data, p)
+	if err != nil {
+		return Note{}, &core.ErrInvalid{Reason: err.Error()}
+	}
+	n.Data = data
+	return n, nil
+}
+
+func applyToDocument(n Note, fn func(doc []byte) ([]byte, error)) (Note, error) {
+	tags := n.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	doc, err := json.Marshal(patchable{Title: n.Title, Data: n.Data, Tags: tags, NotebookID: n.NotebookID})
+	if err != nil {
+		return Note{}, err
+	}
+
+	patched, err := fn(doc)
+	if err != nil {
+		return Note{}, &core.ErrInvalid{Reason: err.Error()}
+	}
+
+	p := patchable{}
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&p); err != nil {
+		return Note{}, &core.ErrInvalid{Reason: "the patched note is invalid: " + err.Error()}
+	}
+
+	n.Title = p.Title
+	n.Data = p.Data
+	n.Tags = p.Tags
+	n.NotebookID = p.NotebookID
+	return n, nil
+}
+
+// Patch applies the patch to the note and saves it as a new version. The
+// note is locked while the patch is applied so that concurrent patches are
+// never lost. The expected version is checked the same way Create does.
+func (s *service) Patch(ctx context.Context, id string, p Patch, expected int64) (Note, error) {
+	return s.patch(ctx, id, p, expected, true)
+}
+
+// patch does the work of Patch, returning a core.ErrForbidden if the patch
+// moves the note to another notebook and move isn't set
+func (s *service) patch(ctx context.Context, id string, p Patch, expected int64, move bool) (Note, error) {
+	const funcName = "PatchNote"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Int64("version", expected).
+		Msg("patching note")
+
+	unlock := s.locks.Lock(id)
+	defer unlock()
+
+	current, err := s.get(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	if expected != AnyVersion && expected != current.Version {
+		return Note{}, errors.WithStack(&core.ErrVersionMismatch{Expected: expected, Actual: current.Version})
+	}
+
+	n, err := p.apply(current)
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	if n.Data == "" {
+		return Note{}, errors.WithStack(&core.ErrInvalid{Reason: "a note's data can't be empty"})
+	}
+
+	if n.Tags, err = NormalizeTags(n.Tags); err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	if n.NotebookID != current.NotebookID {
+		if !move {
+			return Note{}, errors.WithStack(&core.ErrForbidden{Reason: "only the owner can move the note to another notebook"})
+		}
+		if err = s.checkNotebook(ctx, n.NotebookID); err != nil {
+			return Note{}, err
+		}
+	}
+
+	return s.save(ctx, n, expected)
+}
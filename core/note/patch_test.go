@@ -0,0 +1,168 @@
+package note_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+	at := func(i int) *int { return &i }
+	existing := note.Note{ID: "1", Title: "title", Data: "some note", Tags: []string{"home"}, Version: 2}
+
+	tests := []struct {
+		name     string
+		patch    note.Patch
+		version  int64
+		wantErr  func(error) bool
+		wantNote string
+	}{
+		{
+			name:     "Merge",
+			patch:    note.MergePatch(`{"title": "new title", "tags": ["Work", "home"]}`),
+			version:  note.AnyVersion,
+			wantNote: "new title|some note|[home work]|",
+		},
+		{
+			name:     "Merge Removes",
+			patch:    note.MergePatch(`{"tags": null}`),
+			version:  2,
+			wantNote: "title|some note|[]|",
+		},
+		{
+			name:     "JSON",
+			patch:    note.JSONPatch{{Op: "test", Path: "/title", Value: []byte(`"title"`)}, {Op: "add", Path: "/tags/-", Value: []byte(`"work"`)}, {Op: "move", From: "/title", Path: "/data"}, {Op: "add", Path: "/title", Value: []byte(`""`)}},
+			version:  note.AnyVersion,
+			wantNote: "|title|[home work]|",
+		},
+		{
+			name:     "Text",
+			patch:    note.TextPatch{{Start: at(0), End: at(4), Text: "a"}, {Text: "!"}},
+			version:  note.AnyVersion,
+			wantNote: "title|a note!|[home]|",
+		},
+		{
+			name:    "Failed Test",
+			patch:   note.JSONPatch{{Op: "test", Path: "/title", Value: []byte(`"other"`)}},
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Unknown Field",
+			patch:   note.MergePatch(`{"id": "2"}`),
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Wrong Type",
+			patch:   note.MergePatch(`{"title": 5}`),
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Empty Data",
+			patch:   note.MergePatch(`{"data": null}`),
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Bad Tag",
+			patch:   note.MergePatch(`{"tags": ["two words"]}`),
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Missing Notebook",
+			patch:   note.MergePatch(`{"notebookId": "missing"}`),
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Text Out Of Range",
+			patch:   note.TextPatch{{Start: at(100)}},
+			version: note.AnyVersion,
+			wantErr: core.IsErrInvalid,
+		},
+		{
+			name:    "Stale",
+			patch:   note.MergePatch(`{"title": "new title"}`),
+			version: 1,
+			wantErr: core.IsErrVersionMismatch,
+		},
+	}
+
+	for _, test := range tests {
+		repo := newMockNotebookRepo()
+		repo.notes[existing.ID] = existing
+		service := note.NewService(&mockClock{}, repo)
+
+		got, err := service.Patch(ctx, existing.ID, test.patch, test.version)
+		if test.wantErr != nil {
+			if !test.wantErr(err) {
+				t.Errorf("%v: got=[%v] want=[an error]", test.name, err)
+			}
+			if repo.notes[existing.ID].Version != existing.Version {
+				t.Errorf("%v: expected the note not to be saved", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got=[%v] want=[nil]", test.name, err)
+			continue
+		}
+
+		if s := fmt.Sprintf("%v|%v|%v|%v", got.Title, got.Data, got.Tags, got.NotebookID); s != test.wantNote || got.Version != 3 {
+			t.Errorf("%v: got=[%v v%v] want=[%v v3]", test.name, s, got.Version, test.wantNote)
+		}
+		if saved := repo.notes[existing.ID]; saved.Version != 3 || saved.Title != got.Title || saved.Data != got.Data {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, saved, got)
+		}
+	}
+}
+
+func TestPatchMissing(t *testing.T) {
+	ctx := context.Background()
+	service := note.NewService(&mockClock{}, newMockNotebookRepo())
+
+	if _, err := service.Patch(ctx, "missing", note.MergePatch(`{"title": "new"}`), note.AnyVersion); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Concurrent text patches are applied one after the other so none of them
+// are lost
+func TestConcurrentPatches(t *testing.T) {
+	ctx := context.Background()
+	// The mock repository isn't safe for concurrent use by itself, the note's
+	// lock is all that keeps the goroutines apart
+	service := note.NewService(&mockClock{}, newMockRevisionRepo())
+	if _, err := service.Create(ctx, note.Note{ID: "1", Data: "x"}, note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	const count = 20
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.Patch(ctx, "1", note.TextPatch{{Text: "x"}}, note.AnyVersion); err != nil {
+				t.Errorf("got=[%v] want=[nil]", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := service.Get(ctx, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(n.Data) != count+1 || n.Version != count+1 {
+		t.Errorf("got=[%v characters v%v] want=[%v characters v%v]", len(n.Data), n.Version, count+1, count+1)
+	}
+}
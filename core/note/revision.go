@@ -0,0 +1,33 @@
+package note
+
+import (
+	"context"
+	"time"
+)
+
+// Revisioner is implemented by repositories that keep the previous versions
+// of notes
+type Revisioner interface {
+	// SaveRevision stores the note as a revision, replacing any revision
+	// already stored for its version
+	SaveRevision(ctx context.Context, note Note) error
+	// ListRevisions returns the stored revisions of a note, newest first
+	ListRevisions(ctx context.Context, id string) ([]Revision, error)
+	// GetRevision returns the note as it was at the given version or a
+	// core.ErrNotFound if that revision isn't stored
+	GetRevision(ctx context.Context, id string, version int64) (Note, error)
+	// DeleteRevisions removes every revision of a note
+	DeleteRevisions(ctx context.Context, id string) error
+}
+
+// A version of a note. Revisions are identified by the version of the note
+// they hold.
+type Revision struct {
+	Version int64     `json:"version"`
+	Updated time.Time `json:"updated"`
+	Current bool      `json:"current"`
+}
+
+func NewRevision(n Note) Revision {
+	return Revision{Version: n.Version, Updated: n.Updated}
+}
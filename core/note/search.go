@@ -0,0 +1,237 @@
+package note
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/search"
+)
+
+// SnippetSize is the number of words in a search result's snippet
+const SnippetSize = 30
+
+// SearchStore is implemented by repositories that persist the search index.
+// Each note's document is stored on its own so that saving a note never
+// rewrites the whole index.
+type SearchStore interface {
+	SaveSearchDocument(ctx context.Context, doc search.Document) error
+	DeleteSearchDocument(ctx context.Context, id string) error
+	ListSearchDocuments(ctx context.Context) ([]search.Document, error)
+}
+
+// SearchResult is a note matching a search, its score and a snippet of its
+// data with the matching words highlighted
+type SearchResult struct {
+	ListNote
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// Search returns the notes matching the query, most relevant first, between
+// startIdx (inclusive) and endIdx (exclusive) along with the total number of
+// matches. See search.ParseQuery for the query syntax.
+func (s *service) Search(ctx context.Context, query string, startIdx, endIdx int) ([]SearchResult, int, error) {
+	const funcName = "SearchNotes"
+
+	log.Info().
+		Str("func", funcName).
+		Str("query", query).
+		Int("startIdx", startIdx).
+		Int("endIdx", endIdx).
+		Msg("searching notes")
+
+	q := search.ParseQuery(query)
+	if q.IsEmpty() {
+		return []SearchResult{}, 0, errors.WithStack(&core.ErrInvalid{Reason: "the search has no words in it"})
+	}
+
+	ix, err := s.searchIndex(ctx)
+	if err != nil {
+		return []SearchResult{}, 0, err
+	}
+
+	hits := ix.Search(q)
+	start, end := pageBounds(len(hits), startIdx, endIdx)
+
+	results := make([]SearchResult, 0, end-start)
+	for _, h := range hits[start:end] {
+		n, err := s.repo.Get(ctx, h.ID)
+		if err != nil && !core.IsErrNotFound(err) {
+			return []SearchResult{}, 0, errors.WithStack(err)
+		}
+		// The index lags behind when updating it failed, it's caught up with
+		// the next time it's loaded
+		if err != nil || n.IsTrashed() {
+			log.Warn().
+				Str("func", funcName).
+				Str("id", h.ID).
+				Msg("search index has a note that doesn't exist")
+			continue
+		}
+
+		results = append(results, SearchResult{
+			ListNote: NewListNote(n),
+			Score:    h.Score,
+			Snippet:  snippet(n, q),
+		})
+	}
+
+	return results, len(hits), nil
+}
+
+// searchIndex returns the search index, loading it the first time it's used.
+// Loading reconciles the stored documents with the notes in the index,
+// analyzing notes whose document is missing or out of date and deleting
+// documents whose note is gone, so notes saved before the search index
+// existed are indexed on first use.
+func (s *service) searchIndex(ctx context.Context) (*search.Index, error) {
+	const funcName = "LoadSearchIndex"
+
+	store, err := s.searchStore()
+	if err != nil {
+		return nil, err
+	}
+
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+
+	if s.search != nil {
+		return s.search, nil
+	}
+
+	// The documents are listed before the notes so that any document listed
+	// belongs to a note that's either listed too or has since been deleted
+	docs, err := store.ListSearchDocuments(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	list, _, err := s.repo.List(ctx, 0, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	versions := make(map[string]int64, len(list))
+	for _, ln := range list {
+		versions[ln.ID] = ln.Version
+	}
+
+	ix := search.NewIndex()
+	removed := 0
+	for _, doc := range docs {
+		version, ok := versions[doc.ID]
+		if !ok {
+			if err := store.DeleteSearchDocument(ctx, doc.ID); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			removed++
+			continue
+		}
+		if version == doc.Version {
+			ix.Add(doc)
+			delete(versions, doc.ID)
+		}
+	}
+
+	analyzed := 0
+	for _, ln := range list {
+		if _, ok := versions[ln.ID]; !ok {
+			continue
+		}
+
+		n, err := s.repo.Get(ctx, ln.ID)
+		if err != nil {
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		doc := searchDocument(n)
+		if err := store.SaveSearchDocument(ctx, doc); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ix.Add(doc)
+		analyzed++
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("documents", ix.Len()).
+		Int("analyzed", analyzed).
+		Int("removed", removed).
+		Msg("loaded search index")
+
+	s.search = ix
+	return ix, nil
+}
+
+// indexNote adds the note to the search index. Results are always read back
+// from the repository so failing to update the index is logged rather than
+// failing the save.
+func (s *service) indexNote(ctx context.Context, n Note) {
+	store, ok := s.repo.(SearchStore)
+	if !ok {
+		return
+	}
+
+	doc := searchDocument(n)
+	if err := store.SaveSearchDocument(ctx, doc); err != nil {
+		log.Warn().Err(err).Str("func", "indexNote").Str("id", n.ID).Msg("failed to save search document")
+	}
+
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	if s.search != nil {
+		s.search.Add(doc)
+	}
+}
+
+// searchDocument analyzes the note for the search index. Only the plain text
+// of an encrypted note is analyzed, which is its title if that isn't
+// encrypted too.
+func searchDocument(n Note) search.Document {
+	if !n.Encrypted {
+		return search.Analyze(n.ID, n.Version, n.Title, n.Data)
+	}
+	title := n.Title
+	if IsEnvelope(title) {
+		title = ""
+	}
+	return search.Analyze(n.ID, n.Version, title, "")
+}
+
+// snippet returns the snippet of the note's data for a search result, there's
+// none for an encrypted note
+func snippet(n Note, q search.Query) string {
+	if n.Encrypted {
+		return ""
+	}
+	return search.Snippet(n.Data, q, SnippetSize)
+}
+
+// unindexNote takes the note out of the search index
+func (s *service) unindexNote(ctx context.Context, id string) {
+	store, ok := s.repo.(SearchStore)
+	if !ok {
+		return
+	}
+
+	if err := store.DeleteSearchDocument(ctx, id); err != nil {
+		log.Warn().Err(err).Str("func", "unindexNote").Str("id", id).Msg("failed to delete search document")
+	}
+
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	if s.search != nil {
+		s.search.Remove(id)
+	}
+}
+
+func (s *service) searchStore() (SearchStore, error) {
+	store, ok := s.repo.(SearchStore)
+	if !ok {
+		return nil, errors.New("repository does not keep a search index")
+	}
+	return store, nil
+}
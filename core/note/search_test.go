@@ -0,0 +1,161 @@
+package note_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/search"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+
+	service := note.NewService(&mockClock{}, &mockRepo{})
+	if _, _, err := service.Search(ctx, "dog", 0, 0); err == nil {
+		t.Errorf("expected an error for a repository that doesn't keep a search index")
+	}
+
+	repo := newMockSearchRepo()
+	service = note.NewService(&mockClock{}, repo)
+
+	if _, _, err := service.Search(ctx, ` "" , `, 0, 0); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+
+	mustCreate(ctx, t, service, note.Note{ID: "1", Title: "Shopping", Data: "Buy milk, then walk the dog"})
+	mustCreate(ctx, t, service, note.Note{ID: "2", Title: "Dogs", Data: "The dog needs walking"})
+	mustCreate(ctx, t, service, note.Note{ID: "3", Title: "Work", Data: "Quarterly numbers"})
+
+	expectSearch(ctx, t, service, "dogs", 0, 0, 2, "2", "1")
+	expectSearch(ctx, t, service, "dogs", 1, 2, 2, "1")
+	expectSearch(ctx, t, service, `"walk the dog"`, 0, 0, 1, "1")
+	expectSearch(ctx, t, service, "cat", 0, 0, 0)
+
+	results, _, err := service.Search(ctx, "milk", 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(results) != 1 || results[0].Title != "Shopping" || results[0].Score <= 0 ||
+		results[0].Snippet != "Buy <mark>milk</mark>, then walk the dog" {
+		t.Errorf("got=%+v want=[a scored result for 1]", results)
+	}
+
+	// Updates replace what was indexed and trashed notes drop out until
+	// they're restored
+	mustCreate(ctx, t, service, note.Note{ID: "3", Title: "Work", Data: "Take the dog to the vet"})
+	expectSearch(ctx, t, service, "dog", 0, 0, 3, "2", "1", "3")
+	expectSearch(ctx, t, service, "quarterly", 0, 0, 0)
+
+	if err := service.Delete(ctx, "2"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectSearch(ctx, t, service, "dog", 0, 0, 2, "1", "3")
+	if _, err := service.RestoreTrashed(ctx, "2"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectSearch(ctx, t, service, "dog", 0, 0, 3, "2", "1", "3")
+
+	if _, ok := repo.docs["2"]; !ok {
+		t.Errorf("expected the search document to be saved got=%v", repo.docs)
+	}
+}
+
+func TestLoadSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockSearchRepo()
+
+	// 1 was saved before search existed, 2's document is out of date and 3's
+	// note has been deleted
+	repo.notes["1"] = note.Note{ID: "1", Version: 1, Title: "Dogs"}
+	repo.notes["2"] = note.Note{ID: "2", Version: 2, Title: "Dogs"}
+	repo.docs["2"] = search.Analyze("2", 1, "Cats", "")
+	repo.docs["3"] = search.Analyze("3", 1, "Dogs", "")
+
+	service := note.NewService(&mockClock{}, repo)
+	expectSearch(ctx, t, service, "dog", 0, 0, 2, "1", "2")
+	expectSearch(ctx, t, service, "cat", 0, 0, 0)
+
+	got := make([]string, 0, len(repo.docs))
+	for id, doc := range repo.docs {
+		got = append(got, fmt.Sprintf("%v:%v", id, doc.Version))
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[1:1 2:2]" {
+		t.Errorf("got=%v want=[1:1 2:2]", got)
+	}
+}
+
+type searcher interface {
+	Create(ctx context.Context, n note.Note, expected int64) (note.Note, error)
+	Search(ctx context.Context, query string, startIdx, endIdx int) ([]note.SearchResult, int, error)
+}
+
+func expectSearch(ctx context.Context, t *testing.T, service searcher, query string, startIdx, endIdx, wantTotal int, want ...string) {
+	t.Helper()
+	results, total, err := service.Search(ctx, query, startIdx, endIdx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got := make([]string, len(results))
+	for i, r := range results {
+		got[i] = r.ID
+	}
+	if total != wantTotal || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%q: got=%v (%v) want=%v (%v)", query, got, total, want, wantTotal)
+	}
+}
+
+func mustCreate(ctx context.Context, t *testing.T, service searcher, n note.Note) {
+	t.Helper()
+	if _, err := service.Create(ctx, n, note.AnyVersion); err != nil {
+		t.Fatalf("failed to create note %v: %v", n.ID, err)
+	}
+}
+
+// mockSearchRepo lists the live notes with their versions so that loading the
+// search index can tell which documents are out of date
+type mockSearchRepo struct {
+	*mockNotebookRepo
+	docs map[string]search.Document
+}
+
+func newMockSearchRepo() *mockSearchRepo {
+	return &mockSearchRepo{
+		mockNotebookRepo: newMockNotebookRepo(),
+		docs:             make(map[string]search.Document),
+	}
+}
+
+func (r *mockSearchRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list := make([]note.ListNote, 0)
+	for _, n := range r.notes {
+		if !n.IsTrashed() {
+			list = append(list, note.NewListNote(n))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return note.Page(list, startIdx, endIdx), len(list), nil
+}
+
+func (r *mockSearchRepo) SaveSearchDocument(ctx context.Context, doc search.Document) error {
+	r.docs[doc.ID] = doc
+	return nil
+}
+
+func (r *mockSearchRepo) DeleteSearchDocument(ctx context.Context, id string) error {
+	delete(r.docs, id)
+	return nil
+}
+
+func (r *mockSearchRepo) ListSearchDocuments(ctx context.Context) ([]search.Document, error) {
+	docs := make([]search.Document, 0, len(r.docs))
+	for _, doc := range r.docs {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
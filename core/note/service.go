@@ -2,10 +2,16 @@ package note
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/diff"
+	"github.com/sksmith/note-server/core/search"
+	"github.com/sksmith/note-server/internal/lock"
 )
 
 func NewService(clock core.Clock, repo Repository) *service {
@@ -15,26 +21,199 @@ func NewService(clock core.Clock, repo Repository) *service {
 type service struct {
 	repo  Repository
 	clock core.Clock
+	locks lock.KeyedMutex
+
+	// notebooksMu serializes changes to the notebook tree so that concurrent
+	// moves can't create a cycle
+	notebooksMu sync.Mutex
+
+	// searchMu guards search, which is nil until the index is first used
+	searchMu sync.Mutex
+	search   *search.Index
+
+	// audit records changes to the notes of owner, when set
+	audit Recorder
+	owner string
 }
 
-func (s *service) Create(ctx context.Context, note Note) error {
+// Create saves the note, incrementing its version. If version is anything
+// other than AnyVersion it must match the stored note's version, a version of
+// zero meaning the note must not exist yet. If the repository keeps revisions
+// the note being replaced is stored as one. The saved note is returned.
+func (s *service) Create(ctx context.Context, note Note, version int64) (Note, error) {
 	const funcName = "CreateNote"
 
 	log.Info().
 		Str("func", funcName).
 		Str("id", note.ID).
+		Int64("version", version).
 		Msg("creating note")
 
+	tags, err := NormalizeTags(note.Tags)
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	note.Tags = tags
+
+	if err = s.checkNotebook(ctx, note.NotebookID); err != nil {
+		return Note{}, err
+	}
+
+	unlock := s.locks.Lock(note.ID)
+	defer unlock()
+
+	return s.save(ctx, note, version)
+}
+
+// Add saves the note under a newly generated ID and returns it. Any ID the
+// note already has is ignored.
+func (s *service) Add(ctx context.Context, note Note) (Note, error) {
+	const funcName = "AddNote"
+
+	id, err := newNoteID(s.clock.Now())
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	note.ID = id
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", note.ID).
+		Msg("adding note")
+
+	return s.Create(ctx, note, 0)
+}
+
+// Replace overwrites the note the same way Create does but returns a
+// core.ErrNotFound if the note doesn't exist, or is in the trash, unless
+// upsert is set. The note keeps its created time when the replacement doesn't
+// give one. It reports whether the note was created, which an upsert of a note
+// in the trash does too even though its versions carry on.
+func (s *service) Replace(ctx context.Context, note Note, version int64, upsert bool) (Note, bool, error) {
+	return s.replace(ctx, note, version, upsert, true)
+}
+
+// replace does the work of Replace, returning a core.ErrForbidden if the
+// replacement is in another notebook and move isn't set
+func (s *service) replace(ctx context.Context, note Note, version int64, upsert, move bool) (Note, bool, error) {
+	const funcName = "ReplaceNote"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", note.ID).
+		Int64("version", version).
+		Bool("upsert", upsert).
+		Msg("replacing note")
+
+	tags, err := NormalizeTags(note.Tags)
+	if err != nil {
+		return Note{}, false, errors.WithStack(err)
+	}
+	note.Tags = tags
+
+	// Without move the note stays in the notebook it's in, checked below
+	if move {
+		if err = s.checkNotebook(ctx, note.NotebookID); err != nil {
+			return Note{}, false, err
+		}
+	}
+
+	unlock := s.locks.Lock(note.ID)
+	defer unlock()
+
+	current, err := s.get(ctx, note.ID)
+	if err != nil && (!core.IsErrNotFound(err) || !upsert) {
+		return Note{}, false, err
+	}
+	created := err != nil
+	if !move && note.NotebookID != current.NotebookID {
+		return Note{}, false, errors.WithStack(&core.ErrForbidden{Reason: "only the owner can move the note to another notebook"})
+	}
+	if note.Created.IsZero() {
+		note.Created = current.Created
+	}
+
+	n, err := s.save(ctx, note, version)
+	if err != nil {
+		return Note{}, false, err
+	}
+	return n, created, nil
+}
+
+// save does the work of Create, the caller must hold the note's lock. The
+// note keeps the attachments it has, see attachment.go.
+func (s *service) save(ctx context.Context, note Note, version int64) (Note, error) {
+	return s.saveNote(ctx, note, version, false)
+}
+
+// saveNote saves the note, with the attachments it's given when attachments
+// is set
+func (s *service) saveNote(ctx context.Context, note Note, version int64, attachments bool) (Note, error) {
+	if len(note.ID) > MaxIDLength {
+		return Note{}, errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("a note's id can't be longer than %d bytes", MaxIDLength)})
+	}
+	current, exists, err := s.current(ctx, note.ID)
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	// A trashed note doesn't exist as far as the caller is concerned but its
+	// versions carry on from where it left off
+	actual := current.Version
+	if current.IsTrashed() {
+		actual = 0
+	}
+	if version != AnyVersion && version != actual {
+		return Note{}, errors.WithStack(&core.ErrVersionMismatch{Expected: version, Actual: actual})
+	}
+	if err := s.checkEncrypted(ctx, note); err != nil {
+		return Note{}, err
+	}
+
 	if note.Created.IsZero() {
 		note.Created = s.clock.Now()
 	}
 	note.Updated = s.clock.Now()
+	note.Version = current.Version + 1
+	note.Trashed = nil
+	if !attachments {
+		note.Attachments = current.Attachments
+	}
+
+	// The revision is saved first so that a failed save can only ever leave
+	// behind a revision identical to the current note
+	if rr, ok := s.repo.(Revisioner); ok && exists {
+		if err := rr.SaveRevision(ctx, current); err != nil {
+			return Note{}, errors.WithStack(err)
+		}
+	}
 
 	if err := s.repo.Save(ctx, note); err != nil {
-		return errors.WithStack(err)
+		return Note{}, errors.WithStack(err)
 	}
+	s.indexNote(ctx, note)
 
-	return nil
+	action := audit.ActionUpdate
+	if !exists || current.IsTrashed() {
+		action = audit.ActionCreate
+	}
+	if err := s.record(ctx, action, note.ID, current, note); err != nil {
+		return Note{}, err
+	}
+
+	return note, nil
+}
+
+// current returns the stored note and whether it exists. A note that doesn't
+// exist is returned with a version of zero.
+func (s *service) current(ctx context.Context, id string) (Note, bool, error) {
+	n, err := s.repo.Get(ctx, id)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return Note{}, false, nil
+		}
+		return Note{}, false, err
+	}
+	return n, true, nil
 }
 
 func (s *service) Get(ctx context.Context, id string) (Note, error) {
@@ -45,13 +224,27 @@ func (s *service) Get(ctx context.Context, id string) (Note, error) {
 		Str("id", id).
 		Msg("getting note")
 
+	return s.get(ctx, id)
+}
+
+// get returns the note, treating a trashed note as not found
+func (s *service) get(ctx context.Context, id string) (Note, error) {
+	// No note can be saved with an ID that long
+	if len(id) > MaxIDLength {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
 	note, err := s.repo.Get(ctx, id)
 	if err != nil {
 		return note, errors.WithStack(err)
 	}
+	if note.IsTrashed() {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
 	return note, nil
 }
 
+// Delete moves the note into the trash. Repositories without a trash delete
+// the note and its revisions for good.
 func (s *service) Delete(ctx context.Context, id string) error {
 	const funcName = "DeleteNote"
 
@@ -60,31 +253,249 @@ func (s *service) Delete(ctx context.Context, id string) error {
 		Str("id", id).
 		Msg("deleting note")
 
-	err := s.repo.Delete(ctx, id)
+	if _, ok := s.repo.(Trash); !ok {
+		before, _, err := s.current(ctx, id)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := s.purge(ctx, id); err != nil {
+			return err
+		}
+		return s.record(ctx, audit.ActionDelete, id, before, Note{})
+	}
+
+	unlock := s.locks.Lock(id)
+	defer unlock()
+
+	n, err := s.get(ctx, id)
 	if err != nil {
+		return err
+	}
+
+	before := n
+	now := s.clock.Now()
+	n.Trashed = &now
+	if err = s.repo.Save(ctx, n); err != nil {
 		return errors.WithStack(err)
 	}
-	return nil
+	s.unindexNote(ctx, id)
+	return s.record(ctx, audit.ActionTrash, id, before, n)
 }
 
-func (s *service) List(ctx context.Context, startIdx, endIdx int) ([]ListNote, error) {
+// ListRevisions returns every version of the note, newest first, starting
+// with the current one
+func (s *service) ListRevisions(ctx context.Context, id string) ([]Revision, error) {
+	const funcName = "ListRevisions"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Msg("listing revisions")
+
+	rr, err := s.revisioner()
+	if err != nil {
+		return []Revision{}, err
+	}
+
+	current, err := s.get(ctx, id)
+	if err != nil {
+		return []Revision{}, err
+	}
+
+	revs, err := rr.ListRevisions(ctx, id)
+	if err != nil {
+		return []Revision{}, errors.WithStack(err)
+	}
+
+	cur := NewRevision(current)
+	cur.Current = true
+	list := []Revision{cur}
+	for _, r := range revs {
+		// A revision of the current version is left behind when saving the
+		// note fails after its revision was stored
+		if r.Version >= current.Version {
+			continue
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// GetRevision returns the note as it was at the given version, which may be
+// the current one
+func (s *service) GetRevision(ctx context.Context, id string, version int64) (Note, error) {
+	const funcName = "GetRevision"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Int64("version", version).
+		Msg("getting revision")
+
+	rr, err := s.revisioner()
+	if err != nil {
+		return Note{}, err
+	}
+
+	current, err := s.get(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	if version == current.Version {
+		return current, nil
+	}
+	if version > current.Version {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+
+	n, err := rr.GetRevision(ctx, id, version)
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// Diff returns a unified diff of the note's data from one version to another.
+// Encrypted versions can't be diffed.
+func (s *service) Diff(ctx context.Context, id string, from, to int64) (string, error) {
+	const funcName = "DiffRevisions"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Int64("from", from).
+		Int64("to", to).
+		Msg("diffing revisions")
+
+	a, err := s.GetRevision(ctx, id, from)
+	if err != nil {
+		return "", err
+	}
+	b, err := s.GetRevision(ctx, id, to)
+	if err != nil {
+		return "", err
+	}
+	if a.Encrypted || b.Encrypted {
+		return "", errors.WithStack(&core.ErrInvalid{Reason: "encrypted notes can't be diffed"})
+	}
+
+	return diff.Unified(revisionName(a), revisionName(b), a.Data, b.Data, diff.DefaultContext), nil
+}
+
+// Restore saves the note as it was at the given version as a new version,
+// checking the current version the same way Create does. The note stays in
+// the notebook it's currently in.
+func (s *service) Restore(ctx context.Context, id string, version, expected int64) (Note, error) {
+	const funcName = "RestoreRevision"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Int64("version", version).
+		Msg("restoring revision")
+
+	n, err := s.GetRevision(ctx, id, version)
+	if err != nil {
+		return Note{}, err
+	}
+	current, err := s.get(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+	n.NotebookID = current.NotebookID
+
+	return s.Create(ctx, n, expected)
+}
+
+func (s *service) revisioner() (Revisioner, error) {
+	rr, ok := s.repo.(Revisioner)
+	if !ok {
+		return nil, errors.New("repository does not keep revisions")
+	}
+	return rr, nil
+}
+
+func revisionName(n Note) string {
+	return fmt.Sprintf("%s@%d", n.ID, n.Version)
+}
+
+// List returns the notes in the index that pass the filter between startIdx
+// (inclusive) and endIdx (exclusive) along with the total number of notes
+// that pass it.
+func (s *service) List(ctx context.Context, filter ListFilter, startIdx, endIdx int) ([]ListNote, int, error) {
 	const funcName = "ListNote"
 
 	log.Info().
 		Str("func", funcName).
+		Strs("tags", filter.Tags).
+		Bool("any", filter.Any).
+		Str("notebook", filter.Notebook).
+		Int("startIdx", startIdx).
+		Int("endIdx", endIdx).
 		Msg("listing notes")
 
-	list, err := s.repo.List(ctx, startIdx, endIdx)
+	if filter.IsEmpty() {
+		list, total, err := s.repo.List(ctx, startIdx, endIdx)
+		if err != nil {
+			return []ListNote{}, 0, errors.WithStack(err)
+		}
+		return list, total, nil
+	}
+
+	// The page can only be cut once the whole index has been filtered
+	all, _, err := s.repo.List(ctx, 0, 0)
 	if err != nil {
-		return []ListNote{}, errors.WithStack(err)
+		return []ListNote{}, 0, errors.WithStack(err)
 	}
 
-	return list, nil
+	matched := make([]ListNote, 0)
+	for _, ln := range all {
+		if filter.Matches(ln) {
+			matched = append(matched, ln)
+		}
+	}
+
+	return Page(matched, startIdx, endIdx), len(matched), nil
+}
+
+// Reindex reconciles the index with the stored notes, repairing it if asked
+func (s *service) Reindex(ctx context.Context, repair bool) (IndexReport, error) {
+	const funcName = "Reindex"
+
+	log.Info().
+		Str("func", funcName).
+		Bool("repair", repair).
+		Msg("reindexing notes")
+
+	r, ok := s.repo.(Reindexer)
+	if !ok {
+		return IndexReport{}, errors.New("repository does not support reindexing")
+	}
+
+	report, err := r.Reindex(ctx, repair)
+	if err != nil {
+		return IndexReport{}, errors.WithStack(err)
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("notes", report.Notes).
+		Int("indexed", report.Indexed).
+		Int("missing", len(report.Missing)).
+		Int("orphaned", len(report.Orphaned)).
+		Int("stale", len(report.Stale)).
+		Bool("repaired", report.Repaired).
+		Msg("reindexed notes")
+
+	return report, nil
 }
 
 type Repository interface {
 	Save(ctx context.Context, note Note) error
 	Get(ctx context.Context, id string) (Note, error)
 	Delete(ctx context.Context, id string) error
-	List(ctx context.Context, startIdx, endIdx int) ([]ListNote, error)
+	// List returns the notes in the index between startIdx (inclusive) and
+	// endIdx (exclusive) and the total number of notes in the index. An endIdx
+	// of zero or less means the end of the index.
+	List(ctx context.Context, startIdx, endIdx int) ([]ListNote, int, error)
 }
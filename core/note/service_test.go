@@ -2,13 +2,19 @@ package note_test
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 
+	"github.com/sksmith/note-server/core"
 	"github.com/sksmith/note-server/core/note"
 )
 
@@ -33,12 +39,12 @@ func TestCreate(t *testing.T) {
 		{
 			ctx:      context.Background(),
 			input:    note.Note{ID: "id", Data: "some note"},
-			wantNote: note.Note{ID: "id", Data: "some note", Created: mc.Now(), Updated: mc.Now()},
+			wantNote: note.Note{ID: "id", Data: "some note", Version: 1, Created: mc.Now(), Updated: mc.Now()},
 		},
 		{
 			ctx:      context.Background(),
 			input:    note.Note{ID: "id", Data: "some note", Created: othertime, Updated: othertime},
-			wantNote: note.Note{ID: "id", Data: "some note", Created: othertime, Updated: mc.Now()},
+			wantNote: note.Note{ID: "id", Data: "some note", Version: 1, Created: othertime, Updated: mc.Now()},
 		},
 		{
 			ctx:     context.Background(),
@@ -55,13 +61,202 @@ func TestCreate(t *testing.T) {
 		}
 		service := note.NewService(&mc, &mr)
 
-		err := service.Create(test.ctx, test.input)
+		got, err := service.Create(test.ctx, test.input, note.AnyVersion)
 		if errors.Cause(err) != test.wantErr {
 			t.Errorf("got=[%v] want=[%v]", err, test.wantErr)
 		}
-		if mr.savedNote != test.wantNote {
+		if !reflect.DeepEqual(mr.savedNote, test.wantNote) {
 			t.Errorf("got=[%v] want=[%v]", mr.savedNote, test.wantNote)
 		}
+		if !reflect.DeepEqual(got, test.wantNote) {
+			t.Errorf("got=[%v] want=[%v]", got, test.wantNote)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+	rr := newMockRevisionRepo()
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	service := note.NewService(clock, rr)
+
+	a, err := service.Add(ctx, note.Note{ID: "ignored", Data: "a"})
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	b, err := service.Add(ctx, note.Note{Data: "b"})
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, n := range []note.Note{a, b} {
+		if !uuid.MatchString(n.ID) || n.Version != 1 {
+			t.Errorf("got=[%v] want=[a version 7 uuid at version 1]", n)
+		}
+		if _, ok := rr.notes[n.ID]; !ok {
+			t.Errorf("expected %v to be saved", n.ID)
+		}
+	}
+	if a.ID == b.ID {
+		t.Errorf("expected different ids got=[%v]", a.ID)
+	}
+	// The IDs start with the time they were created at in milliseconds
+	ms := fmt.Sprintf("%012x", clock.now.UnixNano()/int64(time.Millisecond))
+	if !strings.HasPrefix(a.ID, ms[:8]+"-"+ms[8:]) {
+		t.Errorf("got=[%v] want=[an id starting with %v]", a.ID, ms)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	ctx := context.Background()
+	created := (&mockClock{}).Now().Add(-time.Hour)
+
+	tests := []struct {
+		name        string
+		existing    []note.Note
+		input       note.Note
+		version     int64
+		upsert      bool
+		wantErr     func(error) bool
+		wantVersion int64
+		wantCreated time.Time
+		wantNew     bool
+	}{
+		{
+			name:        "Replaced",
+			existing:    []note.Note{{ID: "1", Data: "old", Version: 2, Created: created}},
+			input:       note.Note{ID: "1", Data: "new"},
+			version:     note.AnyVersion,
+			wantVersion: 3,
+			wantCreated: created,
+		},
+		{
+			name:    "Missing",
+			input:   note.Note{ID: "1", Data: "new"},
+			version: note.AnyVersion,
+			wantErr: core.IsErrNotFound,
+		},
+		{
+			name:     "Trashed",
+			existing: []note.Note{{ID: "1", Data: "old", Version: 2, Trashed: &created}},
+			input:    note.Note{ID: "1", Data: "new"},
+			version:  note.AnyVersion,
+			wantErr:  core.IsErrNotFound,
+		},
+		{
+			name:        "Upserted",
+			input:       note.Note{ID: "1", Data: "new"},
+			version:     note.AnyVersion,
+			upsert:      true,
+			wantVersion: 1,
+			wantCreated: (&mockClock{}).Now(),
+			wantNew:     true,
+		},
+		{
+			name:        "Upserted From Trash",
+			existing:    []note.Note{{ID: "1", Data: "old", Version: 2, Created: created, Trashed: &created}},
+			input:       note.Note{ID: "1", Data: "new"},
+			version:     note.AnyVersion,
+			upsert:      true,
+			wantVersion: 3,
+			wantCreated: (&mockClock{}).Now(),
+			wantNew:     true,
+		},
+		{
+			name:     "Stale",
+			existing: []note.Note{{ID: "1", Data: "old", Version: 2}},
+			input:    note.Note{ID: "1", Data: "new"},
+			version:  1,
+			wantErr:  core.IsErrVersionMismatch,
+		},
+	}
+
+	for _, test := range tests {
+		rr := newMockRevisionRepo()
+		for _, n := range test.existing {
+			rr.notes[n.ID] = n
+		}
+		service := note.NewService(&mockClock{}, rr)
+
+		got, isNew, err := service.Replace(ctx, test.input, test.version, test.upsert)
+		if test.wantErr != nil {
+			if !test.wantErr(err) {
+				t.Errorf("%v: got=[%v] want=[an error]", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		if got.Version != test.wantVersion || !got.Created.Equal(test.wantCreated) || got.Data != "new" || isNew != test.wantNew {
+			t.Errorf("%v: got=[%v, %v] want=[version %v created at %v, %v]", test.name, got, isNew, test.wantVersion, test.wantCreated, test.wantNew)
+		}
+	}
+}
+
+// IDs too long to store a note under are refused, and can't be found
+func TestLongID(t *testing.T) {
+	ctx := context.Background()
+	service := note.NewService(&mockClock{}, newMockRevisionRepo())
+
+	id := strings.Repeat("a", note.MaxIDLength+1)
+	if _, err := service.Create(ctx, note.Note{ID: id, Data: "new"}, note.AnyVersion); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if _, _, err := service.Replace(ctx, note.Note{ID: id, Data: "new"}, note.AnyVersion, true); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if _, err := service.Get(ctx, id); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.Create(ctx, note.Note{ID: id[1:], Data: "new"}, note.AnyVersion); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+func TestCreateVersion(t *testing.T) {
+	mc := mockClock{}
+
+	tests := []struct {
+		name        string
+		repoNote    note.Note
+		repoErr     error
+		version     int64
+		wantVersion int64
+		wantErr     bool
+	}{
+		{name: "any version", repoNote: note.Note{ID: "id", Version: 3}, version: note.AnyVersion, wantVersion: 4},
+		{name: "matching version", repoNote: note.Note{ID: "id", Version: 3}, version: 3, wantVersion: 4},
+		{name: "stale version", repoNote: note.Note{ID: "id", Version: 3}, version: 2, wantErr: true},
+		{name: "must not exist", repoNote: note.Note{ID: "id", Version: 3}, version: 0, wantErr: true},
+		{name: "new note", repoErr: &core.ErrNotFound{}, version: 0, wantVersion: 1},
+		{name: "missing note", repoErr: &core.ErrNotFound{}, version: 1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		mr := mockRepo{
+			returnNote: test.repoNote,
+			getErr:     test.repoErr,
+		}
+		service := note.NewService(&mc, &mr)
+
+		got, err := service.Create(context.Background(), note.Note{ID: "id", Data: "some note"}, test.version)
+		if test.wantErr {
+			if !core.IsErrVersionMismatch(err) {
+				t.Errorf("%v: got=[%v] want=[version mismatch]", test.name, err)
+			}
+			if !reflect.DeepEqual(mr.savedNote, note.Note{}) {
+				t.Errorf("%v: expected nothing to be saved got=[%v]", test.name, mr.savedNote)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		if got.Version != test.wantVersion || mr.savedNote.Version != test.wantVersion {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, got.Version, test.wantVersion)
+		}
 	}
 }
 
@@ -102,7 +297,7 @@ func TestGet(t *testing.T) {
 		if errors.Cause(err) != test.wantErr {
 			t.Errorf("got=[%v] want=[%v]", err, test.wantErr)
 		}
-		if got != test.wantNote {
+		if !reflect.DeepEqual(got, test.wantNote) {
 			t.Errorf("got=[%v] want=[%v]", got, test.wantNote)
 		}
 	}
@@ -152,8 +347,10 @@ func TestList(t *testing.T) {
 		startIdx      int
 		endIdx        int
 		repoListNotes []note.ListNote
+		repoTotal     int
 		repoErr       error
 		wantListNotes []note.ListNote
+		wantTotal     int
 		wantErr       error
 	}{
 		{
@@ -166,6 +363,21 @@ func TestList(t *testing.T) {
 				{ID: "1", Title: "Some Title"},
 				{ID: "2", Title: "Some Other Title"},
 			},
+			repoTotal: 2,
+			wantTotal: 2,
+		},
+		{
+			ctx:      context.Background(),
+			startIdx: 1,
+			endIdx:   2,
+			repoListNotes: []note.ListNote{
+				{ID: "2", Title: "Some Other Title"},
+			},
+			repoTotal: 3,
+			wantListNotes: []note.ListNote{
+				{ID: "2", Title: "Some Other Title"},
+			},
+			wantTotal: 3,
 		},
 		{
 			ctx:     context.Background(),
@@ -177,19 +389,26 @@ func TestList(t *testing.T) {
 	for _, test := range tests {
 		mr := mockRepo{
 			returnListNote: test.repoListNotes,
+			returnTotal:    test.repoTotal,
 			returnErr:      test.repoErr,
 		}
 		service := note.NewService(&mc, &mr)
 
-		got, err := service.List(test.ctx, test.startIdx, test.endIdx)
+		got, total, err := service.List(test.ctx, note.ListFilter{}, test.startIdx, test.endIdx)
 		if errors.Cause(err) != test.wantErr {
 			t.Errorf("got=[%v] want=[%v]", err, test.wantErr)
 		}
+		if total != test.wantTotal {
+			t.Errorf("got=[%v] want=[%v]", total, test.wantTotal)
+		}
+		if mr.listStartIdx != test.startIdx || mr.listEndIdx != test.endIdx {
+			t.Errorf("got=[%v,%v] want=[%v,%v]", mr.listStartIdx, mr.listEndIdx, test.startIdx, test.endIdx)
+		}
 		if len(got) != len(test.wantListNotes) {
 			t.Errorf("got=[%v] want=[%v]", len(got), len(test.wantListNotes))
 		}
 		for i, ln := range got {
-			if test.wantListNotes[i] != ln {
+			if !reflect.DeepEqual(test.wantListNotes[i], ln) {
 				t.Errorf("got=[%v] want=[%v]", err, test.wantErr)
 			}
 		}
@@ -205,9 +424,13 @@ func (m *mockClock) Now() time.Time {
 
 type mockRepo struct {
 	returnErr      error
+	getErr         error
 	returnNote     note.Note
 	returnListNote []note.ListNote
+	returnTotal    int
 	savedNote      note.Note
+	listStartIdx   int
+	listEndIdx     int
 }
 
 func (r *mockRepo) Save(ctx context.Context, note note.Note) error {
@@ -219,6 +442,9 @@ func (r *mockRepo) Save(ctx context.Context, note note.Note) error {
 }
 
 func (r *mockRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	if r.getErr != nil {
+		return note.Note{}, r.getErr
+	}
 	return r.returnNote, r.returnErr
 }
 
@@ -226,6 +452,380 @@ func (r *mockRepo) Delete(ctx context.Context, id string) error {
 	return r.returnErr
 }
 
-func (r *mockRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, error) {
-	return r.returnListNote, r.returnErr
+func (r *mockRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	r.listStartIdx = startIdx
+	r.listEndIdx = endIdx
+	return r.returnListNote, r.returnTotal, r.returnErr
+}
+
+func TestPage(t *testing.T) {
+	list := []note.ListNote{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+
+	tests := []struct {
+		startIdx int
+		endIdx   int
+		want     []string
+	}{
+		{startIdx: 0, endIdx: 0, want: []string{"1", "2", "3"}},
+		{startIdx: 0, endIdx: 2, want: []string{"1", "2"}},
+		{startIdx: 1, endIdx: 0, want: []string{"2", "3"}},
+		{startIdx: 2, endIdx: 10, want: []string{"3"}},
+		{startIdx: 3, endIdx: 5, want: []string{}},
+		{startIdx: -1, endIdx: 1, want: []string{"1"}},
+	}
+
+	for _, test := range tests {
+		got := note.Page(list, test.startIdx, test.endIdx)
+		if len(got) != len(test.want) {
+			t.Errorf("start=%v end=%v: got=[%v] want=[%v]", test.startIdx, test.endIdx, got, test.want)
+			continue
+		}
+		for i, ln := range got {
+			if ln.ID != test.want[i] {
+				t.Errorf("start=%v end=%v: got=[%v] want=[%v]", test.startIdx, test.endIdx, ln.ID, test.want[i])
+			}
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	mc := mockClock{}
+
+	service := note.NewService(&mc, &mockRepo{})
+	if _, err := service.Reindex(context.Background(), false); err == nil {
+		t.Errorf("expected an error for a repository that can't reindex")
+	}
+
+	rr := &mockReindexRepo{}
+	service = note.NewService(&mc, rr)
+	report, err := service.Reindex(context.Background(), true)
+	if err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+	if !rr.repair || !report.Repaired {
+		t.Errorf("expected the repository to be asked to repair")
+	}
+}
+
+type mockReindexRepo struct {
+	mockRepo
+	repair bool
+}
+
+func (r *mockReindexRepo) Reindex(ctx context.Context, repair bool) (note.IndexReport, error) {
+	r.repair = repair
+	report := note.NewIndexReport()
+	report.Repaired = repair
+	return report, nil
+}
+
+func TestRevisions(t *testing.T) {
+	mc := mockClock{}
+	ctx := context.Background()
+
+	service := note.NewService(&mc, &mockRepo{})
+	if _, err := service.ListRevisions(ctx, "id"); err == nil {
+		t.Errorf("expected an error for a repository that doesn't keep revisions")
+	}
+
+	rr := newMockRevisionRepo()
+	service = note.NewService(&mc, rr)
+	for _, data := range []string{"one\n", "two\n", "three\n"} {
+		if _, err := service.Create(ctx, note.Note{ID: "id", Data: data}, note.AnyVersion); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	revs, err := service.ListRevisions(ctx, "id")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(revs) != 3 || revs[0].Version != 3 || !revs[0].Current || revs[1].Version != 2 || revs[1].Current || revs[2].Version != 1 {
+		t.Errorf("got=[%v] want=[3 (current), 2, 1]", revs)
+	}
+
+	tests := []struct {
+		version  int64
+		wantData string
+		wantErr  bool
+	}{
+		{version: 1, wantData: "one\n"},
+		{version: 2, wantData: "two\n"},
+		{version: 3, wantData: "three\n"},
+		{version: 4, wantErr: true},
+		{version: 0, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := service.GetRevision(ctx, "id", test.version)
+		if test.wantErr {
+			if !core.IsErrNotFound(err) {
+				t.Errorf("version %v: got=[%v] want=[not found]", test.version, err)
+			}
+			continue
+		}
+		if err != nil || got.Data != test.wantData || got.Version != test.version {
+			t.Errorf("version %v: got=[%v,%v] want=[%v]", test.version, got, err, test.wantData)
+		}
+	}
+
+	d, err := service.Diff(ctx, "id", 1, 3)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	want := "--- id@1\n+++ id@3\n@@ -1 +1 @@\n-one\n+three\n"
+	if d != want {
+		t.Errorf("got=[%v] want=[%v]", d, want)
+	}
+
+	if _, err = service.Restore(ctx, "id", 1, 2); !core.IsErrVersionMismatch(err) {
+		t.Errorf("got=[%v] want=[version mismatch]", err)
+	}
+	restored, err := service.Restore(ctx, "id", 1, 3)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if restored.Version != 4 || restored.Data != "one\n" {
+		t.Errorf("got=[%v] want=[version 4 of one]", restored)
+	}
+	if _, ok := rr.revisions["id"][3]; !ok {
+		t.Errorf("expected the restored over version to be kept")
+	}
+
+	if err = service.Delete(ctx, "id"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(rr.revisions["id"]) != 0 {
+		t.Errorf("expected revisions to be deleted with the note got=[%v]", rr.revisions["id"])
+	}
+}
+
+type mockRevisionRepo struct {
+	notes     map[string]note.Note
+	revisions map[string]map[int64]note.Note
+}
+
+func newMockRevisionRepo() *mockRevisionRepo {
+	return &mockRevisionRepo{
+		notes:     make(map[string]note.Note),
+		revisions: make(map[string]map[int64]note.Note),
+	}
+}
+
+func (r *mockRevisionRepo) Save(ctx context.Context, n note.Note) error {
+	r.notes[n.ID] = n
+	return nil
+}
+
+func (r *mockRevisionRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	n, ok := r.notes[id]
+	if !ok {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	return n, nil
+}
+
+func (r *mockRevisionRepo) Delete(ctx context.Context, id string) error {
+	delete(r.notes, id)
+	return nil
+}
+
+func (r *mockRevisionRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	return []note.ListNote{}, 0, nil
+}
+
+func (r *mockRevisionRepo) SaveRevision(ctx context.Context, n note.Note) error {
+	if r.revisions[n.ID] == nil {
+		r.revisions[n.ID] = make(map[int64]note.Note)
+	}
+	r.revisions[n.ID][n.Version] = n
+	return nil
+}
+
+func (r *mockRevisionRepo) ListRevisions(ctx context.Context, id string) ([]note.Revision, error) {
+	revs := make([]note.Revision, 0)
+	for v := int64(len(r.revisions[id]) + 1); v > 0; v-- {
+		if n, ok := r.revisions[id][v]; ok {
+			revs = append(revs, note.NewRevision(n))
+		}
+	}
+	return revs, nil
+}
+
+func (r *mockRevisionRepo) GetRevision(ctx context.Context, id string, version int64) (note.Note, error) {
+	n, ok := r.revisions[id][version]
+	if !ok {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	return n, nil
+}
+
+func (r *mockRevisionRepo) DeleteRevisions(ctx context.Context, id string) error {
+	delete(r.revisions, id)
+	return nil
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+
+	service := note.NewService(&mockClock{}, &mockRepo{})
+	if _, _, err := service.ListTrash(ctx, 0, 0); err == nil {
+		t.Errorf("expected an error for a repository that doesn't keep a trash")
+	}
+
+	clock := &stepClock{now: time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)}
+	repo := &mockTrashRepo{mockRevisionRepo: newMockRevisionRepo()}
+	service = note.NewService(clock, repo)
+
+	for _, id := range []string{"1", "2"} {
+		if _, err := service.Create(ctx, note.Note{ID: id, Data: "some note"}, note.AnyVersion); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	if err := service.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Delete(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("deleting twice: got=[%v] want=[not found]", err)
+	}
+	if _, err := service.Get(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.ListRevisions(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectTrash(ctx, t, service, "1")
+
+	if err := service.Purge(ctx, "2"); !core.IsErrNotFound(err) {
+		t.Errorf("purging a live note: got=[%v] want=[not found]", err)
+	}
+
+	restored, err := service.RestoreTrashed(ctx, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if restored.IsTrashed() || restored.Version != 1 {
+		t.Errorf("got=[%v] want=[untrashed version 1]", restored)
+	}
+	if _, err := service.RestoreTrashed(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("restoring twice: got=[%v] want=[not found]", err)
+	}
+	expectTrash(ctx, t, service)
+
+	if err := service.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Purge(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.Get(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[purged]", err)
+	}
+	expectTrash(ctx, t, service)
+}
+
+func TestCreateOverTrashed(t *testing.T) {
+	ctx := context.Background()
+	repo := &mockTrashRepo{mockRevisionRepo: newMockRevisionRepo()}
+	service := note.NewService(&mockClock{}, repo)
+
+	if _, err := service.Create(ctx, note.Note{ID: "1", Data: "some note"}, note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, err := service.Create(ctx, note.Note{ID: "1", Data: "new note"}, 1); !core.IsErrVersionMismatch(err) {
+		t.Errorf("got=[%v] want=[version mismatch]", err)
+	}
+
+	// The note doesn't exist as far as preconditions go, but versions carry on
+	got, err := service.Create(ctx, note.Note{ID: "1", Data: "new note"}, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.IsTrashed() || got.Version != 2 {
+		t.Errorf("got=[%v] want=[untrashed version 2]", got)
+	}
+	expectTrash(ctx, t, service)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	clock := &stepClock{now: time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)}
+	repo := &mockTrashRepo{mockRevisionRepo: newMockRevisionRepo()}
+	service := note.NewService(clock, repo)
+
+	for _, id := range []string{"old", "new", "live"} {
+		if _, err := service.Create(ctx, note.Note{ID: id, Data: "some note"}, note.AnyVersion); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	if err := service.Delete(ctx, "old"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	clock.now = clock.now.Add(48 * time.Hour)
+	if err := service.Delete(ctx, "new"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+
+	purged, err := service.PurgeExpired(ctx, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if purged != 1 {
+		t.Errorf("got=[%v] want=[1]", purged)
+	}
+	if _, err := repo.Get(ctx, "old"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[purged]", err)
+	}
+	if _, err := service.Get(ctx, "live"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+	expectTrash(ctx, t, service, "new")
+}
+
+type trashLister interface {
+	ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error)
+}
+
+func expectTrash(ctx context.Context, t *testing.T, service trashLister, want ...string) {
+	t.Helper()
+	list, total, err := service.ListTrash(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	got := make([]string, len(list))
+	for i, ln := range list {
+		got[i] = ln.ID
+	}
+	if total != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v (%v) want=%v", got, total, want)
+	}
+}
+
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+// mockTrashRepo lists the trashed notes in ID order
+type mockTrashRepo struct {
+	*mockRevisionRepo
+}
+
+func (r *mockTrashRepo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list := make([]note.ListNote, 0)
+	for _, n := range r.notes {
+		if n.IsTrashed() {
+			list = append(list, note.ListNote{ID: n.ID, Trashed: n.Trashed})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return note.Page(list, startIdx, endIdx), len(list), nil
 }
@@ -0,0 +1,479 @@
+package note
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A Role is what a user may do with a note. The owner can do anything, an
+// editor can change the note and a viewer can only read it.
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+// maxLinkPassword is the longest link password, bcrypt ignores anything past
+// 72 bytes
+const maxLinkPassword = 72
+
+// ErrLinkPassword is returned when opening a share link without its password
+// or with the wrong one
+var ErrLinkPassword = errors.New("share link needs its password")
+
+// Allows reports whether the role can do what needs the other role
+func (r Role) Allows(need Role) bool {
+	return r.rank() > 0 && r.rank() >= need.rank()
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleOwner:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// A Share gives a user access to a note of someone else's. NoteCreated ties
+// the share to the note it was made for, so it doesn't apply to a new note
+// that reuses the ID after the note is purged.
+type Share struct {
+	OwnerID       string    `json:"ownerId"`
+	OwnerUsername string    `json:"ownerUsername"`
+	NoteID        string    `json:"noteId"`
+	NoteCreated   time.Time `json:"noteCreated"`
+	UserID        string    `json:"userId"`
+	Username      string    `json:"username"`
+	Role          Role      `json:"role"`
+	Created       time.Time `json:"created"`
+}
+
+// A Link lets anyone with its token read a note without logging in. Only a
+// hash of the token's secret and of the optional password are kept.
+type Link struct {
+	ID           string     `json:"id"`
+	OwnerID      string     `json:"ownerId"`
+	NoteID       string     `json:"noteId"`
+	NoteCreated  time.Time  `json:"noteCreated"`
+	SecretHash   string     `json:"secretHash"`
+	PasswordHash string     `json:"passwordHash,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Created      time.Time  `json:"created"`
+}
+
+// HasPassword reports whether the link needs a password to open
+func (l Link) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// ShareRepository is implemented by repositories that keep shares and links.
+// They're kept outside of the namespaces as they're looked up by the user
+// they're shared with or by their token.
+type ShareRepository interface {
+	SaveShare(ctx context.Context, s Share) error
+	GetShare(ctx context.Context, userID, ownerID, noteID string) (Share, error)
+	// ListShares returns the shares of the owner's note
+	ListShares(ctx context.Context, ownerID, noteID string) ([]Share, error)
+	// ListSharedWith returns the shares given to the user
+	ListSharedWith(ctx context.Context, userID string) ([]Share, error)
+	DeleteShare(ctx context.Context, userID, ownerID, noteID string) error
+	SaveLink(ctx context.Context, l Link) error
+	GetLink(ctx context.Context, id string) (Link, error)
+	ListLinks(ctx context.Context) ([]Link, error)
+	DeleteLink(ctx context.Context, id string) error
+}
+
+type ownerKey struct{}
+
+// WithOwner returns a copy of the context for working on the notes the owner
+// has shared with the user in the context. Only calls on a single note are
+// allowed and only as far as the share's role permits.
+func WithOwner(ctx context.Context, ownerID string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, ownerID)
+}
+
+// OwnerFromContext returns the owner set by WithOwner, if any
+func OwnerFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ownerKey{}).(string)
+	return id, ok
+}
+
+// Share gives the user the role on the note, replacing any role they already
+// had. Only the owner can share a note.
+func (s *namespacedService) Share(ctx context.Context, id string, with user.User, role Role) (Share, error) {
+	const funcName = "ShareNote"
+
+	owner, svc, err := s.owned(ctx)
+	if err != nil {
+		return Share{}, err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Str("with", with.Username).
+		Str("role", string(role)).
+		Msg("sharing note")
+
+	if role != RoleEditor && role != RoleViewer {
+		return Share{}, errors.WithStack(&core.ErrInvalid{Reason: "role must be editor or viewer"})
+	}
+	if with.ID == owner.ID {
+		return Share{}, errors.WithStack(&core.ErrInvalid{Reason: "notes can't be shared with their owner"})
+	}
+
+	n, err := svc.get(ctx, id)
+	if err != nil {
+		return Share{}, err
+	}
+
+	sh := Share{
+		OwnerID:       owner.ID,
+		OwnerUsername: owner.Username,
+		NoteID:        id,
+		NoteCreated:   n.Created,
+		UserID:        with.ID,
+		Username:      with.Username,
+		Role:          role,
+		Created:       s.clock.Now(),
+	}
+	return sh, errors.WithStack(s.shares.SaveShare(ctx, sh))
+}
+
+// ListShares returns who the note is shared with, by username
+func (s *namespacedService) ListShares(ctx context.Context, id string) ([]Share, error) {
+	owner, svc, err := s.owned(ctx)
+	if err != nil {
+		return []Share{}, err
+	}
+	n, err := svc.get(ctx, id)
+	if err != nil {
+		return []Share{}, err
+	}
+
+	all, err := s.shares.ListShares(ctx, owner.ID, id)
+	if err != nil {
+		return []Share{}, errors.WithStack(err)
+	}
+	shares := make([]Share, 0, len(all))
+	for _, sh := range all {
+		if sh.NoteCreated.Equal(n.Created) {
+			shares = append(shares, sh)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Username < shares[j].Username })
+	return shares, nil
+}
+
+// Unshare takes away the user's access to the note
+func (s *namespacedService) Unshare(ctx context.Context, id, userID string) error {
+	const funcName = "UnshareNote"
+
+	owner, _, err := s.owned(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Str("userId", userID).
+		Msg("unsharing note")
+
+	if _, err := s.shares.GetShare(ctx, userID, owner.ID, id); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(s.shares.DeleteShare(ctx, userID, owner.ID, id))
+}
+
+// ListShared returns the notes shared with the user, oldest share first.
+// Shares of notes that are in the trash or gone are left out.
+func (s *namespacedService) ListShared(ctx context.Context) ([]Share, error) {
+	u, ok := user.FromContext(ctx)
+	if !ok || u.ID == "" {
+		return []Share{}, errors.WithStack(ErrNoUser)
+	}
+	if s.shares == nil {
+		return []Share{}, nil
+	}
+
+	all, err := s.shares.ListSharedWith(ctx, u.ID)
+	if err != nil {
+		return []Share{}, errors.WithStack(err)
+	}
+
+	shares := make([]Share, 0, len(all))
+	for _, sh := range all {
+		if _, err := s.shared(ctx, sh); err != nil {
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []Share{}, err
+		}
+		shares = append(shares, sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	return shares, nil
+}
+
+// CreateLink makes a public read-only link to the note, returning it along
+// with its token. The token is only available now. A link with a password
+// can only be opened with it. Encrypted notes can't have links.
+func (s *namespacedService) CreateLink(ctx context.Context, id string, expires *time.Time, password string) (Link, string, error) {
+	const funcName = "CreateLink"
+
+	owner, svc, err := s.owned(ctx)
+	if err != nil {
+		return Link{}, "", err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Msg("creating share link")
+
+	now := s.clock.Now()
+	if expires != nil && !expires.After(now) {
+		return Link{}, "", errors.WithStack(&core.ErrInvalid{Reason: "expires must be in the future"})
+	}
+	if len(password) > maxLinkPassword {
+		return Link{}, "", errors.WithStack(&core.ErrInvalid{Reason: "password is too long"})
+	}
+
+	n, err := svc.get(ctx, id)
+	if err != nil {
+		return Link{}, "", err
+	}
+	if n.Encrypted {
+		return Link{}, "", errors.WithStack(&core.ErrInvalid{Reason: "encrypted notes can't be shared by link"})
+	}
+
+	linkID, err := randomID()
+	if err != nil {
+		return Link{}, "", errors.WithStack(err)
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return Link{}, "", errors.WithStack(err)
+	}
+
+	l := Link{
+		ID:          linkID,
+		OwnerID:     owner.ID,
+		NoteID:      id,
+		NoteCreated: n.Created,
+		SecretHash:  hashSecret(secret),
+		Expires:     expires,
+		Created:     now,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Link{}, "", errors.WithStack(err)
+		}
+		l.PasswordHash = string(hash)
+	}
+
+	if err := s.shares.SaveLink(ctx, l); err != nil {
+		return Link{}, "", errors.WithStack(err)
+	}
+	return l, l.ID + "." + secret, nil
+}
+
+// ListLinks returns the note's links, oldest first
+func (s *namespacedService) ListLinks(ctx context.Context, id string) ([]Link, error) {
+	owner, svc, err := s.owned(ctx)
+	if err != nil {
+		return []Link{}, err
+	}
+	n, err := svc.get(ctx, id)
+	if err != nil {
+		return []Link{}, err
+	}
+
+	all, err := s.shares.ListLinks(ctx)
+	if err != nil {
+		return []Link{}, errors.WithStack(err)
+	}
+	links := make([]Link, 0)
+	for _, l := range all {
+		if l.OwnerID == owner.ID && l.NoteID == id && l.NoteCreated.Equal(n.Created) {
+			links = append(links, l)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.Before(links[j].Created) })
+	return links, nil
+}
+
+// DeleteLink stops the link working
+func (s *namespacedService) DeleteLink(ctx context.Context, id, linkID string) error {
+	const funcName = "DeleteLink"
+
+	owner, _, err := s.owned(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Str("linkId", linkID).
+		Msg("deleting share link")
+
+	l, err := s.shares.GetLink(ctx, linkID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if l.OwnerID != owner.ID || l.NoteID != id {
+		return errors.WithStack(&core.ErrNotFound{})
+	}
+	return errors.WithStack(s.shares.DeleteLink(ctx, linkID))
+}
+
+// OpenLink returns the note the link's token is for. It doesn't need a user.
+// Unknown, expired and deleted links, and links to notes that are in the
+// trash or have been encrypted, are all not found. A link with a password fails with
+// ErrLinkPassword unless it's given.
+func (s *namespacedService) OpenLink(ctx context.Context, token, password string) (Note, error) {
+	const funcName = "OpenLink"
+
+	parts := strings.SplitN(token, ".", 2)
+	if s.shares == nil || len(parts) != 2 || parts[0] == "" {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("linkId", parts[0]).
+		Msg("opening share link")
+
+	l, err := s.shares.GetLink(ctx, parts[0])
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	if subtle.ConstantTimeCompare([]byte(l.SecretHash), []byte(hashSecret(parts[1]))) != 1 {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	if l.Expires != nil && !s.clock.Now().Before(*l.Expires) {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	if l.HasPassword() && bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) != nil {
+		return Note{}, errors.WithStack(ErrLinkPassword)
+	}
+
+	svc, err := s.namespace(l.OwnerID)
+	if err != nil {
+		return Note{}, err
+	}
+	n, err := svc.get(ctx, l.NoteID)
+	if err != nil {
+		return Note{}, err
+	}
+	// A note encrypted after the link was made can't be shown by it
+	if !n.Created.Equal(l.NoteCreated) || n.Encrypted {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	return n, nil
+}
+
+// owned returns the user in the context along with their namespace, as long as
+// they're working on their own notes and the repository keeps shares
+func (s *namespacedService) owned(ctx context.Context) (user.User, *service, error) {
+	svc, err := s.scope(ctx)
+	if err != nil {
+		return user.User{}, nil, err
+	}
+	if s.shares == nil {
+		return user.User{}, nil, errors.New("repository does not keep shares")
+	}
+	u, _ := user.FromContext(ctx)
+	return u, svc, nil
+}
+
+// scopeNote returns the service for the namespace the note is in. When the
+// context is working on another owner's notes, see WithOwner, the note must
+// be shared with the user with a role that allows what they need.
+func (s *namespacedService) scopeNote(ctx context.Context, id string, need Role) (*service, error) {
+	u, ok := user.FromContext(ctx)
+	if !ok || u.ID == "" {
+		return nil, errors.WithStack(ErrNoUser)
+	}
+	ownerID, ok := OwnerFromContext(ctx)
+	if !ok || ownerID == u.ID {
+		return s.namespace(u.ID)
+	}
+	if s.shares == nil {
+		return nil, errors.WithStack(&core.ErrNotFound{})
+	}
+
+	sh, err := s.shares.GetShare(ctx, u.ID, ownerID, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	svc, err := s.shared(ctx, sh)
+	if err != nil {
+		return nil, err
+	}
+	if !sh.Role.Allows(need) {
+		return nil, errors.WithStack(&core.ErrForbidden{Reason: "the note is shared with you as a " + string(sh.Role)})
+	}
+	return svc, nil
+}
+
+// shared returns the owner's service if the share's note is still the one it
+// was made for and isn't in the trash
+func (s *namespacedService) shared(ctx context.Context, sh Share) (*service, error) {
+	svc, err := s.namespace(sh.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := svc.get(ctx, sh.NoteID)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Created.Equal(sh.NoteCreated) {
+		return nil, errors.WithStack(&core.ErrNotFound{})
+	}
+	return svc, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
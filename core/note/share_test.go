@@ -0,0 +1,346 @@
+package note_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// A note shared with someone can be read by them through the owner, changed
+// if they're an editor, and never deleted or listed
+func TestShareRoles(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	service := note.NewNamespacedService(clock, newMockShareRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	bob := user.User{ID: "bob", Username: "bob"}
+	carol := user.User{ID: "carol", Username: "carol"}
+	dave := user.User{ID: "dave", Username: "dave"}
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus"})
+	mustCreate(alice, t, service, note.Note{ID: "2", Data: "not shared"})
+	mustShare(alice, t, service, "1", bob, note.RoleViewer)
+	mustShare(alice, t, service, "1", carol, note.RoleEditor)
+
+	asBob := note.WithOwner(user.NewContext(context.Background(), bob), "alice")
+	asCarol := note.WithOwner(user.NewContext(context.Background(), carol), "alice")
+	asDave := note.WithOwner(user.NewContext(context.Background(), dave), "alice")
+	patch := note.MergePatch(json.RawMessage(`{"data": "the otter"}`))
+
+	if n, err := service.Get(asBob, "1"); err != nil || n.Data != "the walrus" {
+		t.Errorf("got=[%v, %v] want=[the walrus]", n, err)
+	}
+	if _, err := service.Patch(asBob, "1", patch, note.AnyVersion); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	if n, err := service.Patch(asCarol, "1", patch, note.AnyVersion); err != nil || n.Data != "the otter" {
+		t.Errorf("got=[%v, %v] want=[the otter]", n, err)
+	}
+	if err := service.Delete(asCarol, "1"); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	if _, _, err := service.List(asCarol, note.ListFilter{}, 0, 0); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	if _, err := service.Share(asCarol, "1", dave, note.RoleViewer); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	for _, test := range []struct {
+		ctx context.Context
+		id  string
+	}{{asBob, "2"}, {asDave, "1"}} {
+		if _, err := service.Get(test.ctx, test.id); !core.IsErrNotFound(err) {
+			t.Errorf("got=[%v] want=[not found]", err)
+		}
+	}
+
+	shares, err := service.ListShares(alice, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(shares) != 2 || shares[0].Username != "bob" || shares[1].Username != "carol" {
+		t.Errorf("got=[%v] want=[bob, carol]", shares)
+	}
+
+	if err := service.Unshare(alice, "1", "bob"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := service.Get(asBob, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if err := service.Unshare(alice, "1", "bob"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Only the owner can move a note to another notebook, an editor's changes
+// have to leave it where it is
+func TestShareEditorMove(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	service := note.NewNamespacedService(clock, newMockShareRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	carol := user.User{ID: "carol", Username: "carol"}
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus"})
+	mustShare(alice, t, service, "1", carol, note.RoleEditor)
+	asCarol := note.WithOwner(user.NewContext(context.Background(), carol), "alice")
+
+	if _, _, err := service.Replace(asCarol, note.Note{ID: "1", Data: "the otter", NotebookID: "elsewhere"}, note.AnyVersion, false); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	patch := note.MergePatch(json.RawMessage(`{"notebookId": "elsewhere"}`))
+	if _, err := service.Patch(asCarol, "1", patch, note.AnyVersion); !core.IsErrForbidden(err) {
+		t.Errorf("got=[%v] want=[forbidden]", err)
+	}
+	if n, _, err := service.Replace(asCarol, note.Note{ID: "1", Data: "the otter"}, note.AnyVersion, false); err != nil || n.Data != "the otter" || n.NotebookID != "" {
+		t.Errorf("got=[%v, %v] want=[the otter where it was]", n, err)
+	}
+}
+
+func TestShareInvalid(t *testing.T) {
+	service := note.NewNamespacedService(&mockClock{}, newMockShareRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	mustCreate(alice, t, service, note.Note{ID: "1"})
+
+	tests := []struct {
+		name string
+		id   string
+		with user.User
+		role note.Role
+		want func(error) bool
+	}{
+		{name: "Owner Role", id: "1", with: user.User{ID: "bob"}, role: note.RoleOwner, want: core.IsErrInvalid},
+		{name: "Unknown Role", id: "1", with: user.User{ID: "bob"}, role: "admin", want: core.IsErrInvalid},
+		{name: "With Owner", id: "1", with: user.User{ID: "alice"}, role: note.RoleViewer, want: core.IsErrInvalid},
+		{name: "Missing Note", id: "2", with: user.User{ID: "bob"}, role: note.RoleViewer, want: core.IsErrNotFound},
+	}
+
+	for _, test := range tests {
+		if _, err := service.Share(alice, test.id, test.with, test.role); !test.want(err) {
+			t.Errorf("%v: got=[%v]", test.name, err)
+		}
+	}
+}
+
+// Shares and links are for the note they were made for, not whatever note
+// later takes its ID, and stop working while it's in the trash
+func TestShareFollowsNote(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	service := note.NewNamespacedService(clock, newMockShareRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	bob := user.User{ID: "bob", Username: "bob"}
+	asBob := note.WithOwner(user.NewContext(context.Background(), bob), "alice")
+
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "shared"})
+	mustShare(alice, t, service, "1", bob, note.RoleViewer)
+	_, token, err := service.CreateLink(alice, "1", nil, "")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if err := service.Delete(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectShared(user.NewContext(context.Background(), bob), t, service)
+	if _, err := service.Get(asBob, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.OpenLink(context.Background(), token, ""); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	if _, err := service.RestoreTrashed(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectShared(user.NewContext(context.Background(), bob), t, service, "1")
+
+	if err := service.Delete(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := service.Purge(alice, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "private"})
+
+	expectShared(user.NewContext(context.Background(), bob), t, service)
+	if _, err := service.Get(asBob, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := service.OpenLink(context.Background(), token, ""); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+func TestOpenLink(t *testing.T) {
+	clock := &stepClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	service := note.NewNamespacedService(clock, newMockShareRepo())
+	alice := user.NewContext(context.Background(), user.User{ID: "alice", Username: "alice"})
+	mustCreate(alice, t, service, note.Note{ID: "1", Data: "the walrus"})
+
+	expires := clock.now.Add(time.Hour)
+	l, token, err := service.CreateLink(alice, "1", &expires, "hunter2")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if !l.HasPassword() || strings.Contains(l.PasswordHash, "hunter2") || strings.Contains(l.SecretHash, strings.SplitN(token, ".", 2)[1]) {
+		t.Errorf("got=[%v] want=[hashed secret and password]", l)
+	}
+
+	n, err := service.OpenLink(context.Background(), token, "hunter2")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if n.Data != "the walrus" {
+		t.Errorf("got=[%v] want=[the walrus]", n)
+	}
+
+	for _, password := range []string{"", "hunter3"} {
+		if _, err := service.OpenLink(context.Background(), token, password); errors.Cause(err) != note.ErrLinkPassword {
+			t.Errorf("got=[%v] want=[%v]", err, note.ErrLinkPassword)
+		}
+	}
+	for _, bad := range []string{"", l.ID, l.ID + ".wrong", "unknown." + strings.SplitN(token, ".", 2)[1]} {
+		if _, err := service.OpenLink(context.Background(), bad, "hunter2"); !core.IsErrNotFound(err) {
+			t.Errorf("%q: got=[%v] want=[not found]", bad, err)
+		}
+	}
+
+	clock.now = expires
+	if _, err := service.OpenLink(context.Background(), token, "hunter2"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	links, err := service.ListLinks(alice, "1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(links) != 1 || links[0].ID != l.ID {
+		t.Errorf("got=[%v] want=[%v]", links, l)
+	}
+	if err := service.DeleteLink(alice, "2", l.ID); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if err := service.DeleteLink(alice, "1", l.ID); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+
+	if _, _, err := service.CreateLink(alice, "1", &expires, ""); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+}
+
+func mustShare(ctx context.Context, t *testing.T, service interface {
+	Share(ctx context.Context, id string, with user.User, role note.Role) (note.Share, error)
+}, id string, with user.User, role note.Role) {
+	t.Helper()
+	if _, err := service.Share(ctx, id, with, role); err != nil {
+		t.Fatalf("failed to share note %v: %v", id, err)
+	}
+}
+
+func expectShared(ctx context.Context, t *testing.T, service interface {
+	ListShared(ctx context.Context) ([]note.Share, error)
+}, want ...string) {
+	t.Helper()
+	shares, err := service.ListShared(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	got := make([]string, 0, len(shares))
+	for _, sh := range shares {
+		got = append(got, sh.NoteID)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+// mockShareRepo is a mockNamespaceRepo that keeps shares and links
+type mockShareRepo struct {
+	*mockNamespaceRepo
+	shares map[string]note.Share
+	links  map[string]note.Link
+}
+
+func newMockShareRepo() *mockShareRepo {
+	return &mockShareRepo{
+		mockNamespaceRepo: newMockNamespaceRepo(),
+		shares:            make(map[string]note.Share),
+		links:             make(map[string]note.Link),
+	}
+}
+
+func shareKey(userID, ownerID, noteID string) string {
+	return userID + "\x00" + ownerID + "\x00" + noteID
+}
+
+func (r *mockShareRepo) SaveShare(ctx context.Context, s note.Share) error {
+	r.shares[shareKey(s.UserID, s.OwnerID, s.NoteID)] = s
+	return nil
+}
+
+func (r *mockShareRepo) GetShare(ctx context.Context, userID, ownerID, noteID string) (note.Share, error) {
+	s, ok := r.shares[shareKey(userID, ownerID, noteID)]
+	if !ok {
+		return note.Share{}, &core.ErrNotFound{}
+	}
+	return s, nil
+}
+
+func (r *mockShareRepo) ListShares(ctx context.Context, ownerID, noteID string) ([]note.Share, error) {
+	shares := make([]note.Share, 0)
+	for _, s := range r.shares {
+		if s.OwnerID == ownerID && s.NoteID == noteID {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+func (r *mockShareRepo) ListSharedWith(ctx context.Context, userID string) ([]note.Share, error) {
+	shares := make([]note.Share, 0)
+	for _, s := range r.shares {
+		if s.UserID == userID {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+func (r *mockShareRepo) DeleteShare(ctx context.Context, userID, ownerID, noteID string) error {
+	delete(r.shares, shareKey(userID, ownerID, noteID))
+	return nil
+}
+
+func (r *mockShareRepo) SaveLink(ctx context.Context, l note.Link) error {
+	r.links[l.ID] = l
+	return nil
+}
+
+func (r *mockShareRepo) GetLink(ctx context.Context, id string) (note.Link, error) {
+	l, ok := r.links[id]
+	if !ok {
+		return note.Link{}, &core.ErrNotFound{}
+	}
+	return l, nil
+}
+
+func (r *mockShareRepo) ListLinks(ctx context.Context) ([]note.Link, error) {
+	links := make([]note.Link, 0, len(r.links))
+	for _, l := range r.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (r *mockShareRepo) DeleteLink(ctx context.Context, id string) error {
+	delete(r.links, id)
+	return nil
+}
@@ -0,0 +1,129 @@
+package note
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+)
+
+// MaxTagLength is the longest a single tag may be
+const MaxTagLength = 64
+
+// TagFilter selects notes by their tags. A note matches when it has every
+// tag, or any of them when Any is set. An empty filter matches every note.
+type TagFilter struct {
+	Tags []string
+	Any  bool
+}
+
+// IsEmpty reports whether the filter matches every note
+func (f TagFilter) IsEmpty() bool {
+	return len(f.Tags) == 0
+}
+
+// Matches reports whether a note with the given tags passes the filter
+func (f TagFilter) Matches(tags []string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	has := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		has[t] = true
+	}
+
+	for _, t := range f.Tags {
+		found := has[normalizeTag(t)]
+		if f.Any && found {
+			return true
+		}
+		if !f.Any && !found {
+			return false
+		}
+	}
+	return !f.Any
+}
+
+// TagCount is a tag along with the number of notes that have it
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTags lower cases and trims the tags, dropping empty and duplicate
+// ones, and returns them sorted. Tags may not contain whitespace or commas
+// and are limited to MaxTagLength characters.
+func NormalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, t := range tags {
+		n := normalizeTag(t)
+		if n == "" || seen[n] {
+			continue
+		}
+		if len([]rune(n)) > MaxTagLength {
+			return nil, &core.ErrInvalid{Reason: fmt.Sprintf("tag %q is longer than %d characters", t, MaxTagLength)}
+		}
+		if strings.IndexFunc(n, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) != -1 {
+			return nil, &core.ErrInvalid{Reason: fmt.Sprintf("tag %q contains whitespace or a comma", t)}
+		}
+
+		seen[n] = true
+		normalized = append(normalized, n)
+	}
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func normalizeTag(t string) string {
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// Tags returns every tag used by a note in the index with the number of
+// notes using it, most used first
+func (s *service) Tags(ctx context.Context) ([]TagCount, error) {
+	const funcName = "ListTags"
+
+	log.Info().
+		Str("func", funcName).
+		Msg("listing tags")
+
+	list, _, err := s.repo.List(ctx, 0, 0)
+	if err != nil {
+		return []TagCount{}, errors.WithStack(err)
+	}
+
+	counts := make(map[string]int)
+	for _, ln := range list {
+		for _, t := range ln.Tags {
+			counts[t]++
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for name, count := range counts {
+		tags = append(tags, TagCount{Name: name, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
@@ -0,0 +1,156 @@
+package note_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none", input: nil, want: nil},
+		{name: "only empty", input: []string{"", "  "}, want: nil},
+		{name: "sorted", input: []string{"work", "home"}, want: []string{"home", "work"}},
+		{name: "case and space", input: []string{" Work ", "WORK", "home"}, want: []string{"home", "work"}},
+		{name: "whitespace", input: []string{"to do"}, wantErr: true},
+		{name: "comma", input: []string{"a,b"}, wantErr: true},
+		{name: "too long", input: []string{strings.Repeat("a", note.MaxTagLength+1)}, wantErr: true},
+		{name: "longest", input: []string{strings.Repeat("a", note.MaxTagLength)}, want: []string{strings.Repeat("a", note.MaxTagLength)}},
+	}
+
+	for _, test := range tests {
+		got, err := note.NormalizeTags(test.input)
+		if test.wantErr {
+			if !core.IsErrInvalid(err) {
+				t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) || (got == nil) != (test.want == nil) {
+			t.Errorf("%v: got=[%#v] want=[%#v]", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	tags := []string{"home", "work"}
+
+	tests := []struct {
+		filter note.TagFilter
+		want   bool
+	}{
+		{filter: note.TagFilter{}, want: true},
+		{filter: note.TagFilter{Tags: []string{"home"}}, want: true},
+		{filter: note.TagFilter{Tags: []string{"HOME", "work"}}, want: true},
+		{filter: note.TagFilter{Tags: []string{"home", "play"}}, want: false},
+		{filter: note.TagFilter{Tags: []string{"home", "play"}, Any: true}, want: true},
+		{filter: note.TagFilter{Tags: []string{"play", "school"}, Any: true}, want: false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.Matches(tags); got != test.want {
+			t.Errorf("%+v: got=[%v] want=[%v]", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestListTagged(t *testing.T) {
+	ctx := context.Background()
+	mr := mockRepo{
+		returnListNote: []note.ListNote{
+			{ID: "1", Tags: []string{"home"}},
+			{ID: "2", Tags: []string{"home", "work"}},
+			{ID: "3", Tags: []string{"work"}},
+			{ID: "4"},
+		},
+		returnTotal: 4,
+	}
+	service := note.NewService(&mockClock{}, &mr)
+
+	tests := []struct {
+		filter    note.TagFilter
+		startIdx  int
+		endIdx    int
+		wantIDs   string
+		wantTotal int
+	}{
+		{filter: note.TagFilter{Tags: []string{"home"}}, wantIDs: "[1 2]", wantTotal: 2},
+		{filter: note.TagFilter{Tags: []string{"home", "work"}}, wantIDs: "[2]", wantTotal: 1},
+		{filter: note.TagFilter{Tags: []string{"home", "work"}, Any: true}, wantIDs: "[1 2 3]", wantTotal: 3},
+		{filter: note.TagFilter{Tags: []string{"home", "work"}, Any: true}, startIdx: 1, endIdx: 2, wantIDs: "[2]", wantTotal: 3},
+		{filter: note.TagFilter{Tags: []string{"play"}}, wantIDs: "[]", wantTotal: 0},
+	}
+
+	for _, test := range tests {
+		got, total, err := service.List(ctx, note.ListFilter{TagFilter: test.filter}, test.startIdx, test.endIdx)
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		ids := make([]string, len(got))
+		for i, ln := range got {
+			ids[i] = ln.ID
+		}
+		if fmt.Sprint(ids) != test.wantIDs || total != test.wantTotal {
+			t.Errorf("%+v: got=[%v (%v)] want=[%v (%v)]", test.filter, ids, total, test.wantIDs, test.wantTotal)
+		}
+		// The whole index is filtered before the page is cut
+		if mr.listStartIdx != 0 || mr.listEndIdx != 0 {
+			t.Errorf("%+v: got=[%v,%v] want=[0,0]", test.filter, mr.listStartIdx, mr.listEndIdx)
+		}
+	}
+}
+
+func TestCreateTags(t *testing.T) {
+	mr := mockRepo{getErr: &core.ErrNotFound{}}
+	service := note.NewService(&mockClock{}, &mr)
+
+	got, err := service.Create(context.Background(), note.Note{ID: "id", Tags: []string{"Work", "home", "work"}}, note.AnyVersion)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if fmt.Sprint(got.Tags) != "[home work]" || fmt.Sprint(mr.savedNote.Tags) != "[home work]" {
+		t.Errorf("got=[%v] want=[[home work]]", got.Tags)
+	}
+
+	mr = mockRepo{getErr: &core.ErrNotFound{}}
+	service = note.NewService(&mockClock{}, &mr)
+	if _, err = service.Create(context.Background(), note.Note{ID: "id", Tags: []string{"to do"}}, note.AnyVersion); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if mr.savedNote.ID != "" {
+		t.Errorf("expected nothing to be saved got=[%v]", mr.savedNote)
+	}
+}
+
+func TestTags(t *testing.T) {
+	mr := mockRepo{
+		returnListNote: []note.ListNote{
+			{ID: "1", Tags: []string{"home"}},
+			{ID: "2", Tags: []string{"home", "work"}},
+			{ID: "3", Tags: []string{"play", "work"}},
+			{ID: "4"},
+		},
+	}
+	service := note.NewService(&mockClock{}, &mr)
+
+	got, err := service.Tags(context.Background())
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	want := "[{home 2} {work 2} {play 1}]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
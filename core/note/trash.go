@@ -0,0 +1,220 @@
+package note
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/audit"
+)
+
+// Trash is implemented by repositories that keep trashed notes in a section
+// of the index of their own. Saving a note with Trashed set moves it into the
+// trash, saving it without moves it back out and Delete removes it from
+// either for good.
+type Trash interface {
+	// ListTrash returns the trashed notes between startIdx (inclusive) and
+	// endIdx (exclusive) and the total number of trashed notes. An endIdx of
+	// zero or less means the end of the trash.
+	ListTrash(ctx context.Context, startIdx, endIdx int) ([]ListNote, int, error)
+}
+
+// ListTrash returns the trashed notes between startIdx (inclusive) and endIdx
+// (exclusive) along with the total number of notes in the trash.
+func (s *service) ListTrash(ctx context.Context, startIdx, endIdx int) ([]ListNote, int, error) {
+	const funcName = "ListTrash"
+
+	log.Info().
+		Str("func", funcName).
+		Int("startIdx", startIdx).
+		Int("endIdx", endIdx).
+		Msg("listing trash")
+
+	t, err := s.trash()
+	if err != nil {
+		return []ListNote{}, 0, err
+	}
+
+	list, total, err := t.ListTrash(ctx, startIdx, endIdx)
+	if err != nil {
+		return []ListNote{}, 0, errors.WithStack(err)
+	}
+
+	return list, total, nil
+}
+
+// RestoreTrashed takes the note back out of the trash. If its notebook was
+// deleted in the meantime it's restored to the top level.
+func (s *service) RestoreTrashed(ctx context.Context, id string) (Note, error) {
+	const funcName = "RestoreTrashed"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Msg("restoring note from trash")
+
+	if _, err := s.trash(); err != nil {
+		return Note{}, err
+	}
+
+	unlock := s.locks.Lock(id)
+	defer unlock()
+
+	n, err := s.getTrashed(ctx, id)
+	if err != nil {
+		return Note{}, err
+	}
+
+	before := n
+
+	// The note's notebook may have been deleted while it was in the trash
+	if err = s.checkNotebook(ctx, n.NotebookID); err != nil {
+		if !core.IsErrInvalid(err) {
+			return Note{}, err
+		}
+		n.NotebookID = ""
+	}
+
+	n.Trashed = nil
+	if err = s.repo.Save(ctx, n); err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	s.indexNote(ctx, n)
+
+	if err := s.record(ctx, audit.ActionRestore, id, before, n); err != nil {
+		return Note{}, err
+	}
+	return n, nil
+}
+
+// Purge permanently deletes a trashed note along with its revisions
+func (s *service) Purge(ctx context.Context, id string) error {
+	const funcName = "PurgeNote"
+
+	log.Info().
+		Str("func", funcName).
+		Str("id", id).
+		Msg("purging note")
+
+	if _, err := s.trash(); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(id)
+	defer unlock()
+
+	n, err := s.getTrashed(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.purge(ctx, id); err != nil {
+		return err
+	}
+	return s.record(ctx, audit.ActionPurge, id, n, Note{})
+}
+
+// PurgeExpired purges every note that has been in the trash for longer than
+// the retention and returns how many were purged
+func (s *service) PurgeExpired(ctx context.Context, retention time.Duration) (int, error) {
+	const funcName = "PurgeExpired"
+
+	t, err := s.trash()
+	if err != nil {
+		return 0, err
+	}
+
+	list, _, err := t.ListTrash(ctx, 0, 0)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	cutoff := s.clock.Now().Add(-retention)
+	purged := 0
+	for _, ln := range list {
+		if ln.Trashed == nil || ln.Trashed.After(cutoff) {
+			continue
+		}
+
+		if err := s.Purge(ctx, ln.ID); err != nil {
+			// The note was restored or purged since the trash was listed
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return purged, err
+		}
+		purged++
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("trashed", len(list)).
+		Int("purged", purged).
+		Msg("purged expired notes")
+
+	return purged, nil
+}
+
+// PurgeEvery purges expired notes from the trash on the given interval until
+// the context is done
+func (s *service) PurgeEvery(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := s.PurgeExpired(ctx, retention); err != nil {
+				log.Warn().Err(err).Str("func", "PurgeEvery").Msg("failed to purge trash")
+			}
+		}
+	}
+}
+
+// getTrashed returns the note if it's in the trash or a core.ErrNotFound
+func (s *service) getTrashed(ctx context.Context, id string) (Note, error) {
+	if len(id) > MaxIDLength {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	n, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return Note{}, errors.WithStack(err)
+	}
+	if !n.IsTrashed() {
+		return Note{}, errors.WithStack(&core.ErrNotFound{})
+	}
+	return n, nil
+}
+
+// purge removes the note, its revisions and its search document from the
+// repository
+func (s *service) purge(ctx context.Context, id string) error {
+	if err := s.repo.Delete(ctx, id); err != nil {
+		return errors.WithStack(err)
+	}
+	s.unindexNote(ctx, id)
+
+	if rr, ok := s.repo.(Revisioner); ok {
+		if err := rr.DeleteRevisions(ctx, id); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if as, ok := s.repo.(AttachmentStore); ok {
+		if err := as.DeleteAttachments(ctx, id); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *service) trash() (Trash, error) {
+	t, ok := s.repo.(Trash)
+	if !ok {
+		return nil, errors.New("repository does not keep a trash")
+	}
+	return t, nil
+}
@@ -0,0 +1,78 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// jwks is a JSON Web Key Set, the provider's public signing keys
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKeys returns the signing keys by their ID. Keys that are for
+// encryption or that can't be parsed are left out.
+func (s jwks) publicKeys() map[string]interface{} {
+	keys := make(map[string]interface{})
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub := k.publicKey(); pub != nil {
+			keys[k.Kid] = pub
+		}
+	}
+	return keys
+}
+
+func (k jwk) publicKey() interface{} {
+	switch k.Kty {
+	case "RSA":
+		n, e := decodeInt(k.N), decodeInt(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil
+		}
+		x, y := decodeInt(k.X), decodeInt(k.Y)
+		if x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return nil
+	}
+}
+
+func decodeInt(s string) *big.Int {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
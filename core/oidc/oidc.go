@@ -0,0 +1,415 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+)
+
+const (
+	// discoveryTTL is how long the provider's configuration is trusted before
+	// it's fetched again
+	discoveryTTL = 24 * time.Hour
+	// keysRefetch is how often an unknown key ID can make the provider's keys
+	// be fetched again
+	keysRefetch = time.Minute
+	// leeway allows for the provider's clock being a little off ours
+	leeway = time.Minute
+	// maxResponseSize is the most read from any response from the provider
+	maxResponseSize = 1 << 20
+)
+
+// DefaultScopes are requested when none are configured
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// ErrInvalidLogin means the login couldn't be completed because the provider
+// refused it, it had expired or it was tampered with
+var ErrInvalidLogin = errors.New("invalid login")
+
+type Config struct {
+	// Issuer is the provider's URL, its configuration is discovered from
+	// Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, it must be
+	// registered with the provider
+	RedirectURL string
+	Scopes      []string
+	// UsernameClaim is the ID token claim used as the username
+	UsernameClaim string
+	// AdminGroup, when set, makes members of that group in the groups claim
+	// admins and everyone else not
+	AdminGroup string
+}
+
+// Users creates and looks up the users logging in through the provider
+type Users interface {
+	Provision(ctx context.Context, username, subject string, admin *bool) (user.User, error)
+}
+
+// A Login is an authorization request in progress. It's kept by the user
+// agent between being sent to the provider and coming back.
+type Login struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// Provider logs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. It's the single sign-on counterpart to
+// the passwords checked by user.Service.
+type Provider struct {
+	clock  core.Clock
+	cfg    Config
+	client *http.Client
+	users  Users
+
+	mu          sync.Mutex
+	discovery   discovery
+	discovered  time.Time
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(clock core.Clock, cfg Config, client *http.Client, users Users) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = DefaultScopes
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Provider{clock: clock, cfg: cfg, client: client, users: users}
+}
+
+// Start begins a login, returning it along with the provider URL to send the
+// user to
+func (p *Provider) Start(ctx context.Context) (Login, string, error) {
+	const funcName = "Start"
+
+	log.Debug().
+		Str("func", funcName).
+		Str("issuer", p.cfg.Issuer).
+		Msg("starting login")
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Login{}, "", errors.WithStack(err)
+	}
+
+	var login Login
+	for _, v := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *v, err = randomString(32); err != nil {
+			return Login{}, "", errors.WithStack(err)
+		}
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return Login{}, "", errors.WithStack(err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", login.State)
+	q.Set("nonce", login.Nonce)
+	q.Set("code_challenge", challenge(login.Verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return login, u.String(), nil
+}
+
+// Finish completes the login with the state and code the provider sent the
+// user back with, returning the user they logged in as
+func (p *Provider) Finish(ctx context.Context, login Login, state, code string) (user.User, error) {
+	const funcName = "Finish"
+
+	log.Debug().
+		Str("func", funcName).
+		Str("issuer", p.cfg.Issuer).
+		Msg("finishing login")
+
+	if login.State == "" || state != login.State || code == "" {
+		return user.User{}, errors.Wrap(ErrInvalidLogin, "state doesn't match")
+	}
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return user.User{}, errors.WithStack(err)
+	}
+
+	idToken, err := p.exchange(ctx, d, login, code)
+	if err != nil {
+		return user.User{}, errors.WithStack(err)
+	}
+
+	claims, err := p.validate(ctx, d, idToken, login.Nonce)
+	if err != nil {
+		return user.User{}, errors.WithStack(err)
+	}
+
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if username == "" {
+		return user.User{}, errors.Wrapf(ErrInvalidLogin, "missing %v claim", p.cfg.UsernameClaim)
+	}
+
+	var admin *bool
+	if p.cfg.AdminGroup != "" {
+		member := inGroup(claims["groups"], p.cfg.AdminGroup)
+		admin = &member
+	}
+
+	sub, _ := claims["sub"].(string)
+	return p.users.Provision(ctx, username, d.Issuer+" "+sub, admin)
+}
+
+// exchange swaps the code for the provider's tokens, returning the ID token
+func (p *Provider) exchange(ctx context.Context, d discovery, login Login, code string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", login.Verifier)
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", errors.Wrap(err, "failed to read token response")
+	}
+
+	switch {
+	case body.Error == "invalid_grant":
+		// Codes that are reused, expired or don't match the verifier
+		return "", errors.Wrapf(ErrInvalidLogin, "token endpoint returned %v: %v", body.Error, body.ErrorDescription)
+	case body.Error != "":
+		return "", errors.Errorf("token endpoint returned %v: %v", body.Error, body.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return "", errors.Errorf("token endpoint returned %v", resp.Status)
+	case body.IDToken == "":
+		return "", errors.New("token response is missing the id token")
+	}
+
+	return body.IDToken, nil
+}
+
+// validate checks the ID token was signed by the provider for us in response
+// to this login and hasn't expired, returning its claims
+func (p *Provider) validate(ctx context.Context, d discovery, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithoutClaimsValidation(),
+	)
+	_, err := parser.ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidLogin, err.Error())
+	}
+
+	now := p.clock.Now()
+	switch {
+	case !claims.VerifyIssuer(d.Issuer, true):
+		return nil, errors.Wrap(ErrInvalidLogin, "wrong issuer")
+	case !claims.VerifyAudience(p.cfg.ClientID, true):
+		return nil, errors.Wrap(ErrInvalidLogin, "wrong audience")
+	case !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), true):
+		return nil, errors.Wrap(ErrInvalidLogin, "expired")
+	case !claims.VerifyIssuedAt(now.Add(leeway).Unix(), true):
+		return nil, errors.Wrap(ErrInvalidLogin, "issued in the future")
+	case claims["nonce"] != nonce:
+		return nil, errors.Wrap(ErrInvalidLogin, "nonce doesn't match")
+	}
+
+	// A token for several audiences must say it was issued to us
+	if aud, ok := claims["aud"].([]interface{}); ok && len(aud) > 1 && claims["azp"] != p.cfg.ClientID {
+		return nil, errors.Wrap(ErrInvalidLogin, "wrong authorized party")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.Wrap(ErrInvalidLogin, "missing subject")
+	}
+
+	return claims, nil
+}
+
+// discover returns the provider's configuration, fetching it when it hasn't
+// been or it's out of date. It's fetched without holding mu so a slow
+// provider only holds up the logins that need it.
+func (p *Provider) discover(ctx context.Context) (discovery, error) {
+	p.mu.Lock()
+	now := p.clock.Now()
+	if !p.discovered.IsZero() && now.Sub(p.discovered) < discoveryTTL {
+		d := p.discovery
+		p.mu.Unlock()
+		return d, nil
+	}
+	p.mu.Unlock()
+
+	var d discovery
+	if err := p.get(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return discovery{}, errors.Wrap(err, "failed to discover provider")
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return discovery{}, errors.Errorf("provider says its issuer is %q not %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return discovery{}, errors.New("provider configuration is missing endpoints")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.After(p.discovered) {
+		p.discovery = d
+		p.discovered = now
+	}
+	return d, nil
+}
+
+// key returns the provider's signing key with the ID, fetching the provider's
+// keys again when it's not one we've seen. Like discover the keys are fetched
+// without holding mu, the fetch is claimed first so only one runs at a time.
+func (p *Provider) key(ctx context.Context, d discovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	if k, ok := findKey(p.keys, kid); ok {
+		p.mu.Unlock()
+		return k, nil
+	}
+	now := p.clock.Now()
+	if !p.keysFetched.IsZero() && now.Sub(p.keysFetched) < keysRefetch {
+		p.mu.Unlock()
+		return nil, errors.Errorf("unknown signing key %q", kid)
+	}
+	fetched := p.keysFetched
+	p.keysFetched = now
+	p.mu.Unlock()
+
+	var set jwks
+	if err := p.get(ctx, d.JWKSURI, &set); err != nil {
+		// A failed fetch can be tried again straight away
+		p.mu.Lock()
+		if p.keysFetched.Equal(now) {
+			p.keysFetched = fetched
+		}
+		p.mu.Unlock()
+		return nil, errors.Wrap(err, "failed to fetch signing keys")
+	}
+	keys := set.publicKeys()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A later fetch has the newer keys
+	if p.keysFetched.Equal(now) {
+		p.keys = keys
+	}
+	if k, ok := findKey(keys, kid); ok {
+		return k, nil
+	}
+	return nil, errors.Errorf("unknown signing key %q", kid)
+}
+
+// findKey finds the key with the ID. Tokens without a key ID can only be
+// used with providers that have a single key.
+func findKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, true
+		}
+	}
+	k, ok := keys[kid]
+	return k, ok
+}
+
+func (p *Provider) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%v returned %v", url, resp.Status)
+	}
+	return errors.WithStack(json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v))
+}
+
+func inGroup(groups interface{}, group string) bool {
+	switch g := groups.(type) {
+	case string:
+		return g == group
+	case []interface{}:
+		for _, v := range g {
+			if v == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// challenge is the S256 PKCE code challenge for the verifier
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
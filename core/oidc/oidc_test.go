@@ -0,0 +1,383 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/sksmith/note-server/core/oidc"
+	"github.com/sksmith/note-server/core/oidc/oidctest"
+	"github.com/sksmith/note-server/core/user"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+const redirectURL = "http://notes.example.com/api/v1/auth/oidc/callback"
+
+func TestLogin(t *testing.T) {
+	for _, secret := range []string{"", "some secret"} {
+		fake, clock := newFakeProvider()
+		fake.ClientSecret = secret
+		users := newMockUsers()
+		p := newProvider(fake, clock, users, "")
+
+		login, authURL, err := p.Start(context.Background())
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		q := mustParse(t, authURL).Query()
+		if !strings.HasPrefix(authURL, fake.Issuer()+"/authorize?") || q.Get("code_challenge_method") != "S256" ||
+			q.Get("code_challenge") == login.Verifier || q.Get("nonce") != login.Nonce || q.Get("scope") != "openid profile email" {
+			t.Errorf("got=[%v] want=[a PKCE authorization request]", authURL)
+		}
+
+		state, code := authorize(t, authURL)
+		u, err := p.Finish(context.Background(), login, state, code)
+		fake.Close()
+		if err != nil {
+			t.Fatalf("secret %q: got=[%v] want=[nil]", secret, err)
+		}
+		if u.Username != "alice" || u.Subject != fake.Issuer()+" 1234" || u.Admin {
+			t.Errorf("got=[%v] want=[alice]", u)
+		}
+		if users.admin != nil {
+			t.Errorf("expected admin to be left alone without an admin group")
+		}
+	}
+}
+
+func TestAdminGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups interface{}
+		want   bool
+	}{
+		{name: "Member", groups: []interface{}{"staff", "admins"}, want: true},
+		{name: "Single Group", groups: "admins", want: true},
+		{name: "Not A Member", groups: []interface{}{"staff"}, want: false},
+		{name: "No Groups", want: false},
+	}
+
+	for _, test := range tests {
+		fake, clock := newFakeProvider()
+		if test.groups != nil {
+			fake.Claims["groups"] = test.groups
+		}
+		users := newMockUsers()
+		p := newProvider(fake, clock, users, "admins")
+
+		u, err := login(t, p)
+		fake.Close()
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		if users.admin == nil || *users.admin != test.want || u.Admin != test.want {
+			t.Errorf("%v: got=[%v] want=[admin %v]", test.name, u, test.want)
+		}
+	}
+}
+
+func TestFinishRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		setup  func(fake *oidctest.FakeProvider, clock *stepClock)
+		finish func(p *oidc.Provider, login oidc.Login, state, code string) (user.User, error)
+	}{
+		{name: "Wrong State", finish: func(p *oidc.Provider, login oidc.Login, state, code string) (user.User, error) {
+			return p.Finish(context.Background(), login, "forged", code)
+		}},
+		{name: "No Login", finish: func(p *oidc.Provider, login oidc.Login, state, code string) (user.User, error) {
+			return p.Finish(context.Background(), oidc.Login{}, "", code)
+		}},
+		{name: "Wrong Verifier", finish: func(p *oidc.Provider, login oidc.Login, state, code string) (user.User, error) {
+			login.Verifier = "guessed"
+			return p.Finish(context.Background(), login, state, code)
+		}},
+		{name: "Reused Code", finish: func(p *oidc.Provider, login oidc.Login, state, code string) (user.User, error) {
+			if _, err := p.Finish(context.Background(), login, state, code); err != nil {
+				return user.User{}, err
+			}
+			return p.Finish(context.Background(), login, state, code)
+		}},
+		{name: "Wrong Nonce", claims: map[string]interface{}{"nonce": "replayed"}},
+		{name: "Wrong Audience", claims: map[string]interface{}{"aud": "someone-else"}},
+		{name: "Wrong Authorized Party", claims: map[string]interface{}{"aud": []interface{}{"notes", "someone-else"}, "azp": "someone-else"}},
+		{name: "Wrong Issuer", claims: map[string]interface{}{"iss": "https://evil.example.com"}},
+		{name: "No Subject", claims: map[string]interface{}{"sub": ""}},
+		{name: "No Username", claims: map[string]interface{}{"preferred_username": nil}},
+		{name: "Expired", setup: func(fake *oidctest.FakeProvider, clock *stepClock) {
+			fake.Now = func() time.Time { return clock.now.Add(-2 * time.Hour) }
+		}},
+		{name: "Issued In The Future", setup: func(fake *oidctest.FakeProvider, clock *stepClock) {
+			fake.Now = func() time.Time { return clock.now.Add(time.Hour) }
+		}},
+	}
+
+	for _, test := range tests {
+		fake, clock := newFakeProvider()
+		for k, v := range test.claims {
+			fake.Claims[k] = v
+		}
+		if test.setup != nil {
+			test.setup(fake, clock)
+		}
+		p := newProvider(fake, clock, newMockUsers(), "")
+
+		login, authURL, err := p.Start(context.Background())
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		state, code := authorize(t, authURL)
+		if test.finish == nil {
+			_, err = p.Finish(context.Background(), login, state, code)
+		} else {
+			_, err = test.finish(p, login, state, code)
+		}
+		fake.Close()
+
+		if errors.Cause(err) != oidc.ErrInvalidLogin {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, err, oidc.ErrInvalidLogin)
+		}
+	}
+}
+
+func TestSignedByAnotherKey(t *testing.T) {
+	fake, clock := newFakeProvider()
+	defer fake.Close()
+	other, _ := newFakeProvider()
+	defer other.Close()
+
+	// The token endpoint hands back a token that's fine apart from being
+	// signed by the other provider
+	var forged string
+	client := &http.Client{Transport: &tokenTransport{
+		tokenURL: fake.Issuer() + "/token",
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id_token": "` + forged + `"}`))
+		}),
+	}}
+	p := oidc.NewProvider(clock, oidc.Config{
+		Issuer:        fake.Issuer(),
+		ClientID:      fake.ClientID,
+		RedirectURL:   redirectURL,
+		UsernameClaim: "preferred_username",
+	}, client, newMockUsers())
+
+	login, authURL, err := p.Start(context.Background())
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	forged = other.Sign(jwt.MapClaims{
+		"iss": fake.Issuer(), "aud": fake.ClientID, "sub": "1234", "preferred_username": "alice",
+		"nonce": login.Nonce, "iat": clock.now.Unix(), "exp": clock.now.Add(time.Hour).Unix(),
+	})
+
+	state, code := authorize(t, authURL)
+	if _, err := p.Finish(context.Background(), login, state, code); errors.Cause(err) != oidc.ErrInvalidLogin {
+		t.Errorf("got=[%v] want=[%v]", err, oidc.ErrInvalidLogin)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	fake, clock := newFakeProvider()
+	defer fake.Close()
+	p := newProvider(fake, clock, newMockUsers(), "")
+
+	mustLogin(t, p)
+	mustLogin(t, p)
+	if got := fake.KeyRequests(); got != 1 {
+		t.Errorf("got=[%v] want=[keys fetched once]", got)
+	}
+
+	// A new key is fetched as soon as it's seen
+	clock.now = clock.now.Add(time.Minute)
+	fake.RotateKey()
+	mustLogin(t, p)
+	if got := fake.KeyRequests(); got != 2 {
+		t.Errorf("got=[%v] want=[keys fetched again]", got)
+	}
+
+	// But an unknown key can't make us fetch them more than once a minute
+	fake.RotateKey()
+	if _, err := login(t, p); errors.Cause(err) != oidc.ErrInvalidLogin {
+		t.Errorf("got=[%v] want=[%v]", err, oidc.ErrInvalidLogin)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	mustLogin(t, p)
+	if got := fake.KeyRequests(); got != 3 {
+		t.Errorf("got=[%v] want=[keys fetched three times]", got)
+	}
+}
+
+// A provider that's slow to hand over its keys only holds up the logins
+// waiting on them
+func TestSlowProvider(t *testing.T) {
+	fake, clock := newFakeProvider()
+	defer fake.Close()
+	p := newProvider(fake, clock, newMockUsers(), "")
+
+	stall := make(chan struct{})
+	fake.Stall = stall
+	l, authURL, err := p.Start(context.Background())
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	state, code := authorize(t, authURL)
+	finished := make(chan error, 1)
+	go func() {
+		_, err := p.Finish(context.Background(), l, state, code)
+		finished <- err
+	}()
+	for fake.KeyRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		_, _, err := p.Start(context.Background())
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("got=[%v] want=[nil]", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("got=[blocked] want=[a login started while the keys are fetched]")
+	}
+
+	close(stall)
+	if err := <-finished; err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+func TestProviderUnavailable(t *testing.T) {
+	fake, clock := newFakeProvider()
+	p := newProvider(fake, clock, newMockUsers(), "")
+	fake.Close()
+
+	_, _, err := p.Start(context.Background())
+	if err == nil || errors.Cause(err) == oidc.ErrInvalidLogin {
+		t.Errorf("got=[%v] want=[an error reaching the provider]", err)
+	}
+}
+
+func newFakeProvider() (*oidctest.FakeProvider, *stepClock) {
+	clock := &stepClock{now: time.Now().UTC().Truncate(time.Second)}
+	fake := oidctest.NewFakeProvider("notes", redirectURL)
+	fake.Now = clock.Now
+	return fake, clock
+}
+
+func newProvider(fake *oidctest.FakeProvider, clock *stepClock, users *mockUsers, adminGroup string) *oidc.Provider {
+	return oidc.NewProvider(clock, oidc.Config{
+		Issuer:        fake.Issuer() + "/",
+		ClientID:      fake.ClientID,
+		ClientSecret:  fake.ClientSecret,
+		RedirectURL:   redirectURL,
+		UsernameClaim: "preferred_username",
+		AdminGroup:    adminGroup,
+	}, nil, users)
+}
+
+// authorize follows the authorization URL to the provider, returning the
+// state and code it redirects back with
+func authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, redirectURL+"?") {
+		t.Fatalf("got=[%v] want=[a redirect back to %v]", location, redirectURL)
+	}
+	q := mustParse(t, location).Query()
+	return q.Get("state"), q.Get("code")
+}
+
+func login(t *testing.T, p *oidc.Provider) (user.User, error) {
+	t.Helper()
+	l, authURL, err := p.Start(context.Background())
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	state, code := authorize(t, authURL)
+	return p.Finish(context.Background(), l, state, code)
+}
+
+func mustLogin(t *testing.T, p *oidc.Provider) {
+	t.Helper()
+	if _, err := login(t, p); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return u
+}
+
+// tokenTransport sends requests for the token URL to the handler and
+// everything else to the network
+type tokenTransport struct {
+	tokenURL string
+	handler  http.Handler
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.String() != t.tokenURL {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+type mockUsers struct {
+	admin *bool
+}
+
+func newMockUsers() *mockUsers {
+	return &mockUsers{}
+}
+
+func (m *mockUsers) Provision(_ context.Context, username, subject string, admin *bool) (user.User, error) {
+	m.admin = admin
+	u := user.User{ID: username + "-id", Username: username, Subject: subject}
+	if admin != nil {
+		u.Admin = *admin
+	}
+	return u, nil
+}
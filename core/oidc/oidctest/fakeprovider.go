@@ -0,0 +1,246 @@
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// FakeProvider is an in-process OpenID Connect provider. Its authorization
+// endpoint logs everyone straight in as Claims and redirects back with a
+// code, its token endpoint checks the code against the PKCE verifier and
+// returns an RS256 signed ID token.
+type FakeProvider struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Claims are added to the ID token, overriding the standard ones
+	Claims map[string]interface{}
+	// Now is when tokens are issued, it defaults to the current time
+	Now func() time.Time
+	// Deny makes the authorization endpoint redirect back with access_denied
+	Deny bool
+	// Stall, when set, holds up requests for the keys until it's closed
+	Stall chan struct{}
+
+	mu          sync.Mutex
+	key         *rsa.PrivateKey
+	kid         string
+	codes       map[string]authorization
+	keyRequests int
+}
+
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+// NewFakeProvider starts a provider with a client that has no secret. Close
+// it when done.
+func NewFakeProvider(clientID, redirectURL string) *FakeProvider {
+	f := &FakeProvider{
+		ClientID:    clientID,
+		RedirectURL: redirectURL,
+		Claims:      map[string]interface{}{"sub": "1234", "preferred_username": "alice"},
+		Now:         time.Now,
+		codes:       make(map[string]authorization),
+	}
+	f.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/authorize", f.authorize)
+	mux.HandleFunc("/token", f.token)
+	mux.HandleFunc("/keys", f.keys)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *FakeProvider) Close() {
+	f.Server.Close()
+}
+
+// Issuer is the provider's URL
+func (f *FakeProvider) Issuer() string {
+	return f.Server.URL
+}
+
+// RotateKey replaces the signing key with a new one with a new key ID
+func (f *FakeProvider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.key = key
+	f.kid = randomString()
+}
+
+// KeyRequests is how many times the keys have been fetched
+func (f *FakeProvider) KeyRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keyRequests
+}
+
+// Sign returns an ID token with the claims signed by the provider's key
+func (f *FakeProvider) Sign(claims jwt.MapClaims) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = f.kid
+	signed, err := token.SignedString(f.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func (f *FakeProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                f.Issuer(),
+		"authorization_endpoint":                f.Issuer() + "/authorize",
+		"token_endpoint":                        f.Issuer() + "/token",
+		"jwks_uri":                              f.Issuer() + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (f *FakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != f.ClientID || q.Get("redirect_uri") != f.RedirectURL {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	back, _ := url.Parse(f.RedirectURL)
+	params := back.Query()
+	params.Set("state", q.Get("state"))
+
+	switch {
+	case f.Deny:
+		params.Set("error", "access_denied")
+	case q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		params.Set("error", "invalid_request")
+	default:
+		code := randomString()
+		f.mu.Lock()
+		f.codes[code] = authorization{redirectURI: q.Get("redirect_uri"), challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+		f.mu.Unlock()
+		params.Set("code", code)
+	}
+
+	back.RawQuery = params.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (f *FakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+	secret, _ = url.QueryUnescape(secret)
+	if clientID != f.ClientID || secret != f.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	f.mu.Lock()
+	auth, ok := f.codes[code]
+	delete(f.codes, code)
+	f.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != auth.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := f.Now()
+	claims := jwt.MapClaims{
+		"iss":   f.Issuer(),
+		"aud":   f.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": auth.nonce,
+	}
+	for k, v := range f.Claims {
+		claims[k] = v
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     f.Sign(claims),
+	})
+}
+
+func (f *FakeProvider) keys(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.keyRequests++
+	pub := f.key.PublicKey
+	kid := f.kid
+	stall := f.Stall
+	f.mu.Unlock()
+
+	if stall != nil {
+		<-stall
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
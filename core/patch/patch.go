@@ -0,0 +1,318 @@
+// Package patch applies JSON Merge Patches (RFC 7396), JSON Patches
+// (RFC 6902) and text splices to documents
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Merge applies the merge patch to the JSON document. Members of the patch
+// replace the document's, objects being merged recursively, and members set
+// to null are removed.
+func Merge(doc, patch []byte) ([]byte, error) {
+	var d, p interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %v", err)
+	}
+
+	return json.Marshal(merge(d, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+	return t
+}
+
+// Operation is a single JSON Patch operation. Value is only used by add,
+// replace and test and From only by move and copy.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies the operations to the JSON document in order. If any of them
+// fails, including a failed test, none of them are applied.
+func Apply(doc []byte, ops []Operation) ([]byte, error) {
+	var d interface{}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		var err error
+		if d, err = apply(d, op); err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+
+	return json.Marshal(d)
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%s requires a value", op.Op)
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, value) {
+			return nil, fmt.Errorf("test failed, %q doesn't hold the value given", op.Path)
+		}
+		return doc, nil
+
+	case "remove":
+		return remove(doc, path)
+
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == "copy" {
+			if value, err = clone(value); err != nil {
+				return nil, err
+			}
+			return add(doc, path, value)
+		}
+
+		if len(from) < len(path) && isPrefix(from, path) {
+			return nil, errors.New("a value can't be moved into one of its own children")
+		}
+		if doc, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	}
+
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("path %q must start with a /", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+	}
+	return doc, nil
+}
+
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := index(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a value that isn't an object or an array", token)
+	})
+}
+
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the whole document can't be removed")
+	}
+
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := index(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%q does not exist", token)
+	})
+}
+
+func replace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := index(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("%q does not exist", token)
+	})
+}
+
+// update walks the path and calls fn with the container holding its last
+// token, replacing the container with whatever fn returns. Arrays can't be
+// changed in place since they may grow or shrink.
+func update(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	token := path[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+		child, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[token] = child
+		return d, nil
+	case []interface{}:
+		i, err := index(token, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := update(d[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = child
+		return d, nil
+	}
+	return nil, fmt.Errorf("%q does not exist", token)
+}
+
+// index parses an array index that must be no greater than max
+func index(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func clone(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
@@ -0,0 +1,129 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sksmith/note-server/core/patch"
+)
+
+func TestMerge(t *testing.T) {
+	// The examples from RFC 7396's appendix
+	tests := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{doc: `{"a":["b"]}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{doc: `{"a":"c"}`, patch: `{"a":["b"]}`, want: `{"a":["b"]}`},
+		{doc: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{doc: `["a","b"]`, patch: `["c","d"]`, want: `["c","d"]`},
+		{doc: `{"a":"b"}`, patch: `["c"]`, want: `["c"]`},
+		{doc: `{"a":"foo"}`, patch: `null`, want: `null`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, want: `{"a":1,"e":null}`},
+		{doc: `[1,2]`, patch: `{"a":"b","c":null}`, want: `{"a":"b"}`},
+		{doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		got, err := patch.Merge([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("%v %v: got=[%v] want=[nil]", test.doc, test.patch, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%v %v: got=[%s] want=[%v]", test.doc, test.patch, got, test.want)
+		}
+	}
+
+	if _, err := patch.Merge([]byte(`{}`), []byte(`{`)); err == nil {
+		t.Errorf("expected an error for an invalid patch")
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		ops     string
+		want    string
+		wantErr bool
+	}{
+		{name: "add member", doc: `{"foo":"bar"}`, ops: `[{"op":"add","path":"/baz","value":"qux"}]`, want: `{"baz":"qux","foo":"bar"}`},
+		{name: "add element", doc: `{"foo":["bar","baz"]}`, ops: `[{"op":"add","path":"/foo/1","value":"qux"}]`, want: `{"foo":["bar","qux","baz"]}`},
+		{name: "append", doc: `{"foo":["bar"]}`, ops: `[{"op":"add","path":"/foo/-","value":["abc"]}]`, want: `{"foo":["bar",["abc"]]}`},
+		{name: "add past the end", doc: `{"foo":["bar"]}`, ops: `[{"op":"add","path":"/foo/2","value":"x"}]`, wantErr: true},
+		{name: "add to missing parent", doc: `{"foo":"bar"}`, ops: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, wantErr: true},
+		{name: "remove member", doc: `{"baz":"qux","foo":"bar"}`, ops: `[{"op":"remove","path":"/baz"}]`, want: `{"foo":"bar"}`},
+		{name: "remove element", doc: `{"foo":["bar","qux","baz"]}`, ops: `[{"op":"remove","path":"/foo/1"}]`, want: `{"foo":["bar","baz"]}`},
+		{name: "remove missing", doc: `{"foo":"bar"}`, ops: `[{"op":"remove","path":"/baz"}]`, wantErr: true},
+		{name: "replace", doc: `{"baz":"qux","foo":"bar"}`, ops: `[{"op":"replace","path":"/baz","value":"boo"}]`, want: `{"baz":"boo","foo":"bar"}`},
+		{name: "replace missing", doc: `{"foo":"bar"}`, ops: `[{"op":"replace","path":"/baz","value":"boo"}]`, wantErr: true},
+		{name: "move member", doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, ops: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, want: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{name: "move element", doc: `{"foo":["all","grass","cows","eat"]}`, ops: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, want: `{"foo":["all","cows","eat","grass"]}`},
+		{name: "move into child", doc: `{"foo":{"bar":1}}`, ops: `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, wantErr: true},
+		{name: "copy", doc: `{"foo":["a"]}`, ops: `[{"op":"copy","from":"/foo","path":"/bar"},{"op":"add","path":"/bar/-","value":"b"}]`, want: `{"bar":["a","b"],"foo":["a"]}`},
+		{name: "test", doc: `{"baz":"qux","foo":["a",2,"c"]}`, ops: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, want: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{name: "test failed", doc: `{"baz":"qux"}`, ops: `[{"op":"test","path":"/baz","value":"bar"}]`, wantErr: true},
+		{name: "escaped", doc: `{"/":9,"~1":10}`, ops: `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, want: `{"~1":10}`},
+		{name: "whole document", doc: `{"foo":"bar"}`, ops: `[{"op":"replace","path":"","value":{"baz":"qux"}}]`, want: `{"baz":"qux"}`},
+		{name: "leading zero", doc: `{"foo":["a","b"]}`, ops: `[{"op":"remove","path":"/foo/01"}]`, wantErr: true},
+		{name: "missing value", doc: `{"foo":"bar"}`, ops: `[{"op":"add","path":"/baz"}]`, wantErr: true},
+		{name: "bad path", doc: `{"foo":"bar"}`, ops: `[{"op":"remove","path":"foo"}]`, wantErr: true},
+		{name: "unknown op", doc: `{"foo":"bar"}`, ops: `[{"op":"frob","path":"/foo"}]`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		ops := []patch.Operation{}
+		if err := json.Unmarshal([]byte(test.ops), &ops); err != nil {
+			t.Fatalf("%v: failed to parse operations %v", test.name, err)
+		}
+
+		got, err := patch.Apply([]byte(test.doc), ops)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got=[%v] wantErr=[%v]", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && string(got) != test.want {
+			t.Errorf("%v: got=[%s] want=[%v]", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	at := func(i int) *int { return &i }
+
+	tests := []struct {
+		name    string
+		text    string
+		edits   []patch.TextEdit
+		want    string
+		wantErr bool
+	}{
+		{name: "append", text: "some", edits: []patch.TextEdit{{Text: " note"}}, want: "some note"},
+		{name: "insert", text: "some note", edits: []patch.TextEdit{{Start: at(5), Text: "new "}}, want: "some new note"},
+		{name: "replace", text: "some note", edits: []patch.TextEdit{{Start: at(0), End: at(4), Text: "a"}}, want: "a note"},
+		{name: "delete", text: "some note", edits: []patch.TextEdit{{Start: at(4), End: at(9)}}, want: "some"},
+		{name: "in order", text: "ab", edits: []patch.TextEdit{{Start: at(0), End: at(1)}, {Start: at(1), Text: "c"}}, want: "bc"},
+		{name: "characters", text: "café au lait", edits: []patch.TextEdit{{Start: at(4), End: at(7), Text: " et"}}, want: "café et lait"},
+		{name: "out of range", text: "ab", edits: []patch.TextEdit{{Start: at(3)}}, wantErr: true},
+		{name: "backwards", text: "ab", edits: []patch.TextEdit{{Start: at(2), End: at(1)}}, wantErr: true},
+		{name: "negative", text: "ab", edits: []patch.TextEdit{{Start: at(-1)}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := patch.Splice(test.text, test.edits)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got=[%v] wantErr=[%v]", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, got, test.want)
+		}
+	}
+}
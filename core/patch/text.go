@@ -0,0 +1,39 @@
+package patch
+
+import "fmt"
+
+// TextEdit replaces the characters of a text from Start up to End with Text.
+// A missing Start is the end of the text, so an edit with only Text appends
+// it, and a missing End is the same as Start, inserting Text without
+// replacing anything. Offsets count characters rather than bytes.
+type TextEdit struct {
+	Start *int   `json:"start,omitempty"`
+	End   *int   `json:"end,omitempty"`
+	Text  string `json:"text"`
+}
+
+// Splice applies the edits to the text in order, each one's offsets referring
+// to the text as the edits before it left it
+func Splice(text string, edits []TextEdit) (string, error) {
+	runes := []rune(text)
+	for i, e := range edits {
+		start := len(runes)
+		if e.Start != nil {
+			start = *e.Start
+		}
+		end := start
+		if e.End != nil {
+			end = *e.End
+		}
+		if start < 0 || end < start || end > len(runes) {
+			return "", fmt.Errorf("edit %d: %d to %d is outside of the %d characters of text", i, start, end, len(runes))
+		}
+
+		spliced := make([]rune, 0, len(runes)-(end-start)+len(e.Text))
+		spliced = append(spliced, runes[:start]...)
+		spliced = append(spliced, []rune(e.Text)...)
+		spliced = append(spliced, runes[end:]...)
+		runes = spliced
+	}
+	return string(runes), nil
+}
@@ -0,0 +1,389 @@
+// Package search provides an in memory inverted index for full-text search
+// over notes. Text is split into words which are lower cased and stemmed, so
+// searching for "running" finds notes containing "runs". Every word's
+// positions are kept so that phrases can be matched and results are ranked
+// with BM25, matches in a note's title counting for more than ones in its
+// body.
+package search
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// bm25 term frequency saturation and length normalization
+	k1 = 1.2
+	b  = 0.75
+
+	// titleBoost is how many body matches a title match is worth
+	titleBoost = 2
+
+	// snippetLead is how many words a snippet shows before its first match
+	snippetLead = 3
+)
+
+// Token is a word in some text, stemmed, along with the byte offsets of the
+// word as it appears in the text
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// Tokenize splits the text into words. A word is a run of letters and digits.
+func Tokenize(text string) []Token {
+	tokens := make([]Token, 0)
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			tokens = append(tokens, newToken(text, start, i))
+			start = -1
+		}
+	}
+	if start != -1 {
+		tokens = append(tokens, newToken(text, start, len(text)))
+	}
+	return tokens
+}
+
+func newToken(text string, start, end int) Token {
+	return Token{Term: Stem(strings.ToLower(text[start:end])), Start: start, End: end}
+}
+
+// Document is a note as it's stored in the index. Terms maps each term to
+// the positions it appears at, the title's words coming first followed by
+// the body's. The body starts one position after the title ends so that a
+// phrase can't span the two.
+//
+// A repository that encrypts documents at rest stores the whole document in
+// Sealed instead, leaving only the ID and Version as they are.
+type Document struct {
+	ID      string           `json:"id"`
+	Version int64            `json:"version"`
+	Title   int              `json:"title"`
+	Length  int              `json:"length"`
+	Terms   map[string][]int `json:"terms"`
+	Sealed  string           `json:"sealed,omitempty"`
+}
+
+// Analyze builds the document for a note
+func Analyze(id string, version int64, title, body string) Document {
+	doc := Document{ID: id, Version: version, Terms: make(map[string][]int)}
+
+	titleTokens := Tokenize(title)
+	for i, t := range titleTokens {
+		doc.Terms[t.Term] = append(doc.Terms[t.Term], i)
+	}
+	doc.Title = len(titleTokens)
+
+	bodyTokens := Tokenize(body)
+	for i, t := range bodyTokens {
+		doc.Terms[t.Term] = append(doc.Terms[t.Term], doc.Title+1+i)
+	}
+	doc.Length = doc.Title + len(bodyTokens)
+
+	return doc
+}
+
+// Query is a parsed search. Every term has to appear in a note for it to
+// match, and every phrase has to appear with its terms next to each other.
+type Query struct {
+	Terms   []string
+	Phrases [][]string
+}
+
+// ParseQuery reads a query made up of words and "quoted phrases". A phrase
+// missing its closing quote runs to the end of the query.
+func ParseQuery(q string) Query {
+	query := Query{}
+	seen := make(map[string]bool)
+	add := func(tokens []Token) {
+		for _, t := range tokens {
+			if !seen[t.Term] {
+				seen[t.Term] = true
+				query.Terms = append(query.Terms, t.Term)
+			}
+		}
+	}
+
+	for i, part := range strings.Split(q, `"`) {
+		tokens := Tokenize(part)
+		add(tokens)
+
+		// Every other part is between quotes
+		if i%2 == 0 || len(tokens) < 2 {
+			continue
+		}
+		phrase := make([]string, len(tokens))
+		for j, t := range tokens {
+			phrase[j] = t.Term
+		}
+		query.Phrases = append(query.Phrases, phrase)
+	}
+
+	return query
+}
+
+// IsEmpty reports whether the query has nothing to search for
+func (q Query) IsEmpty() bool {
+	return len(q.Terms) == 0
+}
+
+// Hit is a document matching a query and its score, higher being more
+// relevant
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// Index is an inverted index of documents. It's safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[string]Document
+	postings map[string]map[string][]int
+	length   int
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[string]Document),
+		postings: make(map[string]map[string][]int),
+	}
+}
+
+// Add adds the document to the index, replacing any document with its ID
+func (ix *Index) Add(doc Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(doc.ID)
+
+	ix.docs[doc.ID] = doc
+	ix.length += doc.Length
+	for term, positions := range doc.Terms {
+		p, ok := ix.postings[term]
+		if !ok {
+			p = make(map[string][]int)
+			ix.postings[term] = p
+		}
+		p[doc.ID] = positions
+	}
+}
+
+// Remove takes the document out of the index
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+
+	for term := range doc.Terms {
+		delete(ix.postings[term], id)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	ix.length -= doc.Length
+	delete(ix.docs, id)
+}
+
+// Len returns the number of documents in the index
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return len(ix.docs)
+}
+
+// Search returns every document matching the query, most relevant first
+func (ix *Index) Search(q Query) []Hit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	hits := make([]Hit, 0)
+	if q.IsEmpty() {
+		return hits
+	}
+
+	// Candidates come from the rarest term's postings
+	rarest := q.Terms[0]
+	for _, term := range q.Terms[1:] {
+		if len(ix.postings[term]) < len(ix.postings[rarest]) {
+			rarest = term
+		}
+	}
+
+	for id := range ix.postings[rarest] {
+		if !ix.matches(id, q) {
+			continue
+		}
+		hits = append(hits, Hit{ID: id, Score: ix.score(id, q)})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+func (ix *Index) matches(id string, q Query) bool {
+	for _, term := range q.Terms {
+		if _, ok := ix.postings[term][id]; !ok {
+			return false
+		}
+	}
+	for _, phrase := range q.Phrases {
+		if !ix.hasPhrase(id, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPhrase reports whether the phrase's terms appear one after the other
+func (ix *Index) hasPhrase(id string, phrase []string) bool {
+	for _, start := range ix.postings[phrase[0]][id] {
+		found := true
+		for i, term := range phrase[1:] {
+			if !contains(ix.postings[term][id], start+i+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// contains searches the sorted positions for the position
+func contains(positions []int, pos int) bool {
+	i := sort.SearchInts(positions, pos)
+	return i < len(positions) && positions[i] == pos
+}
+
+// score is the document's BM25 score for the query's terms
+func (ix *Index) score(id string, q Query) float64 {
+	doc := ix.docs[id]
+	n := float64(len(ix.docs))
+	avg := float64(ix.length) / n
+	if avg == 0 {
+		avg = 1
+	}
+
+	score := 0.0
+	for _, term := range q.Terms {
+		positions := ix.postings[term][id]
+		tf := 0.0
+		for _, p := range positions {
+			if p < doc.Title {
+				tf += titleBoost
+			} else {
+				tf++
+			}
+		}
+
+		df := float64(len(ix.postings[term]))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(doc.Length)/avg))
+	}
+	return score
+}
+
+// Snippet returns up to size words of the text around where the query's terms
+// appear most densely. The text is HTML escaped and the matching words are
+// wrapped in <mark> tags. Text without any matches gives its first words.
+func Snippet(text string, q Query, size int) string {
+	tokens := Tokenize(text)
+	if len(tokens) == 0 || size <= 0 {
+		return ""
+	}
+
+	wanted := make(map[string]bool, len(q.Terms))
+	for _, term := range q.Terms {
+		wanted[term] = true
+	}
+	matched := make([]bool, len(tokens))
+	for i, t := range tokens {
+		matched[i] = wanted[t.Term]
+	}
+
+	// Slide a window of size tokens along the text keeping the first one with
+	// the most matches in it
+	best, bestCount, count := 0, -1, 0
+	for i := range tokens {
+		if matched[i] {
+			count++
+		}
+		if i >= size && matched[i-size] {
+			count--
+		}
+		if i < size-1 && i < len(tokens)-1 {
+			continue
+		}
+		if count > bestCount {
+			best, bestCount = i-size+1, count
+			if best < 0 {
+				best = 0
+			}
+		}
+	}
+
+	// The first window with the most matches has its last match at its very
+	// end, move it along so its first match has a few words in front of it
+	if bestCount > 0 {
+		first := best
+		for !matched[first] {
+			first++
+		}
+		for best+snippetLead < first && best+size < len(tokens) {
+			best++
+		}
+	}
+	end := best + size
+	if end > len(tokens) {
+		end = len(tokens)
+	}
+
+	var sb strings.Builder
+	if best > 0 {
+		sb.WriteString("… ")
+	}
+	prev := tokens[best].Start
+	for i := best; i < end; i++ {
+		t := tokens[i]
+		sb.WriteString(html.EscapeString(text[prev:t.Start]))
+		if matched[i] {
+			sb.WriteString("<mark>" + html.EscapeString(text[t.Start:t.End]) + "</mark>")
+		} else {
+			sb.WriteString(html.EscapeString(text[t.Start:t.End]))
+		}
+		prev = t.End
+	}
+	if end < len(tokens) {
+		sb.WriteString(" …")
+	}
+	return sb.String()
+}
@@ -0,0 +1,184 @@
+package search_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sksmith/note-server/core/search"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{word: "caresses", want: "caress"},
+		{word: "ponies", want: "poni"},
+		{word: "ties", want: "ti"},
+		{word: "cats", want: "cat"},
+		{word: "feed", want: "feed"},
+		{word: "agreed", want: "agre"},
+		{word: "plastered", want: "plaster"},
+		{word: "bled", want: "bled"},
+		{word: "motoring", want: "motor"},
+		{word: "sing", want: "sing"},
+		{word: "conflated", want: "conflat"},
+		{word: "troubled", want: "troubl"},
+		{word: "sized", want: "size"},
+		{word: "hopping", want: "hop"},
+		{word: "falling", want: "fall"},
+		{word: "hissing", want: "hiss"},
+		{word: "fizzed", want: "fizz"},
+		{word: "filing", want: "file"},
+		{word: "happy", want: "happi"},
+		{word: "sky", want: "sky"},
+		{word: "relational", want: "relat"},
+		{word: "conditional", want: "condit"},
+		{word: "rational", want: "ration"},
+		{word: "digitizer", want: "digit"},
+		{word: "vietnamization", want: "vietnam"},
+		{word: "operator", want: "oper"},
+		{word: "decisiveness", want: "decis"},
+		{word: "hopefulness", want: "hope"},
+		{word: "sensibiliti", want: "sensibl"},
+		{word: "triplicate", want: "triplic"},
+		{word: "formative", want: "form"},
+		{word: "electrical", want: "electr"},
+		{word: "goodness", want: "good"},
+		{word: "allowance", want: "allow"},
+		{word: "airliner", want: "airlin"},
+		{word: "adjustable", want: "adjust"},
+		{word: "replacement", want: "replac"},
+		{word: "adoption", want: "adopt"},
+		{word: "communism", want: "commun"},
+		{word: "effective", want: "effect"},
+		{word: "probate", want: "probat"},
+		{word: "rate", want: "rate"},
+		{word: "cease", want: "ceas"},
+		{word: "controll", want: "control"},
+		{word: "roll", want: "roll"},
+		{word: "generalizations", want: "gener"},
+		{word: "connection", want: "connect"},
+		{word: "connecting", want: "connect"},
+		{word: "is", want: "is"},
+		{word: "café", want: "café"},
+		{word: "2021", want: "2021"},
+	}
+
+	for _, test := range tests {
+		if got := search.Stem(test.word); got != test.want {
+			t.Errorf("%v: got=[%v] want=[%v]", test.word, got, test.want)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	text := "Running, the  dogs' café-2021!"
+	got := search.Tokenize(text)
+	want := []search.Token{
+		{Term: "run", Start: 0, End: 7},
+		{Term: "the", Start: 9, End: 12},
+		{Term: "dog", Start: 14, End: 18},
+		{Term: "café", Start: 20, End: 25},
+		{Term: "2021", Start: 26, End: 30},
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v want=%v", got, want)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query       string
+		wantTerms   string
+		wantPhrases string
+	}{
+		{query: "", wantTerms: "[]", wantPhrases: "[]"},
+		{query: "  ,. ", wantTerms: "[]", wantPhrases: "[]"},
+		{query: "Running dogs", wantTerms: "[run dog]", wantPhrases: "[]"},
+		{query: `cats "running dogs" dogs`, wantTerms: "[cat run dog]", wantPhrases: "[[run dog]]"},
+		{query: `"dogs"`, wantTerms: "[dog]", wantPhrases: "[]"},
+		{query: `cats "running dogs`, wantTerms: "[cat run dog]", wantPhrases: "[[run dog]]"},
+	}
+
+	for _, test := range tests {
+		q := search.ParseQuery(test.query)
+		if fmt.Sprint(q.Terms) != test.wantTerms || fmt.Sprint(q.Phrases) != test.wantPhrases {
+			t.Errorf("%q: got=[%v %v] want=[%v %v]", test.query, q.Terms, q.Phrases, test.wantTerms, test.wantPhrases)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ix := search.NewIndex()
+	ix.Add(search.Analyze("1", 1, "Shopping", "Buy milk and eggs, then walk the dog"))
+	ix.Add(search.Analyze("2", 1, "Dogs", "The dog needs walking twice a day"))
+	ix.Add(search.Analyze("3", 1, "Work", "Walk through the quarterly numbers"))
+	ix.Add(search.Analyze("4", 1, "Walks", "A long walk"))
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: "[]"},
+		{query: "cat", want: "[]"},
+		// The title match ranks 2 above 1
+		{query: "dog", want: "[2 1]"},
+		{query: "walked dogs", want: "[2 1]"},
+		{query: `"walk the dog"`, want: "[1]"},
+		{query: `"dog walk"`, want: "[]"},
+		// Phrases don't run from the title into the body
+		{query: `"walks a long"`, want: "[]"},
+		{query: `"long walk"`, want: "[4]"},
+	}
+
+	for _, test := range tests {
+		hits := ix.Search(search.ParseQuery(test.query))
+		ids := make([]string, len(hits))
+		for i, h := range hits {
+			ids[i] = h.ID
+		}
+		if fmt.Sprint(ids) != test.want {
+			t.Errorf("%q: got=%v want=%v", test.query, ids, test.want)
+		}
+	}
+
+	ix.Add(search.Analyze("2", 2, "Cats", "Feed the cat"))
+	ix.Remove("1")
+	ix.Remove("missing")
+	if hits := ix.Search(search.ParseQuery("dog")); len(hits) != 0 {
+		t.Errorf("got=%v want=[]", hits)
+	}
+	if hits := ix.Search(search.ParseQuery("cat")); len(hits) != 1 || hits[0].ID != "2" {
+		t.Errorf("got=%v want=[2]", hits)
+	}
+	if ix.Len() != 3 {
+		t.Errorf("got=[%v] want=[3]", ix.Len())
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := "one two three four five six seven eight nine ten walking the dog eleven twelve thirteen"
+
+	tests := []struct {
+		name  string
+		text  string
+		query string
+		size  int
+		want  string
+	}{
+		{name: "Empty", text: "", query: "dog", size: 5, want: ""},
+		{name: "Short", text: "Walk the dog.", query: "dog", size: 5, want: "Walk the <mark>dog</mark>"},
+		{name: "Window", text: long, query: "walk dog", size: 6, want: "… eight nine ten <mark>walking</mark> the <mark>dog</mark> …"},
+		{name: "End", text: long, query: "thirteen", size: 5, want: "… the dog eleven twelve <mark>thirteen</mark>"},
+		{name: "No Match", text: long, query: "cat", size: 3, want: "one two three …"},
+		{name: "Escaped", text: "if a < b && dog", query: "dog", size: 5, want: "if a &lt; b &amp;&amp; <mark>dog</mark>"},
+	}
+
+	for _, test := range tests {
+		if got := search.Snippet(test.text, search.ParseQuery(test.query), test.size); got != test.want {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package search
+
+// Stem reduces an English word to its stem using Porter's algorithm, so that
+// "connected", "connecting" and "connection" are all indexed as "connect".
+// The word must already be lower case. Words of two letters or less and words
+// with anything other than the letters a-z are returned as they are.
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	w := []byte(word)
+	w = step1a(w)
+	w = step1b(w)
+	w = step1c(w)
+	w = step2(w)
+	w = step3(w)
+	w = step4(w)
+	w = step5(w)
+	return string(w)
+}
+
+// rule replaces suffix with repl when the stem left in front of it satisfies
+// cond
+type rule struct {
+	suffix string
+	repl   string
+	cond   func(stem []byte) bool
+}
+
+// applyRules applies the first rule whose suffix the word ends with. Only
+// that rule is considered even when its condition doesn't hold.
+func applyRules(w []byte, rules []rule) []byte {
+	for _, r := range rules {
+		if !hasSuffix(w, r.suffix) {
+			continue
+		}
+		stem := w[:len(w)-len(r.suffix)]
+		if r.cond == nil || r.cond(stem) {
+			return append(stem[:len(stem):len(stem)], r.repl...)
+		}
+		return w
+	}
+	return w
+}
+
+func step1a(w []byte) []byte {
+	return applyRules(w, []rule{
+		{suffix: "sses", repl: "ss"},
+		{suffix: "ies", repl: "i"},
+		{suffix: "ss", repl: "ss"},
+		{suffix: "s", repl: ""},
+	})
+}
+
+func step1b(w []byte) []byte {
+	if hasSuffix(w, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+
+	var stem []byte
+	switch {
+	case hasSuffix(w, "ed") && hasVowel(w[:len(w)-2]):
+		stem = w[:len(w)-2]
+	case hasSuffix(w, "ing") && hasVowel(w[:len(w)-3]):
+		stem = w[:len(w)-3]
+	default:
+		return w
+	}
+
+	switch {
+	case hasSuffix(stem, "at"), hasSuffix(stem, "bl"), hasSuffix(stem, "iz"):
+		return append(stem[:len(stem):len(stem)], 'e')
+	case endsDoubleConsonant(stem):
+		if last := stem[len(stem)-1]; last != 'l' && last != 's' && last != 'z' {
+			return stem[:len(stem)-1]
+		}
+		return stem
+	case measure(stem) == 1 && endsCVC(stem):
+		return append(stem[:len(stem):len(stem)], 'e')
+	}
+	return stem
+}
+
+func step1c(w []byte) []byte {
+	if hasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		return append(w[:len(w)-1:len(w)-1], 'i')
+	}
+	return w
+}
+
+func step2(w []byte) []byte {
+	return applyRules(w, []rule{
+		{suffix: "ational", repl: "ate", cond: measureAbove(0)},
+		{suffix: "tional", repl: "tion", cond: measureAbove(0)},
+		{suffix: "enci", repl: "ence", cond: measureAbove(0)},
+		{suffix: "anci", repl: "ance", cond: measureAbove(0)},
+		{suffix: "izer", repl: "ize", cond: measureAbove(0)},
+		{suffix: "bli", repl: "ble", cond: measureAbove(0)},
+		{suffix: "alli", repl: "al", cond: measureAbove(0)},
+		{suffix: "entli", repl: "ent", cond: measureAbove(0)},
+		{suffix: "eli", repl: "e", cond: measureAbove(0)},
+		{suffix: "ousli", repl: "ous", cond: measureAbove(0)},
+		{suffix: "ization", repl: "ize", cond: measureAbove(0)},
+		{suffix: "ation", repl: "ate", cond: measureAbove(0)},
+		{suffix: "ator", repl: "ate", cond: measureAbove(0)},
+		{suffix: "alism", repl: "al", cond: measureAbove(0)},
+		{suffix: "iveness", repl: "ive", cond: measureAbove(0)},
+		{suffix: "fulness", repl: "ful", cond: measureAbove(0)},
+		{suffix: "ousness", repl: "ous", cond: measureAbove(0)},
+		{suffix: "aliti", repl: "al", cond: measureAbove(0)},
+		{suffix: "iviti", repl: "ive", cond: measureAbove(0)},
+		{suffix: "biliti", repl: "ble", cond: measureAbove(0)},
+		{suffix: "logi", repl: "log", cond: measureAbove(0)},
+	})
+}
+
+func step3(w []byte) []byte {
+	return applyRules(w, []rule{
+		{suffix: "icate", repl: "ic", cond: measureAbove(0)},
+		{suffix: "ative", repl: "", cond: measureAbove(0)},
+		{suffix: "alize", repl: "al", cond: measureAbove(0)},
+		{suffix: "iciti", repl: "ic", cond: measureAbove(0)},
+		{suffix: "ical", repl: "ic", cond: measureAbove(0)},
+		{suffix: "ful", repl: "", cond: measureAbove(0)},
+		{suffix: "ness", repl: "", cond: measureAbove(0)},
+	})
+}
+
+func step4(w []byte) []byte {
+	// ion is only a suffix after an s or a t
+	if hasSuffix(w, "ion") {
+		stem := w[:len(w)-3]
+		if len(stem) > 0 && (stem[len(stem)-1] == 's' || stem[len(stem)-1] == 't') {
+			if measure(stem) > 1 {
+				return stem
+			}
+			return w
+		}
+	}
+
+	return applyRules(w, []rule{
+		{suffix: "al", cond: measureAbove(1)},
+		{suffix: "ance", cond: measureAbove(1)},
+		{suffix: "ence", cond: measureAbove(1)},
+		{suffix: "er", cond: measureAbove(1)},
+		{suffix: "ic", cond: measureAbove(1)},
+		{suffix: "able", cond: measureAbove(1)},
+		{suffix: "ible", cond: measureAbove(1)},
+		{suffix: "ant", cond: measureAbove(1)},
+		{suffix: "ement", cond: measureAbove(1)},
+		{suffix: "ment", cond: measureAbove(1)},
+		{suffix: "ent", cond: measureAbove(1)},
+		{suffix: "ou", cond: measureAbove(1)},
+		{suffix: "ism", cond: measureAbove(1)},
+		{suffix: "ate", cond: measureAbove(1)},
+		{suffix: "iti", cond: measureAbove(1)},
+		{suffix: "ous", cond: measureAbove(1)},
+		{suffix: "ive", cond: measureAbove(1)},
+		{suffix: "ize", cond: measureAbove(1)},
+	})
+}
+
+func step5(w []byte) []byte {
+	if hasSuffix(w, "e") {
+		stem := w[:len(w)-1]
+		if m := measure(stem); m > 1 || (m == 1 && !endsCVC(stem)) {
+			w = stem
+		}
+	}
+
+	if hasSuffix(w, "ll") && measure(w) > 1 {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+func measureAbove(n int) func([]byte) bool {
+	return func(stem []byte) bool {
+		return measure(stem) > n
+	}
+}
+
+func hasSuffix(w []byte, suffix string) bool {
+	return len(w) >= len(suffix) && string(w[len(w)-len(suffix):]) == suffix
+}
+
+// isConsonant reports whether the letter at i is a consonant. A y is a
+// consonant unless it follows one.
+func isConsonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in the word, m in
+// [C](VC){m}[V]
+func measure(w []byte) int {
+	m, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i >= len(w) {
+			return m
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+}
+
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether the word ends consonant-vowel-consonant where the
+// last consonant isn't a w, x or y, as in hop but not in snow
+func endsCVC(w []byte) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	last := w[n-1]
+	return last != 'w' && last != 'x' && last != 'y'
+}
@@ -0,0 +1,16 @@
+package user
+
+import "context"
+
+type ctxKey struct{}
+
+// NewContext returns a copy of the context carrying the user
+func NewContext(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, ctxKey{}, u)
+}
+
+// FromContext returns the user carried by the context, if any
+func FromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(ctxKey{}).(User)
+	return u, ok
+}
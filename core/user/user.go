@@ -2,15 +2,261 @@ package user
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// MinPasswordLength and MaxPasswordLength bound a password's length in
+	// bytes, bcrypt ignores anything past 72 bytes
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
 )
 
-func NewService() Service {
-	return Service{}
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// A User is someone who can log in. Passwords are only ever stored as bcrypt
+// hashes. Users who log in through an OpenID Connect provider have no password
+// and their Subject is the provider's issuer and subject claim joined by a
+// space. Sessions started before PasswordChanged are no longer accepted.
+type User struct {
+	ID              string     `json:"id"`
+	Username        string     `json:"username"`
+	PasswordHash    string     `json:"passwordHash"`
+	Subject         string     `json:"subject,omitempty"`
+	Admin           bool       `json:"admin"`
+	Created         time.Time  `json:"created"`
+	Updated         time.Time  `json:"updated"`
+	PasswordChanged *time.Time `json:"passwordChanged,omitempty"`
+}
+
+// Repository stores users by their username
+type Repository interface {
+	SaveUser(ctx context.Context, u User) error
+	// GetUser returns the user or a core.ErrNotFound
+	GetUser(ctx context.Context, username string) (User, error)
+}
+
+func NewService(clock core.Clock, repo Repository) *Service {
+	return &Service{clock: clock, repo: repo}
 }
 
 type Service struct {
+	clock core.Clock
+	repo  Repository
+
+	// mu serializes creating users so that two can't take the same username
+	mu sync.Mutex
+}
+
+// Auth returns the user if the password is theirs. Unknown usernames take as
+// long to check as wrong passwords so they can't be told apart.
+func (s *Service) Auth(ctx context.Context, username, password string) (User, bool) {
+	u, err := s.repo.GetUser(ctx, normalizeUsername(username))
+	if err != nil {
+		if !core.IsErrNotFound(err) {
+			log.Error().Err(err).Str("func", "Auth").Str("username", username).Msg("failed to get user")
+		}
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return User{}, false
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return User{}, false
+	}
+	return u, true
+}
+
+// Register creates an account for someone signing themselves up
+func (s *Service) Register(ctx context.Context, username, password string) (User, error) {
+	return s.Create(ctx, username, password, false)
+}
+
+// Create adds a user with the password. Usernames are lower cased and may
+// contain letters, digits, dots, underscores and dashes.
+func (s *Service) Create(ctx context.Context, username, password string, admin bool) (User, error) {
+	const funcName = "CreateUser"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", username).
+		Bool("admin", admin).
+		Msg("creating user")
+
+	username = normalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return User{}, errors.WithStack(&core.ErrInvalid{Reason: "usernames must be 1 to 64 letters, digits, dots, underscores or dashes"})
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return User{}, errors.WithStack(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.repo.GetUser(ctx, username); err == nil {
+		return User{}, errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("username %q is taken", username)})
+	} else if !core.IsErrNotFound(err) {
+		return User{}, errors.WithStack(err)
+	}
+
+	now := s.clock.Now()
+	u := User{ID: id, Username: username, PasswordHash: hash, Admin: admin, Created: now, Updated: now}
+	if err = s.repo.SaveUser(ctx, u); err != nil {
+		return User{}, errors.WithStack(err)
+	}
+
+	return u, nil
+}
+
+// Provision returns the user logging in through an OpenID Connect provider as
+// subject, creating them the first time. A username already taken by someone
+// else, including a local account, can't be used. Admin is updated when set.
+func (s *Service) Provision(ctx context.Context, username, subject string, admin *bool) (User, error) {
+	const funcName = "ProvisionUser"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", username).
+		Str("subject", subject).
+		Msg("provisioning user")
+
+	username = normalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return User{}, errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("%q can't be used as a username", username)})
+	}
+	if subject == "" {
+		return User{}, errors.WithStack(&core.ErrInvalid{Reason: "missing subject"})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	u, err := s.repo.GetUser(ctx, username)
+	if err != nil {
+		if !core.IsErrNotFound(err) {
+			return User{}, errors.WithStack(err)
+		}
+
+		id, err := newID()
+		if err != nil {
+			return User{}, errors.WithStack(err)
+		}
+		u = User{ID: id, Username: username, Subject: subject, Created: now, Updated: now}
+		if admin != nil {
+			u.Admin = *admin
+		}
+		return u, errors.WithStack(s.repo.SaveUser(ctx, u))
+	}
+
+	if u.Subject != subject {
+		return User{}, errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("username %q is taken", username)})
+	}
+	if admin == nil || u.Admin == *admin {
+		return u, nil
+	}
+
+	u.Admin = *admin
+	u.Updated = now
+	return u, errors.WithStack(s.repo.SaveUser(ctx, u))
+}
+
+func (s *Service) Get(ctx context.Context, username string) (User, error) {
+	const funcName = "GetUser"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", username).
+		Msg("getting user")
+
+	u, err := s.repo.GetUser(ctx, normalizeUsername(username))
+	if err != nil {
+		return User{}, errors.WithStack(err)
+	}
+	return u, nil
+}
+
+// ChangePassword replaces the user's password, which requires their current
+// one, and ends every session they've logged in to so that a stolen token
+// stops working along with the old password. Their API keys carry on, they're
+// revoked on their own.
+func (s *Service) ChangePassword(ctx context.Context, username, current, password string) error {
+	const funcName = "ChangePassword"
+
+	log.Info().
+		Str("func", funcName).
+		Str("username", username).
+		Msg("changing password")
+
+	u, ok := s.Auth(ctx, username, current)
+	if !ok {
+		return errors.WithStack(&core.ErrInvalid{Reason: "the current password is wrong"})
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	u.PasswordHash = hash
+	u.Updated = now
+	u.PasswordChanged = &now
+	return errors.WithStack(s.repo.SaveUser(ctx, u))
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return "", errors.WithStack(&core.ErrInvalid{Reason: fmt.Sprintf("passwords must be %d to %d bytes long", MinPasswordLength, MaxPasswordLength)})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(hash), nil
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     []byte
+)
+
+// dummyHash is compared against when a user doesn't exist
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	})
+	return dummy
 }
 
-func (u Service) Auth(ctx context.Context, username, password string) bool {
-	return username == "test" && password == "test"
+// newID returns a random 128 bit ID, hex encoded
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
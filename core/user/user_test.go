@@ -3,9 +3,12 @@ package user_test
 import (
 	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/sksmith/note-server/core"
 	"github.com/sksmith/note-server/core/user"
 )
 
@@ -15,23 +18,182 @@ func TestMain(m *testing.M) {
 }
 
 func TestAuth(t *testing.T) {
+	svc := user.NewService(&mockClock{}, newMockRepo())
+	if _, err := svc.Create(context.Background(), "test", "testpassword", false); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
 	tests := []struct {
 		ctx      context.Context
 		username string
 		password string
 		want     bool
 	}{
-		{ctx: context.Background(), username: "test", password: "test", want: true},
-		{ctx: context.Background(), username: "test", password: "badpass", want: false},
-		{ctx: context.Background(), username: "baduser", password: "test", want: false},
-		{ctx: context.Background(), username: "baduser", password: "badpass", want: false},
+		{ctx: context.Background(), username: "test", password: "testpassword", want: true},
+		{ctx: context.Background(), username: " Test ", password: "testpassword", want: true},
+		{ctx: context.Background(), username: "test", password: "badpassword", want: false},
+		{ctx: context.Background(), username: "test", password: "", want: false},
+		{ctx: context.Background(), username: "baduser", password: "testpassword", want: false},
+		{ctx: context.Background(), username: "baduser", password: "badpassword", want: false},
 	}
 
 	for _, test := range tests {
-		svc := user.NewService()
+		u, got := svc.Auth(test.ctx, test.username, test.password)
+		if got != test.want {
+			t.Errorf("%v/%v: got=[%v] want=[%v]", test.username, test.password, got, test.want)
+		}
+		if got && u.Username != "test" {
+			t.Errorf("got=[%v] want=[test]", u.Username)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockRepo()
+	svc := user.NewService(&mockClock{}, repo)
 
-		if got := svc.Auth(test.ctx, test.username, test.password); got != test.want {
-			t.Errorf("got=[%v] want=[%v]", got, test.want)
+	u, err := svc.Create(ctx, "Some.One", "somepassword", true)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if u.ID == "" || u.Username != "some.one" || !u.Admin || !u.Created.Equal((&mockClock{}).Now()) {
+		t.Errorf("got=[%v] want=[some.one, an admin with an id]", u)
+	}
+	if saved := repo.users["some.one"]; saved.PasswordHash == "" || strings.Contains(saved.PasswordHash, "somepassword") {
+		t.Errorf("expected the password to be hashed got=[%v]", saved.PasswordHash)
+	}
+
+	registered, err := svc.Register(ctx, "another", "somepassword")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if registered.Admin || registered.ID == u.ID {
+		t.Errorf("got=[%v] want=[a different user who isn't an admin]", registered)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{name: "Taken", username: "SOME.ONE", password: "somepassword"},
+		{name: "Empty Username", username: " ", password: "somepassword"},
+		{name: "Bad Username", username: "some one", password: "somepassword"},
+		{name: "Long Username", username: strings.Repeat("a", 65), password: "somepassword"},
+		{name: "Short Password", username: "short", password: "1234567"},
+		{name: "Long Password", username: "long", password: strings.Repeat("a", user.MaxPasswordLength+1)},
+	}
+
+	for _, test := range tests {
+		if _, err := svc.Create(ctx, test.username, test.password, false); !core.IsErrInvalid(err) {
+			t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
 		}
 	}
 }
+
+func TestChangePassword(t *testing.T) {
+	ctx := context.Background()
+	svc := user.NewService(&mockClock{}, newMockRepo())
+	if _, err := svc.Create(ctx, "test", "oldpassword", false); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if err := svc.ChangePassword(ctx, "test", "wrongpassword", "newpassword"); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if err := svc.ChangePassword(ctx, "test", "oldpassword", "short"); !core.IsErrInvalid(err) {
+		t.Errorf("got=[%v] want=[invalid]", err)
+	}
+	if err := svc.ChangePassword(ctx, "test", "oldpassword", "newpassword"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, ok := svc.Auth(ctx, "test", "oldpassword"); ok {
+		t.Errorf("expected the old password to stop working")
+	}
+	if _, ok := svc.Auth(ctx, "test", "newpassword"); !ok {
+		t.Errorf("expected the new password to work")
+	}
+	if u, _ := svc.Get(ctx, "test"); u.PasswordChanged == nil || !u.PasswordChanged.Equal((&mockClock{}).Now()) {
+		t.Errorf("got=[%v] want=[when the password was changed]", u.PasswordChanged)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	ctx := context.Background()
+	repo := newMockRepo()
+	svc := user.NewService(&mockClock{}, repo)
+	if _, err := svc.Create(ctx, "local", "somepassword", false); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	admin := true
+	u, err := svc.Provision(ctx, "Alice", "https://idp 1", &admin)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if u.ID == "" || u.Username != "alice" || u.Subject != "https://idp 1" || !u.Admin || u.PasswordHash != "" {
+		t.Errorf("got=[%v] want=[alice, an admin without a password]", u)
+	}
+	if _, ok := svc.Auth(ctx, "alice", ""); ok {
+		t.Errorf("expected provisioned users not to log in with a password")
+	}
+
+	again, err := svc.Provision(ctx, "alice", "https://idp 1", nil)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if again.ID != u.ID || !again.Admin {
+		t.Errorf("got=[%v] want=[the same user, still an admin]", again)
+	}
+
+	demoted := false
+	if u, _ = svc.Provision(ctx, "alice", "https://idp 1", &demoted); u.Admin || repo.users["alice"].Admin {
+		t.Errorf("expected alice to no longer be an admin")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		subject  string
+	}{
+		{name: "Someone Else", username: "alice", subject: "https://idp 2"},
+		{name: "Local Account", username: "local", subject: "https://idp 3"},
+		{name: "Bad Username", username: "some one", subject: "https://idp 4"},
+		{name: "No Subject", username: "bob", subject: ""},
+	}
+
+	for _, test := range tests {
+		if _, err := svc.Provision(ctx, test.username, test.subject, nil); !core.IsErrInvalid(err) {
+			t.Errorf("%v: got=[%v] want=[invalid]", test.name, err)
+		}
+	}
+}
+
+type mockClock struct{}
+
+func (m *mockClock) Now() time.Time {
+	return time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+}
+
+type mockRepo struct {
+	users map[string]user.User
+}
+
+func newMockRepo() *mockRepo {
+	return &mockRepo{users: make(map[string]user.User)}
+}
+
+func (r *mockRepo) SaveUser(ctx context.Context, u user.User) error {
+	r.users[u.Username] = u
+	return nil
+}
+
+func (r *mockRepo) GetUser(ctx context.Context, username string) (user.User, error) {
+	u, ok := r.users[username]
+	if !ok {
+		return user.User{}, &core.ErrNotFound{}
+	}
+	return u, nil
+}
@@ -6,9 +6,11 @@ require (
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/go-chi/cors v1.2.0
 	github.com/go-chi/render v1.0.1
+	github.com/golang-jwt/jwt/v4 v4.3.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.26.1
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
 
 require (
@@ -0,0 +1,30 @@
+// Package lock has the lock types used by both the core and the repositories.
+package lock
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const stripes = 64
+
+// KeyedMutex serializes work on the same key within this process. Keys are
+// hashed onto a fixed set of mutexes so memory stays bounded no matter how
+// many keys there are, keys that hash to the same stripe share a lock. The
+// zero value is ready to use.
+//
+// Locks aren't reentrant, so each user keeps a KeyedMutex of its own. The
+// note service holds a note's lock while it saves through a repository that
+// may lock the same note, which would deadlock on a shared one.
+type KeyedMutex struct {
+	stripes [stripes]sync.Mutex
+}
+
+// Lock locks the key and returns the function that unlocks it
+func (k *KeyedMutex) Lock(key string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	m := &k.stripes[h.Sum32()%stripes]
+	m.Lock()
+	return m.Unlock
+}
@@ -31,6 +31,36 @@ var (
 		},
 		[]string{"func"},
 	)
+
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smfg_inventory_cache_hits",
+			Help: "Number of reads of the given kind served from the cache",
+		},
+		[]string{"cache"},
+	)
+
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smfg_inventory_cache_misses",
+			Help: "Number of reads of the given kind that missed the cache",
+		},
+		[]string{"cache"},
+	)
+
+	cacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "smfg_inventory_cache_evictions",
+			Help: "Number of entries dropped from the cache to make room",
+		},
+	)
+
+	cacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smfg_inventory_cache_bytes",
+			Help: "Approximate size of what's in the cache",
+		},
+	)
 )
 
 type Metric struct {
@@ -50,8 +80,28 @@ func (m *Metric) Complete(err error) {
 	dbLatency.WithLabelValues(m.funcName).Observe(float64(time.Since(m.start).Milliseconds()))
 }
 
+func CacheHit(cache string) {
+	cacheHits.With(prometheus.Labels{"cache": cache}).Inc()
+}
+
+func CacheMiss(cache string) {
+	cacheMisses.With(prometheus.Labels{"cache": cache}).Inc()
+}
+
+func CacheEvicted(n int) {
+	cacheEvictions.Add(float64(n))
+}
+
+func CacheSize(bytes int64) {
+	cacheBytes.Set(float64(bytes))
+}
+
 func init() {
 	prometheus.MustRegister(dbVolume)
 	prometheus.MustRegister(dbLatency)
 	prometheus.MustRegister(dbErrors)
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(cacheEvictions)
+	prometheus.MustRegister(cacheBytes)
 }
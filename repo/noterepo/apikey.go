@@ -0,0 +1,253 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+)
+
+// API keys are stored alongside the signing keys and sessions, one object per
+// key. Listing them reads every one, there are only a few per user.
+//
+// When a key was last used is stored in an object of its own so that
+// recording it never writes the key. Deleting a key deletes the key first, a
+// use recorded as it's revoked may leave the other object behind but can't
+// bring the key back.
+
+const (
+	apiKeyPrefix    = AuthPrefix + "apikeys/"
+	apiKeyUsePrefix = AuthPrefix + "apikeyuse/"
+
+	apiKeysDir   = "apikeys"
+	apiKeyUseDir = "apikeyuse"
+)
+
+func (r *s3Repo) SaveAPIKey(ctx context.Context, k apikey.Key) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(apiKeyPrefix+k.ID, data)
+	return err
+}
+
+func (r *s3Repo) GetAPIKey(ctx context.Context, id string) (apikey.Key, error) {
+	data, err := r.download(apiKeyPrefix + id)
+	if err != nil {
+		return apikey.Key{}, err
+	}
+
+	k := apikey.Key{}
+	if err = json.Unmarshal(data, &k); err != nil {
+		return apikey.Key{}, err
+	}
+
+	data, err = r.download(apiKeyUsePrefix + id)
+	if core.IsErrNotFound(err) {
+		return k, nil
+	}
+	if err != nil {
+		return apikey.Key{}, err
+	}
+	return withLastUsed(k, data)
+}
+
+func (r *s3Repo) ListAPIKeys(ctx context.Context) ([]apikey.Key, error) {
+	objects, err := r.listObjects(apiKeyPrefix)
+	if err != nil {
+		return []apikey.Key{}, err
+	}
+
+	keys := make([]apikey.Key, 0, len(objects))
+	for _, o := range objects {
+		k, err := r.GetAPIKey(ctx, strings.TrimPrefix(aws.StringValue(o.Key), apiKeyPrefix))
+		if err != nil {
+			// The key was revoked while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []apikey.Key{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (r *s3Repo) DeleteAPIKey(ctx context.Context, id string) error {
+	if err := r.deleteObject(apiKeyPrefix + id); err != nil {
+		return err
+	}
+	return r.deleteObject(apiKeyUsePrefix + id)
+}
+
+func (r *s3Repo) TouchAPIKey(ctx context.Context, id string, used time.Time) error {
+	data, err := json.Marshal(used)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(apiKeyUsePrefix+id, data)
+	return err
+}
+
+func (r *fileRepo) SaveAPIKey(ctx context.Context, k apikey.Key) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, authDir, apiKeysDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.authPath(apiKeysDir, k.ID), data)
+}
+
+func (r *fileRepo) GetAPIKey(ctx context.Context, id string) (apikey.Key, error) {
+	return r.readAPIKeyFile(r.authPath(apiKeysDir, id))
+}
+
+func (r *fileRepo) ListAPIKeys(ctx context.Context) ([]apikey.Key, error) {
+	dir := filepath.Join(r.dir, authDir, apiKeysDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []apikey.Key{}, nil
+		}
+		return []apikey.Key{}, err
+	}
+
+	keys := make([]apikey.Key, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		k, err := r.readAPIKeyFile(filepath.Join(dir, name))
+		if err != nil {
+			// The key was revoked while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []apikey.Key{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (r *fileRepo) DeleteAPIKey(ctx context.Context, id string) error {
+	if err := r.removeAuthFile(apiKeysDir, id); err != nil {
+		return err
+	}
+	return r.removeAuthFile(apiKeyUseDir, id)
+}
+
+func (r *fileRepo) TouchAPIKey(ctx context.Context, id string, used time.Time) error {
+	data, err := json.Marshal(used)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, authDir, apiKeyUseDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.authPath(apiKeyUseDir, id), data)
+}
+
+func (r *fileRepo) readAPIKeyFile(path string) (apikey.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return apikey.Key{}, &core.ErrNotFound{}
+		}
+		return apikey.Key{}, err
+	}
+
+	k := apikey.Key{}
+	if err = json.Unmarshal(data, &k); err != nil {
+		return apikey.Key{}, err
+	}
+
+	data, err = os.ReadFile(r.authPath(apiKeyUseDir, k.ID))
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return apikey.Key{}, err
+	}
+	return withLastUsed(k, data)
+}
+
+// withLastUsed sets when the key was last used from its own object
+func withLastUsed(k apikey.Key, data []byte) (apikey.Key, error) {
+	used := time.Time{}
+	if err := json.Unmarshal(data, &used); err != nil {
+		return apikey.Key{}, err
+	}
+	k.LastUsed = &used
+	return k, nil
+}
+
+func (r *memRepo) SaveAPIKey(ctx context.Context, k apikey.Key) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.apiKeys[k.ID] = k
+	return nil
+}
+
+func (r *memRepo) GetAPIKey(ctx context.Context, id string) (apikey.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, ok := r.apiKeys[id]
+	if !ok {
+		return apikey.Key{}, &core.ErrNotFound{}
+	}
+	return k, nil
+}
+
+func (r *memRepo) ListAPIKeys(ctx context.Context) ([]apikey.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]apikey.Key, 0, len(r.apiKeys))
+	for _, k := range r.apiKeys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (r *memRepo) DeleteAPIKey(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.apiKeys, id)
+	return nil
+}
+
+// TouchAPIKey only records the use of a key that still exists, checking
+// under the same lock as DeleteAPIKey
+func (r *memRepo) TouchAPIKey(ctx context.Context, id string, used time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if k, ok := r.apiKeys[id]; ok {
+		k.LastUsed = &used
+		r.apiKeys[id] = k
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package noterepo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sksmith/note-server/core"
+)
+
+// Attachments are stored as they're uploaded, streamed through rather than
+// held in memory, and never compressed as they're mostly images and documents
+// that are compressed already. In s3 they're stored as
+// attachments/<note id>/<attachment id> and for file storage in a directory
+// per note.
+
+const attachmentsDir = "attachments"
+
+// errUnexpectedOffset is returned when the downloader writes out of order
+var errUnexpectedOffset = errors.New("download written out of order")
+
+func attachmentPrefix(noteID string) string {
+	return AttachmentPrefix + noteID + "/"
+}
+
+// isAttachmentKey reports whether the key, which may be in a namespace,
+// belongs to an attachment
+func isAttachmentKey(key string) bool {
+	for strings.HasPrefix(key, NamespacePrefix) {
+		rest := strings.TrimPrefix(key, NamespacePrefix)
+		i := strings.Index(rest, "/")
+		if i == -1 {
+			return false
+		}
+		key = rest[i+1:]
+	}
+	return strings.HasPrefix(key, AttachmentPrefix)
+}
+
+func (r *s3Repo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) error {
+	_, err := r.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.prefix + attachmentPrefix(noteID) + id),
+		Body:   body,
+	})
+	return err
+}
+
+// OpenAttachment streams the attachment from the offset through a pipe. The
+// download is only returned once it has started, so a missing attachment is
+// reported straight away, and is cancelled when the reader is closed.
+func (r *s3Repo) OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.prefix + attachmentPrefix(noteID) + id),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := r.downloader.Download(&sequentialWriter{w: pw}, input, func(d *s3manager.Downloader) {
+			d.Concurrency = 1
+		})
+		pw.CloseWithError(err)
+	}()
+
+	br := bufio.NewReader(pr)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		_ = pr.Close()
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchKey:
+				return nil, &core.ErrNotFound{}
+			case "InvalidRange":
+				return nil, &core.ErrRangeNotSatisfiable{}
+			}
+		}
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, pr}, nil
+}
+
+// sequentialWriter turns the writes of a downloader that downloads one part
+// at a time, in order, into a stream
+type sequentialWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (s *sequentialWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != s.offset {
+		return 0, errUnexpectedOffset
+	}
+	n, err := s.w.Write(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Repo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	return r.deleteObject(attachmentPrefix(noteID) + id)
+}
+
+// DeleteAttachments skips the keys of notes whose ID starts with this note's
+// ID followed by a slash, like DeleteRevisions does
+func (r *s3Repo) DeleteAttachments(ctx context.Context, noteID string) error {
+	objects, err := r.listObjects(attachmentPrefix(noteID))
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if strings.Contains(strings.TrimPrefix(key, attachmentPrefix(noteID)), "/") {
+			continue
+		}
+		if err := r.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveAttachment writes the attachment to a temporary file that's only
+// renamed into place once it's complete
+func (r *fileRepo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) (err error) {
+	dir := r.attachmentDir(noteID)
+	if err = os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+	path := r.attachmentPath(noteID, id)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), filePerm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func (r *fileRepo) OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(r.attachmentPath(noteID, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &core.ErrNotFound{}
+		}
+		return nil, err
+	}
+	if offset > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if offset >= info.Size() {
+			_ = f.Close()
+			return nil, &core.ErrRangeNotSatisfiable{}
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (r *fileRepo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	if err := os.Remove(r.attachmentPath(noteID, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(r.attachmentDir(noteID))
+}
+
+func (r *fileRepo) DeleteAttachments(ctx context.Context, noteID string) error {
+	dir := r.attachmentDir(noteID)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(r.dir, attachmentsDir))
+}
+
+// attachmentDir hex encodes the ID for the same reasons as notePath
+func (r *fileRepo) attachmentDir(noteID string) string {
+	return filepath.Join(r.dir, attachmentsDir, hex.EncodeToString([]byte(noteID)))
+}
+
+func (r *fileRepo) attachmentPath(noteID, id string) string {
+	return filepath.Join(r.attachmentDir(noteID), hex.EncodeToString([]byte(id)))
+}
+
+// SaveAttachment reads the whole attachment before taking the lock so a slow
+// upload doesn't hold up everything else
+func (r *memRepo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attachments, ok := r.attachments[noteID]
+	if !ok {
+		attachments = make(map[string][]byte)
+		r.attachments[noteID] = attachments
+	}
+	attachments[id] = data
+	return nil
+}
+
+func (r *memRepo) OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, ok := r.attachments[noteID][id]
+	if !ok {
+		return nil, &core.ErrNotFound{}
+	}
+	if offset > 0 && offset >= int64(len(data)) {
+		return nil, &core.ErrRangeNotSatisfiable{}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (r *memRepo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attachments[noteID], id)
+	return nil
+}
+
+func (r *memRepo) DeleteAttachments(ctx context.Context, noteID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attachments, noteID)
+	return nil
+}
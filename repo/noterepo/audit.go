@@ -0,0 +1,171 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core/audit"
+)
+
+// Audit events are stored an event at a time as audit/<day>/<id>, the day
+// being the UTC date they were recorded on, so listing a range of time only
+// reads the events of the days it covers. Events are never overwritten or
+// deleted.
+
+const (
+	auditDir    = "audit"
+	auditLayout = "2006-01-02"
+)
+
+// auditKey is the key of the event relative to AuditPrefix or the audit
+// directory. The ID must have been checked with validNamespace.
+func auditKey(e audit.Event) string {
+	return e.Time.UTC().Format(auditLayout) + "/" + e.ID
+}
+
+// auditDayInRange reports whether any of the day could fall between from and
+// to, see audit.Store
+func auditDayInRange(day string, from, to time.Time) bool {
+	return (from.IsZero() || day >= from.UTC().Format(auditLayout)) &&
+		(to.IsZero() || day <= to.UTC().Format(auditLayout))
+}
+
+func auditEventInRange(e audit.Event, from, to time.Time) bool {
+	return (from.IsZero() || !e.Time.Before(from)) && (to.IsZero() || e.Time.Before(to))
+}
+
+func (r *s3Repo) AppendAuditEvent(ctx context.Context, e audit.Event) error {
+	if !validNamespace(e.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(AuditPrefix+auditKey(e), data)
+	return err
+}
+
+func (r *s3Repo) ListAuditEvents(ctx context.Context, from, to time.Time) ([]audit.Event, error) {
+	objects, err := r.listObjects(AuditPrefix)
+	if err != nil {
+		return []audit.Event{}, err
+	}
+
+	events := make([]audit.Event, 0)
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		day := path.Dir(strings.TrimPrefix(key, AuditPrefix))
+		if !auditDayInRange(day, from, to) {
+			continue
+		}
+
+		data, err := r.download(key)
+		if err != nil {
+			return []audit.Event{}, err
+		}
+		e := audit.Event{}
+		if err = json.Unmarshal(data, &e); err != nil {
+			return []audit.Event{}, err
+		}
+		if auditEventInRange(e, from, to) {
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
+
+func (r *fileRepo) AppendAuditEvent(ctx context.Context, e audit.Event) error {
+	if !validNamespace(e.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, auditDir, filepath.FromSlash(auditKey(e))+".json")
+	if err = os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (r *fileRepo) ListAuditEvents(ctx context.Context, from, to time.Time) ([]audit.Event, error) {
+	dir := filepath.Join(r.dir, auditDir)
+	days, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []audit.Event{}, nil
+		}
+		return []audit.Event{}, err
+	}
+
+	events := make([]audit.Event, 0)
+	for _, day := range days {
+		if !day.IsDir() || !auditDayInRange(day.Name(), from, to) {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, day.Name()))
+		if err != nil {
+			return []audit.Event{}, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, day.Name(), name))
+			if err != nil {
+				return []audit.Event{}, err
+			}
+			e := audit.Event{}
+			if err = json.Unmarshal(data, &e); err != nil {
+				return []audit.Event{}, err
+			}
+			if auditEventInRange(e, from, to) {
+				events = append(events, e)
+			}
+		}
+	}
+
+	return events, nil
+}
+
+func (r *memRepo) AppendAuditEvent(ctx context.Context, e audit.Event) error {
+	if !validNamespace(e.ID) {
+		return ErrInvalidNamespace
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.audit = append(r.audit, e)
+	return nil
+}
+
+func (r *memRepo) ListAuditEvents(ctx context.Context, from, to time.Time) ([]audit.Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := make([]audit.Event, 0)
+	for _, e := range r.audit {
+		if auditEventInRange(e, from, to) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,249 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/auth"
+)
+
+// Signing keys and sessions are stored next to the accounts, one object each.
+// There are only ever a few signing keys so listing them reads every one.
+
+const (
+	signingKeyPrefix = AuthPrefix + "keys/"
+	sessionPrefix    = AuthPrefix + "sessions/"
+
+	signingKeysDir = "keys"
+	sessionsDir    = "sessions"
+)
+
+func (r *s3Repo) SaveSigningKey(ctx context.Context, k auth.SigningKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(signingKeyPrefix+k.ID, data)
+	return err
+}
+
+func (r *s3Repo) ListSigningKeys(ctx context.Context) ([]auth.SigningKey, error) {
+	objects, err := r.listObjects(signingKeyPrefix)
+	if err != nil {
+		return []auth.SigningKey{}, err
+	}
+
+	keys := make([]auth.SigningKey, 0, len(objects))
+	for _, o := range objects {
+		data, err := r.download(aws.StringValue(o.Key))
+		if err != nil {
+			// The key was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []auth.SigningKey{}, err
+		}
+
+		k := auth.SigningKey{}
+		if err = json.Unmarshal(data, &k); err != nil {
+			return []auth.SigningKey{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (r *s3Repo) DeleteSigningKey(ctx context.Context, id string) error {
+	return r.deleteObject(signingKeyPrefix + id)
+}
+
+func (r *s3Repo) SaveSession(ctx context.Context, s auth.Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(sessionPrefix+s.ID, data)
+	return err
+}
+
+func (r *s3Repo) GetSession(ctx context.Context, id string) (auth.Session, error) {
+	data, err := r.download(sessionPrefix + id)
+	if err != nil {
+		return auth.Session{}, err
+	}
+
+	s := auth.Session{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return auth.Session{}, err
+	}
+	return s, nil
+}
+
+func (r *s3Repo) DeleteSession(ctx context.Context, id string) error {
+	return r.deleteObject(sessionPrefix + id)
+}
+
+func (r *fileRepo) SaveSigningKey(ctx context.Context, k auth.SigningKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(r.dir, authDir, signingKeysDir)
+	if err = os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.authPath(signingKeysDir, k.ID), data)
+}
+
+func (r *fileRepo) ListSigningKeys(ctx context.Context) ([]auth.SigningKey, error) {
+	dir := filepath.Join(r.dir, authDir, signingKeysDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []auth.SigningKey{}, nil
+		}
+		return []auth.SigningKey{}, err
+	}
+
+	keys := make([]auth.SigningKey, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			// The key was deleted while we were listing them
+			if os.IsNotExist(err) {
+				continue
+			}
+			return []auth.SigningKey{}, err
+		}
+
+		k := auth.SigningKey{}
+		if err = json.Unmarshal(data, &k); err != nil {
+			return []auth.SigningKey{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (r *fileRepo) DeleteSigningKey(ctx context.Context, id string) error {
+	return r.removeAuthFile(signingKeysDir, id)
+}
+
+func (r *fileRepo) SaveSession(ctx context.Context, s auth.Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, authDir, sessionsDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.authPath(sessionsDir, s.ID), data)
+}
+
+func (r *fileRepo) GetSession(ctx context.Context, id string) (auth.Session, error) {
+	data, err := os.ReadFile(r.authPath(sessionsDir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return auth.Session{}, &core.ErrNotFound{}
+		}
+		return auth.Session{}, err
+	}
+
+	s := auth.Session{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return auth.Session{}, err
+	}
+	return s, nil
+}
+
+func (r *fileRepo) DeleteSession(ctx context.Context, id string) error {
+	return r.removeAuthFile(sessionsDir, id)
+}
+
+func (r *fileRepo) removeAuthFile(dir, id string) error {
+	if err := os.Remove(r.authPath(dir, id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Join(r.dir, authDir, dir))
+}
+
+// authPath hex encodes the ID for the same reasons as notePath
+func (r *fileRepo) authPath(dir, id string) string {
+	return filepath.Join(r.dir, authDir, dir, hex.EncodeToString([]byte(id))+".json")
+}
+
+func (r *memRepo) SaveSigningKey(ctx context.Context, k auth.SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signingKeys[k.ID] = k
+	return nil
+}
+
+func (r *memRepo) ListSigningKeys(ctx context.Context) ([]auth.SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]auth.SigningKey, 0, len(r.signingKeys))
+	for _, k := range r.signingKeys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (r *memRepo) DeleteSigningKey(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.signingKeys, id)
+	return nil
+}
+
+func (r *memRepo) SaveSession(ctx context.Context, s auth.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[s.ID] = s
+	return nil
+}
+
+func (r *memRepo) GetSession(ctx context.Context, id string) (auth.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return auth.Session{}, &core.ErrNotFound{}
+	}
+	return s, nil
+}
+
+func (r *memRepo) DeleteSession(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, id)
+	return nil
+}
@@ -0,0 +1,399 @@
+package noterepo
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo"
+)
+
+// A cachingRepo keeps the notes read from another repository, and its index
+// and trash, in memory. Entries are kept for the TTL and then read again, or
+// revalidated when the repository is a Revalidator so a note that didn't
+// change isn't downloaded again. Saving or deleting a note through the
+// cache drops it, along with the index and trash, from the cache. Every other
+// change to a note's index entries goes through those two, trashing and
+// restoring a note and adopting notes into a namespace included, and
+// revisions and attachments drop the note they belong to as well.
+//
+// Changes made by another process, like another replica writing to the same
+// bucket, are only seen once the TTL is up. The index and trash aren't
+// revalidated themselves as the s3 index already only downloads the entries
+// that changed, see s3index.go.
+//
+// The cache is bounded by the approximate size of what it holds, the least
+// recently used entries are dropped first. Namespaces share the cache of the
+// repository they're in.
+
+const (
+	cacheNote  = "note"
+	cacheIndex = "index"
+	cacheTrash = "trash"
+
+	// entryOverhead is roughly what an entry costs on top of its strings
+	entryOverhead = 200
+)
+
+// ErrNotModified is returned by a Revalidator for a note that hasn't changed
+var ErrNotModified = errors.New("note not modified")
+
+// Revalidator is implemented by repositories that can tell whether a note
+// changed since it was read without reading it again
+type Revalidator interface {
+	// GetIfModified returns the note and its ETag, or ErrNotModified if its
+	// ETag is still etag
+	GetIfModified(ctx context.Context, id, etag string) (note.Note, string, error)
+}
+
+// CacheConfig says how much a cachingRepo keeps and for how long
+type CacheConfig struct {
+	// Size is the most bytes, roughly, kept in the cache
+	Size int64
+	// TTL is how long an entry is used before it's read or revalidated again
+	TTL time.Duration
+}
+
+// GetIfModified downloads the note with a conditional GET, which S3 answers
+// with a 304 when the ETag of its object is still etag. The note and the ETag
+// returned come from the same response.
+func (r *s3Repo) GetIfModified(ctx context.Context, id, etag string) (note.Note, string, error) {
+	obj, err := r.getObject(id, etag)
+	if err != nil {
+		return note.Note{}, "", err
+	}
+	data, err := decompressObject(obj.data, obj.encoding)
+	if err != nil {
+		return note.Note{}, "", err
+	}
+
+	n := note.Note{}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return note.Note{}, "", err
+	}
+	return n, obj.etag, nil
+}
+
+// cacheEntry is what's kept for a note, the index or the trash
+type cacheEntry struct {
+	key     string
+	size    int64
+	expires time.Time
+
+	note note.Note
+	etag string
+	list []note.ListNote
+}
+
+// lruCache holds entries up to a total size, dropping the least recently used
+// ones to make room
+type lruCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+
+	// invalidations counts the entries dropped because they changed, a read
+	// only fills the cache if there were none while it was reading, so that
+	// it can't put back what a save just dropped
+	invalidations uint64
+}
+
+func newLRUCache(max int64) *lruCache {
+	return &lruCache{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// generation returns the number of invalidations so far, to be given to put
+func (c *lruCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.invalidations
+}
+
+// put adds the entry unless there were invalidations since the generation
+// was taken
+func (c *lruCache) put(e *cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.invalidations || e.size > c.max {
+		return
+	}
+	c.remove(e.key)
+	c.items[e.key] = c.order.PushFront(e)
+	c.size += e.size
+
+	evicted := 0
+	for c.size > c.max {
+		c.remove(c.order.Back().Value.(*cacheEntry).key)
+		evicted++
+	}
+	if evicted > 0 {
+		repo.CacheEvicted(evicted)
+	}
+	repo.CacheSize(c.size)
+}
+
+func (c *lruCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidations++
+	for _, key := range keys {
+		c.remove(key)
+	}
+	repo.CacheSize(c.size)
+}
+
+func (c *lruCache) remove(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(el)
+	delete(c.items, key)
+	c.size -= el.Value.(*cacheEntry).size
+}
+
+func noteSize(n note.Note) int64 {
+	size := entryOverhead + len(n.ID) + len(n.Title) + len(n.Data) + len(n.NotebookID)
+	for _, t := range n.Tags {
+		size += len(t)
+	}
+	return int64(size)
+}
+
+func listSize(l []note.ListNote) int64 {
+	size := entryOverhead
+	for _, ln := range l {
+		size += entryOverhead + len(ln.ID) + len(ln.Title) + len(ln.NotebookID)
+		for _, t := range ln.Tags {
+			size += len(t)
+		}
+	}
+	return int64(size)
+}
+
+type cachingRepo struct {
+	Backend
+	clock core.Clock
+	ttl   time.Duration
+	cache *lruCache
+
+	// namespace is the ID of the user whose notes these are, if any, it keeps
+	// their entries apart from everyone else's in the shared cache
+	namespace string
+
+	// namespacesMu guards namespaces, the namespaces used so far
+	namespacesMu sync.Mutex
+	namespaces   map[string]*cachingRepo
+}
+
+// NewCachingRepo returns a repository that caches the notes, index and trash
+// read from repo
+func NewCachingRepo(clock core.Clock, repo Backend, cfg CacheConfig) *cachingRepo {
+	return &cachingRepo{
+		Backend:    repo,
+		clock:      clock,
+		ttl:        cfg.TTL,
+		cache:      newLRUCache(cfg.Size),
+		namespaces: make(map[string]*cachingRepo),
+	}
+}
+
+func (r *cachingRepo) key(kind, id string) string {
+	return r.namespace + "\x00" + kind + "\x00" + id
+}
+
+func (r *cachingRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	key := r.key(cacheNote, id)
+	cached, ok := r.cache.get(key)
+	if ok && r.clock.Now().Before(cached.expires) {
+		repo.CacheHit(cacheNote)
+		return cached.note, nil
+	}
+
+	generation := r.cache.generation()
+	v, revalidate := r.Backend.(Revalidator)
+	if !revalidate {
+		repo.CacheMiss(cacheNote)
+		n, err := r.Backend.Get(ctx, id)
+		if err != nil {
+			return note.Note{}, err
+		}
+		r.cache.put(&cacheEntry{key: key, size: noteSize(n), expires: r.clock.Now().Add(r.ttl), note: n}, generation)
+		return n, nil
+	}
+
+	etag := ""
+	if ok {
+		etag = cached.etag
+	}
+	n, etag, err := v.GetIfModified(ctx, id, etag)
+	switch {
+	case errors.Is(err, ErrNotModified):
+		repo.CacheHit(cacheNote)
+		n, etag = cached.note, cached.etag
+	case err != nil:
+		return note.Note{}, err
+	default:
+		repo.CacheMiss(cacheNote)
+	}
+	r.cache.put(&cacheEntry{key: key, size: noteSize(n), expires: r.clock.Now().Add(r.ttl), note: n, etag: etag}, generation)
+	return n, nil
+}
+
+// cachedList returns the whole index or trash, reading it with list when it
+// isn't cached
+func (r *cachingRepo) cachedList(ctx context.Context, kind string, list func(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error)) ([]note.ListNote, error) {
+	key := r.key(kind, "")
+	if cached, ok := r.cache.get(key); ok && r.clock.Now().Before(cached.expires) {
+		repo.CacheHit(kind)
+		return cached.list, nil
+	}
+
+	repo.CacheMiss(kind)
+	generation := r.cache.generation()
+	l, _, err := list(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.put(&cacheEntry{key: key, size: listSize(l), expires: r.clock.Now().Add(r.ttl), list: l}, generation)
+	return l, nil
+}
+
+// page copies the page of the cached list so callers can't modify it
+func page(l []note.ListNote, startIdx, endIdx int) []note.ListNote {
+	p := note.Page(l, startIdx, endIdx)
+	cp := make([]note.ListNote, len(p))
+	copy(cp, p)
+	return cp
+}
+
+func (r *cachingRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	l, err := r.cachedList(ctx, cacheIndex, r.Backend.List)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	return page(l, startIdx, endIdx), len(l), nil
+}
+
+func (r *cachingRepo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	l, err := r.cachedList(ctx, cacheTrash, r.Backend.ListTrash)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	return page(l, startIdx, endIdx), len(l), nil
+}
+
+// invalidate drops the note, and the index and trash it's listed in
+func (r *cachingRepo) invalidate(id string) {
+	r.cache.invalidate(r.key(cacheNote, id), r.key(cacheIndex, ""), r.key(cacheTrash, ""))
+}
+
+// Changes drop what they change once they're made, even when they fail as
+// they may have been made in part. Reads that started before then don't fill
+// the cache, see lruCache.
+
+func (r *cachingRepo) Save(ctx context.Context, n note.Note) error {
+	defer r.invalidate(n.ID)
+
+	return r.Backend.Save(ctx, n)
+}
+
+func (r *cachingRepo) Delete(ctx context.Context, id string) error {
+	defer r.invalidate(id)
+
+	return r.Backend.Delete(ctx, id)
+}
+
+// Revisions and attachments aren't cached but they belong to a note, so
+// writing them drops the note too. Nothing cached for a note can then outlive
+// a change to anything it's made of, even from a repository that keeps the
+// two together.
+
+func (r *cachingRepo) SaveRevision(ctx context.Context, n note.Note) error {
+	defer r.invalidate(n.ID)
+
+	return r.Backend.SaveRevision(ctx, n)
+}
+
+func (r *cachingRepo) DeleteRevisions(ctx context.Context, id string) error {
+	defer r.invalidate(id)
+
+	return r.Backend.DeleteRevisions(ctx, id)
+}
+
+func (r *cachingRepo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) error {
+	defer r.invalidate(noteID)
+
+	return r.Backend.SaveAttachment(ctx, noteID, id, body)
+}
+
+func (r *cachingRepo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	defer r.invalidate(noteID)
+
+	return r.Backend.DeleteAttachment(ctx, noteID, id)
+}
+
+func (r *cachingRepo) DeleteAttachments(ctx context.Context, noteID string) error {
+	defer r.invalidate(noteID)
+
+	return r.Backend.DeleteAttachments(ctx, noteID)
+}
+
+// Reindex drops the index and trash when repairing as it may rewrite them
+func (r *cachingRepo) Reindex(ctx context.Context, repair bool) (note.IndexReport, error) {
+	if repair {
+		defer r.cache.invalidate(r.key(cacheIndex, ""), r.key(cacheTrash, ""))
+	}
+	return r.Backend.Reindex(ctx, repair)
+}
+
+func (r *cachingRepo) Namespace(userID string) (note.Repository, error) {
+	r.namespacesMu.Lock()
+	defer r.namespacesMu.Unlock()
+
+	if ns, ok := r.namespaces[userID]; ok {
+		return ns, nil
+	}
+
+	inner, err := r.Backend.Namespace(userID)
+	if err != nil {
+		return nil, err
+	}
+	backend, ok := inner.(Backend)
+	if !ok {
+		return nil, errors.New("namespace can't be cached")
+	}
+	ns := &cachingRepo{
+		Backend:    backend,
+		clock:      r.clock,
+		ttl:        r.ttl,
+		cache:      r.cache,
+		namespace:  r.namespace + NamespacePrefix + userID + "/",
+		namespaces: make(map[string]*cachingRepo),
+	}
+	r.namespaces[userID] = ns
+	return ns, nil
+}
@@ -0,0 +1,254 @@
+package noterepo_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/user"
+	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
+)
+
+var cacheConfig = noterepo.CacheConfig{Size: 1 << 20, TTL: time.Minute}
+
+func TestCachingRepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		return noterepo.NewCachingRepo(core.NewClock(), noterepo.NewMemRepo(), cacheConfig)
+	})
+}
+
+func TestCachingNamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		s3 := repotest.NewFakeS3()
+		return mustNamespace(t, noterepo.NewCachingRepo(core.NewClock(), noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket"), cacheConfig))
+	})
+}
+
+func TestCachingRepoGet(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	s3 := repotest.NewFakeS3()
+	counter := &countingDownloader{Downloader: s3}
+	inner := noterepo.NewS3Repo(s3, counter, s3, s3, "somebucket")
+	repo := noterepo.NewCachingRepo(clock, inner, cacheConfig)
+
+	if err := repo.Save(ctx, note.Note{ID: "1", Data: "first"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	// Saving reads the note's index entry
+	counter.downloaded, counter.bytes = nil, 0
+
+	get := func(want string) {
+		t.Helper()
+		n, err := repo.Get(ctx, "1")
+		if err != nil || n.Data != want {
+			t.Errorf("got=[%v, %v] want=[%v]", n, err, want)
+		}
+	}
+
+	get("first")
+	get("first")
+	compare("cached", counter.keys(), "1", t)
+
+	// Once the TTL is up the note is revalidated with a single conditional
+	// download, which an unchanged note doesn't come back from
+	clock.advance(2 * time.Minute)
+	get("first")
+	compare("revalidated", counter.keys(), "1,1 if changed", t)
+	compare("not modified", counter.bytes, int64(len(marshal(note.Note{ID: "1", Data: "first"}))), t)
+
+	// A note changed behind the cache's back is downloaded again after the
+	// TTL
+	if err := inner.Save(ctx, note.Note{ID: "1", Data: "second"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	get("first")
+	clock.advance(2 * time.Minute)
+	get("second")
+	compare("changed", counter.keys(), "1,1 if changed,1 if changed", t)
+
+	// Saving through the cache drops the note straight away
+	if err := repo.Save(ctx, note.Note{ID: "1", Data: "third"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	get("third")
+
+	if err := repo.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.Get(ctx, "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+func TestCachingRepoList(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	inner := &countingListRepo{Backend: noterepo.NewMemRepo()}
+	repo := noterepo.NewCachingRepo(clock, inner, cacheConfig)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := repo.Save(ctx, note.Note{ID: id}); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	list, total, err := repo.List(ctx, 1, 2)
+	if err != nil || total != 3 || len(list) != 1 || list[0].ID != "2" {
+		t.Errorf("got=[%v, %v, %v] want=[the second note of 3]", list, total, err)
+	}
+	_, _, _ = repo.List(ctx, 0, 0)
+	compare("cached", inner.count(), 1, t)
+
+	trashed := clock.now
+	if err := repo.Save(ctx, note.Note{ID: "2", Trashed: &trashed}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, total, _ := repo.List(ctx, 0, 0); total != 2 {
+		t.Errorf("got=[%v] want=[2 after trashing]", total)
+	}
+	if _, total, _ := repo.ListTrash(ctx, 0, 0); total != 1 {
+		t.Errorf("got=[%v] want=[1 in the trash]", total)
+	}
+	compare("invalidated", inner.count(), 2, t)
+
+	clock.advance(2 * time.Minute)
+	_, _, _ = repo.List(ctx, 0, 0)
+	compare("expired", inner.count(), 3, t)
+}
+
+// Every change made through the service is seen straight away, however it
+// reaches the repository, while the TTL never runs out
+func TestCachingRepoChanges(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewCachingRepo(clock, noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket"), cacheConfig)
+	svc := note.NewNamespacedService(clock, repo)
+	ctx := user.NewContext(context.Background(), user.User{ID: "someone", Username: "some.one"})
+
+	expectList := func(name string, want int, wantTrash int) {
+		t.Helper()
+		if _, total, err := svc.List(ctx, note.ListFilter{}, 0, 0); err != nil || total != want {
+			t.Errorf("%v: got=[%v, %v] want=[%v notes]", name, total, err, want)
+		}
+		if _, total, err := svc.ListTrash(ctx, 0, 0); err != nil || total != wantTrash {
+			t.Errorf("%v: got=[%v, %v] want=[%v trashed]", name, total, err, wantTrash)
+		}
+	}
+
+	if _, err := svc.Create(ctx, note.Note{ID: "1", Data: "first"}, note.AnyVersion); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectList("created", 1, 0)
+
+	if err := svc.Delete(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectList("trashed", 0, 1)
+	if _, err := svc.RestoreTrashed(ctx, "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectList("restored", 1, 0)
+
+	a, err := svc.AddAttachment(ctx, "1", "notes.txt", strings.NewReader("some text"))
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if n, err := svc.Get(ctx, "1"); err != nil || len(n.Attachments) != 1 {
+		t.Errorf("attached: got=[%v, %v] want=[the attachment]", n, err)
+	}
+	if err := svc.DeleteAttachment(ctx, "1", a.ID); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	n, err := svc.Get(ctx, "1")
+	if err != nil || len(n.Attachments) != 0 {
+		t.Errorf("detached: got=[%v, %v] want=[no attachments]", n, err)
+	}
+	if n, err = svc.Restore(ctx, "1", 1, n.Version); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got, err := svc.Get(ctx, "1"); err != nil || got.Version != n.Version {
+		t.Errorf("reverted: got=[%v, %v] want=[%v]", got, err, n)
+	}
+
+	// Notes from before there were users are adopted from outside the
+	// namespace, both lists having been cached
+	if err := repo.Save(ctx, note.Note{ID: "legacy", Version: 1}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, total, _ := repo.List(ctx, 0, 0); total != 1 {
+		t.Fatalf("got=[%v] want=[1 legacy note]", total)
+	}
+	if moved, err := svc.Adopt(ctx, "someone"); err != nil || moved != 1 {
+		t.Fatalf("got=[%v, %v] want=[1]", moved, err)
+	}
+	if _, total, _ := repo.List(ctx, 0, 0); total != 0 {
+		t.Errorf("got=[%v] want=[nothing left outside the namespace]", total)
+	}
+	expectList("adopted", 2, 0)
+}
+
+func TestCachingRepoEvicts(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)}
+	s3 := repotest.NewFakeS3()
+	counter := &countingDownloader{Downloader: s3}
+	repo := noterepo.NewCachingRepo(clock, noterepo.NewS3Repo(s3, counter, s3, s3, "somebucket"), noterepo.CacheConfig{Size: 1500, TTL: time.Minute})
+
+	// Each note takes up about half the cache
+	for _, id := range []string{"1", "2", "3"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Data: strings.Repeat("a", 500)}); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	counter.downloaded = nil
+	for _, id := range []string{"1", "2", "1", "3", "1", "2"} {
+		if _, err := repo.Get(ctx, id); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	compare("evicted", counter.keys(), "1,2,3,2", t)
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// countingListRepo counts the lists that reach the repository
+type countingListRepo struct {
+	noterepo.Backend
+
+	mu    sync.Mutex
+	lists int
+}
+
+func (r *countingListRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	r.mu.Lock()
+	r.lists++
+	r.mu.Unlock()
+	return r.Backend.List(ctx, startIdx, endIdx)
+}
+
+func (r *countingListRepo) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lists
+}
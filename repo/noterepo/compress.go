@@ -0,0 +1,130 @@
+package noterepo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Objects can be gzipped before they're uploaded, which mostly pays off for
+// the index snapshot and the index entries as they're downloaded on every
+// list. A gzipped object has its Content-Encoding set to gzip, which is how
+// it's told apart from the objects stored before compression was turned on,
+// or after it was turned off, when it's read back. Other tools reading the
+// bucket know what it holds from it too.
+//
+// Compression happens as objects are uploaded, after an encryptedRepo above
+// the repository has sealed them. Ciphertext doesn't compress, so with
+// encryption at rest on only the IDs, times and JSON around the sealed values
+// get any smaller and compression hardly pays off.
+
+// ContentEncodingGzip is the Content-Encoding of gzipped objects
+const ContentEncodingGzip = "gzip"
+
+// SetCompression turns gzipping objects as they're uploaded on or off, for
+// the repository and every namespace in it. It has to be called before the
+// repository is used.
+func (r *s3Repo) SetCompression(enabled bool) {
+	r.compress = enabled
+}
+
+// compressObject gzips the data when compression is on, returning the content
+// encoding to store it with
+func (r *s3Repo) compressObject(data []byte) ([]byte, string, error) {
+	if !r.compress {
+		return data, "", nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ContentEncodingGzip, nil
+}
+
+// decompressObject returns the data as it was before it was uploaded with
+// the content encoding
+func decompressObject(data []byte, encoding string) ([]byte, error) {
+	if encoding != ContentEncodingGzip {
+		return data, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// MigrateReport says how many objects Migrate looked at and how many of them
+// it rewrote
+type MigrateReport struct {
+	Objects   int `json:"objects"`
+	Rewritten int `json:"rewritten"`
+}
+
+// Migrate rewrites every object in the repository, namespaces included, that
+// isn't stored the way it would be uploaded now, compressing objects stored
+// before compression was turned on or decompressing them after it was turned
+// off. Objects are read and written back whole so it should be run while
+// nothing else is writing to the bucket. Attachments are left alone as they're
+// never compressed.
+func (r *s3Repo) Migrate(ctx context.Context) (MigrateReport, error) {
+	const funcName = "Migrate"
+
+	objects, err := r.listObjects("")
+	if err != nil {
+		return MigrateReport{}, err
+	}
+
+	report := MigrateReport{}
+	for _, o := range objects {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		key := *o.Key
+		if isAttachmentKey(key) {
+			continue
+		}
+		obj, err := r.getObject(key, "")
+		if err != nil {
+			return report, err
+		}
+		report.Objects++
+		if (obj.encoding == ContentEncodingGzip) == r.compress {
+			continue
+		}
+
+		data, err := decompressObject(obj.data, obj.encoding)
+		if err != nil {
+			return report, err
+		}
+		if _, err := r.upload(key, data); err != nil {
+			return report, err
+		}
+		report.Rewritten++
+
+		log.Debug().
+			Str("func", funcName).
+			Str("key", key).
+			Bool("compressed", r.compress).
+			Msg("rewrote object")
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("objects", report.Objects).
+		Int("rewritten", report.Rewritten).
+		Msg("migrated objects")
+
+	return report, nil
+}
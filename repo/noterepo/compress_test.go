@@ -0,0 +1,115 @@
+package noterepo_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
+)
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	repo.SetCompression(true)
+
+	// Stored before compression was turned on, and gzipped by another tool
+	s3.Put("legacy", []byte(marshal(note.Note{ID: "legacy", Title: "legacy"})))
+	s3.PutEncoded("other", gzipped(t, marshal(note.Note{ID: "other", Title: "other"})), noterepo.ContentEncodingGzip)
+
+	if err := repo.Save(ctx, note.Note{ID: "1", Title: "first", Data: "some note"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	for _, key := range []string{"1", noterepo.IndexPrefix + "1"} {
+		data, _ := s3.Object(key)
+		if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) || s3.ContentEncoding(key) != noterepo.ContentEncodingGzip {
+			t.Errorf("%v: got=[%q, %v] want=[gzipped]", key, data, s3.ContentEncoding(key))
+		}
+	}
+
+	for _, id := range []string{"1", "legacy", "other"} {
+		if n, err := repo.Get(ctx, id); err != nil || n.ID != id {
+			t.Errorf("got=[%v, %v] want=[%v]", n, err, id)
+		}
+	}
+	if err := repo.Compact(ctx); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if list, total, err := repo.List(ctx, 0, 0); err != nil || total != 1 || list[0].Title != "first" {
+		t.Errorf("got=[%v, %v, %v] want=[the first note]", list, total, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	plain := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	if err := plain.Save(ctx, note.Note{ID: "1", Title: "first"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	ns, _ := plain.Namespace("someone")
+	if err := ns.Save(ctx, note.Note{ID: "2", Title: "second"}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	// Attachments are never compressed
+	if err := ns.(note.AttachmentStore).SaveAttachment(ctx, "2", "a", strings.NewReader("attached")); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	attachment := noterepo.NamespacePrefix + "someone/" + noterepo.AttachmentPrefix + "2/a"
+
+	compressed := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	compressed.SetCompression(true)
+	report, err := compressed.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if report.Objects != 4 || report.Rewritten != 4 {
+		t.Errorf("got=[%+v] want=[every object rewritten]", report)
+	}
+	for _, key := range s3.Keys() {
+		if key != attachment && s3.ContentEncoding(key) != noterepo.ContentEncodingGzip {
+			t.Errorf("%v: got=[%q] want=[gzip]", key, s3.ContentEncoding(key))
+		}
+	}
+	if report, _ := compressed.Migrate(ctx); report.Rewritten != 0 {
+		t.Errorf("got=[%+v] want=[nothing left to rewrite]", report)
+	}
+
+	// Only the Content-Encoding says whether an object is gzipped
+	s3.PutEncoded("1", gzipped(t, marshal(note.Note{ID: "1", Title: "first"})), "")
+	if report, _ := compressed.Migrate(ctx); report.Rewritten != 1 {
+		t.Errorf("got=[%+v] want=[the object without an encoding rewritten]", report)
+	}
+	s3.PutEncoded("1", gzipped(t, marshal(note.Note{ID: "1", Title: "first"})), noterepo.ContentEncodingGzip)
+
+	// Turning compression off again
+	report, err = plain.Migrate(ctx)
+	if err != nil || report.Rewritten != 4 {
+		t.Errorf("got=[%+v, %v] want=[every object rewritten]", report, err)
+	}
+	data, _ := s3.Object("1")
+	if string(data) != marshal(note.Note{ID: "1", Title: "first"}) {
+		t.Errorf("got=[%s] want=[the note as json]", data)
+	}
+	if data, _ := s3.Object(attachment); string(data) != "attached" {
+		t.Errorf("got=[%s] want=[the attachment as it was]", data)
+	}
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,83 @@
+package noterepo_test
+
+import (
+	"testing"
+
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
+)
+
+func TestMemRepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		return noterepo.NewMemRepo()
+	})
+}
+
+func TestFileRepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		repo, err := noterepo.NewFileRepo(t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to create repo: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestS3RepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		s3 := repotest.NewFakeS3()
+		return noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	})
+}
+
+// Namespaces have to behave like any other repository
+
+func TestMemNamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		return mustNamespace(t, noterepo.NewMemRepo())
+	})
+}
+
+func TestFileNamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		repo, err := noterepo.NewFileRepo(t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to create repo: %v", err)
+		}
+		return mustNamespace(t, repo)
+	})
+}
+
+func TestS3NamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		s3 := repotest.NewFakeS3()
+		return mustNamespace(t, noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket"))
+	})
+}
+
+func mustNamespace(t *testing.T, repo note.Namespaces) note.Repository {
+	ns, err := repo.Namespace("someone")
+	if err != nil {
+		t.Fatalf("failed to get namespace: %v", err)
+	}
+	return ns
+}
+
+func TestCompressedS3RepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		s3 := repotest.NewFakeS3()
+		repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+		repo.SetCompression(true)
+		return repo
+	})
+}
+
+func TestCompressedS3NamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		s3 := repotest.NewFakeS3()
+		repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+		repo.SetCompression(true)
+		return mustNamespace(t, repo)
+	})
+}
@@ -0,0 +1,639 @@
+package noterepo
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/search"
+	"github.com/sksmith/note-server/core/user"
+	"github.com/sksmith/note-server/internal/lock"
+)
+
+// An encryptedRepo encrypts notes at rest on top of another repository. The
+// titles, data and tags of notes and their revisions are sealed with
+// AES-256-GCM before they reach the repository it wraps, which takes care of
+// the index entries too as they're made from the sealed note, and search
+// documents are sealed whole. Attachments are sealed in chunks, see
+// encryptattachment.go. A sealed value is written as
+// nse1.<key id>.<nonce and ciphertext> and is bound to the note it belongs to
+// so it can't be moved to another note.
+//
+// Everything else, from IDs, versions and times to notebooks, users and the
+// audit log, is passed straight through.
+//
+// Values are always sealed with the current key. Reencrypt seals anything
+// sealed with an older key, or not sealed at all, with the current one so old
+// keys can be dropped.
+
+const (
+	sealedPrefix = "nse1."
+	sealedKeyLen = 32
+)
+
+// ErrUnknownKey is returned when reading a value sealed with a key that isn't
+// in the keys
+var ErrUnknownKey = errors.New("value is encrypted with an unknown key")
+
+// Backend is a repository that keeps everything the repositories in this
+// package do, as the encrypted repository has to be able to stand in for
+// them. Content that isn't sealed passes through to it untouched, so anything
+// new that holds the contents of notes has to be sealed here.
+type Backend interface {
+	note.Namespaces
+	note.Revisioner
+	note.Trash
+	note.NotebookRepository
+	note.SearchStore
+	note.Reindexer
+	note.ShareRepository
+	note.KeyRing
+	note.AttachmentStore
+	user.Repository
+	auth.Store
+	apikey.Store
+	audit.Store
+}
+
+// Keys are the keys notes are encrypted at rest with. Values are sealed with
+// the current key, the others are only kept to open what was sealed with them
+// before it.
+type Keys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeys returns the keys, each of which must be 32 bytes, with the current
+// one being the one new values are sealed with
+func NewKeys(current string, keys map[string][]byte) (*Keys, error) {
+	k := &Keys{current: current, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if !validNamespace(id) {
+			return nil, fmt.Errorf("key id %q must be letters, digits, dashes or underscores", id)
+		}
+		if len(key) != sealedKeyLen {
+			return nil, fmt.Errorf("key %q must be %d bytes", id, sealedKeyLen)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	if _, ok := k.aeads[current]; !ok {
+		return nil, fmt.Errorf("current key %q isn't one of the keys", current)
+	}
+	return k, nil
+}
+
+// ParseKeys reads keys written as comma separated <id>:<base64 key> pairs, the
+// first of which is the current key
+func ParseKeys(s string) (*Keys, error) {
+	current := ""
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("keys must be written as <id>:<base64 key>")
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, fmt.Errorf("key %q is given twice", parts[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %q isn't base64: %w", parts[0], err)
+		}
+		if current == "" {
+			current = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+	return NewKeys(current, keys)
+}
+
+// seal encrypts the value with the current key, binding it to aad. Empty
+// values are left empty.
+func (k *Keys) seal(value, aad string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(aad))
+	return sealedPrefix + k.current + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a sealed value. Values that aren't sealed, as stored before
+// encryption was turned on, are returned as they are.
+func (k *Keys) open(value, aad string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("sealed value is malformed")
+	}
+	aead, ok := k.aeads[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, parts[0])
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed value is malformed")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", errors.New("sealed value failed to decrypt")
+	}
+	return string(plain), nil
+}
+
+// stale reports whether the value needs sealing with the current key
+func (k *Keys) stale(value string) bool {
+	return value != "" && !strings.HasPrefix(value, sealedPrefix+k.current+".")
+}
+
+type encryptedRepo struct {
+	Backend
+	keys *Keys
+
+	// namespace is the ID of the user whose notes these are, if any, it's
+	// part of what values are bound to
+	namespace string
+
+	// locks serializes changes to a note with Reencrypt so that it can't
+	// write back a note that was changed or deleted while it was being
+	// sealed again
+	locks lock.KeyedMutex
+
+	// namespacesMu guards namespaces, the namespaces used so far, which are
+	// kept so that everyone using one shares its locks
+	namespacesMu sync.Mutex
+	namespaces   map[string]*encryptedRepo
+}
+
+// NewEncryptedRepo returns a repository that encrypts notes with the keys
+// before storing them in repo
+func NewEncryptedRepo(repo Backend, keys *Keys) *encryptedRepo {
+	return &encryptedRepo{Backend: repo, keys: keys, namespaces: make(map[string]*encryptedRepo)}
+}
+
+// aad binds a value to the field of the note it's stored in
+func (r *encryptedRepo) aad(id, field string) string {
+	return r.namespace + "\x00" + id + "\x00" + field
+}
+
+func (r *encryptedRepo) sealNote(n note.Note) (note.Note, error) {
+	var err error
+	if n.Title, err = r.keys.seal(n.Title, r.aad(n.ID, "title")); err != nil {
+		return note.Note{}, err
+	}
+	if n.Data, err = r.keys.seal(n.Data, r.aad(n.ID, "data")); err != nil {
+		return note.Note{}, err
+	}
+	if n.Tags, err = r.sealTags(n.ID, n.Tags); err != nil {
+		return note.Note{}, err
+	}
+	if n.Attachments, err = r.sealAttachments(n.ID, n.Attachments); err != nil {
+		return note.Note{}, err
+	}
+	return n, nil
+}
+
+func (r *encryptedRepo) openNote(n note.Note) (note.Note, error) {
+	var err error
+	if n.Title, err = r.keys.open(n.Title, r.aad(n.ID, "title")); err != nil {
+		return note.Note{}, err
+	}
+	if n.Data, err = r.keys.open(n.Data, r.aad(n.ID, "data")); err != nil {
+		return note.Note{}, err
+	}
+	if n.Tags, err = r.openTags(n.ID, n.Tags); err != nil {
+		return note.Note{}, err
+	}
+	if n.Attachments, err = r.openAttachments(n.ID, n.Attachments); err != nil {
+		return note.Note{}, err
+	}
+	return n, nil
+}
+
+func (r *encryptedRepo) sealTags(id string, tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	sealed := make([]string, 0, len(tags))
+	for _, t := range tags {
+		s, err := r.keys.seal(t, r.aad(id, "tag"))
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, s)
+	}
+	return sealed, nil
+}
+
+func (r *encryptedRepo) openTags(id string, tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	opened := make([]string, 0, len(tags))
+	for _, t := range tags {
+		o, err := r.keys.open(t, r.aad(id, "tag"))
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, o)
+	}
+	return opened, nil
+}
+
+func (r *encryptedRepo) openList(list []note.ListNote) ([]note.ListNote, error) {
+	opened := make([]note.ListNote, 0, len(list))
+	for _, ln := range list {
+		var err error
+		if ln.Title, err = r.keys.open(ln.Title, r.aad(ln.ID, "title")); err != nil {
+			return nil, err
+		}
+		if ln.Tags, err = r.openTags(ln.ID, ln.Tags); err != nil {
+			return nil, err
+		}
+		opened = append(opened, ln)
+	}
+	return opened, nil
+}
+
+// staleNote reports whether any of the note's values need sealing with the
+// current key
+func (r *encryptedRepo) staleNote(n note.Note) bool {
+	if r.keys.stale(n.Title) || r.keys.stale(n.Data) {
+		return true
+	}
+	for _, t := range n.Tags {
+		if r.keys.stale(t) {
+			return true
+		}
+	}
+	for _, a := range n.Attachments {
+		if r.keys.stale(a.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *encryptedRepo) Save(ctx context.Context, n note.Note) error {
+	unlock := r.locks.Lock(n.ID)
+	defer unlock()
+
+	sealed, err := r.sealNote(n)
+	if err != nil {
+		return err
+	}
+	return r.Backend.Save(ctx, sealed)
+}
+
+func (r *encryptedRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	n, err := r.Backend.Get(ctx, id)
+	if err != nil {
+		return note.Note{}, err
+	}
+	return r.openNote(n)
+}
+
+func (r *encryptedRepo) Delete(ctx context.Context, id string) error {
+	unlock := r.locks.Lock(id)
+	defer unlock()
+
+	return r.Backend.Delete(ctx, id)
+}
+
+func (r *encryptedRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list, total, err := r.Backend.List(ctx, startIdx, endIdx)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	opened, err := r.openList(list)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	return opened, total, nil
+}
+
+func (r *encryptedRepo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list, total, err := r.Backend.ListTrash(ctx, startIdx, endIdx)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	opened, err := r.openList(list)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+	return opened, total, nil
+}
+
+func (r *encryptedRepo) SaveRevision(ctx context.Context, n note.Note) error {
+	unlock := r.locks.Lock(n.ID)
+	defer unlock()
+
+	sealed, err := r.sealNote(n)
+	if err != nil {
+		return err
+	}
+	return r.Backend.SaveRevision(ctx, sealed)
+}
+
+func (r *encryptedRepo) GetRevision(ctx context.Context, id string, version int64) (note.Note, error) {
+	n, err := r.Backend.GetRevision(ctx, id, version)
+	if err != nil {
+		return note.Note{}, err
+	}
+	return r.openNote(n)
+}
+
+func (r *encryptedRepo) DeleteRevisions(ctx context.Context, id string) error {
+	unlock := r.locks.Lock(id)
+	defer unlock()
+
+	return r.Backend.DeleteRevisions(ctx, id)
+}
+
+// A search document is sealed whole, its terms and positions included, and
+// stored in the document's Sealed field
+
+func (r *encryptedRepo) sealSearchDocument(doc search.Document) (search.Document, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return search.Document{}, err
+	}
+	sealed, err := r.keys.seal(string(data), r.aad(doc.ID, "search"))
+	if err != nil {
+		return search.Document{}, err
+	}
+	return search.Document{ID: doc.ID, Version: doc.Version, Sealed: sealed}, nil
+}
+
+func (r *encryptedRepo) openSearchDocument(doc search.Document) (search.Document, error) {
+	if doc.Sealed == "" {
+		return doc, nil
+	}
+	data, err := r.keys.open(doc.Sealed, r.aad(doc.ID, "search"))
+	if err != nil {
+		return search.Document{}, err
+	}
+	opened := search.Document{}
+	if err := json.Unmarshal([]byte(data), &opened); err != nil {
+		return search.Document{}, err
+	}
+	return opened, nil
+}
+
+func (r *encryptedRepo) SaveSearchDocument(ctx context.Context, doc search.Document) error {
+	unlock := r.locks.Lock(doc.ID)
+	defer unlock()
+
+	sealed, err := r.sealSearchDocument(doc)
+	if err != nil {
+		return err
+	}
+	return r.Backend.SaveSearchDocument(ctx, sealed)
+}
+
+func (r *encryptedRepo) DeleteSearchDocument(ctx context.Context, id string) error {
+	unlock := r.locks.Lock(id)
+	defer unlock()
+
+	return r.Backend.DeleteSearchDocument(ctx, id)
+}
+
+func (r *encryptedRepo) ListSearchDocuments(ctx context.Context) ([]search.Document, error) {
+	docs, err := r.Backend.ListSearchDocuments(ctx)
+	if err != nil {
+		return []search.Document{}, err
+	}
+	opened := make([]search.Document, 0, len(docs))
+	for _, doc := range docs {
+		o, err := r.openSearchDocument(doc)
+		if err != nil {
+			return []search.Document{}, err
+		}
+		opened = append(opened, o)
+	}
+	return opened, nil
+}
+
+func (r *encryptedRepo) Namespace(userID string) (note.Repository, error) {
+	r.namespacesMu.Lock()
+	defer r.namespacesMu.Unlock()
+
+	if ns, ok := r.namespaces[userID]; ok {
+		return ns, nil
+	}
+
+	repo, err := r.Backend.Namespace(userID)
+	if err != nil {
+		return nil, err
+	}
+	backend, ok := repo.(Backend)
+	if !ok {
+		return nil, errors.New("namespace can't be encrypted")
+	}
+	ns := NewEncryptedRepo(backend, r.keys)
+	ns.namespace = userID
+	r.namespaces[userID] = ns
+	return ns, nil
+}
+
+// Reencrypt seals every note, revision, attachment and search document that
+// isn't sealed with the current key, in this repository and its namespaces, with the
+// current key. It returns how many were sealed again.
+func (r *encryptedRepo) Reencrypt(ctx context.Context) (int, error) {
+	count, err := r.reencrypt(ctx)
+	if err != nil {
+		return count, err
+	}
+
+	ids, err := r.ListNamespaces(ctx)
+	if err != nil {
+		return count, err
+	}
+	for _, id := range ids {
+		ns, err := r.Namespace(id)
+		if err != nil {
+			return count, err
+		}
+		n, err := ns.(*encryptedRepo).reencrypt(ctx)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// reencrypt does the work of Reencrypt for this repository alone
+func (r *encryptedRepo) reencrypt(ctx context.Context) (int, error) {
+	list, _, err := r.Backend.List(ctx, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	trash, _, err := r.Backend.ListTrash(ctx, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, ln := range append(list, trash...) {
+		n, err := r.reencryptNote(ctx, ln.ID)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	docs, err := r.Backend.ListSearchDocuments(ctx)
+	if err != nil {
+		return count, err
+	}
+	for _, doc := range docs {
+		ok, err := r.reencryptSearchDocument(ctx, doc)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reencryptNote seals the note, its attachments and its revisions again
+// where they need it, returning how many did
+func (r *encryptedRepo) reencryptNote(ctx context.Context, id string) (int, error) {
+	unlock := r.locks.Lock(id)
+	defer unlock()
+
+	count := 0
+	n, err := r.Backend.Get(ctx, id)
+	if err == nil {
+		for _, a := range n.Attachments {
+			ok, err := r.reencryptAttachment(ctx, id, a.ID)
+			if err != nil {
+				return count, err
+			}
+			if ok {
+				count++
+			}
+		}
+	}
+	switch {
+	case core.IsErrNotFound(err):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case r.staleNote(n):
+		if n, err = r.openNote(n); err != nil {
+			return 0, err
+		}
+		if n, err = r.sealNote(n); err != nil {
+			return 0, err
+		}
+		if err = r.Backend.Save(ctx, n); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	revs, err := r.Backend.ListRevisions(ctx, id)
+	if err != nil {
+		return count, err
+	}
+	for _, rev := range revs {
+		n, err := r.Backend.GetRevision(ctx, id, rev.Version)
+		if core.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if !r.staleNote(n) {
+			continue
+		}
+		if n, err = r.openNote(n); err != nil {
+			return count, err
+		}
+		if n, err = r.sealNote(n); err != nil {
+			return count, err
+		}
+		if err = r.Backend.SaveRevision(ctx, n); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// reencryptSearchDocument seals the document again if it needs it. Documents
+// are written back as they were listed, so one that changed since is only
+// replaced by the newer version the next time the index is loaded.
+func (r *encryptedRepo) reencryptSearchDocument(ctx context.Context, doc search.Document) (bool, error) {
+	if doc.Sealed != "" && !r.keys.stale(doc.Sealed) {
+		return false, nil
+	}
+
+	unlock := r.locks.Lock(doc.ID)
+	defer unlock()
+
+	opened, err := r.openSearchDocument(doc)
+	if err != nil {
+		return false, err
+	}
+	sealed, err := r.sealSearchDocument(opened)
+	if err != nil {
+		return false, err
+	}
+	return true, r.Backend.SaveSearchDocument(ctx, sealed)
+}
+
+// ReencryptEvery runs Reencrypt on the given interval until the context is
+// done
+func (r *encryptedRepo) ReencryptEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := r.Reencrypt(ctx)
+			if err != nil {
+				log.Warn().Err(err).Str("func", "ReencryptEvery").Msg("failed to re-encrypt notes")
+				continue
+			}
+			log.Info().Str("func", "ReencryptEvery").Int("reencrypted", n).Msg("re-encrypted notes")
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package noterepo_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/search"
+	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
+)
+
+var (
+	key1 = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", 32)))
+	key2 = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", 32)))
+)
+
+func TestEncryptedRepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		return noterepo.NewEncryptedRepo(noterepo.NewMemRepo(), mustParseKeys(t, "k1:"+key1))
+	})
+}
+
+func TestEncryptedNamespaceConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) note.Repository {
+		repo, err := noterepo.NewFileRepo(t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to create repo: %v", err)
+		}
+		return mustNamespace(t, noterepo.NewEncryptedRepo(repo, mustParseKeys(t, "k1:"+key1)))
+	})
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "One Key", input: "k1:" + key1},
+		{name: "Two Keys", input: "k2:" + key2 + ", k1:" + key1},
+		{name: "Empty", input: "", wantErr: true},
+		{name: "No ID", input: key1, wantErr: true},
+		{name: "Bad ID", input: "k/1:" + key1, wantErr: true},
+		{name: "Not Base64", input: "k1:not-base64!", wantErr: true},
+		{name: "Short Key", input: "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "Given Twice", input: "k1:" + key1 + ",k1:" + key2, wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, err := noterepo.ParseKeys(test.input)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got=[%v] wantErr=[%v]", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// Nothing the wrapped repository stores may hold a note's contents
+func TestEncryptedRepoSeals(t *testing.T) {
+	ctx := context.Background()
+	inner := noterepo.NewMemRepo()
+	repo := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k1:"+key1))
+
+	n := note.Note{ID: "1", Title: "walrus", Data: "the walrus", Tags: []string{"beatles"}, Version: 1}
+	if err := repo.Save(ctx, n); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := repo.SaveRevision(ctx, n); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	doc := search.Analyze(n.ID, n.Version, n.Title, n.Data)
+	if err := repo.SaveSearchDocument(ctx, doc); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	raw, _ := inner.Get(ctx, "1")
+	rev, _ := inner.GetRevision(ctx, "1", 1)
+	list, _, _ := inner.List(ctx, 0, 0)
+	docs, _ := inner.ListSearchDocuments(ctx)
+	stored := []string{raw.Title, raw.Data, raw.Tags[0], rev.Title, rev.Data, list[0].Title, list[0].Tags[0], docs[0].Sealed}
+	if len(docs[0].Terms) != 0 {
+		t.Errorf("got=[%v] want=[no terms outside the sealed document]", docs[0].Terms)
+	}
+	for _, s := range stored {
+		if !strings.HasPrefix(s, "nse1.k1.") {
+			t.Errorf("got=[%v] want=[a value sealed with k1]", s)
+		}
+	}
+
+	got, err := repo.Get(ctx, "1")
+	if err != nil || got.Title != n.Title || got.Data != n.Data || len(got.Tags) != 1 || got.Tags[0] != "beatles" {
+		t.Errorf("got=[%v, %v] want=[%v]", got, err, n)
+	}
+	gotDocs, err := repo.ListSearchDocuments(ctx)
+	if err != nil || len(gotDocs) != 1 || len(gotDocs[0].Terms) != len(doc.Terms) {
+		t.Errorf("got=[%v, %v] want=[%v]", gotDocs, err, doc)
+	}
+
+	// A value moved to another note doesn't open
+	raw.ID = "2"
+	if err := inner.Save(ctx, raw); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.Get(ctx, "2"); err == nil {
+		t.Errorf("got=[nil] want=[an error for a value sealed for another note]")
+	}
+}
+
+// Rotating keys seals everything with the new key so the old one can go
+func TestEncryptedRepoReencrypt(t *testing.T) {
+	ctx := context.Background()
+	inner := noterepo.NewMemRepo()
+
+	// A note from before encryption was turned on
+	if err := inner.Save(ctx, note.Note{ID: "0", Data: "plain", Version: 1}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	old := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k1:"+key1))
+	ns, err := old.Namespace("someone")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	n := note.Note{ID: "1", Title: "walrus", Data: "the walrus", Tags: []string{"beatles"}, Version: 1}
+	for _, r := range []note.Repository{old, ns} {
+		if err := r.Save(ctx, n); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		if err := r.(note.Revisioner).SaveRevision(ctx, n); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		if err := r.(note.SearchStore).SaveSearchDocument(ctx, search.Analyze(n.ID, n.Version, n.Title, n.Data)); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	rotated := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k2:"+key2+",k1:"+key1))
+	count, err := rotated.Reencrypt(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if count != 7 {
+		t.Errorf("got=[%v] want=[7]", count)
+	}
+	if count, _ := rotated.Reencrypt(ctx); count != 0 {
+		t.Errorf("got=[%v] want=[nothing left to re-encrypt]", count)
+	}
+
+	raw, _ := inner.Get(ctx, "0")
+	if !strings.HasPrefix(raw.Data, "nse1.k2.") {
+		t.Errorf("got=[%v] want=[a value sealed with k2]", raw.Data)
+	}
+
+	current := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k2:"+key2))
+	ns, _ = current.Namespace("someone")
+	for _, r := range []note.Repository{current, ns} {
+		got, err := r.Get(ctx, "1")
+		if err != nil || got.Data != n.Data {
+			t.Errorf("got=[%v, %v] want=[%v]", got, err, n)
+		}
+		if _, err := r.(note.Revisioner).GetRevision(ctx, "1", 1); err != nil {
+			t.Errorf("got=[%v] want=[nil]", err)
+		}
+		if _, err := r.(note.SearchStore).ListSearchDocuments(ctx); err != nil {
+			t.Errorf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	dropped := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k3:"+key1))
+	if _, err := dropped.Get(ctx, "1"); !errors.Is(err, noterepo.ErrUnknownKey) {
+		t.Errorf("got=[%v] want=[%v]", err, noterepo.ErrUnknownKey)
+	}
+}
+
+// Attachments are sealed, bound to where they're stored and re-encrypted
+// along with their notes
+func TestEncryptedRepoAttachments(t *testing.T) {
+	ctx := context.Background()
+	inner := noterepo.NewMemRepo()
+	data := bytes.Repeat([]byte("the walrus "), 20000)
+
+	// An attachment from before encryption was turned on
+	legacy := note.Note{ID: "0", Version: 1, Attachments: []note.Attachment{{ID: "a", Name: "legacy.txt"}}}
+	if err := inner.Save(ctx, legacy); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := inner.SaveAttachment(ctx, "0", "a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	old := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k1:"+key1))
+	n := note.Note{ID: "1", Version: 1, Attachments: []note.Attachment{{ID: "a", Name: "walrus.txt"}}}
+	if err := old.Save(ctx, n); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := old.SaveAttachment(ctx, "1", "a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	raw, _ := inner.Get(ctx, "1")
+	if !strings.HasPrefix(raw.Attachments[0].Name, "nse1.k1.") {
+		t.Errorf("got=[%v] want=[a name sealed with k1]", raw.Attachments[0].Name)
+	}
+	stored := readAttachment(t, inner, "1", "a", 0)
+	if !bytes.HasPrefix(stored, []byte("nse1.k1.")) || bytes.Contains(stored, []byte("walrus")) {
+		t.Errorf("got=[%.20q] want=[an attachment sealed with k1]", stored)
+	}
+	for _, id := range []string{"0", "1"} {
+		if got := readAttachment(t, old, id, "a", 100000); !bytes.Equal(got, data[100000:]) {
+			t.Errorf("got=[%v bytes] want=[%v bytes]", len(got), len(data)-100000)
+		}
+	}
+
+	// An attachment moved to another note, or cut short, doesn't open
+	if err := inner.SaveAttachment(ctx, "2", "a", bytes.NewReader(stored)); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := inner.SaveAttachment(ctx, "1", "short", bytes.NewReader(stored[:len(stored)-1000])); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	for _, at := range [][2]string{{"2", "a"}, {"1", "short"}} {
+		rc, err := old.OpenAttachment(ctx, at[0], at[1], 0)
+		if err == nil {
+			_, err = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Errorf("%v: got=[nil] want=[an error]", at)
+		}
+	}
+
+	rotated := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k2:"+key2+",k1:"+key1))
+	count, err := rotated.Reencrypt(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if count != 4 {
+		t.Errorf("got=[%v] want=[4]", count)
+	}
+
+	current := noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k2:"+key2))
+	for _, id := range []string{"0", "1"} {
+		if got := readAttachment(t, current, id, "a", 0); !bytes.Equal(got, data) {
+			t.Errorf("got=[%v bytes] want=[%v bytes]", len(got), len(data))
+		}
+	}
+}
+
+func readAttachment(t *testing.T, repo note.AttachmentStore, noteID, id string, offset int64) []byte {
+	t.Helper()
+	rc, err := repo.OpenAttachment(context.Background(), noteID, id, offset)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return data
+}
+
+func TestReencryptEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inner := noterepo.NewMemRepo()
+	if err := inner.Save(ctx, note.Note{ID: "0", Data: "plain", Version: 1}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		noterepo.NewEncryptedRepo(inner, mustParseKeys(t, "k1:"+key1)).ReencryptEvery(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		raw, _ := inner.Get(ctx, "0")
+		if strings.HasPrefix(raw.Data, "nse1.k1.") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got=[%v] want=[a value sealed with k1]", raw.Data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func mustParseKeys(t *testing.T, s string) *noterepo.Keys {
+	keys, err := noterepo.ParseKeys(s)
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+	return keys
+}
@@ -0,0 +1,340 @@
+package noterepo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Attachments are too large to seal as a single value so they're sealed in
+// chunks, streamed through rather than held in memory. A sealed attachment
+// starts with nse1.<key id>. followed by the chunks, each being a nonce and
+// the ciphertext of up to attachmentChunkLen bytes. Every chunk is bound to
+// the attachment, its position in it and whether it's the last one, so that
+// chunks can't be reordered, moved to another attachment or cut off.
+//
+// Because every chunk but the last is the same size a read from an offset
+// only has to fetch the chunks from the one the offset falls in. The names of
+// attachments are sealed with the note, their sizes, content types and hashes
+// aren't.
+
+const (
+	attachmentChunkLen = 64 << 10
+
+	// maxSealedHeaderLen bounds how much of an attachment is looked at for
+	// the header
+	maxSealedHeaderLen = 128
+)
+
+var (
+	errSealedAttachmentTruncated = errors.New("sealed attachment is truncated")
+	errSealedAttachmentMalformed = errors.New("sealed attachment is malformed")
+)
+
+func sealedChunkLen(aead cipher.AEAD) int {
+	return aead.NonceSize() + attachmentChunkLen + aead.Overhead()
+}
+
+// chunkAAD binds a chunk to the attachment, its index and whether it's last
+func (r *encryptedRepo) chunkAAD(noteID, id string, index int64, final bool) []byte {
+	return []byte(r.aad(noteID, "attachment") + "\x00" + id + "\x00" +
+		strconv.FormatInt(index, 10) + "\x00" + strconv.FormatBool(final))
+}
+
+func (r *encryptedRepo) sealAttachments(noteID string, attachments []note.Attachment) ([]note.Attachment, error) {
+	if attachments == nil {
+		return nil, nil
+	}
+	sealed := make([]note.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		var err error
+		if a.Name, err = r.keys.seal(a.Name, r.aad(noteID, "attachment name")); err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, a)
+	}
+	return sealed, nil
+}
+
+func (r *encryptedRepo) openAttachments(noteID string, attachments []note.Attachment) ([]note.Attachment, error) {
+	if attachments == nil {
+		return nil, nil
+	}
+	opened := make([]note.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		var err error
+		if a.Name, err = r.keys.open(a.Name, r.aad(noteID, "attachment name")); err != nil {
+			return nil, err
+		}
+		opened = append(opened, a)
+	}
+	return opened, nil
+}
+
+// SaveAttachment seals the attachment as it's read, the repository reading
+// the sealed chunks from a pipe
+func (r *encryptedRepo) SaveAttachment(ctx context.Context, noteID, id string, body io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.sealAttachment(pw, noteID, id, body))
+	}()
+
+	err := r.Backend.SaveAttachment(ctx, noteID, id, pr)
+	// Stops the sealing if the repository gave up before reading everything
+	_ = pr.Close()
+	return err
+}
+
+func (r *encryptedRepo) sealAttachment(w io.Writer, noteID, id string, body io.Reader) error {
+	aead := r.keys.aeads[r.keys.current]
+	if _, err := io.WriteString(w, sealedPrefix+r.keys.current+"."); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(body)
+	plain := make([]byte, attachmentChunkLen)
+	sealed := make([]byte, 0, sealedChunkLen(aead))
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, plain)
+		final := false
+		switch err {
+		case nil:
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return err
+		}
+
+		nonce := sealed[:aead.NonceSize()]
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		chunk := aead.Seal(nonce, nonce, plain[:n], r.chunkAAD(noteID, id, index, final))
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// readSealedHeader reads the header of a sealed attachment, returning the
+// key it's sealed with and the header's length. Attachments stored before
+// encryption was turned on aren't sealed and are left unread.
+func readSealedHeader(br *bufio.Reader) (string, int64, bool, error) {
+	peek, err := br.Peek(maxSealedHeaderLen)
+	if err != nil && err != io.EOF {
+		return "", 0, false, err
+	}
+	if !bytes.HasPrefix(peek, []byte(sealedPrefix)) {
+		return "", 0, false, nil
+	}
+
+	rest := peek[len(sealedPrefix):]
+	i := bytes.IndexByte(rest, '.')
+	if i <= 0 {
+		return "", 0, false, errSealedAttachmentMalformed
+	}
+	length := len(sealedPrefix) + i + 1
+	if _, err := br.Discard(length); err != nil {
+		return "", 0, false, err
+	}
+	return string(rest[:i]), int64(length), true, nil
+}
+
+// OpenAttachment opens the chunks from the one the offset falls in. A read
+// from the start reads the chunks straight after the header, anything else
+// opens the attachment again at the chunk and opens the chunk straight away
+// to tell whether the offset is past the end.
+func (r *encryptedRepo) OpenAttachment(ctx context.Context, noteID, id string, offset int64) (io.ReadCloser, error) {
+	rc, err := r.Backend.OpenAttachment(ctx, noteID, id, 0)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(rc)
+	keyID, headerLen, sealed, err := readSealedHeader(br)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+
+	if !sealed {
+		if offset == 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{br, rc}, nil
+		}
+		_ = rc.Close()
+		return r.Backend.OpenAttachment(ctx, noteID, id, offset)
+	}
+
+	aead, ok := r.keys.aeads[keyID]
+	if !ok {
+		_ = rc.Close()
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+
+	index := offset / attachmentChunkLen
+	if index > 0 {
+		_ = rc.Close()
+		rc, err = r.Backend.OpenAttachment(ctx, noteID, id, headerLen+index*int64(sealedChunkLen(aead)))
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(rc)
+	}
+
+	sr := &sealedAttachmentReader{
+		src:    br,
+		closer: rc,
+		aead:   aead,
+		aad: func(index int64, final bool) []byte {
+			return r.chunkAAD(noteID, id, index, final)
+		},
+		index:  index,
+		skip:   int(offset % attachmentChunkLen),
+		sealed: make([]byte, sealedChunkLen(aead)),
+		buf:    make([]byte, 0, attachmentChunkLen),
+	}
+	if offset > 0 {
+		if err := sr.next(); err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+	}
+	return sr, nil
+}
+
+// sealedAttachmentReader opens a sealed attachment's chunks as they're read
+type sealedAttachmentReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	aad    func(index int64, final bool) []byte
+
+	// index is the next chunk's, skip is how much of it to skip
+	index int64
+	skip  int
+
+	sealed []byte
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func (s *sealedAttachmentReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next opens the next chunk
+func (s *sealedAttachmentReader) next() error {
+	n, err := io.ReadFull(s.src, s.sealed)
+	final := false
+	switch err {
+	case nil:
+		if _, err := s.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		return errSealedAttachmentTruncated
+	default:
+		return err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if n < nonceSize {
+		return errSealedAttachmentMalformed
+	}
+	plain, err := s.aead.Open(s.buf[:0], s.sealed[:nonceSize], s.sealed[nonceSize:n], s.aad(s.index, final))
+	if err != nil {
+		return errors.New("sealed attachment failed to decrypt")
+	}
+
+	if s.skip > 0 && s.skip >= len(plain) {
+		return &core.ErrRangeNotSatisfiable{}
+	}
+	s.plain = plain[s.skip:]
+	s.skip = 0
+	s.index++
+	s.done = final
+	return nil
+}
+
+func (s *sealedAttachmentReader) Close() error {
+	return s.closer.Close()
+}
+
+func (r *encryptedRepo) DeleteAttachment(ctx context.Context, noteID, id string) error {
+	unlock := r.locks.Lock(noteID)
+	defer unlock()
+
+	return r.Backend.DeleteAttachment(ctx, noteID, id)
+}
+
+func (r *encryptedRepo) DeleteAttachments(ctx context.Context, noteID string) error {
+	unlock := r.locks.Lock(noteID)
+	defer unlock()
+
+	return r.Backend.DeleteAttachments(ctx, noteID)
+}
+
+// reencryptAttachment seals the attachment again if it isn't sealed with the
+// current key, the caller must hold the note's lock. The attachment is read
+// while it's being replaced, which every repository allows as the new one only
+// takes its place once it's complete.
+func (r *encryptedRepo) reencryptAttachment(ctx context.Context, noteID, id string) (bool, error) {
+	rc, err := r.Backend.OpenAttachment(ctx, noteID, id, 0)
+	if core.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	keyID, _, sealed, err := readSealedHeader(bufio.NewReader(rc))
+	_ = rc.Close()
+	if err != nil {
+		return false, err
+	}
+	if sealed && keyID == r.keys.current {
+		return false, nil
+	}
+
+	plain, err := r.OpenAttachment(ctx, noteID, id, 0)
+	if err != nil {
+		return false, err
+	}
+	defer plain.Close()
+
+	return true, r.SaveAttachment(ctx, noteID, id, plain)
+}
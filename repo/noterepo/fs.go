@@ -0,0 +1,248 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+const (
+	indexFile    = "index.json"
+	trashFile    = "trash.json"
+	notesDir     = "notes"
+	revisionsDir = "revisions"
+	notebooksDir = "notebooks"
+	searchDir    = "search"
+	accountsDir  = "accounts"
+	authDir      = "auth"
+
+	dirPerm  = 0700
+	filePerm = 0600
+)
+
+// fileRepo stores each note as a JSON file in a directory alongside an index
+// file. Trashed notes are indexed in a trash file instead, revisions are kept
+// in a directory per note and everything else it stores in directories of its
+// own. Every write goes to a temporary file that is synced and then renamed
+// over the original so a crash never leaves a partially written file behind.
+// Each user's namespace is a fileRepo in a directory of its own, see
+// namespace.go.
+type fileRepo struct {
+	dir string
+
+	// mu guards the index file against concurrent read-modify-writes
+	mu sync.RWMutex
+
+	// namespacesMu guards namespaces, the namespaces used so far. Namespaces
+	// are kept so that everyone using one shares its lock.
+	namespacesMu sync.Mutex
+	namespaces   map[string]*fileRepo
+}
+
+func NewFileRepo(dir string) (*fileRepo, error) {
+	log.Info().
+		Str("func", "NewFileRepo").
+		Str("dir", dir).
+		Msg("setting up file storage")
+
+	if err := os.MkdirAll(filepath.Join(dir, notesDir), dirPerm); err != nil {
+		return nil, err
+	}
+
+	return &fileRepo{dir: dir, namespaces: make(map[string]*fileRepo)}, nil
+}
+
+func (r *fileRepo) Save(ctx context.Context, n note.Note) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err = writeFileAtomic(r.notePath(n.ID), data); err != nil {
+		return err
+	}
+
+	into, from := indexFile, trashFile
+	if n.IsTrashed() {
+		into, from = trashFile, indexFile
+	}
+
+	list, err := r.readIndex(into)
+	if err != nil {
+		return err
+	}
+	if err = r.writeIndex(into, upsertListNote(list, n)); err != nil {
+		return err
+	}
+
+	return r.removeFromIndex(from, n.ID)
+}
+
+func (r *fileRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	return readNoteFile(r.notePath(id))
+}
+
+// readNoteFile reads a note or revision file, returning a core.ErrNotFound if
+// it doesn't exist
+func readNoteFile(path string) (note.Note, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note.Note{}, &core.ErrNotFound{}
+		}
+		return note.Note{}, err
+	}
+
+	n := note.Note{}
+	if err = json.Unmarshal(data, &n); err != nil {
+		return note.Note{}, err
+	}
+
+	return n, nil
+}
+
+func (r *fileRepo) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := os.Remove(r.notePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncDir(filepath.Join(r.dir, notesDir)); err != nil {
+		return err
+	}
+
+	if err := r.removeFromIndex(indexFile, id); err != nil {
+		return err
+	}
+	return r.removeFromIndex(trashFile, id)
+}
+
+func (r *fileRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	return r.listIndex(indexFile, startIdx, endIdx)
+}
+
+func (r *fileRepo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	return r.listIndex(trashFile, startIdx, endIdx)
+}
+
+func (r *fileRepo) listIndex(file string, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list, err := r.readIndex(file)
+	if err != nil {
+		return []note.ListNote{}, 0, err
+	}
+
+	return note.Page(list, startIdx, endIdx), len(list), nil
+}
+
+// removeFromIndex removes the note from an index file, only rewriting the
+// file if the note was in it
+func (r *fileRepo) removeFromIndex(file, id string) error {
+	list, err := r.readIndex(file)
+	if err != nil {
+		return err
+	}
+
+	if removeListNote(&list, id) == -1 {
+		return nil
+	}
+
+	return r.writeIndex(file, list)
+}
+
+// readIndex returns every note in an index file, treating a missing file as
+// empty
+func (r *fileRepo) readIndex(file string) ([]note.ListNote, error) {
+	data, err := os.ReadFile(filepath.Join(r.dir, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.ListNote{}, nil
+		}
+		return []note.ListNote{}, err
+	}
+
+	l := make([]note.ListNote, 0)
+	if err = json.Unmarshal(data, &l); err != nil {
+		return []note.ListNote{}, err
+	}
+
+	return l, nil
+}
+
+func (r *fileRepo) writeIndex(file string, list []note.ListNote) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(r.dir, file), data)
+}
+
+// notePath hex encodes the ID so that client supplied IDs can never escape the
+// notes directory and can't collide on case-insensitive file systems.
+func (r *fileRepo) notePath(id string) string {
+	return filepath.Join(r.dir, notesDir, hex.EncodeToString([]byte(id))+".json")
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory, syncs
+// it, renames it over path and finally syncs the directory so the rename
+// itself is durable.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), filePerm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory's entries to disk. Some platforms (windows)
+// don't support syncing a directory so failures there are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+	return nil
+}
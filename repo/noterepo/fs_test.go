@@ -0,0 +1,150 @@
+package noterepo_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo/noterepo"
+)
+
+func TestFileRepoSaveAndGet(t *testing.T) {
+	ctx := context.Background()
+	repo, err := noterepo.NewFileRepo(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	want := note.Note{ID: "1", Title: "some title", Data: "some note"}
+	if err := repo.Save(ctx, want); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+
+	got, err := repo.Get(ctx, "1")
+	compare("Get", err, nil, t)
+	compare("Get", marshal(got), marshal(want), t)
+
+	want.Title = "some updated title"
+	if err := repo.Save(ctx, want); err != nil {
+		t.Fatalf("failed to update note: %v", err)
+	}
+
+	got, err = repo.Get(ctx, "1")
+	compare("Get Updated", err, nil, t)
+	compare("Get Updated", marshal(got), marshal(want), t)
+
+	list, total, err := repo.List(ctx, 0, 0)
+	compare("List", err, nil, t)
+	compare("List", total, 1, t)
+	compare("List", marshal(list[0]), marshal(note.ListNote{ID: "1", Title: "some updated title"}), t)
+}
+
+func TestFileRepoGetNotFound(t *testing.T) {
+	repo, err := noterepo.NewFileRepo(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	_, err = repo.Get(context.Background(), "missing")
+	compare("Get Missing", core.IsErrNotFound(err), true, t)
+}
+
+func TestFileRepoDelete(t *testing.T) {
+	ctx := context.Background()
+	repo, err := noterepo.NewFileRepo(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Data: "some note"}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+
+	compare("Delete", repo.Delete(ctx, "1"), nil, t)
+	compare("Delete Missing", repo.Delete(ctx, "3"), nil, t)
+
+	_, err = repo.Get(ctx, "1")
+	compare("Get Deleted", core.IsErrNotFound(err), true, t)
+
+	list, total, err := repo.List(ctx, 0, 0)
+	compare("List", err, nil, t)
+	compare("List", total, 1, t)
+	compare("List", list[0].ID, "2", t)
+}
+
+func TestFileRepoList(t *testing.T) {
+	ctx := context.Background()
+	repo, err := noterepo.NewFileRepo(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	list, total, err := repo.List(ctx, 0, 0)
+	compare("Empty", err, nil, t)
+	compare("Empty", total, 0, t)
+	compare("Empty", len(list), 0, t)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Data: "some note"}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+
+	list, total, err = repo.List(ctx, 1, 3)
+	compare("Page", err, nil, t)
+	compare("Page", total, 3, t)
+	compare("Page", len(list), 2, t)
+	compare("Page", list[0].ID, "2", t)
+	compare("Page", list[1].ID, "3", t)
+}
+
+func TestFileRepoPersists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := noterepo.NewFileRepo(dir)
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+	if err := repo.Save(ctx, note.Note{ID: "1", Data: "some note"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+
+	reopened, err := noterepo.NewFileRepo(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen repo: %v", err)
+	}
+
+	got, err := reopened.Get(ctx, "1")
+	compare("Reopened", err, nil, t)
+	compare("Reopened", got.Data, "some note", t)
+}
+
+func TestFileRepoUnsafeIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := noterepo.NewFileRepo(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	for _, id := range []string{"../escape", "a/b", "..", "A", "a"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Data: id}); err != nil {
+			t.Fatalf("%v: failed to save note: %v", id, err)
+		}
+		got, err := repo.Get(ctx, id)
+		compare(id, err, nil, t)
+		compare(id, got.Data, id, t)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	compare("Escaped", len(entries), 1, t)
+}
@@ -0,0 +1,174 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Wrapped keys are stored a key at a time as keyring/<id> in each namespace.
+// A user only has a handful so listing them reads every one.
+
+const keyringDir = "keyring"
+
+func (r *s3Repo) SaveWrappedKey(ctx context.Context, k note.WrappedKey) error {
+	if !validNamespace(k.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(KeyRingPrefix+k.ID, data)
+	return err
+}
+
+func (r *s3Repo) GetWrappedKey(ctx context.Context, id string) (note.WrappedKey, error) {
+	if !validNamespace(id) {
+		return note.WrappedKey{}, &core.ErrNotFound{}
+	}
+
+	data, err := r.download(KeyRingPrefix + id)
+	if err != nil {
+		return note.WrappedKey{}, err
+	}
+
+	k := note.WrappedKey{}
+	if err = json.Unmarshal(data, &k); err != nil {
+		return note.WrappedKey{}, err
+	}
+	return k, nil
+}
+
+func (r *s3Repo) ListWrappedKeys(ctx context.Context) ([]note.WrappedKey, error) {
+	objects, err := r.listObjects(KeyRingPrefix)
+	if err != nil {
+		return []note.WrappedKey{}, err
+	}
+
+	keys := make([]note.WrappedKey, 0, len(objects))
+	for _, o := range objects {
+		k, err := r.GetWrappedKey(ctx, strings.TrimPrefix(aws.StringValue(o.Key), KeyRingPrefix))
+		if err != nil {
+			return []note.WrappedKey{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (r *fileRepo) SaveWrappedKey(ctx context.Context, k note.WrappedKey) error {
+	if !validNamespace(k.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, keyringDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.wrappedKeyPath(k.ID), data)
+}
+
+func (r *fileRepo) GetWrappedKey(ctx context.Context, id string) (note.WrappedKey, error) {
+	if !validNamespace(id) {
+		return note.WrappedKey{}, &core.ErrNotFound{}
+	}
+	return readWrappedKeyFile(r.wrappedKeyPath(id))
+}
+
+func (r *fileRepo) ListWrappedKeys(ctx context.Context) ([]note.WrappedKey, error) {
+	dir := filepath.Join(r.dir, keyringDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.WrappedKey{}, nil
+		}
+		return []note.WrappedKey{}, err
+	}
+
+	keys := make([]note.WrappedKey, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		k, err := readWrappedKeyFile(filepath.Join(dir, name))
+		if err != nil {
+			return []note.WrappedKey{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// wrappedKeyPath is the path of the key's file, the ID must have been checked
+// with validNamespace
+func (r *fileRepo) wrappedKeyPath(id string) string {
+	return filepath.Join(r.dir, keyringDir, id+".json")
+}
+
+func readWrappedKeyFile(path string) (note.WrappedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note.WrappedKey{}, &core.ErrNotFound{}
+		}
+		return note.WrappedKey{}, err
+	}
+
+	k := note.WrappedKey{}
+	if err = json.Unmarshal(data, &k); err != nil {
+		return note.WrappedKey{}, err
+	}
+	return k, nil
+}
+
+func (r *memRepo) SaveWrappedKey(ctx context.Context, k note.WrappedKey) error {
+	if !validNamespace(k.ID) {
+		return ErrInvalidNamespace
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keyring[k.ID] = k
+	return nil
+}
+
+func (r *memRepo) GetWrappedKey(ctx context.Context, id string) (note.WrappedKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, ok := r.keyring[id]
+	if !ok {
+		return note.WrappedKey{}, &core.ErrNotFound{}
+	}
+	return k, nil
+}
+
+func (r *memRepo) ListWrappedKeys(ctx context.Context) ([]note.WrappedKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]note.WrappedKey, 0, len(r.keyring))
+	for _, k := range r.keyring {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,128 @@
+package noterepo
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/search"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// memRepo keeps notes, their revisions, the index, the trash, notebooks,
+// search documents, wrapped keys, accounts, signing keys, sessions, API keys,
+// shares, share links, the audit log, attachments and the users' namespaces in
+// memory. It's safe for concurrent use and is mostly useful for tests and
+// throwaway servers.
+type memRepo struct {
+	mu    sync.RWMutex
+	notes map[string]note.Note
+	index []note.ListNote
+	trash []note.ListNote
+
+	revisions map[string]map[int64]note.Note
+	notebooks map[string]note.Notebook
+	search    map[string]search.Document
+	keyring   map[string]note.WrappedKey
+	users     map[string]user.User
+
+	signingKeys map[string]auth.SigningKey
+	sessions    map[string]auth.Session
+	apiKeys     map[string]apikey.Key
+
+	shares map[memShareKey]note.Share
+	links  map[string]note.Link
+	audit  []audit.Event
+
+	attachments map[string]map[string][]byte
+
+	namespaces map[string]*memRepo
+}
+
+func NewMemRepo() *memRepo {
+	return &memRepo{
+		notes: make(map[string]note.Note),
+		index: []note.ListNote{},
+		trash: []note.ListNote{},
+
+		revisions: make(map[string]map[int64]note.Note),
+		notebooks: make(map[string]note.Notebook),
+		search:    make(map[string]search.Document),
+		keyring:   make(map[string]note.WrappedKey),
+		users:     make(map[string]user.User),
+
+		signingKeys: make(map[string]auth.SigningKey),
+		sessions:    make(map[string]auth.Session),
+		apiKeys:     make(map[string]apikey.Key),
+
+		shares: make(map[memShareKey]note.Share),
+		links:  make(map[string]note.Link),
+
+		attachments: make(map[string]map[string][]byte),
+
+		namespaces: make(map[string]*memRepo),
+	}
+}
+
+func (r *memRepo) Save(ctx context.Context, n note.Note) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.notes[n.ID] = n
+	if n.IsTrashed() {
+		r.trash = upsertListNote(r.trash, n)
+		_ = removeListNote(&r.index, n.ID)
+	} else {
+		r.index = upsertListNote(r.index, n)
+		_ = removeListNote(&r.trash, n.ID)
+	}
+	return nil
+}
+
+func (r *memRepo) Get(ctx context.Context, id string) (note.Note, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n, ok := r.notes[id]
+	if !ok {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	return n, nil
+}
+
+func (r *memRepo) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.notes, id)
+	_ = removeListNote(&r.index, id)
+	_ = removeListNote(&r.trash, id)
+	return nil
+}
+
+func (r *memRepo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return copyPage(r.index, startIdx, endIdx), len(r.index), nil
+}
+
+func (r *memRepo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return copyPage(r.trash, startIdx, endIdx), len(r.trash), nil
+}
+
+// copyPage copies the page so callers can't modify the index out from under
+// the lock
+func copyPage(l []note.ListNote, startIdx, endIdx int) []note.ListNote {
+	page := note.Page(l, startIdx, endIdx)
+	list := make([]note.ListNote, len(page))
+	copy(list, page)
+	return list
+}
@@ -0,0 +1,162 @@
+package noterepo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Each user's notes are kept in a namespace, a repository of the same kind
+// nested inside this one. In s3 a namespace's keys sit under
+// NamespacePrefix/<user id>/ and for file storage its files are in
+// <dir>/users/<user id>. The notes stored at the top level, by versions of
+// the server from before there were users, don't belong to anyone.
+
+const usersDir = "users"
+
+// ErrInvalidNamespace is returned for a user ID that can't name a namespace
+var ErrInvalidNamespace = errors.New("namespace id is invalid")
+
+// validNamespace reports whether the ID is safe to use in a key or a path.
+// User IDs are generated by the server so anything else is a bug.
+func validNamespace(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *s3Repo) Namespace(userID string) (note.Repository, error) {
+	if !validNamespace(userID) {
+		return nil, ErrInvalidNamespace
+	}
+
+	r.namespacesMu.Lock()
+	defer r.namespacesMu.Unlock()
+
+	if ns, ok := r.namespaces[userID]; ok {
+		return ns, nil
+	}
+
+	ns := NewS3Repo(r.uploader, r.downloader, r.deleter, r.lister, r.bucket)
+	ns.prefix = r.prefix + NamespacePrefix + userID + "/"
+	ns.compress = r.compress
+	r.namespaces[userID] = ns
+	return ns, nil
+}
+
+func (r *s3Repo) ListNamespaces(ctx context.Context) ([]string, error) {
+	ids := make([]string, 0)
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(r.bucket),
+		Prefix:    aws.String(r.prefix + NamespacePrefix),
+		Delimiter: aws.String("/"),
+	}
+
+	for {
+		out, err := r.lister.ListObjectsV2(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.CommonPrefixes {
+			id := strings.TrimPrefix(aws.StringValue(p.Prefix), r.prefix+NamespacePrefix)
+			ids = append(ids, strings.TrimSuffix(id, "/"))
+		}
+
+		if !aws.BoolValue(out.IsTruncated) {
+			return ids, nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// loadedNamespaces returns the namespaces used so far
+func (r *s3Repo) loadedNamespaces() []*s3Repo {
+	r.namespacesMu.Lock()
+	defer r.namespacesMu.Unlock()
+
+	list := make([]*s3Repo, 0, len(r.namespaces))
+	for _, ns := range r.namespaces {
+		list = append(list, ns)
+	}
+	return list
+}
+
+func (r *fileRepo) Namespace(userID string) (note.Repository, error) {
+	if !validNamespace(userID) {
+		return nil, ErrInvalidNamespace
+	}
+
+	r.namespacesMu.Lock()
+	defer r.namespacesMu.Unlock()
+
+	if ns, ok := r.namespaces[userID]; ok {
+		return ns, nil
+	}
+
+	ns, err := NewFileRepo(filepath.Join(r.dir, usersDir, userID))
+	if err != nil {
+		return nil, err
+	}
+	r.namespaces[userID] = ns
+	return ns, nil
+}
+
+func (r *fileRepo) ListNamespaces(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.dir, usersDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() && validNamespace(e.Name()) {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (r *memRepo) Namespace(userID string) (note.Repository, error) {
+	if !validNamespace(userID) {
+		return nil, ErrInvalidNamespace
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ns, ok := r.namespaces[userID]; ok {
+		return ns, nil
+	}
+
+	ns := NewMemRepo()
+	r.namespaces[userID] = ns
+	return ns, nil
+}
+
+func (r *memRepo) ListNamespaces(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.namespaces))
+	for id := range r.namespaces {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,183 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Notebooks are few and small so each is stored as an object of its own and
+// listing them reads every one
+
+func (r *s3Repo) SaveNotebook(ctx context.Context, nb note.Notebook) error {
+	data, err := json.Marshal(nb)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(NotebookPrefix+nb.ID, data)
+	return err
+}
+
+func (r *s3Repo) GetNotebook(ctx context.Context, id string) (note.Notebook, error) {
+	data, err := r.download(NotebookPrefix + id)
+	if err != nil {
+		return note.Notebook{}, err
+	}
+
+	nb := note.Notebook{}
+	if err = json.Unmarshal(data, &nb); err != nil {
+		return note.Notebook{}, err
+	}
+	return nb, nil
+}
+
+func (r *s3Repo) DeleteNotebook(ctx context.Context, id string) error {
+	return r.deleteObject(NotebookPrefix + id)
+}
+
+func (r *s3Repo) ListNotebooks(ctx context.Context) ([]note.Notebook, error) {
+	objects, err := r.listObjects(NotebookPrefix)
+	if err != nil {
+		return []note.Notebook{}, err
+	}
+
+	list := make([]note.Notebook, 0, len(objects))
+	for _, o := range objects {
+		nb, err := r.GetNotebook(ctx, strings.TrimPrefix(aws.StringValue(o.Key), NotebookPrefix))
+		if err != nil {
+			// The notebook was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Notebook{}, err
+		}
+		list = append(list, nb)
+	}
+
+	return list, nil
+}
+
+func (r *fileRepo) SaveNotebook(ctx context.Context, nb note.Notebook) error {
+	data, err := json.Marshal(nb)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, notebooksDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.notebookPath(nb.ID), data)
+}
+
+func (r *fileRepo) GetNotebook(ctx context.Context, id string) (note.Notebook, error) {
+	return readNotebookFile(r.notebookPath(id))
+}
+
+func (r *fileRepo) DeleteNotebook(ctx context.Context, id string) error {
+	if err := os.Remove(r.notebookPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Join(r.dir, notebooksDir))
+}
+
+func (r *fileRepo) ListNotebooks(ctx context.Context) ([]note.Notebook, error) {
+	dir := filepath.Join(r.dir, notebooksDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.Notebook{}, nil
+		}
+		return []note.Notebook{}, err
+	}
+
+	list := make([]note.Notebook, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		nb, err := readNotebookFile(filepath.Join(dir, name))
+		if err != nil {
+			// The notebook was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Notebook{}, err
+		}
+		list = append(list, nb)
+	}
+
+	return list, nil
+}
+
+// notebookPath hex encodes the ID for the same reasons as notePath
+func (r *fileRepo) notebookPath(id string) string {
+	return filepath.Join(r.dir, notebooksDir, hex.EncodeToString([]byte(id))+".json")
+}
+
+func readNotebookFile(path string) (note.Notebook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note.Notebook{}, &core.ErrNotFound{}
+		}
+		return note.Notebook{}, err
+	}
+
+	nb := note.Notebook{}
+	if err = json.Unmarshal(data, &nb); err != nil {
+		return note.Notebook{}, err
+	}
+	return nb, nil
+}
+
+func (r *memRepo) SaveNotebook(ctx context.Context, nb note.Notebook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.notebooks[nb.ID] = nb
+	return nil
+}
+
+func (r *memRepo) GetNotebook(ctx context.Context, id string) (note.Notebook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nb, ok := r.notebooks[id]
+	if !ok {
+		return note.Notebook{}, &core.ErrNotFound{}
+	}
+	return nb, nil
+}
+
+func (r *memRepo) DeleteNotebook(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.notebooks, id)
+	return nil
+}
+
+func (r *memRepo) ListNotebooks(ctx context.Context) ([]note.Notebook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]note.Notebook, 0, len(r.notebooks))
+	for _, nb := range r.notebooks {
+		list = append(list, nb)
+	}
+	return list, nil
+}
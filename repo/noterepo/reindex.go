@@ -0,0 +1,216 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// reconcile compares the IDs of the stored notes against the index, both its
+// live and trash sections, and returns the drift along with the notes whose
+// index entries need to be rewritten
+func reconcile(ids []string, index []note.ListNote, get func(id string) (note.Note, error)) (note.IndexReport, []note.Note, error) {
+	report := note.NewIndexReport()
+	report.Notes = len(ids)
+	report.Indexed = len(index)
+
+	entries := make(map[string]note.ListNote, len(index))
+	duplicates := make(map[string]bool)
+	for _, ln := range index {
+		if _, ok := entries[ln.ID]; ok {
+			duplicates[ln.ID] = true
+		}
+		entries[ln.ID] = ln
+	}
+
+	reindex := make([]note.Note, 0)
+	for _, id := range ids {
+		n, err := get(id)
+		if err != nil {
+			// The note was deleted while we were reconciling
+			if core.IsErrNotFound(err) {
+				report.Notes--
+				continue
+			}
+			return note.IndexReport{}, nil, err
+		}
+
+		ln, ok := entries[id]
+		delete(entries, id)
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, id)
+			reindex = append(reindex, n)
+		case !note.IndexMatches(ln, n) || duplicates[id]:
+			report.Stale = append(report.Stale, id)
+			reindex = append(reindex, n)
+		}
+	}
+
+	for id := range entries {
+		report.Orphaned = append(report.Orphaned, id)
+	}
+
+	sort.Strings(report.Missing)
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Stale)
+
+	return report, reindex, nil
+}
+
+func (r *s3Repo) Reindex(ctx context.Context, repair bool) (note.IndexReport, error) {
+	objects, err := r.listObjects("")
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+
+	ids := make([]string, 0, len(objects))
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if isReservedKey(key) {
+			continue
+		}
+		ids = append(ids, key)
+	}
+
+	index, err := r.listAll(ctx)
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+	trash, err := r.listTrash(ctx)
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+	index = append(index, trash...)
+
+	report, reindex, err := reconcile(ids, index, func(id string) (note.Note, error) {
+		return r.Get(ctx, id)
+	})
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+
+	if !repair || !report.Drifted() {
+		return report, nil
+	}
+
+	for _, n := range reindex {
+		if err := r.putIndexEntry(ctx, n); err != nil {
+			return report, err
+		}
+	}
+	for _, id := range report.Orphaned {
+		if err := r.deleteIndexEntry(ctx, id); err != nil {
+			return report, err
+		}
+	}
+	if err := r.saveSnapshot(); err != nil {
+		return report, err
+	}
+
+	report.Repaired = true
+	return report, nil
+}
+
+func (r *fileRepo) Reindex(ctx context.Context, repair bool) (note.IndexReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files, err := os.ReadDir(filepath.Join(r.dir, notesDir))
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		// Skip leftover temporary files and anything we didn't write
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, string(id))
+	}
+
+	index, err := r.readIndex(indexFile)
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+	trash, err := r.readIndex(trashFile)
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+
+	all := append(append([]note.ListNote{}, index...), trash...)
+	report, reindex, err := reconcile(ids, all, func(id string) (note.Note, error) {
+		return r.Get(ctx, id)
+	})
+	if err != nil {
+		return note.IndexReport{}, err
+	}
+
+	if !repair || !report.Drifted() {
+		return report, nil
+	}
+
+	// Missing notes go on the end of the index in the order they were created
+	sort.SliceStable(reindex, func(i, j int) bool {
+		return reindex[i].Created.Before(reindex[j].Created)
+	})
+	for _, n := range reindex {
+		if n.IsTrashed() {
+			trash = upsertListNote(trash, n)
+			_ = removeListNote(&index, n.ID)
+		} else {
+			index = upsertListNote(index, n)
+			_ = removeListNote(&trash, n.ID)
+		}
+	}
+	for _, id := range report.Orphaned {
+		_ = removeListNote(&index, id)
+		_ = removeListNote(&trash, id)
+	}
+	if err := r.writeIndex(indexFile, index); err != nil {
+		return report, err
+	}
+	if err := r.writeIndex(trashFile, trash); err != nil {
+		return report, err
+	}
+
+	report.Repaired = true
+	return report, nil
+}
+
+// The in-memory repository updates notes and the index together so it can't
+// drift, but it still reports on itself like the others
+func (r *memRepo) Reindex(ctx context.Context, repair bool) (note.IndexReport, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	report := note.NewIndexReport()
+	report.Notes = len(r.notes)
+	report.Indexed = len(r.index) + len(r.trash)
+	return report, nil
+}
+
+// isReservedKey reports whether an s3 key is the index or sits under one of
+// the reserved key prefixes rather than belonging to a note
+func isReservedKey(key string) bool {
+	return key == IndexID || strings.HasPrefix(key, IndexPrefix) ||
+		strings.HasPrefix(key, TrashPrefix) || strings.HasPrefix(key, RevisionPrefix) ||
+		strings.HasPrefix(key, NotebookPrefix) || strings.HasPrefix(key, SearchPrefix) ||
+		strings.HasPrefix(key, KeyRingPrefix) || strings.HasPrefix(key, AccountPrefix) ||
+		strings.HasPrefix(key, AuthPrefix) || strings.HasPrefix(key, SharePrefix) ||
+		strings.HasPrefix(key, AuditPrefix) || strings.HasPrefix(key, AttachmentPrefix) ||
+		strings.HasPrefix(key, NamespacePrefix)
+}
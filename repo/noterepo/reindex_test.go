@@ -0,0 +1,163 @@
+package noterepo_test
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
+)
+
+func TestS3RepoReindex(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	for _, id := range []string{"indexed", "stale", "orphaned"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Title: id}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+
+	// A note whose index entry was never written
+	s3.Put("missing", []byte(marshal(note.Note{ID: "missing", Title: "missing"})))
+	// A note that was updated without updating its entry
+	s3.Put("stale", []byte(marshal(note.Note{ID: "stale", Title: "updated"})))
+	// An entry whose note was deleted
+	_, _ = s3.DeleteObject(deleteInput("orphaned"))
+	// Revisions aren't notes
+	if err := repo.SaveRevision(ctx, note.Note{ID: "indexed", Title: "old"}); err != nil {
+		t.Fatalf("failed to save revision: %v", err)
+	}
+
+	report, err := repo.Reindex(ctx, false)
+	compare("Report", err, nil, t)
+	compare("Report", report.Notes, 3, t)
+	compare("Report", report.Indexed, 3, t)
+	compare("Report", fmt.Sprint(report.Missing), "[missing]", t)
+	compare("Report", fmt.Sprint(report.Stale), "[stale]", t)
+	compare("Report", fmt.Sprint(report.Orphaned), "[orphaned]", t)
+	compare("Report", report.Repaired, false, t)
+
+	report, err = repo.Reindex(ctx, true)
+	compare("Repair", err, nil, t)
+	compare("Repair", report.Drifted(), true, t)
+	compare("Repair", report.Repaired, true, t)
+
+	fresh := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	report, err = fresh.Reindex(ctx, false)
+	compare("Repaired", err, nil, t)
+	compare("Repaired", report.Drifted(), false, t)
+	compare("Repaired", report.Notes, 3, t)
+
+	list, _, _ := fresh.List(ctx, 0, 0)
+	compare("Repaired", marshal(list), marshal([]note.ListNote{
+		{ID: "indexed", Title: "indexed"},
+		{ID: "stale", Title: "updated"},
+		{ID: "missing", Title: "missing"},
+	}), t)
+}
+
+func TestS3RepoReindexTrash(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	if err := repo.Save(ctx, note.Note{ID: "trashed"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+	// The note was trashed without moving its entry into the trash
+	trashed := time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)
+	s3.Put("trashed", []byte(marshal(note.Note{ID: "trashed", Trashed: &trashed})))
+
+	report, err := repo.Reindex(ctx, true)
+	compare("Repair", err, nil, t)
+	compare("Repair", fmt.Sprint(report.Stale), "[trashed]", t)
+	compare("Repair", report.Repaired, true, t)
+
+	fresh := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+	_, total, _ := fresh.List(ctx, 0, 0)
+	compare("Repaired", total, 0, t)
+	trash, _, _ := fresh.ListTrash(ctx, 0, 0)
+	compare("Repaired", marshal(trash), marshal([]note.ListNote{{ID: "trashed", Trashed: &trashed}}), t)
+
+	report, err = fresh.Reindex(ctx, false)
+	compare("Repaired", err, nil, t)
+	compare("Repaired", report.Drifted(), false, t)
+}
+
+func TestFileRepoReindex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := noterepo.NewFileRepo(dir)
+	if err != nil {
+		t.Fatalf("failed to create repo: %v", err)
+	}
+
+	created := time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)
+	for _, id := range []string{"indexed", "stale", "orphaned"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Title: id, Created: created}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+
+	notePath := func(id string) string {
+		return filepath.Join(dir, "notes", hex.EncodeToString([]byte(id))+".json")
+	}
+	writeNote := func(n note.Note) {
+		if err := os.WriteFile(notePath(n.ID), []byte(marshal(n)), 0600); err != nil {
+			t.Fatalf("failed to write note: %v", err)
+		}
+	}
+	writeNote(note.Note{ID: "missing", Title: "missing", Created: created.Add(time.Hour)})
+	writeNote(note.Note{ID: "stale", Title: "updated", Created: created})
+	if err := os.Remove(notePath("orphaned")); err != nil {
+		t.Fatalf("failed to remove note: %v", err)
+	}
+	// Leftovers from an interrupted write are ignored
+	if err := os.WriteFile(filepath.Join(dir, "notes", ".tmp-123"), []byte("{"), 0600); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+
+	report, err := repo.Reindex(ctx, false)
+	compare("Report", err, nil, t)
+	compare("Report", report.Notes, 3, t)
+	compare("Report", report.Indexed, 3, t)
+	compare("Report", fmt.Sprint(report.Missing), "[missing]", t)
+	compare("Report", fmt.Sprint(report.Stale), "[stale]", t)
+	compare("Report", fmt.Sprint(report.Orphaned), "[orphaned]", t)
+
+	report, err = repo.Reindex(ctx, true)
+	compare("Repair", err, nil, t)
+	compare("Repair", report.Repaired, true, t)
+
+	report, err = repo.Reindex(ctx, false)
+	compare("Repaired", err, nil, t)
+	compare("Repaired", report.Drifted(), false, t)
+
+	list, _, _ := repo.List(ctx, 0, 0)
+	ids := make([]string, len(list))
+	for i, ln := range list {
+		ids[i] = ln.ID
+	}
+	compare("Repaired", fmt.Sprint(ids), "[indexed stale missing]", t)
+}
+
+func TestMemRepoReindex(t *testing.T) {
+	ctx := context.Background()
+	repo := noterepo.NewMemRepo()
+	if err := repo.Save(ctx, note.Note{ID: "1"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+
+	report, err := repo.Reindex(ctx, true)
+	compare("Mem", err, nil, t)
+	compare("Mem", report.Drifted(), false, t)
+	compare("Mem", report.Notes, 1, t)
+}
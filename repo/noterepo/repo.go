@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/rs/zerolog/log"
@@ -15,14 +20,81 @@ import (
 	"github.com/sksmith/note-server/core/note"
 )
 
+// s3Repo stores each note as an object keyed by its ID. The index is made up
+// of one small entry object per note under IndexPrefix so that saves and
+// deletes never read-modify-write a shared object. See s3index.go.
+//
+// A namespace is an s3Repo whose keys all sit under its prefix, see
+// namespace.go.
 type s3Repo struct {
 	bucket     string
+	prefix     string
 	uploader   Uploader
 	downloader Downloader
 	deleter    Deleter
+	lister     Lister
+
+	index *indexCache
+	trash *indexCache
+
+	// compress gzips objects as they're uploaded, see compress.go
+	compress bool
+
+	// namespacesMu guards namespaces, the namespaces used so far
+	namespacesMu sync.Mutex
+	namespaces   map[string]*s3Repo
 }
 
-const IndexID = "index"
+const (
+	// IndexID is the key of the index snapshot, a cache of every index entry
+	IndexID = "index"
+
+	// IndexPrefix is the key prefix of the per-note index entries
+	IndexPrefix = "index/"
+
+	// TrashPrefix is the key prefix of the index entries of trashed notes
+	TrashPrefix = "trash/"
+
+	// RevisionPrefix is the key prefix of the previous versions of notes,
+	// stored as revisions/<id>/<version>.<timestamp>
+	RevisionPrefix = "revisions/"
+
+	// NotebookPrefix is the key prefix of the notebooks
+	NotebookPrefix = "notebooks/"
+
+	// SearchPrefix is the key prefix of the notes' search documents
+	SearchPrefix = "search/"
+
+	// KeyRingPrefix is the key prefix of the wrapped keys encrypted notes are
+	// encrypted with
+	KeyRingPrefix = "keyring/"
+
+	// AccountPrefix is the key prefix of the user accounts
+	AccountPrefix = "accounts/"
+
+	// AuthPrefix is the key prefix of the keys access tokens are signed with,
+	// the users' sessions and their API keys
+	AuthPrefix = "auth/"
+
+	// SharePrefix is the key prefix of the notes shared with other users and
+	// the public share links
+	SharePrefix = "shares/"
+
+	// AuditPrefix is the key prefix of the audit log's events
+	AuditPrefix = "audit/"
+
+	// AttachmentPrefix is the key prefix of the files attached to notes,
+	// stored as attachments/<id>/<attachment id>
+	AttachmentPrefix = "attachments/"
+
+	// NamespacePrefix is the key prefix of the users' namespaces, each user's
+	// notes are stored under users/<user id>/ with keys of their own
+	NamespacePrefix = "users/"
+)
+
+// ErrReservedID is returned when saving a note whose ID is the index's or
+// clashes with one of the reserved key prefixes above
+var ErrReservedID = errors.New("note id is reserved")
 
 type Downloader interface {
 	Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (n int64, err error)
@@ -36,7 +108,11 @@ type Deleter interface {
 	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
 }
 
-func NewS3Repo(uploader Uploader, downloader Downloader, deleter Deleter, bucket string) *s3Repo {
+type Lister interface {
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+}
+
+func NewS3Repo(uploader Uploader, downloader Downloader, deleter Deleter, lister Lister, bucket string) *s3Repo {
 	log.Info().
 		Str("func", "NewS3Repo").
 		Msg("setting up s3 session")
@@ -46,59 +122,45 @@ func NewS3Repo(uploader Uploader, downloader Downloader, deleter Deleter, bucket
 		deleter:    deleter,
 		uploader:   uploader,
 		downloader: downloader,
+		lister:     lister,
+		index:      newIndexCache(),
+		trash:      newIndexCache(),
+		namespaces: make(map[string]*s3Repo),
 	}
 }
 
 func (r *s3Repo) Save(ctx context.Context, note note.Note) error {
+	if isReservedKey(note.ID) {
+		return ErrReservedID
+	}
+
 	n, err := json.Marshal(note)
 	if err != nil {
 		return err
 	}
-	_, err = r.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(note.ID),
-		Body:   bytes.NewReader(n),
-	})
-	if err != nil {
+	if _, err = r.upload(note.ID, n); err != nil {
 		return err
 	}
 
 	// Note: There are no rollbacks with s3 storage so we can't rollback creating
 	// the note if adding it to index fails.
-	err = r.upsertNoteToIndex(ctx, note)
-	if err != nil {
-		return err
-	}
-	return nil
+	return r.putIndexEntry(ctx, note)
 }
 
 func (r *s3Repo) Get(ctx context.Context, id string) (note.Note, error) {
-	data := aws.NewWriteAtBuffer([]byte{})
-	s, err := r.downloader.Download(data, &s3.GetObjectInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(id),
-	})
+	data, err := r.download(id)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return note.Note{}, &core.ErrNotFound{}
-			default:
-				return note.Note{}, err
-			}
-		} else {
-			return note.Note{}, err
-		}
+		return note.Note{}, err
 	}
 
 	log.Info().
 		Str("func", "GetNote").
 		Str("id", id).
-		Int64("size", s).
+		Int("size", len(data)).
 		Msg("downloaded note")
 
 	n := note.Note{}
-	err = json.Unmarshal(data.Bytes(), &n)
+	err = json.Unmarshal(data, &n)
 	if err != nil {
 		return note.Note{}, err
 	}
@@ -107,84 +169,181 @@ func (r *s3Repo) Get(ctx context.Context, id string) (note.Note, error) {
 }
 
 func (r *s3Repo) Delete(ctx context.Context, id string) error {
-	_, err := r.deleter.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(id),
-	})
-
-	if err != nil {
+	if err := r.deleteObject(id); err != nil {
 		return err
 	}
 
-	err = r.deleteNoteFromIndex(ctx, id)
+	return r.deleteIndexEntry(ctx, id)
+}
+
+func (r *s3Repo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list, err := r.listAll(ctx)
 	if err != nil {
-		return err
+		return []note.ListNote{}, 0, err
 	}
 
-	return nil
+	return note.Page(list, startIdx, endIdx), len(list), nil
 }
 
-func (r *s3Repo) List(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, error) {
-	idx, err := r.getIndex(ctx)
+func (r *s3Repo) ListTrash(ctx context.Context, startIdx, endIdx int) ([]note.ListNote, int, error) {
+	list, err := r.listTrash(ctx)
 	if err != nil {
-		if core.IsErrNotFound(err) {
-			return []note.ListNote{}, nil
-		} else {
-			return []note.ListNote{}, err
-		}
+		return []note.ListNote{}, 0, err
 	}
 
-	_ = removeListNote(&idx, IndexID)
+	return note.Page(list, startIdx, endIdx), len(list), nil
+}
+
+// download returns the object's contents, decompressed, or a
+// core.ErrNotFound if there is no such key. Keys here and in the other object
+// helpers are relative to the repository's prefix.
+func (r *s3Repo) download(key string) ([]byte, error) {
+	obj, err := r.getObject(key, "")
+	if err != nil {
+		return nil, err
+	}
+	return decompressObject(obj.data, obj.encoding)
+}
 
-	return idx, nil
+// storedObject is an object's contents as they're stored along with the
+// headers it was downloaded with
+type storedObject struct {
+	data     []byte
+	etag     string
+	encoding string
 }
 
-func (r *s3Repo) upsertNoteToIndex(ctx context.Context, n note.Note) error {
-	list, err := r.List(ctx, 0, 0)
-	if err != nil && !core.IsErrNotFound(err) {
-		return err
+// getObject downloads the object as it's stored. Given an ETag it's only
+// downloaded if it has changed, returning ErrNotModified if it hasn't.
+func (r *s3Repo) getObject(key, ifNoneMatch string) (storedObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.prefix + key),
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
 	}
 
-	updated := false
-	for i := range list {
-		if list[i].ID != n.ID {
-			continue
+	data := aws.NewWriteAtBuffer([]byte{})
+	headers := &responseHeaders{}
+	_, err := r.downloader.Download(data, input, s3manager.WithDownloaderRequestOptions(headers.capture))
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+			return storedObject{}, ErrNotModified
 		}
-
-		list[i].Title = n.Title
-		list[i].Created = n.Created
-		list[i].Updated = n.Updated
-		updated = true
-		break
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return storedObject{}, &core.ErrNotFound{}
+		}
+		return storedObject{}, err
 	}
 
-	if !updated {
-		list = append(list, mapNoteToListNote(n))
+	etag, encoding := headers.get()
+	return storedObject{data: data.Bytes(), etag: etag, encoding: encoding}, nil
+}
+
+// responseHeaders keeps the headers of the responses to a download, which
+// may be made of several requests
+type responseHeaders struct {
+	mu       sync.Mutex
+	etag     string
+	encoding string
+}
+
+// capture is a request option that records the response's headers once the
+// request is complete
+func (h *responseHeaders) capture(req *request.Request) {
+	req.Handlers.Complete.PushBack(func(req *request.Request) {
+		if req.HTTPResponse == nil {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.etag = req.HTTPResponse.Header.Get("ETag")
+		h.encoding = req.HTTPResponse.Header.Get("Content-Encoding")
+	})
+}
+
+func (h *responseHeaders) get() (etag, encoding string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.etag, h.encoding
+}
+
+// upload writes the object, compressed when compression is on, and returns
+// its ETag
+func (r *s3Repo) upload(key string, data []byte) (string, error) {
+	data, encoding, err := r.compressObject(data)
+	if err != nil {
+		return "", err
 	}
 
-	err = r.saveIndex(ctx, list)
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.prefix + key),
+		Body:   bytes.NewReader(data),
+	}
+	if encoding != "" {
+		input.ContentEncoding = aws.String(encoding)
+	}
+	out, err := r.uploader.Upload(input)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return aws.StringValue(out.ETag), nil
 }
 
-func (r *s3Repo) deleteNoteFromIndex(ctx context.Context, ID string) error {
-	list, err := r.List(ctx, 0, 0)
-	if err != nil {
-		return err
+func (r *s3Repo) deleteObject(key string) error {
+	_, err := r.deleter.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.prefix + key),
+	})
+	return err
+}
+
+// listObjects returns every object under the prefix, following continuation
+// tokens until the listing is complete. The objects' keys are relative to the
+// repository's prefix.
+func (r *s3Repo) listObjects(prefix string) ([]*s3.Object, error) {
+	objects := make([]*s3.Object, 0)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.prefix + prefix),
 	}
 
-	idx := removeListNote(&list, ID)
-	if idx != -1 {
-		err = r.saveIndex(ctx, list)
+	for {
+		out, err := r.lister.ListObjectsV2(input)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		for _, o := range out.Contents {
+			rel := *o
+			rel.Key = aws.String(strings.TrimPrefix(aws.StringValue(o.Key), r.prefix))
+			objects = append(objects, &rel)
+		}
+
+		if !aws.BoolValue(out.IsTruncated) {
+			return objects, nil
 		}
+		input.ContinuationToken = out.NextContinuationToken
 	}
+}
 
-	return nil
+// upsertListNote updates the note's entry in the list or appends it if it
+// isn't there yet
+func upsertListNote(list []note.ListNote, n note.Note) []note.ListNote {
+	for i := range list {
+		if list[i].ID != n.ID {
+			continue
+		}
+
+		list[i] = note.NewListNote(n)
+		return list
+	}
+
+	return append(list, note.NewListNote(n))
 }
 
 // returns a -1 if ID not found
@@ -204,62 +363,3 @@ func removeListNote(l *[]note.ListNote, ID string) int {
 
 	return idx
 }
-
-func (r *s3Repo) getIndex(ctx context.Context) ([]note.ListNote, error) {
-	data := aws.NewWriteAtBuffer([]byte{})
-	s, err := r.downloader.Download(data, &s3.GetObjectInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(IndexID),
-	})
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return []note.ListNote{}, &core.ErrNotFound{}
-			default:
-				return []note.ListNote{}, err
-			}
-		} else {
-			return []note.ListNote{}, err
-		}
-	}
-
-	log.Info().
-		Str("func", "getIndex").
-		Int64("size", s).
-		Msg("downloaded index")
-
-	l := make([]note.ListNote, 0)
-	err = json.Unmarshal(data.Bytes(), &l)
-	if err != nil {
-		return []note.ListNote{}, err
-	}
-
-	return l, nil
-}
-
-func (r *s3Repo) saveIndex(ctx context.Context, idx []note.ListNote) error {
-	data, err := json.Marshal(idx)
-	if err != nil {
-		return err
-	}
-	_, err = r.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(r.bucket),
-		Key:    aws.String(IndexID),
-		Body:   bytes.NewReader(data),
-	})
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func mapNoteToListNote(n note.Note) note.ListNote {
-	return note.ListNote{
-		ID:      n.ID,
-		Title:   n.Title,
-		Created: n.Created,
-		Updated: n.Updated,
-	}
-}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -16,6 +19,7 @@ import (
 	"github.com/sksmith/note-server/core"
 	"github.com/sksmith/note-server/core/note"
 	"github.com/sksmith/note-server/repo/noterepo"
+	"github.com/sksmith/note-server/repo/noterepo/repotest"
 )
 
 func TestMain(m *testing.M) {
@@ -60,14 +64,13 @@ func TestGet(t *testing.T) {
 
 	for _, test := range tests {
 		downloader := &mockDownloader{note: test.s3Note, err: test.s3Err}
-		uploader := &mockUploader{}
-		deleter := &mockDeleter{}
+		s3 := repotest.NewFakeS3()
 
-		repo := noterepo.NewS3Repo(uploader, downloader, deleter, "somebucket")
+		repo := noterepo.NewS3Repo(s3, downloader, s3, s3, "somebucket")
 		got, err := repo.Get(test.ctx, test.input)
 
 		compare(test.name, err, test.wantErr, t)
-		compare(test.name, got, test.wantNote, t)
+		compare(test.name, marshal(got), marshal(test.wantNote), t)
 	}
 }
 
@@ -80,25 +83,50 @@ func TestList(t *testing.T) {
 		startIdx      int
 		endIdx        int
 		s3Err         error
-		s3ListNotes   string
+		s3Notes       []note.Note
 		wantListNotes []note.ListNote
+		wantTotal     int
 		wantErr       error
 	}{
 		{
-			name:        "Happy Path",
-			s3ListNotes: `[{"id": "1", "title": "somenote"},{"id": "2", "title": "someothernote"}]`,
+			name:    "Happy Path",
+			s3Notes: []note.Note{{ID: "1", Title: "somenote"}, {ID: "2", Title: "someothernote"}},
 			wantListNotes: []note.ListNote{
 				{ID: "1", Title: "somenote"},
 				{ID: "2", Title: "someothernote"},
 			},
+			wantTotal: 2,
 		},
 		{
-			name: "Not Found",
-			s3Err: awserr.New(
-				s3.ErrCodeNoSuchKey,
-				"no such key",
-				errors.New("madeup error"),
-			),
+			name:    "First Page",
+			endIdx:  2,
+			s3Notes: []note.Note{{ID: "1", Title: "a"}, {ID: "2", Title: "b"}, {ID: "3", Title: "c"}},
+			wantListNotes: []note.ListNote{
+				{ID: "1", Title: "a"},
+				{ID: "2", Title: "b"},
+			},
+			wantTotal: 3,
+		},
+		{
+			name:     "Last Page",
+			startIdx: 2,
+			endIdx:   4,
+			s3Notes:  []note.Note{{ID: "1", Title: "a"}, {ID: "2", Title: "b"}, {ID: "3", Title: "c"}},
+			wantListNotes: []note.ListNote{
+				{ID: "3", Title: "c"},
+			},
+			wantTotal: 3,
+		},
+		{
+			name:          "Past the End",
+			startIdx:      5,
+			endIdx:        10,
+			s3Notes:       []note.Note{{ID: "1", Title: "a"}, {ID: "2", Title: "b"}},
+			wantListNotes: []note.ListNote{},
+			wantTotal:     2,
+		},
+		{
+			name:          "Empty",
 			wantErr:       nil,
 			wantListNotes: []note.ListNote{},
 		},
@@ -110,18 +138,23 @@ func TestList(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		downloader := &mockDownloader{listNotes: test.s3ListNotes, err: test.s3Err}
-		uploader := &mockUploader{}
-		deleter := &mockDeleter{}
-		repo := noterepo.NewS3Repo(uploader, downloader, deleter, "somebucket")
+		s3 := repotest.NewFakeS3()
+		repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+		for _, n := range test.s3Notes {
+			if err := repo.Save(context.Background(), n); err != nil {
+				t.Fatalf("%v: failed to save note: %v", test.name, err)
+			}
+		}
+		s3.Err = test.s3Err
 
-		got, err := repo.List(test.ctx, test.startIdx, test.endIdx)
+		got, total, err := repo.List(test.ctx, test.startIdx, test.endIdx)
 
 		compare(test.name, err, test.wantErr, t)
+		compare(test.name, total, test.wantTotal, t)
 		compare(test.name, len(got), len(test.wantListNotes), t)
 
 		for i, ln := range got {
-			compare(test.name, test.wantListNotes[i], ln, t)
+			compare(test.name, marshal(test.wantListNotes[i]), marshal(ln), t)
 		}
 	}
 }
@@ -130,49 +163,115 @@ func TestSave(t *testing.T) {
 	err := errors.New("some unkown error")
 
 	tests := []struct {
-		name          string
-		ctx           context.Context
-		input         note.Note
-		s3Err         error
-		s3Note        string
-		s3ListNotes   string
-		wantNote      string
-		wantListNotes string
-		wantErr       error
+		name     string
+		ctx      context.Context
+		existing []note.Note
+		input    note.Note
+		s3Err    error
+		wantNote string
+		wantList []note.ListNote
+		wantErr  error
 	}{
 		{
-			name:          "Add a New Note",
-			input:         note.Note{ID: "2", Title: "some note title", Data: "some other note"},
-			s3ListNotes:   marshal([]note.ListNote{{ID: "1", Title: "somenote"}}),
-			wantNote:      marshal(note.Note{ID: "2", Title: "some note title", Data: "some other note"}),
-			wantListNotes: marshal([]note.ListNote{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}}),
+			name:     "Add a New Note",
+			existing: []note.Note{{ID: "1", Title: "somenote"}},
+			input:    note.Note{ID: "2", Title: "some note title", Data: "some other note"},
+			wantNote: marshal(note.Note{ID: "2", Title: "some note title", Data: "some other note"}),
+			wantList: []note.ListNote{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}},
+		},
+		{
+			name:     "Update a Note",
+			existing: []note.Note{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some other note"}},
+			input:    note.Note{ID: "1", Title: "some updated note", Data: "some new text"},
+			wantNote: marshal(note.Note{ID: "1", Title: "some updated note", Data: "some new text"}),
+			wantList: []note.ListNote{{ID: "1", Title: "some updated note"}, {ID: "2", Title: "some other note"}},
+		},
+		{
+			name:    "Reserved ID",
+			input:   note.Note{ID: noterepo.IndexPrefix + "1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Revision ID",
+			input:   note.Note{ID: noterepo.RevisionPrefix + "1/2"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Notebook ID",
+			input:   note.Note{ID: noterepo.NotebookPrefix + "1"},
+			wantErr: noterepo.ErrReservedID,
 		},
 		{
-			name:          "Update a Note",
-			input:         note.Note{ID: "1", Title: "some updated note", Data: "some new text"},
-			s3ListNotes:   marshal([]note.ListNote{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some other note"}}),
-			wantNote:      marshal(note.Note{ID: "1", Title: "some updated note", Data: "some new text"}),
-			wantListNotes: marshal([]note.ListNote{{ID: "1", Title: "some updated note"}, {ID: "2", Title: "some other note"}}),
+			name:    "Search ID",
+			input:   note.Note{ID: noterepo.SearchPrefix + "1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Key Ring ID",
+			input:   note.Note{ID: noterepo.KeyRingPrefix + "1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Account ID",
+			input:   note.Note{ID: noterepo.AccountPrefix + "someone"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Auth ID",
+			input:   note.Note{ID: noterepo.AuthPrefix + "sessions/1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Share ID",
+			input:   note.Note{ID: noterepo.SharePrefix + "links/1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Audit ID",
+			input:   note.Note{ID: noterepo.AuditPrefix + "2021-05-05/1"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Attachment ID",
+			input:   note.Note{ID: noterepo.AttachmentPrefix + "1/2"},
+			wantErr: noterepo.ErrReservedID,
+		},
+		{
+			name:    "Namespace ID",
+			input:   note.Note{ID: noterepo.NamespacePrefix + "someone/1"},
+			wantErr: noterepo.ErrReservedID,
 		},
 		{
 			name:    "Unknown Error",
-			input:   note.Note{},
+			input:   note.Note{ID: "1"},
 			s3Err:   err,
 			wantErr: err,
 		},
 	}
 
 	for _, test := range tests {
-		downloader := &mockDownloader{note: test.s3Note, listNotes: test.s3ListNotes, err: test.s3Err}
-		uploader := &mockUploader{err: test.s3Err}
-		deleter := &mockDeleter{}
+		s3 := repotest.NewFakeS3()
+		repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+		for _, n := range test.existing {
+			if err := repo.Save(context.Background(), n); err != nil {
+				t.Fatalf("%v: failed to save note: %v", test.name, err)
+			}
+		}
+		s3.Err = test.s3Err
 
-		repo := noterepo.NewS3Repo(uploader, downloader, deleter, "somebucket")
 		err := repo.Save(test.ctx, test.input)
-
 		compare(test.name, err, test.wantErr, t)
-		compare(test.name, uploader.uploadedNote, test.wantNote, t)
-		compare(test.name, uploader.uploadedIndex, test.wantListNotes, t)
+		if test.wantErr != nil {
+			continue
+		}
+
+		saved, _ := s3.Object(test.input.ID)
+		compare(test.name, string(saved), test.wantNote, t)
+
+		// A new repo has to go to the bucket rather than its cache
+		list, _, err := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket").List(test.ctx, 0, 0)
+		compare(test.name, err, nil, t)
+		compare(test.name, marshal(list), marshal(test.wantList), t)
 	}
 }
 
@@ -180,48 +279,231 @@ func TestDelete(t *testing.T) {
 	err := errors.New("some unkown error")
 
 	tests := []struct {
-		name          string
-		ctx           context.Context
-		input         string
-		s3Err         error
-		s3ListNotes   string
-		wantListNotes string
-		wantErr       error
+		name     string
+		ctx      context.Context
+		input    string
+		existing []note.Note
+		s3Err    error
+		wantKeys []string
+		wantErr  error
 	}{
 		{
-			name:          "Delete a Note",
-			input:         "1",
-			s3ListNotes:   marshal([]note.ListNote{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}}),
-			wantListNotes: marshal([]note.ListNote{{ID: "2", Title: "some note title"}}),
+			name:     "Delete a Note",
+			input:    "1",
+			existing: []note.Note{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}},
+			wantKeys: []string{"2", noterepo.IndexPrefix + "2"},
 		},
 		{
-			name:          "Delete a Missing Note",
-			input:         "3",
-			s3ListNotes:   marshal([]note.ListNote{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}}),
-			wantListNotes: "",
+			name:     "Delete a Missing Note",
+			input:    "3",
+			existing: []note.Note{{ID: "1", Title: "somenote"}, {ID: "2", Title: "some note title"}},
+			wantKeys: []string{"1", "2", noterepo.IndexPrefix + "1", noterepo.IndexPrefix + "2"},
 		},
 		{
-			name:    "Unknown Error",
-			input:   "1",
-			s3Err:   err,
-			wantErr: err,
+			name:     "Unknown Error",
+			input:    "1",
+			existing: []note.Note{{ID: "1", Title: "somenote"}},
+			s3Err:    err,
+			wantKeys: []string{"1", noterepo.IndexPrefix + "1"},
+			wantErr:  err,
 		},
 	}
 
 	for _, test := range tests {
-		downloader := &mockDownloader{listNotes: test.s3ListNotes, err: test.s3Err}
-		uploader := &mockUploader{err: test.s3Err}
-		deleter := &mockDeleter{err: test.s3Err}
+		s3 := repotest.NewFakeS3()
+		repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+		for _, n := range test.existing {
+			if err := repo.Save(context.Background(), n); err != nil {
+				t.Fatalf("%v: failed to save note: %v", test.name, err)
+			}
+		}
+		s3.Err = test.s3Err
 
-		repo := noterepo.NewS3Repo(uploader, downloader, deleter, "somebucket")
 		err := repo.Delete(test.ctx, test.input)
 
 		compare(test.name, err, test.wantErr, t)
-		compare(test.name, deleter.requestedID, test.input, t)
-		compare(test.name, uploader.uploadedIndex, test.wantListNotes, t)
+		compare(test.name, fmt.Sprint(s3.Keys()), fmt.Sprint(test.wantKeys), t)
+	}
+}
+
+func TestListPaginatesBucket(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	s3.PageSize = 2
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	for i := 0; i < 5; i++ {
+		if err := repo.Save(ctx, note.Note{ID: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+
+	_, total, err := repo.List(ctx, 0, 0)
+	compare("Paginated", err, nil, t)
+	compare("Paginated", total, 5, t)
+}
+
+func TestListMigratesLegacyIndex(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	s3.Put(noterepo.IndexID, []byte(marshal([]note.ListNote{{ID: "b", Title: "first"}, {ID: "a", Title: "second"}})))
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	list, total, err := repo.List(ctx, 0, 0)
+	compare("Migrated", err, nil, t)
+	compare("Migrated", total, 2, t)
+	compare("Migrated", marshal(list), marshal([]note.ListNote{{ID: "b", Title: "first"}, {ID: "a", Title: "second"}}), t)
+	compare("Migrated", fmt.Sprint(s3.Keys()), fmt.Sprint([]string{noterepo.IndexID, noterepo.IndexPrefix + "a", noterepo.IndexPrefix + "b"}), t)
+
+	// New notes go after the migrated ones
+	if err := repo.Save(ctx, note.Note{ID: "0", Title: "third"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+	list, _, _ = noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket").List(ctx, 0, 0)
+	compare("Migrated", list[2].ID, "0", t)
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	for _, id := range []string{"1", "2"} {
+		if err := repo.Save(ctx, note.Note{ID: id, Title: "title " + id}); err != nil {
+			t.Fatalf("failed to save note: %v", err)
+		}
+	}
+	compare("Compact", repo.Compact(ctx), nil, t)
+
+	// A new process can list the index from the snapshot without downloading
+	// any entries
+	counter := &countingDownloader{Downloader: s3}
+	fresh := noterepo.NewS3Repo(s3, counter, s3, s3, "somebucket")
+	_, total, err := fresh.List(ctx, 0, 0)
+	compare("Compact", err, nil, t)
+	compare("Compact", total, 2, t)
+	compare("Compact", counter.keys(), noterepo.IndexID, t)
+
+	// A stale snapshot is corrected by the entries
+	if err := repo.Delete(ctx, "1"); err != nil {
+		t.Fatalf("failed to delete note: %v", err)
+	}
+	if err := repo.Save(ctx, note.Note{ID: "2", Title: "updated"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+	list, _, err := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket").List(ctx, 0, 0)
+	compare("Stale Snapshot", err, nil, t)
+	compare("Stale Snapshot", marshal(list), marshal([]note.ListNote{{ID: "2", Title: "updated"}}), t)
+}
+
+// A namespace's objects are all stored under its prefix and are left out when
+// reindexing the top level
+func TestNamespaceKeys(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	repo := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket")
+
+	ns, err := repo.Namespace("someone")
+	if err != nil {
+		t.Fatalf("failed to get namespace: %v", err)
+	}
+	if err := ns.Save(ctx, note.Note{ID: "1"}); err != nil {
+		t.Fatalf("failed to save note: %v", err)
+	}
+	compare("Keys", strings.Join(s3.Keys(), ","), "users/someone/1,users/someone/index/1", t)
+
+	report, err := repo.Reindex(ctx, false)
+	compare("Reindex", err, nil, t)
+	compare("Reindex", report.Notes, 0, t)
+	compare("Reindex", report.Drifted(), false, t)
+
+	// A fresh process finds the namespace's notes under the same prefix
+	fresh, err := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket").Namespace("someone")
+	if err != nil {
+		t.Fatalf("failed to get namespace: %v", err)
+	}
+	_, total, err := fresh.List(ctx, 0, 0)
+	compare("Fresh", err, nil, t)
+	compare("Fresh", total, 1, t)
+}
+
+// Two replicas sharing a bucket must never lose each other's index updates
+func TestConcurrentReplicas(t *testing.T) {
+	ctx := context.Background()
+	s3 := repotest.NewFakeS3()
+	replicas := []*countingDownloader{{Downloader: s3}, {Downloader: s3}}
+
+	const count = 40
+	var wg sync.WaitGroup
+	for r, d := range replicas {
+		repo := noterepo.NewS3Repo(s3, d, s3, s3, "somebucket")
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(r, i int) {
+				defer wg.Done()
+				id := fmt.Sprintf("%v-%v", r, i)
+				if err := repo.Save(ctx, note.Note{ID: id}); err != nil {
+					t.Errorf("failed to save note: %v", err)
+				}
+				if i%4 == 0 {
+					if err := repo.Delete(ctx, id); err != nil {
+						t.Errorf("failed to delete note: %v", err)
+					}
+				}
+				if i%3 == 0 {
+					_ = repo.Compact(ctx)
+				}
+			}(r, i)
+		}
+	}
+	wg.Wait()
+
+	list, total, err := noterepo.NewS3Repo(s3, s3, s3, s3, "somebucket").List(ctx, 0, 0)
+	compare("Replicas", err, nil, t)
+	compare("Replicas", total, len(replicas)*(count-count/4), t)
+	for _, ln := range list {
+		var r, i int
+		_, _ = fmt.Sscanf(ln.ID, "%d-%d", &r, &i)
+		if i%4 == 0 {
+			t.Errorf("deleted note %v is still in the index", ln.ID)
+		}
 	}
 }
 
+func deleteInput(key string) *s3.DeleteObjectInput {
+	return &s3.DeleteObjectInput{Bucket: aws.String("somebucket"), Key: aws.String(key)}
+}
+
+// countingDownloader records the keys downloaded, marking conditional
+// downloads, and how many bytes came back
+type countingDownloader struct {
+	noterepo.Downloader
+
+	mu         sync.Mutex
+	downloaded []string
+	bytes      int64
+}
+
+func (c *countingDownloader) Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error) {
+	key := *input.Key
+	if input.IfNoneMatch != nil {
+		key += " if changed"
+	}
+	n, err := c.Downloader.Download(w, input, options...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.downloaded = append(c.downloaded, key)
+	c.bytes += n
+	return n, err
+}
+
+func (c *countingDownloader) keys() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.downloaded, ",")
+}
+
 func compare(testName string, got, want interface{}, t *testing.T) {
 	if got != want {
 		t.Errorf("%v: got=[%v] want=[%v]", testName, got, want)
@@ -250,42 +532,3 @@ func (m *mockDownloader) Download(w io.WriterAt, input *s3.GetObjectInput, optio
 	}
 	return -1, nil
 }
-
-type mockUploader struct {
-	uploadedNote  string
-	uploadedIndex string
-	err           error
-}
-
-func (m *mockUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
-	if m.err != nil {
-		return &s3manager.UploadOutput{}, m.err
-	}
-	if *input.Key == noterepo.IndexID {
-		bytes, err := ioutil.ReadAll(input.Body)
-		if err != nil {
-			return &s3manager.UploadOutput{}, err
-		}
-		m.uploadedIndex = string(bytes)
-	} else {
-		bytes, err := ioutil.ReadAll(input.Body)
-		if err != nil {
-			return &s3manager.UploadOutput{}, err
-		}
-		m.uploadedNote = string(bytes)
-	}
-	return &s3manager.UploadOutput{}, nil
-}
-
-type mockDeleter struct {
-	requestedID string
-	err         error
-}
-
-func (m *mockDeleter) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
-	m.requestedID = *input.Key
-	if m.err != nil {
-		return &s3.DeleteObjectOutput{}, m.err
-	}
-	return &s3.DeleteObjectOutput{}, nil
-}
@@ -0,0 +1,259 @@
+package repotest
+
+import (
+	"crypto/md5" // #nosec G501 -- s3 ETags are md5 sums
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const defaultPageSize = 1000
+
+// FakeS3 is an in-memory bucket that satisfies the uploader, downloader,
+// deleter and lister interfaces used by the s3 repository. Downloads honour
+// the input's Range and IfNoneMatch, and run the downloader's request options
+// against a response with the object's ETag and Content-Encoding headers.
+type FakeS3 struct {
+	// PageSize is the most keys returned by a single list call
+	PageSize int
+
+	// Err, when set, is returned by every call
+	Err error
+
+	mu        sync.Mutex
+	objects   map[string][]byte
+	encodings map[string]string
+}
+
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{PageSize: defaultPageSize, objects: make(map[string][]byte), encodings: make(map[string]string)}
+}
+
+func (f *FakeS3) Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (int64, error) {
+	f.mu.Lock()
+	data, ok := f.objects[*input.Key]
+	encoding := f.encodings[*input.Key]
+	err := f.Err
+	f.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+
+	header := http.Header{}
+	header.Set("ETag", etag(data))
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	respond(options, header)
+
+	if match := aws.StringValue(input.IfNoneMatch); match != "" && match == etag(data) {
+		return 0, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), http.StatusNotModified, "")
+	}
+	if rng := aws.StringValue(input.Range); rng != "" {
+		data, err = byteRange(data, rng)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.WriteAt(data, 0)
+	return int64(n), err
+}
+
+// respond completes a request made with the downloader's request options
+// with a response carrying the headers
+func respond(options []func(*s3manager.Downloader), header http.Header) {
+	d := &s3manager.Downloader{}
+	for _, o := range options {
+		o(d)
+	}
+
+	req := &request.Request{HTTPResponse: &http.Response{Header: header}}
+	for _, o := range d.RequestOptions {
+		o(req)
+	}
+	req.Handlers.Complete.Run(req)
+}
+
+// byteRange returns the part of the object a Range header of the form
+// bytes=<first>- or bytes=<first>-<last> asks for
+func byteRange(data []byte, rng string) ([]byte, error) {
+	invalid := awserr.New("InvalidRange", "the requested range is not satisfiable", nil)
+
+	bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return nil, invalid
+	}
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil || first >= len(data) {
+		return nil, invalid
+	}
+	last := len(data) - 1
+	if bounds[1] != "" {
+		if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+			return nil, invalid
+		}
+		if last >= len(data) {
+			last = len(data) - 1
+		}
+	}
+	return data[first : last+1], nil
+}
+
+func (f *FakeS3) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.objects[*input.Key] = data
+	f.encodings[*input.Key] = aws.StringValue(input.ContentEncoding)
+
+	return &s3manager.UploadOutput{ETag: aws.String(etag(data))}, nil
+}
+
+func (f *FakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	delete(f.objects, *input.Key)
+	delete(f.encodings, *input.Key)
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsV2 lists keys in lexical order, PageSize at a time. Keys with
+// the delimiter after the prefix are rolled up into common prefixes, which
+// count towards the page like keys do. The continuation token is simply the
+// last key or common prefix returned.
+func (f *FakeS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	after := aws.StringValue(input.ContinuationToken)
+
+	keys := make([]string, 0)
+	prefixes := make(map[string]bool)
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i != -1 {
+			k = k[:len(prefix)+i+len(delimiter)]
+			if prefixes[k] {
+				continue
+			}
+			prefixes[k] = true
+		}
+		if k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	if len(keys) > f.PageSize {
+		keys = keys[:f.PageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+
+	for _, k := range keys {
+		if prefixes[k] {
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(k)})
+			continue
+		}
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:  aws.String(k),
+			ETag: aws.String(etag(f.objects[k])),
+			Size: aws.Int64(int64(len(f.objects[k]))),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents)))
+
+	return out, nil
+}
+
+// Keys returns the sorted keys of every object in the bucket
+func (f *FakeS3) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object returns the contents of the object stored under key
+func (f *FakeS3) Object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// ContentEncoding returns the Content-Encoding the object was uploaded with
+func (f *FakeS3) ContentEncoding(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.encodings[key]
+}
+
+// Put stores an object directly, without a Content-Encoding, bypassing Err
+func (f *FakeS3) Put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[key] = data
+	delete(f.encodings, key)
+}
+
+// PutEncoded stores an object directly with the Content-Encoding, bypassing
+// Err
+func (f *FakeS3) PutEncoded(key string, data []byte, encoding string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[key] = data
+	f.encodings[key] = encoding
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data) // #nosec G401
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,1539 @@
+// Package repotest provides a conformance suite that every note.Repository
+// implementation is expected to pass.
+package repotest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/apikey"
+	"github.com/sksmith/note-server/core/audit"
+	"github.com/sksmith/note-server/core/auth"
+	"github.com/sksmith/note-server/core/note"
+	"github.com/sksmith/note-server/core/search"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// Factory returns a new, empty repository for a single test
+type Factory func(t *testing.T) note.Repository
+
+// Run executes the conformance suite against repositories built by newRepo
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, note.Repository)
+	}{
+		{name: "GetMissing", fn: testGetMissing},
+		{name: "SaveAndGet", fn: testSaveAndGet},
+		{name: "SaveOverwrites", fn: testSaveOverwrites},
+		{name: "ListEmpty", fn: testListEmpty},
+		{name: "ListOrder", fn: testListOrder},
+		{name: "ListPage", fn: testListPage},
+		{name: "Delete", fn: testDelete},
+		{name: "DeleteMissing", fn: testDeleteMissing},
+		{name: "ConcurrentSaves", fn: testConcurrentSaves},
+		{name: "ConcurrentSavesAndDeletes", fn: testConcurrentSavesAndDeletes},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newRepo(t))
+		})
+	}
+
+	revisionTests := []struct {
+		name string
+		fn   func(*testing.T, note.Revisioner)
+	}{
+		{name: "RevisionsMissing", fn: testRevisionsMissing},
+		{name: "SaveAndGetRevisions", fn: testSaveAndGetRevisions},
+		{name: "RevisionsPerNote", fn: testRevisionsPerNote},
+		{name: "DeleteRevisions", fn: testDeleteRevisions},
+	}
+
+	for _, test := range revisionTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			rr, ok := newRepo(t).(note.Revisioner)
+			if !ok {
+				t.Skip("repository does not keep revisions")
+			}
+			test.fn(t, rr)
+		})
+	}
+
+	trashTests := []struct {
+		name string
+		fn   func(*testing.T, trashRepo)
+	}{
+		{name: "TrashAndRestore", fn: testTrashAndRestore},
+		{name: "TrashOrder", fn: testTrashOrder},
+		{name: "DeleteTrashed", fn: testDeleteTrashed},
+	}
+
+	for _, test := range trashTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tr, ok := newRepo(t).(trashRepo)
+			if !ok {
+				t.Skip("repository does not keep a trash")
+			}
+			test.fn(t, tr)
+		})
+	}
+
+	notebookTests := []struct {
+		name string
+		fn   func(*testing.T, note.NotebookRepository)
+	}{
+		{name: "NotebookMissing", fn: testNotebookMissing},
+		{name: "SaveAndGetNotebooks", fn: testSaveAndGetNotebooks},
+		{name: "DeleteNotebook", fn: testDeleteNotebook},
+	}
+
+	for _, test := range notebookTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			nr, ok := newRepo(t).(note.NotebookRepository)
+			if !ok {
+				t.Skip("repository does not keep notebooks")
+			}
+			test.fn(t, nr)
+		})
+	}
+
+	searchTests := []struct {
+		name string
+		fn   func(*testing.T, note.SearchStore)
+	}{
+		{name: "SaveAndListSearchDocuments", fn: testSaveAndListSearchDocuments},
+		{name: "DeleteSearchDocument", fn: testDeleteSearchDocument},
+	}
+
+	for _, test := range searchTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ss, ok := newRepo(t).(note.SearchStore)
+			if !ok {
+				t.Skip("repository does not keep a search index")
+			}
+			test.fn(t, ss)
+		})
+	}
+
+	t.Run("SaveAndGetWrappedKeys", func(t *testing.T) {
+		kr, ok := newRepo(t).(note.KeyRing)
+		if !ok {
+			t.Skip("repository does not keep wrapped keys")
+		}
+		testSaveAndGetWrappedKeys(t, kr)
+	})
+
+	t.Run("SaveAndGetUsers", func(t *testing.T) {
+		ur, ok := newRepo(t).(user.Repository)
+		if !ok {
+			t.Skip("repository does not keep users")
+		}
+		testSaveAndGetUsers(t, ur)
+	})
+
+	authTests := []struct {
+		name string
+		fn   func(*testing.T, auth.Store)
+	}{
+		{name: "SaveAndListSigningKeys", fn: testSaveAndListSigningKeys},
+		{name: "SaveAndGetSessions", fn: testSaveAndGetSessions},
+	}
+
+	for _, test := range authTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			as, ok := newRepo(t).(auth.Store)
+			if !ok {
+				t.Skip("repository does not keep signing keys and sessions")
+			}
+			test.fn(t, as)
+		})
+	}
+
+	t.Run("SaveAndGetAPIKeys", func(t *testing.T) {
+		ks, ok := newRepo(t).(apikey.Store)
+		if !ok {
+			t.Skip("repository does not keep api keys")
+		}
+		testSaveAndGetAPIKeys(t, ks)
+	})
+
+	shareTests := []struct {
+		name string
+		fn   func(*testing.T, note.ShareRepository)
+	}{
+		{name: "SaveAndGetShares", fn: testSaveAndGetShares},
+		{name: "SaveAndGetLinks", fn: testSaveAndGetLinks},
+	}
+
+	for _, test := range shareTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			sr, ok := newRepo(t).(note.ShareRepository)
+			if !ok {
+				t.Skip("repository does not keep shares")
+			}
+			test.fn(t, sr)
+		})
+	}
+
+	attachmentTests := []struct {
+		name string
+		fn   func(*testing.T, attachmentRepo)
+	}{
+		{name: "AttachmentMissing", fn: testAttachmentMissing},
+		{name: "SaveAndOpenAttachments", fn: testSaveAndOpenAttachments},
+		{name: "SaveAttachmentFails", fn: testSaveAttachmentFails},
+		{name: "DeleteAttachments", fn: testDeleteAttachments},
+	}
+
+	for _, test := range attachmentTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ar, ok := newRepo(t).(attachmentRepo)
+			if !ok {
+				t.Skip("repository does not store attachments")
+			}
+			test.fn(t, ar)
+		})
+	}
+
+	t.Run("AppendAndListAuditEvents", func(t *testing.T) {
+		as, ok := newRepo(t).(audit.Store)
+		if !ok {
+			t.Skip("repository does not keep an audit log")
+		}
+		testAppendAndListAuditEvents(t, as)
+	})
+
+	namespaceTests := []struct {
+		name string
+		fn   func(*testing.T, note.Namespaces)
+	}{
+		{name: "NamespacesIsolated", fn: testNamespacesIsolated},
+		{name: "NamespaceTrashIsolated", fn: testNamespaceTrashIsolated},
+		{name: "ListNamespaces", fn: testListNamespaces},
+		{name: "InvalidNamespace", fn: testInvalidNamespace},
+	}
+
+	for _, test := range namespaceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ns, ok := newRepo(t).(note.Namespaces)
+			if !ok {
+				t.Skip("repository does not keep namespaces")
+			}
+			test.fn(t, ns)
+		})
+	}
+}
+
+type trashRepo interface {
+	note.Repository
+	note.Trash
+}
+
+type attachmentRepo interface {
+	note.Repository
+	note.AttachmentStore
+}
+
+// A missing note is reported with a core.ErrNotFound
+func testGetMissing(t *testing.T, repo note.Repository) {
+	_, err := repo.Get(context.Background(), "missing")
+	if !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Every field of a saved note comes back from Get and the index
+func testSaveAndGet(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	want := newNote("1")
+
+	mustSave(ctx, t, repo, want)
+
+	got, err := repo.Get(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNote(t, got, want)
+
+	list, total, err := repo.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if total != 1 || len(list) != 1 {
+		t.Fatalf("got=[%v,%v] want=[1,1]", total, len(list))
+	}
+	expectListNote(t, list[0], want)
+}
+
+// Saving an existing ID replaces the note and its index entry
+func testSaveOverwrites(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	n := newNote("1")
+	mustSave(ctx, t, repo, n)
+
+	n.Title = "an updated title"
+	n.Data = "e2e1.k.AAAAAAAAAAAAAAAA.AAAAAAAAAAAAAAAAAAAAAA"
+	n.Encrypted = true
+	n.Version++
+	n.Updated = n.Updated.Add(time.Hour)
+	mustSave(ctx, t, repo, n)
+
+	got, err := repo.Get(ctx, n.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNote(t, got, n)
+
+	list, total, err := repo.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if total != 1 || len(list) != 1 {
+		t.Fatalf("got=[%v,%v] want=[1,1]", total, len(list))
+	}
+	expectListNote(t, list[0], n)
+}
+
+// An empty repository lists an empty, non-nil slice
+func testListEmpty(t *testing.T, repo note.Repository) {
+	list, total, err := repo.List(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if list == nil {
+		t.Errorf("got=[nil] want=[empty list]")
+	}
+	if total != 0 || len(list) != 0 {
+		t.Errorf("got=[%v,%v] want=[0,0]", total, len(list))
+	}
+}
+
+// The index is kept in the order notes were first saved, updating a note
+// doesn't move it
+func testListOrder(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	for _, id := range []string{"c", "a", "b"} {
+		mustSave(ctx, t, repo, newNote(id))
+	}
+	n := newNote("a")
+	n.Title = "updated"
+	mustSave(ctx, t, repo, n)
+
+	expectIDs(ctx, t, repo, 0, 0, "c", "a", "b")
+}
+
+// startIdx is inclusive, endIdx is exclusive and an endIdx of zero means the
+// end of the index
+func testListPage(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		mustSave(ctx, t, repo, newNote(fmt.Sprint(i)))
+	}
+
+	expectIDs(ctx, t, repo, 0, 2, "1", "2")
+	expectIDs(ctx, t, repo, 2, 4, "3", "4")
+	expectIDs(ctx, t, repo, 4, 6, "5")
+	expectIDs(ctx, t, repo, 3, 0, "4", "5")
+	expectIDs(ctx, t, repo, 5, 10)
+}
+
+// A deleted note can't be fetched and is removed from the index
+func testDelete(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	for _, id := range []string{"1", "2", "3"} {
+		mustSave(ctx, t, repo, newNote(id))
+	}
+
+	if err := repo.Delete(ctx, "2"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, err := repo.Get(ctx, "2"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectIDs(ctx, t, repo, 0, 0, "1", "3")
+}
+
+// Deleting a note that doesn't exist is not an error and changes nothing
+func testDeleteMissing(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	mustSave(ctx, t, repo, newNote("1"))
+
+	if err := repo.Delete(ctx, "missing"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+	expectIDs(ctx, t, repo, 0, 0, "1")
+}
+
+// Notes saved in parallel all make it into the index
+func testConcurrentSaves(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	const count = 50
+
+	hammer(t, count, func(i int) error {
+		return repo.Save(ctx, newNote(fmt.Sprint(i)))
+	})
+
+	want := make([]string, count)
+	for i := range want {
+		want[i] = fmt.Sprint(i)
+	}
+	expectIDSet(ctx, t, repo, want)
+}
+
+// Deletes running in parallel with saves only remove the deleted notes
+func testConcurrentSavesAndDeletes(t *testing.T, repo note.Repository) {
+	ctx := context.Background()
+	const count = 50
+
+	for i := 0; i < count; i++ {
+		mustSave(ctx, t, repo, newNote(fmt.Sprint("old", i)))
+	}
+
+	hammer(t, count*2, func(i int) error {
+		if i%2 == 0 {
+			return repo.Delete(ctx, fmt.Sprint("old", i/2))
+		}
+		return repo.Save(ctx, newNote(fmt.Sprint("new", i/2)))
+	})
+
+	want := make([]string, count)
+	for i := range want {
+		want[i] = fmt.Sprint("new", i)
+	}
+	expectIDSet(ctx, t, repo, want)
+}
+
+// hammer calls fn count times in parallel and fails on the first error
+// A note without revisions has an empty history
+func testRevisionsMissing(t *testing.T, repo note.Revisioner) {
+	ctx := context.Background()
+
+	revs, err := repo.ListRevisions(ctx, "missing")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(revs) != 0 {
+		t.Errorf("got=%v want=[]", revs)
+	}
+
+	_, err = repo.GetRevision(ctx, "missing", 1)
+	if !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	// Deleting revisions that were never saved is a no-op, even before any
+	// note has had a revision
+	if err = repo.DeleteRevisions(ctx, "missing"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+}
+
+// Revisions are listed newest first and come back whole from GetRevision
+func testSaveAndGetRevisions(t *testing.T, repo note.Revisioner) {
+	ctx := context.Background()
+	versions := revisionsOf(newNote("1"), 3)
+	for _, n := range versions {
+		mustSaveRevision(ctx, t, repo, n)
+	}
+
+	expectRevisions(ctx, t, repo, "1", versions[2], versions[1], versions[0])
+
+	for _, want := range versions {
+		got, err := repo.GetRevision(ctx, "1", want.Version)
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		expectNote(t, got, want)
+	}
+
+	_, err := repo.GetRevision(ctx, "1", 4)
+	if !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Revisions of notes whose IDs share a prefix don't mix
+func testRevisionsPerNote(t *testing.T, repo note.Revisioner) {
+	ctx := context.Background()
+	a := newNote("a")
+	ab := newNote("a/b")
+	ab.Version = 2
+	mustSaveRevision(ctx, t, repo, a)
+	mustSaveRevision(ctx, t, repo, ab)
+
+	expectRevisions(ctx, t, repo, "a", a)
+	expectRevisions(ctx, t, repo, "a/b", ab)
+
+	_, err := repo.GetRevision(ctx, "a", 2)
+	if !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Deleting revisions only removes the given note's
+func testDeleteRevisions(t *testing.T, repo note.Revisioner) {
+	ctx := context.Background()
+	a := revisionsOf(newNote("a"), 2)
+	ab := newNote("a/b")
+	for _, n := range append(a, ab) {
+		mustSaveRevision(ctx, t, repo, n)
+	}
+
+	if err := repo.DeleteRevisions(ctx, "a"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := repo.DeleteRevisions(ctx, "missing"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	expectRevisions(ctx, t, repo, "a")
+	expectRevisions(ctx, t, repo, "a/b", ab)
+}
+
+// A missing attachment is reported with a core.ErrNotFound
+func testAttachmentMissing(t *testing.T, repo attachmentRepo) {
+	_, err := repo.OpenAttachment(context.Background(), "1", "missing", 0)
+	if !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Attachments read back whole or from any offset, and the note lists them
+func testSaveAndOpenAttachments(t *testing.T, repo attachmentRepo) {
+	ctx := context.Background()
+	n := newNote("1")
+	n.Attachments = []note.Attachment{{ID: "a", Name: "picture.png", ContentType: "image/png", Size: 200000}}
+	mustSave(ctx, t, repo, n)
+
+	got, err := repo.Get(ctx, "1")
+	if err != nil || len(got.Attachments) != 1 || got.Attachments[0] != n.Attachments[0] {
+		t.Errorf("got=[%v, %v] want=[%v]", got.Attachments, err, n.Attachments)
+	}
+
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	mustSaveAttachment(ctx, t, repo, "1", "a", data)
+	mustSaveAttachment(ctx, t, repo, "1", "empty", nil)
+
+	for _, offset := range []int64{0, 1, 65536, 70000, 131072, 199999} {
+		expectAttachment(ctx, t, repo, "1", "a", offset, data[offset:])
+	}
+	expectAttachment(ctx, t, repo, "1", "empty", 0, nil)
+
+	// Reading from the end or past it is refused rather than reading nothing
+	for _, test := range []struct {
+		id     string
+		offset int64
+	}{{"a", 200000}, {"a", 200001}, {"a", 300000}, {"empty", 1}} {
+		if _, err := repo.OpenAttachment(ctx, "1", test.id, test.offset); !core.IsErrRangeNotSatisfiable(err) {
+			t.Errorf("%v offset %v: got=[%v] want=[range not satisfiable]", test.id, test.offset, err)
+		}
+	}
+}
+
+// Nothing is stored when reading the attachment fails
+func testSaveAttachmentFails(t *testing.T, repo attachmentRepo) {
+	ctx := context.Background()
+	body := io.MultiReader(bytes.NewReader(make([]byte, 100000)), iotest.ErrReader(errors.New("broken")))
+	if err := repo.SaveAttachment(ctx, "1", "a", body); err == nil {
+		t.Errorf("got=[nil] want=[error]")
+	}
+	if _, err := repo.OpenAttachment(ctx, "1", "a", 0); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// Deleting a note's attachments leaves those of notes whose ID starts with
+// its ID alone
+func testDeleteAttachments(t *testing.T, repo attachmentRepo) {
+	ctx := context.Background()
+	mustSaveAttachment(ctx, t, repo, "a", "1", []byte("first"))
+	mustSaveAttachment(ctx, t, repo, "a", "2", []byte("second"))
+	mustSaveAttachment(ctx, t, repo, "a/b", "1", []byte("third"))
+
+	if err := repo.DeleteAttachment(ctx, "a", "1"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.OpenAttachment(ctx, "a", "1", 0); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectAttachment(ctx, t, repo, "a", "2", 0, []byte("second"))
+
+	if err := repo.DeleteAttachments(ctx, "a"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := repo.DeleteAttachments(ctx, "missing"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.OpenAttachment(ctx, "a", "2", 0); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectAttachment(ctx, t, repo, "a/b", "1", 0, []byte("third"))
+}
+
+// Saving a trashed note moves it from the index to the trash and saving it
+// untrashed moves it back
+func testTrashAndRestore(t *testing.T, repo trashRepo) {
+	ctx := context.Background()
+	n := newNote("1")
+	mustSave(ctx, t, repo, n)
+	mustSave(ctx, t, repo, newNote("2"))
+
+	trashed := trash(n)
+	mustSave(ctx, t, repo, trashed)
+
+	got, err := repo.Get(ctx, n.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNote(t, got, trashed)
+	expectIDs(ctx, t, repo, 0, 0, "2")
+	expectTrashIDs(ctx, t, repo, "1")
+
+	list, _, err := repo.ListTrash(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectListNote(t, list[0], trashed)
+
+	mustSave(ctx, t, repo, n)
+	expectIDSet(ctx, t, repo, []string{"1", "2"})
+	expectTrashIDs(ctx, t, repo)
+}
+
+// The trash lists notes in the order they were trashed
+func testTrashOrder(t *testing.T, repo trashRepo) {
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c"} {
+		mustSave(ctx, t, repo, newNote(id))
+	}
+	for _, id := range []string{"c", "a", "b"} {
+		mustSave(ctx, t, repo, trash(newNote(id)))
+	}
+
+	expectTrashIDs(ctx, t, repo, "c", "a", "b")
+
+	page, total, err := repo.ListTrash(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if total != 3 || len(page) != 1 || page[0].ID != "a" {
+		t.Errorf("got=%v (%v) want=[a] (3)", page, total)
+	}
+}
+
+// Deleting a trashed note removes it for good
+func testDeleteTrashed(t *testing.T, repo trashRepo) {
+	ctx := context.Background()
+	n := newNote("1")
+	mustSave(ctx, t, repo, n)
+	mustSave(ctx, t, repo, trash(n))
+
+	if err := repo.Delete(ctx, n.ID); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, err := repo.Get(ctx, n.ID); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectIDs(ctx, t, repo, 0, 0)
+	expectTrashIDs(ctx, t, repo)
+}
+
+// A missing notebook is reported with a core.ErrNotFound and listing no
+// notebooks returns an empty list
+func testNotebookMissing(t *testing.T, repo note.NotebookRepository) {
+	ctx := context.Background()
+	if _, err := repo.GetNotebook(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectNotebookIDs(ctx, t, repo)
+}
+
+// Every field of a saved notebook comes back from Get and List and saving it
+// again replaces it
+func testSaveAndGetNotebooks(t *testing.T, repo note.NotebookRepository) {
+	ctx := context.Background()
+	parent := newNotebook("a", "")
+	child := newNotebook("b", parent.ID)
+	mustSaveNotebook(ctx, t, repo, parent)
+	mustSaveNotebook(ctx, t, repo, child)
+
+	got, err := repo.GetNotebook(ctx, child.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNotebook(t, got, child)
+	expectNotebookIDs(ctx, t, repo, "a", "b")
+
+	child.Name = "a new name"
+	child.ParentID = ""
+	child.Updated = child.Updated.Add(time.Hour)
+	mustSaveNotebook(ctx, t, repo, child)
+
+	got, err = repo.GetNotebook(ctx, child.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectNotebook(t, got, child)
+	expectNotebookIDs(ctx, t, repo, "a", "b")
+}
+
+// Deleting a notebook leaves the others alone and deleting a missing one
+// isn't an error
+func testDeleteNotebook(t *testing.T, repo note.NotebookRepository) {
+	ctx := context.Background()
+	mustSaveNotebook(ctx, t, repo, newNotebook("a", ""))
+	mustSaveNotebook(ctx, t, repo, newNotebook("b", ""))
+
+	if err := repo.DeleteNotebook(ctx, "a"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := repo.DeleteNotebook(ctx, "missing"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, err := repo.GetNotebook(ctx, "a"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectNotebookIDs(ctx, t, repo, "b")
+}
+
+// Saved search documents come back from List intact and saving one again
+// replaces it
+func testSaveAndListSearchDocuments(t *testing.T, repo note.SearchStore) {
+	ctx := context.Background()
+	expectSearchDocuments(ctx, t, repo)
+
+	a := search.Analyze("a", 1, "title a", "some note a")
+	b := search.Analyze("b/c", 1, "title b", "some note b")
+	mustSaveSearchDocument(ctx, t, repo, a)
+	mustSaveSearchDocument(ctx, t, repo, b)
+	expectSearchDocuments(ctx, t, repo, a, b)
+
+	a = search.Analyze("a", 2, "a new title", "")
+	mustSaveSearchDocument(ctx, t, repo, a)
+	expectSearchDocuments(ctx, t, repo, a, b)
+}
+
+// Deleting a search document leaves the others alone and deleting a missing
+// one isn't an error
+func testDeleteSearchDocument(t *testing.T, repo note.SearchStore) {
+	ctx := context.Background()
+	a := search.Analyze("a", 1, "title a", "some note a")
+	b := search.Analyze("b", 1, "title b", "some note b")
+	mustSaveSearchDocument(ctx, t, repo, a)
+	mustSaveSearchDocument(ctx, t, repo, b)
+
+	if err := repo.DeleteSearchDocument(ctx, "a"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := repo.DeleteSearchDocument(ctx, "missing"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectSearchDocuments(ctx, t, repo, b)
+}
+
+// A missing user is reported with a core.ErrNotFound and every field of a
+// saved user comes back from Get
+func testSaveAndGetUsers(t *testing.T, repo user.Repository) {
+	ctx := context.Background()
+	if _, err := repo.GetUser(ctx, "someone"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	want := user.User{ID: "1", Username: "some.one", PasswordHash: "hash", Admin: true, Created: created, Updated: created}
+	if err := repo.SaveUser(ctx, want); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	want.PasswordHash = "new hash"
+	if err := repo.SaveUser(ctx, want); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := repo.GetUser(ctx, "some.one")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.ID != want.ID || got.Username != want.Username || got.PasswordHash != want.PasswordHash ||
+		got.Admin != want.Admin || !got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+// Every field of a signing key comes back from List and deleting a key, even
+// one that doesn't exist, leaves the others
+func testSaveAndListSigningKeys(t *testing.T, repo auth.Store) {
+	ctx := context.Background()
+	keys, err := repo.ListSigningKeys(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got=[%v] want=[no keys]", keys)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	a := auth.SigningKey{ID: "a", Secret: []byte{0, 1, 2, 255}, Created: created}
+	b := auth.SigningKey{ID: "b", Secret: []byte("secret"), Created: created.Add(time.Hour)}
+	for _, k := range []auth.SigningKey{a, b} {
+		if err := repo.SaveSigningKey(ctx, k); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	for _, id := range []string{"a", "missing"} {
+		if err := repo.DeleteSigningKey(ctx, id); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	keys, err = repo.ListSigningKeys(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(keys) != 1 || keys[0].ID != b.ID || string(keys[0].Secret) != string(b.Secret) || !keys[0].Created.Equal(b.Created) {
+		t.Errorf("got=[%v] want=[%v]", keys, b)
+	}
+}
+
+// A missing session is reported with a core.ErrNotFound, every field of a
+// saved one comes back from Get and a deleted one is gone
+func testSaveAndGetSessions(t *testing.T, repo auth.Store) {
+	ctx := context.Background()
+	if _, err := repo.GetSession(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	want := auth.Session{ID: "s-1_", UserID: "1", Username: "some.one", SecretHash: "hash", Created: created, Expires: created.Add(time.Hour)}
+	if err := repo.SaveSession(ctx, want); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	want.SecretHash = "new hash"
+	if err := repo.SaveSession(ctx, want); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := repo.GetSession(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got.ID != want.ID || got.UserID != want.UserID || got.Username != want.Username || got.SecretHash != want.SecretHash ||
+		!got.Created.Equal(want.Created) || !got.Expires.Equal(want.Expires) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+
+	for _, id := range []string{want.ID, "missing"} {
+		if err := repo.DeleteSession(ctx, id); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	if _, err := repo.GetSession(ctx, want.ID); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+// A missing API key is reported with a core.ErrNotFound, every field of a
+// saved one comes back from Get and List and a deleted one is gone
+// Saved keys come back intact, saving one again replaces it and an invalid ID
+// is refused. Each namespace has a key ring of its own.
+func testSaveAndGetWrappedKeys(t *testing.T, repo note.KeyRing) {
+	ctx := context.Background()
+	if _, err := repo.GetWrappedKey(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	a := note.WrappedKey{ID: "a", Algorithm: note.WrapPBKDF2AESKW, Key: "key a", Salt: "salt a", Iterations: 100000, Created: created, Updated: created}
+	b := note.WrappedKey{ID: "b", Algorithm: note.WrapPBKDF2AESKW, Key: "key b", Salt: "salt b", Iterations: 200000, Created: created, Updated: created}
+	for _, k := range []note.WrappedKey{a, b} {
+		if err := repo.SaveWrappedKey(ctx, k); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	a.Key = "key a rewrapped"
+	a.Salt = "another salt"
+	a.Updated = created.Add(time.Hour)
+	if err := repo.SaveWrappedKey(ctx, a); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := repo.GetWrappedKey(ctx, "a")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectWrappedKey(t, got, a)
+
+	keys, err := repo.ListWrappedKeys(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	if len(keys) != 2 {
+		t.Fatalf("got=[%v] want=[%v %v]", keys, a, b)
+	}
+	expectWrappedKey(t, keys[0], a)
+	expectWrappedKey(t, keys[1], b)
+
+	if err := repo.SaveWrappedKey(ctx, note.WrappedKey{ID: "../a"}); err == nil {
+		t.Errorf("got=[nil] want=[an error]")
+	}
+
+	ns, ok := repo.(note.Namespaces)
+	if !ok {
+		return
+	}
+	other, err := ns.Namespace("someone")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := other.(note.KeyRing).GetWrappedKey(ctx, "a"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+func expectWrappedKey(t *testing.T, got, want note.WrappedKey) {
+	t.Helper()
+	if got.ID != want.ID || got.Algorithm != want.Algorithm || got.Key != want.Key || got.Salt != want.Salt ||
+		got.Iterations != want.Iterations || !got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+func testSaveAndGetAPIKeys(t *testing.T, repo apikey.Store) {
+	ctx := context.Background()
+	if _, err := repo.GetAPIKey(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	expires := created.Add(time.Hour)
+	a := apikey.Key{ID: "a", UserID: "1", Username: "some.one", Name: "backups", Scope: apikey.ScopeRead, SecretHash: "hash", Created: created, Expires: &expires}
+	b := apikey.Key{ID: "b", UserID: "2", Username: "another", Name: "bot", Scope: apikey.ScopeWrite, SecretHash: "hash", Created: created}
+	for _, k := range []apikey.Key{a, b} {
+		if err := repo.SaveAPIKey(ctx, k); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	used := created.Add(time.Minute)
+	a.LastUsed = &used
+	if err := repo.TouchAPIKey(ctx, "a", used); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := repo.GetAPIKey(ctx, "a")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectAPIKey(t, got, a)
+
+	for _, id := range []string{"b", "missing"} {
+		if err := repo.DeleteAPIKey(ctx, id); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	keys, err := repo.ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got=[%v] want=[%v]", keys, a)
+	}
+	expectAPIKey(t, keys[0], a)
+
+	// Recording a use of a deleted key doesn't bring it back
+	if err := repo.TouchAPIKey(ctx, "b", used); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := repo.GetAPIKey(ctx, "b"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+}
+
+func expectAPIKey(t *testing.T, got, want apikey.Key) {
+	t.Helper()
+	if got.ID != want.ID || got.UserID != want.UserID || got.Username != want.Username || got.Name != want.Name ||
+		got.Scope != want.Scope || got.SecretHash != want.SecretHash || !got.Created.Equal(want.Created) ||
+		!timesEqual(got.Expires, want.Expires) || !timesEqual(got.LastUsed, want.LastUsed) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+// Shares are found by who they're shared with and by the note, note IDs that
+// aren't safe in a path included
+func testSaveAndGetShares(t *testing.T, repo note.ShareRepository) {
+	ctx := context.Background()
+	if _, err := repo.GetShare(ctx, "bob", "alice", "1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	shares := []note.Share{
+		{OwnerID: "alice", OwnerUsername: "alice", NoteID: "../1", NoteCreated: created, UserID: "bob", Username: "bob", Role: note.RoleViewer, Created: created},
+		{OwnerID: "alice", OwnerUsername: "alice", NoteID: "../1", NoteCreated: created, UserID: "carol", Username: "carol", Role: note.RoleEditor, Created: created},
+		{OwnerID: "alice", OwnerUsername: "alice", NoteID: "2", NoteCreated: created, UserID: "bob", Username: "bob", Role: note.RoleEditor, Created: created},
+		{OwnerID: "carol", OwnerUsername: "carol", NoteID: "../1", NoteCreated: created, UserID: "bob", Username: "bob", Role: note.RoleViewer, Created: created},
+	}
+	for _, s := range shares {
+		if err := repo.SaveShare(ctx, s); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	got, err := repo.GetShare(ctx, "bob", "alice", "../1")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if got != shares[0] {
+		t.Errorf("got=[%v] want=[%v]", got, shares[0])
+	}
+	if _, err := repo.GetShare(ctx, "../bob", "alice", "../1"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	expectShares(t, repo.ListShares)(ctx, "alice", "../1", "bob", "carol")
+	expectShares(t, func(ctx context.Context, _, userID string) ([]note.Share, error) {
+		return repo.ListSharedWith(ctx, userID)
+	})(ctx, "", "bob", "alice ../1", "alice 2", "carol ../1")
+
+	for _, s := range []note.Share{shares[0], {UserID: "dave", OwnerID: "alice", NoteID: "missing"}} {
+		if err := repo.DeleteShare(ctx, s.UserID, s.OwnerID, s.NoteID); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	expectShares(t, repo.ListShares)(ctx, "alice", "../1", "carol")
+	if err := repo.SaveShare(ctx, note.Share{OwnerID: "alice", NoteID: "1", UserID: "../bob"}); err == nil {
+		t.Errorf("expected a share with an invalid user id to be refused")
+	}
+}
+
+// expectShares returns a check that the listing returns shares identified by
+// username, or by owner and note when listing by user
+func expectShares(t *testing.T, list func(ctx context.Context, a, b string) ([]note.Share, error)) func(ctx context.Context, a, b string, want ...string) {
+	return func(ctx context.Context, a, b string, want ...string) {
+		t.Helper()
+		shares, err := list(ctx, a, b)
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+
+		got := make([]string, 0, len(shares))
+		for _, s := range shares {
+			if a == "" {
+				got = append(got, s.OwnerID+" "+s.NoteID)
+			} else {
+				got = append(got, s.Username)
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got=[%v] want=[%v]", got, want)
+		}
+	}
+}
+
+func testSaveAndGetLinks(t *testing.T, repo note.ShareRepository) {
+	ctx := context.Background()
+	if _, err := repo.GetLink(ctx, "missing"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := repo.GetLink(ctx, "../escape"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	expires := created.Add(time.Hour)
+	a := note.Link{ID: "a", OwnerID: "alice", NoteID: "../1", NoteCreated: created, SecretHash: "hash", PasswordHash: "password", Expires: &expires, Created: created}
+	b := note.Link{ID: "b", OwnerID: "alice", NoteID: "2", NoteCreated: created, SecretHash: "hash", Created: created}
+	for _, l := range []note.Link{a, b} {
+		if err := repo.SaveLink(ctx, l); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+
+	got, err := repo.GetLink(ctx, "a")
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	expectLink(t, got, a)
+
+	for _, id := range []string{"b", "missing"} {
+		if err := repo.DeleteLink(ctx, id); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	links, err := repo.ListLinks(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("got=[%v] want=[%v]", links, a)
+	}
+	expectLink(t, links[0], a)
+}
+
+func expectLink(t *testing.T, got, want note.Link) {
+	t.Helper()
+	if got.ID != want.ID || got.OwnerID != want.OwnerID || got.NoteID != want.NoteID || !got.NoteCreated.Equal(want.NoteCreated) ||
+		got.SecretHash != want.SecretHash || got.PasswordHash != want.PasswordHash || !got.Created.Equal(want.Created) ||
+		!timesEqual(got.Expires, want.Expires) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+// Events are listed by when they were recorded, across days and up to but
+// not including the end of the range
+func testAppendAndListAuditEvents(t *testing.T, repo audit.Store) {
+	ctx := context.Background()
+	day := time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC)
+	events := []audit.Event{
+		{ID: "a", Time: day.Add(-time.Minute), Action: audit.ActionCreate, OwnerID: "alice", NoteID: "../1", After: "hash"},
+		{ID: "b", Time: day, Action: audit.ActionUpdate, OwnerID: "alice", NoteID: "../1", Before: "hash", After: "other"},
+		{ID: "c", Time: day.Add(23 * time.Hour), Action: audit.ActionTrash, OwnerID: "alice", NoteID: "../1"},
+		{ID: "d", Time: day.Add(24 * time.Hour), Action: audit.ActionPurge, OwnerID: "alice", NoteID: "../1"},
+	}
+	for _, e := range events {
+		if err := repo.AppendAuditEvent(ctx, e); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	if err := repo.AppendAuditEvent(ctx, audit.Event{ID: "../e", Time: day}); err == nil {
+		t.Errorf("expected an event with an invalid id to be refused")
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{name: "All", want: []string{"a", "b", "c", "d"}},
+		{name: "From", from: day, want: []string{"b", "c", "d"}},
+		{name: "To", to: day.Add(24 * time.Hour), want: []string{"a", "b", "c"}},
+		{name: "Day", from: day, to: day.Add(24 * time.Hour), want: []string{"b", "c"}},
+		{name: "Empty", from: day.Add(time.Hour), to: day.Add(2 * time.Hour), want: []string{}},
+	}
+
+	for _, test := range tests {
+		list, err := repo.ListAuditEvents(ctx, test.from, test.to)
+		if err != nil {
+			t.Fatalf("%v: got=[%v] want=[nil]", test.name, err)
+		}
+		got := make([]string, 0, len(list))
+		for _, e := range list {
+			got = append(got, e.ID)
+			if e.ID == "b" && (e.Before != "hash" || e.After != "other" || e.NoteID != "../1" || !e.Time.Equal(day)) {
+				t.Errorf("%v: got=[%v] want=[%v]", test.name, e, events[1])
+			}
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%v: got=[%v] want=[%v]", test.name, got, test.want)
+		}
+	}
+}
+
+// Notes with the same ID in different namespaces, or at the top level, are
+// different notes. Nothing done in one namespace is visible from another.
+func testNamespacesIsolated(t *testing.T, repo note.Namespaces) {
+	ctx := context.Background()
+	a, b := mustNamespace(t, repo, "a"), mustNamespace(t, repo, "b")
+
+	for r, data := range map[note.Repository]string{repo: "top", a: "a", b: "b"} {
+		if err := r.Save(ctx, note.Note{ID: "same", Data: data, Version: 1}); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	if err := a.Save(ctx, note.Note{ID: "only-a", Data: "a", Version: 1}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	for r, data := range map[note.Repository]string{repo: "top", a: "a", b: "b"} {
+		got, err := r.Get(ctx, "same")
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+		if got.Data != data {
+			t.Errorf("got=[%v] want=[%v]", got.Data, data)
+		}
+	}
+
+	if _, err := b.Get(ctx, "only-a"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	if _, err := repo.Get(ctx, "only-a"); !core.IsErrNotFound(err) {
+		t.Errorf("got=[%v] want=[not found]", err)
+	}
+	expectListIDs(t, a, "same", "only-a")
+	expectListIDs(t, b, "same")
+	expectListIDs(t, repo, "same")
+
+	if err := b.Delete(ctx, "only-a"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if err := b.Delete(ctx, "same"); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if _, err := a.Get(ctx, "only-a"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+	if _, err := a.Get(ctx, "same"); err != nil {
+		t.Errorf("got=[%v] want=[nil]", err)
+	}
+	expectListIDs(t, a, "same", "only-a")
+	expectListIDs(t, b)
+	expectListIDs(t, repo, "same")
+}
+
+// Each namespace has a trash of its own
+func testNamespaceTrashIsolated(t *testing.T, repo note.Namespaces) {
+	ctx := context.Background()
+	a, b := mustNamespace(t, repo, "a"), mustNamespace(t, repo, "b")
+
+	ta, ok := a.(note.Trash)
+	if !ok {
+		t.Skip("repository does not keep a trash")
+	}
+	tb := b.(note.Trash)
+
+	trashed := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	if err := a.Save(ctx, note.Note{ID: "1", Version: 1, Trashed: &trashed}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	if _, total, err := ta.ListTrash(ctx, 0, 0); err != nil || total != 1 {
+		t.Errorf("got=[%v,%v] want=[1,nil]", total, err)
+	}
+	if _, total, err := tb.ListTrash(ctx, 0, 0); err != nil || total != 0 {
+		t.Errorf("got=[%v,%v] want=[0,nil]", total, err)
+	}
+}
+
+// Namespaces are listed once they have notes in them
+func testListNamespaces(t *testing.T, repo note.Namespaces) {
+	ctx := context.Background()
+	for _, id := range []string{"b", "a"} {
+		if err := mustNamespace(t, repo, id).Save(ctx, note.Note{ID: "1", Version: 1}); err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+	if err := repo.Save(ctx, note.Note{ID: "1", Version: 1}); err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got, err := repo.ListNamespaces(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[a b]" {
+		t.Errorf("got=[%v] want=[[a b]]", got)
+	}
+}
+
+// User IDs that could escape the namespace are refused
+func testInvalidNamespace(t *testing.T, repo note.Namespaces) {
+	for _, id := range []string{"", "..", "a/b", "../a", `a\b`} {
+		if _, err := repo.Namespace(id); err == nil {
+			t.Errorf("%q: got=[nil] want=[an error]", id)
+		}
+	}
+}
+
+func mustNamespace(t *testing.T, repo note.Namespaces, userID string) note.Repository {
+	t.Helper()
+
+	ns, err := repo.Namespace(userID)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	return ns
+}
+
+func expectListIDs(t *testing.T, repo note.Repository, want ...string) {
+	t.Helper()
+
+	list, total, err := repo.List(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	ids := make([]string, 0, len(list))
+	for _, ln := range list {
+		ids = append(ids, ln.ID)
+	}
+	if total != len(want) || fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("got=[%v] want=[%v]", ids, want)
+	}
+}
+
+func hammer(t *testing.T, count int, fn func(i int) error) {
+	t.Helper()
+
+	errs := make(chan error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- fn(i)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("got=[%v] want=[nil]", err)
+		}
+	}
+}
+
+func newNote(id string) note.Note {
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	return note.Note{
+		ID:         id,
+		Title:      "title " + id,
+		Data:       "some note " + id,
+		Tags:       []string{"tag", "tag-" + id},
+		NotebookID: "notebook",
+		Version:    1,
+		Created:    created,
+		Updated:    created.Add(time.Minute),
+	}
+}
+
+func newNotebook(id, parentID string) note.Notebook {
+	created := time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)
+	return note.Notebook{
+		ID:       id,
+		Name:     "notebook " + id,
+		ParentID: parentID,
+		Created:  created,
+		Updated:  created.Add(time.Minute),
+	}
+}
+
+func mustSaveNotebook(ctx context.Context, t *testing.T, repo note.NotebookRepository, nb note.Notebook) {
+	t.Helper()
+	if err := repo.SaveNotebook(ctx, nb); err != nil {
+		t.Fatalf("failed to save notebook %v: %v", nb.ID, err)
+	}
+}
+
+func expectNotebook(t *testing.T, got, want note.Notebook) {
+	t.Helper()
+	if got.ID != want.ID || got.Name != want.Name || got.ParentID != want.ParentID ||
+		!got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+// expectNotebookIDs checks the repository holds exactly the given notebooks in
+// any order
+func expectNotebookIDs(ctx context.Context, t *testing.T, repo note.NotebookRepository, want ...string) {
+	t.Helper()
+	list, err := repo.ListNotebooks(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got := make([]string, len(list))
+	for i, nb := range list {
+		got[i] = nb.ID
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v want=%v", got, want)
+	}
+}
+
+func mustSaveSearchDocument(ctx context.Context, t *testing.T, repo note.SearchStore, doc search.Document) {
+	t.Helper()
+	if err := repo.SaveSearchDocument(ctx, doc); err != nil {
+		t.Fatalf("failed to save search document %v: %v", doc.ID, err)
+	}
+}
+
+// expectSearchDocuments checks the repository holds exactly the given search
+// documents in any order
+func expectSearchDocuments(ctx context.Context, t *testing.T, repo note.SearchStore, want ...search.Document) {
+	t.Helper()
+	got, err := repo.ListSearchDocuments(ctx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v want=%v", got, want)
+	}
+}
+
+// revisionsOf returns count successive versions of the note
+func revisionsOf(n note.Note, count int) []note.Note {
+	versions := make([]note.Note, count)
+	for i := range versions {
+		versions[i] = n
+		versions[i].Version = int64(i + 1)
+		versions[i].Data = fmt.Sprintf("%v version %v", n.Data, i+1)
+		versions[i].Updated = n.Updated.Add(time.Duration(i) * time.Minute)
+	}
+	return versions
+}
+
+func mustSaveRevision(ctx context.Context, t *testing.T, repo note.Revisioner, n note.Note) {
+	t.Helper()
+	if err := repo.SaveRevision(ctx, n); err != nil {
+		t.Fatalf("failed to save revision %v@%v: %v", n.ID, n.Version, err)
+	}
+}
+
+func expectRevisions(ctx context.Context, t *testing.T, repo note.Revisioner, id string, want ...note.Note) {
+	t.Helper()
+	got, err := repo.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got=%v want=%v revisions", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Version != want[i].Version || !got[i].Updated.Equal(want[i].Updated) || got[i].Current {
+			t.Errorf("got=[%v] want=[%v]", got[i], note.NewRevision(want[i]))
+		}
+	}
+}
+
+func trash(n note.Note) note.Note {
+	trashed := n.Updated.Add(time.Hour)
+	n.Trashed = &trashed
+	return n
+}
+
+func expectTrashIDs(ctx context.Context, t *testing.T, repo note.Trash, want ...string) {
+	t.Helper()
+	list, total, err := repo.ListTrash(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got := make([]string, len(list))
+	for i, ln := range list {
+		got[i] = ln.ID
+	}
+	if total != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got=%v (%v) want=%v", got, total, want)
+	}
+}
+
+func mustSaveAttachment(ctx context.Context, t *testing.T, repo note.AttachmentStore, noteID, id string, data []byte) {
+	t.Helper()
+	if err := repo.SaveAttachment(ctx, noteID, id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to save attachment %v: %v", id, err)
+	}
+}
+
+func expectAttachment(ctx context.Context, t *testing.T, repo note.AttachmentStore, noteID, id string, offset int64, want []byte) {
+	t.Helper()
+	rc, err := repo.OpenAttachment(ctx, noteID, id, offset)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("offset %v: got=[%v bytes, %v] want=[%v bytes]", offset, len(got), err, len(want))
+	}
+}
+
+func mustSave(ctx context.Context, t *testing.T, repo note.Repository, n note.Note) {
+	t.Helper()
+	if err := repo.Save(ctx, n); err != nil {
+		t.Fatalf("failed to save note %v: %v", n.ID, err)
+	}
+}
+
+func expectNote(t *testing.T, got, want note.Note) {
+	t.Helper()
+	if got.ID != want.ID || got.Title != want.Title || got.Data != want.Data || got.NotebookID != want.NotebookID || got.Encrypted != want.Encrypted || got.Version != want.Version ||
+		fmt.Sprint(got.Tags) != fmt.Sprint(want.Tags) || !got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) || !timesEqual(got.Trashed, want.Trashed) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+func expectListNote(t *testing.T, got note.ListNote, want note.Note) {
+	t.Helper()
+	if got.ID != want.ID || got.Title != want.Title || got.NotebookID != want.NotebookID || got.Encrypted != want.Encrypted || got.Version != want.Version ||
+		fmt.Sprint(got.Tags) != fmt.Sprint(want.Tags) || !got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) || !timesEqual(got.Trashed, want.Trashed) {
+		t.Errorf("got=[%v] want=[%v]", got, want)
+	}
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// expectIDSet checks the index holds exactly the given IDs in any order
+func expectIDSet(ctx context.Context, t *testing.T, repo note.Repository, want []string) {
+	t.Helper()
+	list, total, err := repo.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got := make([]string, len(list))
+	for i, ln := range list {
+		got[i] = ln.ID
+	}
+	sort.Strings(got)
+	sorted := append([]string{}, want...)
+	sort.Strings(sorted)
+
+	if total != len(want) || fmt.Sprint(got) != fmt.Sprint(sorted) {
+		t.Errorf("got=%v (%v) want=%v", got, total, sorted)
+	}
+}
+
+func expectIDs(ctx context.Context, t *testing.T, repo note.Repository, startIdx, endIdx int, want ...string) {
+	t.Helper()
+	list, _, err := repo.List(ctx, startIdx, endIdx)
+	if err != nil {
+		t.Fatalf("got=[%v] want=[nil]", err)
+	}
+
+	got := make([]string, len(list))
+	for i, ln := range list {
+		got[i] = ln.ID
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("start=%v end=%v: got=%v want=%v", startIdx, endIdx, got, want)
+	}
+}
@@ -0,0 +1,252 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Revisions are named by their zero padded version so they list in order
+const revisionFormat = "%020d"
+
+func sortRevisions(revs []note.Revision) {
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Version > revs[j].Version
+	})
+}
+
+// The s3 key of a revision carries its timestamp so that listing revisions
+// doesn't have to download every one of them
+
+func revisionPrefix(id string) string {
+	return RevisionPrefix + id + "/"
+}
+
+func revisionKey(n note.Note) string {
+	return revisionPrefix(n.ID) + fmt.Sprintf(revisionFormat, n.Version) + "." +
+		strconv.FormatInt(n.Updated.UnixNano(), 10)
+}
+
+// parseRevisionKey reads the revision from a key under the note's revision
+// prefix. Keys of notes whose ID starts with this note's ID followed by a
+// slash share the prefix and are rejected.
+func parseRevisionKey(id, key string) (note.Revision, bool) {
+	name := strings.TrimPrefix(key, revisionPrefix(id))
+	if strings.Contains(name, "/") {
+		return note.Revision{}, false
+	}
+
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return note.Revision{}, false
+	}
+	version, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return note.Revision{}, false
+	}
+	updated, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return note.Revision{}, false
+	}
+
+	return note.Revision{Version: version, Updated: time.Unix(0, updated).UTC()}, true
+}
+
+func (r *s3Repo) SaveRevision(ctx context.Context, n note.Note) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(revisionKey(n), data)
+	return err
+}
+
+func (r *s3Repo) ListRevisions(ctx context.Context, id string) ([]note.Revision, error) {
+	objects, err := r.listObjects(revisionPrefix(id))
+	if err != nil {
+		return []note.Revision{}, err
+	}
+
+	revs := make([]note.Revision, 0, len(objects))
+	for _, o := range objects {
+		rev, ok := parseRevisionKey(id, aws.StringValue(o.Key))
+		if !ok {
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	sortRevisions(revs)
+
+	return revs, nil
+}
+
+func (r *s3Repo) GetRevision(ctx context.Context, id string, version int64) (note.Note, error) {
+	objects, err := r.listObjects(revisionPrefix(id) + fmt.Sprintf(revisionFormat, version) + ".")
+	if err != nil {
+		return note.Note{}, err
+	}
+
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if _, ok := parseRevisionKey(id, key); !ok {
+			continue
+		}
+
+		data, err := r.download(key)
+		if err != nil {
+			return note.Note{}, err
+		}
+		n := note.Note{}
+		if err = json.Unmarshal(data, &n); err != nil {
+			return note.Note{}, err
+		}
+		return n, nil
+	}
+
+	return note.Note{}, &core.ErrNotFound{}
+}
+
+func (r *s3Repo) DeleteRevisions(ctx context.Context, id string) error {
+	objects, err := r.listObjects(revisionPrefix(id))
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if _, ok := parseRevisionKey(id, key); !ok {
+			continue
+		}
+		if err := r.deleteObject(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fileRepo) SaveRevision(ctx context.Context, n note.Note) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	dir := r.revisionDir(n.ID)
+	if err = os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, fmt.Sprintf(revisionFormat, n.Version)+".json"), data)
+}
+
+func (r *fileRepo) ListRevisions(ctx context.Context, id string) ([]note.Revision, error) {
+	dir := r.revisionDir(id)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.Revision{}, nil
+		}
+		return []note.Revision{}, err
+	}
+
+	revs := make([]note.Revision, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		n, err := readNoteFile(filepath.Join(dir, name))
+		if err != nil {
+			// The revisions were deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Revision{}, err
+		}
+		revs = append(revs, note.NewRevision(n))
+	}
+	sortRevisions(revs)
+
+	return revs, nil
+}
+
+func (r *fileRepo) GetRevision(ctx context.Context, id string, version int64) (note.Note, error) {
+	return readNoteFile(filepath.Join(r.revisionDir(id), fmt.Sprintf(revisionFormat, version)+".json"))
+}
+
+func (r *fileRepo) DeleteRevisions(ctx context.Context, id string) error {
+	dir := r.revisionDir(id)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Join(r.dir, revisionsDir))
+}
+
+// revisionDir hex encodes the ID for the same reasons as notePath
+func (r *fileRepo) revisionDir(id string) string {
+	return filepath.Join(r.dir, revisionsDir, hex.EncodeToString([]byte(id)))
+}
+
+func (r *memRepo) SaveRevision(ctx context.Context, n note.Note) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	revs, ok := r.revisions[n.ID]
+	if !ok {
+		revs = make(map[int64]note.Note)
+		r.revisions[n.ID] = revs
+	}
+	revs[n.Version] = n
+	return nil
+}
+
+func (r *memRepo) ListRevisions(ctx context.Context, id string) ([]note.Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	revs := make([]note.Revision, 0, len(r.revisions[id]))
+	for _, n := range r.revisions[id] {
+		revs = append(revs, note.NewRevision(n))
+	}
+	sortRevisions(revs)
+
+	return revs, nil
+}
+
+func (r *memRepo) GetRevision(ctx context.Context, id string, version int64) (note.Note, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n, ok := r.revisions[id][version]
+	if !ok {
+		return note.Note{}, &core.ErrNotFound{}
+	}
+	return n, nil
+}
+
+func (r *memRepo) DeleteRevisions(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.revisions, id)
+	return nil
+}
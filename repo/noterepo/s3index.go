@@ -0,0 +1,395 @@
+package noterepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// The s3 index is stored as one entry object per note under IndexPrefix.
+// Saves and deletes only ever write or remove their own note's entry, so two
+// requests, or two replicas, can no longer lose each other's updates the way
+// they could when everything lived in a single index object.
+//
+// Listing the entries is the source of truth for what's in the index. Entry
+// contents are cached in memory along with their ETags so a list only has to
+// download the entries that changed since the last one. The cache is
+// periodically compacted into a snapshot stored under IndexID so that a fresh
+// process doesn't have to download every entry. The snapshot is only ever
+// used as a cache, so a stale snapshot written by a slower replica costs a
+// few extra downloads but can never lose an entry.
+
+// Trashed notes have their entries under TrashPrefix instead, a section of
+// the index of their own that isn't part of the snapshot.
+
+// indexEntry is the contents of an entry object. Seq is when the note was
+// first indexed and keeps the index in insertion order.
+type indexEntry struct {
+	Seq  int64         `json:"seq"`
+	Note note.ListNote `json:"note"`
+}
+
+// cachedEntry is an entry along with the ETag of the object it was read from
+type cachedEntry struct {
+	ETag  string     `json:"etag"`
+	Entry indexEntry `json:"entry"`
+}
+
+// indexSnapshot is the format of the object stored under IndexID. Older
+// versions of the server stored a plain array of notes there instead, see
+// migrateLegacyIndex.
+type indexSnapshot struct {
+	Entries map[string]cachedEntry `json:"entries"`
+}
+
+type indexCache struct {
+	// loadMu is held while the snapshot is loaded so it only happens once
+	loadMu sync.Mutex
+	loaded bool
+
+	mu      sync.Mutex
+	entries map[string]cachedEntry
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{entries: make(map[string]cachedEntry)}
+}
+
+func (c *indexCache) get(id string) (cachedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	return e, ok
+}
+
+func (c *indexCache) put(id string, e cachedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = e
+}
+
+func (c *indexCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// retain drops every cached entry that isn't in ids
+func (c *indexCache) retain(ids map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.entries {
+		if !ids[id] {
+			delete(c.entries, id)
+		}
+	}
+}
+
+func (c *indexCache) snapshot() indexSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := indexSnapshot{Entries: make(map[string]cachedEntry, len(c.entries))}
+	for id, e := range c.entries {
+		s.Entries[id] = e
+	}
+	return s
+}
+
+// indexSection is one of the prefixes index entries are kept under along
+// with the cache of its entries
+type indexSection struct {
+	prefix string
+	cache  *indexCache
+}
+
+func (r *s3Repo) liveSection() indexSection {
+	return indexSection{prefix: IndexPrefix, cache: r.index}
+}
+
+func (r *s3Repo) trashSection() indexSection {
+	return indexSection{prefix: TrashPrefix, cache: r.trash}
+}
+
+// sections returns the section the note's entry belongs in followed by the
+// one it doesn't
+func (r *s3Repo) sections(n note.Note) (indexSection, indexSection) {
+	if n.IsTrashed() {
+		return r.trashSection(), r.liveSection()
+	}
+	return r.liveSection(), r.trashSection()
+}
+
+// putIndexEntry writes the note's entry into the live or trash section as
+// appropriate, removing it from the other
+func (r *s3Repo) putIndexEntry(ctx context.Context, n note.Note) error {
+	into, from := r.sections(n)
+
+	seq, err := r.entrySeq(into, n.ID)
+	if err != nil {
+		return err
+	}
+
+	e := indexEntry{Seq: seq, Note: note.NewListNote(n)}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	etag, err := r.upload(into.prefix+n.ID, data)
+	if err != nil {
+		return err
+	}
+	into.cache.put(n.ID, cachedEntry{ETag: etag, Entry: e})
+
+	if err = r.deleteObject(from.prefix + n.ID); err != nil {
+		return err
+	}
+	from.cache.remove(n.ID)
+
+	return nil
+}
+
+// deleteIndexEntry removes the note's entry from both sections
+func (r *s3Repo) deleteIndexEntry(ctx context.Context, id string) error {
+	for _, sec := range []indexSection{r.liveSection(), r.trashSection()} {
+		if err := r.deleteObject(sec.prefix + id); err != nil {
+			return err
+		}
+		sec.cache.remove(id)
+	}
+	return nil
+}
+
+// entrySeq returns the sequence of the note's existing entry so that updates
+// keep their place in the section, or a new sequence for a note that's new to
+// it
+func (r *s3Repo) entrySeq(sec indexSection, id string) (int64, error) {
+	if ce, ok := sec.cache.get(id); ok {
+		return ce.Entry.Seq, nil
+	}
+
+	e, err := r.readIndexEntry(sec.prefix + id)
+	if err != nil {
+		if core.IsErrNotFound(err) {
+			return time.Now().UnixNano(), nil
+		}
+		return 0, err
+	}
+	return e.Seq, nil
+}
+
+func (r *s3Repo) readIndexEntry(key string) (indexEntry, error) {
+	data, err := r.download(key)
+	if err != nil {
+		return indexEntry{}, err
+	}
+
+	e := indexEntry{}
+	if err = json.Unmarshal(data, &e); err != nil {
+		return indexEntry{}, err
+	}
+	return e, nil
+}
+
+// listAll returns every note in the index in insertion order
+func (r *s3Repo) listAll(ctx context.Context) ([]note.ListNote, error) {
+	if err := r.loadIndex(ctx); err != nil {
+		return []note.ListNote{}, err
+	}
+
+	return r.listSection(ctx, r.liveSection())
+}
+
+// listTrash returns every trashed note in the order they were trashed
+func (r *s3Repo) listTrash(ctx context.Context) ([]note.ListNote, error) {
+	return r.listSection(ctx, r.trashSection())
+}
+
+func (r *s3Repo) listSection(ctx context.Context, sec indexSection) ([]note.ListNote, error) {
+	objects, err := r.listObjects(sec.prefix)
+	if err != nil {
+		return []note.ListNote{}, err
+	}
+
+	ids := make(map[string]bool, len(objects))
+	entries := make([]indexEntry, 0, len(objects))
+	downloaded := 0
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		id := strings.TrimPrefix(key, sec.prefix)
+		etag := aws.StringValue(o.ETag)
+
+		if ce, ok := sec.cache.get(id); ok && ce.ETag == etag {
+			ids[id] = true
+			entries = append(entries, ce.Entry)
+			continue
+		}
+
+		e, err := r.readIndexEntry(key)
+		if err != nil {
+			// The note was deleted after the entries were listed
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.ListNote{}, err
+		}
+		downloaded++
+
+		ids[id] = true
+		entries = append(entries, e)
+		sec.cache.put(id, cachedEntry{ETag: etag, Entry: e})
+	}
+	sec.cache.retain(ids)
+
+	log.Debug().
+		Str("func", "listSection").
+		Str("prefix", sec.prefix).
+		Int("entries", len(entries)).
+		Int("downloaded", downloaded).
+		Msg("listed index")
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Seq != entries[j].Seq {
+			return entries[i].Seq < entries[j].Seq
+		}
+		return entries[i].Note.ID < entries[j].Note.ID
+	})
+
+	list := make([]note.ListNote, len(entries))
+	for i, e := range entries {
+		list[i] = e.Note
+	}
+	return list, nil
+}
+
+// loadIndex warms the cache from the snapshot the first time the index is
+// read, migrating a legacy index if that's what it finds
+func (r *s3Repo) loadIndex(ctx context.Context) error {
+	r.index.loadMu.Lock()
+	defer r.index.loadMu.Unlock()
+
+	if r.index.loaded {
+		return nil
+	}
+
+	data, err := r.download(IndexID)
+	if err != nil && !core.IsErrNotFound(err) {
+		return err
+	}
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+	case data[0] == '[':
+		if err = r.migrateLegacyIndex(ctx, data); err != nil {
+			return err
+		}
+	default:
+		s := indexSnapshot{}
+		if err = json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		for id, e := range s.Entries {
+			r.index.put(id, e)
+		}
+	}
+
+	r.index.loaded = true
+	return nil
+}
+
+// migrateLegacyIndex turns an index written as a single array of notes into
+// entry objects. It's skipped when entries already exist, which means another
+// replica has migrated the index.
+func (r *s3Repo) migrateLegacyIndex(ctx context.Context, data []byte) error {
+	legacy := make([]note.ListNote, 0)
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	existing, err := r.listObjects(IndexPrefix)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	log.Info().
+		Str("func", "migrateLegacyIndex").
+		Int("notes", len(legacy)).
+		Msg("migrating legacy index")
+
+	for i, ln := range legacy {
+		if isReservedKey(ln.ID) {
+			continue
+		}
+
+		// Legacy notes are numbered from one so they sort ahead of every note
+		// indexed from now on
+		e := indexEntry{Seq: int64(i + 1), Note: ln}
+		entry, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		etag, err := r.upload(IndexPrefix+ln.ID, entry)
+		if err != nil {
+			return err
+		}
+		r.index.put(ln.ID, cachedEntry{ETag: etag, Entry: e})
+	}
+
+	return r.saveSnapshot()
+}
+
+// Compact refreshes the cached index from the entries and writes it to the
+// snapshot
+func (r *s3Repo) Compact(ctx context.Context) error {
+	if _, err := r.listAll(ctx); err != nil {
+		return err
+	}
+
+	return r.saveSnapshot()
+}
+
+// CompactEvery compacts the index, and those of the namespaces used so far,
+// on the given interval until the context is done
+func (r *s3Repo) CompactEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := r.Compact(ctx); err != nil {
+				log.Warn().Err(err).Str("func", "CompactEvery").Msg("failed to compact index")
+			}
+			for _, ns := range r.loadedNamespaces() {
+				if err := ns.Compact(ctx); err != nil {
+					log.Warn().Err(err).Str("func", "CompactEvery").Str("prefix", ns.prefix).Msg("failed to compact index")
+				}
+			}
+		}
+	}
+}
+
+func (r *s3Repo) saveSnapshot() error {
+	data, err := json.Marshal(r.index.snapshot())
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(IndexID, data)
+	return err
+}
@@ -0,0 +1,149 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/search"
+)
+
+// Each note's search document is stored on its own and they're all read back
+// when the search index is first used
+
+func (r *s3Repo) SaveSearchDocument(ctx context.Context, doc search.Document) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(SearchPrefix+doc.ID, data)
+	return err
+}
+
+func (r *s3Repo) DeleteSearchDocument(ctx context.Context, id string) error {
+	return r.deleteObject(SearchPrefix + id)
+}
+
+func (r *s3Repo) ListSearchDocuments(ctx context.Context) ([]search.Document, error) {
+	objects, err := r.listObjects(SearchPrefix)
+	if err != nil {
+		return []search.Document{}, err
+	}
+
+	docs := make([]search.Document, 0, len(objects))
+	for _, o := range objects {
+		data, err := r.download(aws.StringValue(o.Key))
+		if err != nil {
+			// The note was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []search.Document{}, err
+		}
+
+		doc := search.Document{}
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return []search.Document{}, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (r *fileRepo) SaveSearchDocument(ctx context.Context, doc search.Document) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, searchDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.searchPath(doc.ID), data)
+}
+
+func (r *fileRepo) DeleteSearchDocument(ctx context.Context, id string) error {
+	if err := os.Remove(r.searchPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Join(r.dir, searchDir))
+}
+
+func (r *fileRepo) ListSearchDocuments(ctx context.Context) ([]search.Document, error) {
+	dir := filepath.Join(r.dir, searchDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []search.Document{}, nil
+		}
+		return []search.Document{}, err
+	}
+
+	docs := make([]search.Document, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			// The note was deleted while we were listing them
+			if os.IsNotExist(err) {
+				continue
+			}
+			return []search.Document{}, err
+		}
+
+		doc := search.Document{}
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return []search.Document{}, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// searchPath hex encodes the ID for the same reasons as notePath
+func (r *fileRepo) searchPath(id string) string {
+	return filepath.Join(r.dir, searchDir, hex.EncodeToString([]byte(id))+".json")
+}
+
+func (r *memRepo) SaveSearchDocument(ctx context.Context, doc search.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.search[doc.ID] = doc
+	return nil
+}
+
+func (r *memRepo) DeleteSearchDocument(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.search, id)
+	return nil
+}
+
+func (r *memRepo) ListSearchDocuments(ctx context.Context) ([]search.Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	docs := make([]search.Document, 0, len(r.search))
+	for _, doc := range r.search {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
@@ -0,0 +1,506 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/note"
+)
+
+// Shares are stored by the user they're shared with, as
+// shares/users/<user id>/<owner id>/<hex note id>, so that the notes shared
+// with someone are a single listing away and checking a share is a single
+// read. Listing who a note is shared with lists every share's key. Links are
+// stored as shares/links/<id> and listing them reads every one.
+
+const (
+	shareUsersPrefix = SharePrefix + "users/"
+	linkPrefix       = SharePrefix + "links/"
+
+	sharesDir = "shares"
+	linksDir  = "links"
+)
+
+// shareKey is the key of the share relative to shareUsersPrefix or the
+// shares directory. The IDs must have been checked with validNamespace.
+func shareKey(userID, ownerID, noteID string) string {
+	return userID + "/" + ownerID + "/" + hex.EncodeToString([]byte(noteID))
+}
+
+func validShare(userID, ownerID string) bool {
+	return validNamespace(userID) && validNamespace(ownerID)
+}
+
+func (r *s3Repo) SaveShare(ctx context.Context, s note.Share) error {
+	if !validShare(s.UserID, s.OwnerID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(shareUsersPrefix+shareKey(s.UserID, s.OwnerID, s.NoteID), data)
+	return err
+}
+
+func (r *s3Repo) GetShare(ctx context.Context, userID, ownerID, noteID string) (note.Share, error) {
+	if !validShare(userID, ownerID) {
+		return note.Share{}, &core.ErrNotFound{}
+	}
+	return r.getShare(shareUsersPrefix + shareKey(userID, ownerID, noteID))
+}
+
+func (r *s3Repo) getShare(key string) (note.Share, error) {
+	data, err := r.download(key)
+	if err != nil {
+		return note.Share{}, err
+	}
+
+	s := note.Share{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return note.Share{}, err
+	}
+	return s, nil
+}
+
+func (r *s3Repo) ListShares(ctx context.Context, ownerID, noteID string) ([]note.Share, error) {
+	if !validNamespace(ownerID) {
+		return []note.Share{}, nil
+	}
+	suffix := "/" + ownerID + "/" + hex.EncodeToString([]byte(noteID))
+	return r.listShares(shareUsersPrefix, func(key string) bool { return strings.HasSuffix(key, suffix) })
+}
+
+func (r *s3Repo) ListSharedWith(ctx context.Context, userID string) ([]note.Share, error) {
+	if !validNamespace(userID) {
+		return []note.Share{}, nil
+	}
+	return r.listShares(shareUsersPrefix+userID+"/", func(string) bool { return true })
+}
+
+func (r *s3Repo) listShares(prefix string, match func(key string) bool) ([]note.Share, error) {
+	objects, err := r.listObjects(prefix)
+	if err != nil {
+		return []note.Share{}, err
+	}
+
+	shares := make([]note.Share, 0)
+	for _, o := range objects {
+		key := aws.StringValue(o.Key)
+		if !match(key) {
+			continue
+		}
+
+		s, err := r.getShare(key)
+		if err != nil {
+			// The share was taken away while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Share{}, err
+		}
+		shares = append(shares, s)
+	}
+
+	return shares, nil
+}
+
+func (r *s3Repo) DeleteShare(ctx context.Context, userID, ownerID, noteID string) error {
+	if !validShare(userID, ownerID) {
+		return nil
+	}
+	return r.deleteObject(shareUsersPrefix + shareKey(userID, ownerID, noteID))
+}
+
+func (r *s3Repo) SaveLink(ctx context.Context, l note.Link) error {
+	if !validNamespace(l.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(linkPrefix+l.ID, data)
+	return err
+}
+
+func (r *s3Repo) GetLink(ctx context.Context, id string) (note.Link, error) {
+	if !validNamespace(id) {
+		return note.Link{}, &core.ErrNotFound{}
+	}
+
+	data, err := r.download(linkPrefix + id)
+	if err != nil {
+		return note.Link{}, err
+	}
+
+	l := note.Link{}
+	if err = json.Unmarshal(data, &l); err != nil {
+		return note.Link{}, err
+	}
+	return l, nil
+}
+
+func (r *s3Repo) ListLinks(ctx context.Context) ([]note.Link, error) {
+	objects, err := r.listObjects(linkPrefix)
+	if err != nil {
+		return []note.Link{}, err
+	}
+
+	links := make([]note.Link, 0, len(objects))
+	for _, o := range objects {
+		l, err := r.GetLink(ctx, strings.TrimPrefix(aws.StringValue(o.Key), linkPrefix))
+		if err != nil {
+			// The link was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Link{}, err
+		}
+		links = append(links, l)
+	}
+
+	return links, nil
+}
+
+func (r *s3Repo) DeleteLink(ctx context.Context, id string) error {
+	if !validNamespace(id) {
+		return nil
+	}
+	return r.deleteObject(linkPrefix + id)
+}
+
+func (r *fileRepo) SaveShare(ctx context.Context, s note.Share) error {
+	if !validShare(s.UserID, s.OwnerID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := r.sharePath(s.UserID, s.OwnerID, s.NoteID)
+	if err = os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (r *fileRepo) GetShare(ctx context.Context, userID, ownerID, noteID string) (note.Share, error) {
+	if !validShare(userID, ownerID) {
+		return note.Share{}, &core.ErrNotFound{}
+	}
+	return readShareFile(r.sharePath(userID, ownerID, noteID))
+}
+
+func (r *fileRepo) ListShares(ctx context.Context, ownerID, noteID string) ([]note.Share, error) {
+	if !validNamespace(ownerID) {
+		return []note.Share{}, nil
+	}
+
+	users, err := os.ReadDir(filepath.Join(r.dir, sharesDir, usersDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.Share{}, nil
+		}
+		return []note.Share{}, err
+	}
+
+	shares := make([]note.Share, 0)
+	for _, u := range users {
+		if !u.IsDir() || !validNamespace(u.Name()) {
+			continue
+		}
+
+		s, err := readShareFile(r.sharePath(u.Name(), ownerID, noteID))
+		if err != nil {
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Share{}, err
+		}
+		shares = append(shares, s)
+	}
+
+	return shares, nil
+}
+
+func (r *fileRepo) ListSharedWith(ctx context.Context, userID string) ([]note.Share, error) {
+	if !validNamespace(userID) {
+		return []note.Share{}, nil
+	}
+
+	dir := filepath.Join(r.dir, sharesDir, usersDir, userID)
+	owners, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.Share{}, nil
+		}
+		return []note.Share{}, err
+	}
+
+	shares := make([]note.Share, 0)
+	for _, o := range owners {
+		if !o.IsDir() {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, o.Name()))
+		if err != nil {
+			return []note.Share{}, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+
+			s, err := readShareFile(filepath.Join(dir, o.Name(), name))
+			if err != nil {
+				// The share was taken away while we were listing them
+				if core.IsErrNotFound(err) {
+					continue
+				}
+				return []note.Share{}, err
+			}
+			shares = append(shares, s)
+		}
+	}
+
+	return shares, nil
+}
+
+func (r *fileRepo) DeleteShare(ctx context.Context, userID, ownerID, noteID string) error {
+	if !validShare(userID, ownerID) {
+		return nil
+	}
+	return removeFile(r.sharePath(userID, ownerID, noteID))
+}
+
+func (r *fileRepo) SaveLink(ctx context.Context, l note.Link) error {
+	if !validNamespace(l.ID) {
+		return ErrInvalidNamespace
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, sharesDir, linksDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.linkPath(l.ID), data)
+}
+
+func (r *fileRepo) GetLink(ctx context.Context, id string) (note.Link, error) {
+	if !validNamespace(id) {
+		return note.Link{}, &core.ErrNotFound{}
+	}
+	return readLinkFile(r.linkPath(id))
+}
+
+func (r *fileRepo) ListLinks(ctx context.Context) ([]note.Link, error) {
+	dir := filepath.Join(r.dir, sharesDir, linksDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []note.Link{}, nil
+		}
+		return []note.Link{}, err
+	}
+
+	links := make([]note.Link, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		l, err := readLinkFile(filepath.Join(dir, name))
+		if err != nil {
+			// The link was deleted while we were listing them
+			if core.IsErrNotFound(err) {
+				continue
+			}
+			return []note.Link{}, err
+		}
+		links = append(links, l)
+	}
+
+	return links, nil
+}
+
+func (r *fileRepo) DeleteLink(ctx context.Context, id string) error {
+	if !validNamespace(id) {
+		return nil
+	}
+	return removeFile(r.linkPath(id))
+}
+
+func (r *fileRepo) sharePath(userID, ownerID, noteID string) string {
+	return filepath.Join(r.dir, sharesDir, usersDir, filepath.FromSlash(shareKey(userID, ownerID, noteID))+".json")
+}
+
+func (r *fileRepo) linkPath(id string) string {
+	return filepath.Join(r.dir, sharesDir, linksDir, id+".json")
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func readShareFile(path string) (note.Share, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note.Share{}, &core.ErrNotFound{}
+		}
+		return note.Share{}, err
+	}
+
+	s := note.Share{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return note.Share{}, err
+	}
+	return s, nil
+}
+
+func readLinkFile(path string) (note.Link, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return note.Link{}, &core.ErrNotFound{}
+		}
+		return note.Link{}, err
+	}
+
+	l := note.Link{}
+	if err = json.Unmarshal(data, &l); err != nil {
+		return note.Link{}, err
+	}
+	return l, nil
+}
+
+// memShareKey keys the memRepo's shares
+type memShareKey struct {
+	userID, ownerID, noteID string
+}
+
+func (r *memRepo) SaveShare(ctx context.Context, s note.Share) error {
+	if !validShare(s.UserID, s.OwnerID) {
+		return ErrInvalidNamespace
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.shares[memShareKey{s.UserID, s.OwnerID, s.NoteID}] = s
+	return nil
+}
+
+func (r *memRepo) GetShare(ctx context.Context, userID, ownerID, noteID string) (note.Share, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.shares[memShareKey{userID, ownerID, noteID}]
+	if !ok {
+		return note.Share{}, &core.ErrNotFound{}
+	}
+	return s, nil
+}
+
+func (r *memRepo) ListShares(ctx context.Context, ownerID, noteID string) ([]note.Share, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shares := make([]note.Share, 0)
+	for k, s := range r.shares {
+		if k.ownerID == ownerID && k.noteID == noteID {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+func (r *memRepo) ListSharedWith(ctx context.Context, userID string) ([]note.Share, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shares := make([]note.Share, 0)
+	for k, s := range r.shares {
+		if k.userID == userID {
+			shares = append(shares, s)
+		}
+	}
+	return shares, nil
+}
+
+func (r *memRepo) DeleteShare(ctx context.Context, userID, ownerID, noteID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.shares, memShareKey{userID, ownerID, noteID})
+	return nil
+}
+
+func (r *memRepo) SaveLink(ctx context.Context, l note.Link) error {
+	if !validNamespace(l.ID) {
+		return ErrInvalidNamespace
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.links[l.ID] = l
+	return nil
+}
+
+func (r *memRepo) GetLink(ctx context.Context, id string) (note.Link, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l, ok := r.links[id]
+	if !ok {
+		return note.Link{}, &core.ErrNotFound{}
+	}
+	return l, nil
+}
+
+func (r *memRepo) ListLinks(ctx context.Context) ([]note.Link, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	links := make([]note.Link, 0, len(r.links))
+	for _, l := range r.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (r *memRepo) DeleteLink(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.links, id)
+	return nil
+}
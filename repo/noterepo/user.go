@@ -0,0 +1,91 @@
+package noterepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/sksmith/note-server/core"
+	"github.com/sksmith/note-server/core/user"
+)
+
+// Accounts are stored next to the notes, one object per user keyed by their
+// username
+
+func (r *s3Repo) SaveUser(ctx context.Context, u user.User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.upload(AccountPrefix+u.Username, data)
+	return err
+}
+
+func (r *s3Repo) GetUser(ctx context.Context, username string) (user.User, error) {
+	data, err := r.download(AccountPrefix + username)
+	if err != nil {
+		return user.User{}, err
+	}
+
+	u := user.User{}
+	if err = json.Unmarshal(data, &u); err != nil {
+		return user.User{}, err
+	}
+	return u, nil
+}
+
+func (r *fileRepo) SaveUser(ctx context.Context, u user.User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(r.dir, accountsDir), dirPerm); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.accountPath(u.Username), data)
+}
+
+func (r *fileRepo) GetUser(ctx context.Context, username string) (user.User, error) {
+	data, err := os.ReadFile(r.accountPath(username))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return user.User{}, &core.ErrNotFound{}
+		}
+		return user.User{}, err
+	}
+
+	u := user.User{}
+	if err = json.Unmarshal(data, &u); err != nil {
+		return user.User{}, err
+	}
+	return u, nil
+}
+
+// accountPath hex encodes the username for the same reasons as notePath
+func (r *fileRepo) accountPath(username string) string {
+	return filepath.Join(r.dir, accountsDir, hex.EncodeToString([]byte(username))+".json")
+}
+
+func (r *memRepo) SaveUser(ctx context.Context, u user.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.users[u.Username] = u
+	return nil
+}
+
+func (r *memRepo) GetUser(ctx context.Context, username string) (user.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u, ok := r.users[username]
+	if !ok {
+		return user.User{}, &core.ErrNotFound{}
+	}
+	return u, nil
+}